@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessLog writes one line per request in the Combined Log Format of
+// Apache and nginx, which log analyzers read
+type accessLog struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// openAccessLog appends to the access log at path, creating it if needed
+func openAccessLog(path string) (*accessLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open access log: %v", err)
+	}
+	return &accessLog{out: file}, nil
+}
+
+func (l *accessLog) Close() error {
+	if c, ok := l.out.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// wrap logs every request to next once its response is done
+func (l *accessLog) wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{sentWriter: sentWriter{ResponseWriter: w}}
+		next.ServeHTTP(sw, r)
+		l.write(r, sw, start)
+	})
+}
+
+func (l *accessLog) write(r *http.Request, sw *statusWriter, start time.Time) {
+	client, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		client = r.RemoteAddr
+	}
+	status := sw.status
+	if status == 0 {
+		// The handler wrote nothing, which net/http sends as 200
+		status = http.StatusOK
+	}
+	size := "-"
+	if n := sw.n.Load(); n > 0 {
+		size = strconv.FormatInt(n, 10)
+	}
+	line := fmt.Sprintf("%s - - [%s] %s %d %s %s %s\n",
+		client, start.Format("02/Jan/2006:15:04:05 -0700"),
+		logQuote(r.Method+" "+r.RequestURI+" "+r.Proto), status, size,
+		logQuote(r.Referer()), logQuote(r.UserAgent()))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	io.WriteString(l.out, line)
+}
+
+// logQuote quotes a field of a log line, "-" if it is empty. Quotes,
+// backslashes and control characters are escaped so that a client can't
+// forge lines.
+func logQuote(s string) string {
+	if s == "" {
+		return `"-"`
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range []byte(s) {
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// statusWriter records the status and body size of a response
+type statusWriter struct {
+	sentWriter
+	status int
+}
+
+func (s *statusWriter) WriteHeader(code int) {
+	if s.status == 0 && code >= 200 {
+		s.status = code
+	}
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *statusWriter) Write(b []byte) (int, error) {
+	if s.status == 0 {
+		s.status = http.StatusOK
+	}
+	return s.sentWriter.Write(b)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestAccessLog(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		setup   func(r *http.Request)
+		match   string
+	}{
+		{
+			name:    "download",
+			handler: func(w http.ResponseWriter, r *http.Request) { w.Write([]byte("hello")) },
+			setup: func(r *http.Request) {
+				r.Header.Set("Referer", "http://example.com/")
+				r.Header.Set("User-Agent", "curl/8.0")
+			},
+			match: `^192\.0\.2\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET /file\.txt HTTP/1\.1" 200 5 "http://example\.com/" "curl/8\.0"\n$`,
+		},
+		{
+			name:    "no body",
+			handler: func(w http.ResponseWriter, r *http.Request) { http.NotFound(w, r) },
+			match:   `"GET /file\.txt HTTP/1\.1" 404 19 "-" "-"\n$`,
+		},
+		{
+			name:    "nothing written",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			match:   `" 200 - "-"`,
+		},
+		{
+			name:    "forged line",
+			handler: func(w http.ResponseWriter, r *http.Request) {},
+			setup:   func(r *http.Request) { r.Header.Set("User-Agent", "x\"\n1.2.3.4 - - ") },
+			match:   `"x\\"\\x0a1\.2\.3\.4 - - "\n$`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			l := &accessLog{out: &buf}
+			r := httptest.NewRequest("GET", "/file.txt", nil)
+			if tt.setup != nil {
+				tt.setup(r)
+			}
+			l.wrap(tt.handler).ServeHTTP(httptest.NewRecorder(), r)
+			if !regexp.MustCompile(tt.match).MatchString(buf.String()) {
+				t.Errorf("expected a line matching %s, got %q", tt.match, buf.String())
+			}
+		})
+	}
+}
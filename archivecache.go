@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// seekableContent is implemented by providers whose content can be read
+// at any offset, so their downloads have a length and can be resumed
+type seekableContent interface {
+	contentProvider
+	// open returns the content as a file positioned at the start
+	open() (*os.File, error)
+}
+
+// cacheArchive wraps p in a cachedArchive if opts ask for it
+func cacheArchive(p *archiveProvider, opts archiveOptions) contentProvider {
+	if !opts.cache {
+		return p
+	}
+	return &cachedArchive{contentProvider: p}
+}
+
+// cachedArchive builds an archive into a temporary file on the first
+// download and serves every download from there. Changes to the directory
+// after that are not picked up.
+type cachedArchive struct {
+	contentProvider
+
+	mu   sync.Mutex
+	path string
+	size int64
+	sum  string // hex SHA-256
+}
+
+func (c *cachedArchive) ContentLength() int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" {
+		return -1 // Not built yet
+	}
+	return c.size
+}
+
+func (c *cachedArchive) WriteTo(w io.Writer) (int64, error) {
+	file, err := c.open()
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(w, file)
+}
+
+// open builds the archive unless it already exists. Concurrent first
+// downloads wait for a single build.
+func (c *cachedArchive) open() (*os.File, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path == "" {
+		if err := c.build(); err != nil {
+			return nil, err
+		}
+	}
+	return os.Open(c.path)
+}
+
+func (c *cachedArchive) build() error {
+	logEvent("archive_building", logFields{"file": c.Filename()}, "Building %s", c.Filename())
+	file, err := os.CreateTemp("", "userve-archive-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary file: %v", err)
+	}
+	hash := sha256.New()
+	size, err := c.contentProvider.WriteTo(io.MultiWriter(file, hash))
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return fmt.Errorf("cannot build archive: %v", err)
+	}
+	c.path, c.size, c.sum = file.Name(), size, hex.EncodeToString(hash.Sum(nil))
+	logEvent("archive_built", logFields{"file": c.Filename(), "bytes": size, "sha256": c.sum}, "Built %s (%s)", c.Filename(), formatSize(size))
+	return nil
+}
+
+// prebuild builds the archive ahead of the first download
+func (c *cachedArchive) prebuild() error {
+	file, err := c.open()
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// checksum returns the SHA-256 of the archive, or "" if it isn't built yet
+func (c *cachedArchive) checksum() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.sum
+}
+
+// remove deletes the temporary file
+func (c *cachedArchive) remove() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.path != "" {
+		os.Remove(c.path)
+		c.path = ""
+	}
+}
+
+// serveSeekable answers a download, including Range requests, from a
+// seekable provider. started is called once a body is about to be sent,
+// which a HEAD request or an unchanged-file probe never gets. complete
+// reports whether the client received the last byte, which is when a
+// download counts.
+func serveSeekable(w http.ResponseWriter, r *http.Request, content seekableContent, started func()) (complete bool, err error) {
+	file, err := content.open()
+	if err != nil {
+		http.Error(w, "cannot prepare download", http.StatusInternalServerError)
+		return false, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		http.Error(w, "cannot prepare download", http.StatusInternalServerError)
+		return false, err
+	}
+
+	// ServeContent swallows errors, so they are tracked on both ends
+	tr := &trackingReader{file: file, size: info.Size()}
+	tw := &trackingWriter{ResponseWriter: w}
+	if r.Method != http.MethodHead {
+		tw.started = started
+	}
+	http.ServeContent(tw, r, content.Filename(), info.ModTime(), tr)
+	if tw.err != nil {
+		return false, tw.err
+	}
+	return r.Method != http.MethodHead && tr.pos == tr.size, nil
+}
+
+// trackingReader records how far into the file the last read went
+type trackingReader struct {
+	file *os.File
+	size int64
+	pos  int64
+}
+
+func (t *trackingReader) Read(b []byte) (int, error) {
+	n, err := t.file.Read(b)
+	t.pos += int64(n)
+	return n, err
+}
+
+func (t *trackingReader) Seek(offset int64, whence int) (int64, error) {
+	pos, err := t.file.Seek(offset, whence)
+	t.pos = pos
+	return pos, err
+}
+
+// trackingWriter records the first error writing the response, and
+// reports when the response carries content
+type trackingWriter struct {
+	http.ResponseWriter
+	started func()
+	err     error
+}
+
+func (t *trackingWriter) WriteHeader(code int) {
+	if t.started != nil && (code == http.StatusOK || code == http.StatusPartialContent) {
+		t.started()
+		t.started = nil
+	}
+	t.ResponseWriter.WriteHeader(code)
+}
+
+func (t *trackingWriter) Write(b []byte) (int, error) {
+	n, err := t.ResponseWriter.Write(b)
+	if err != nil && t.err == nil {
+		t.err = err
+	}
+	return n, err
+}
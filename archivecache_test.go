@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestCachedArchive(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), bytes.Repeat([]byte("notes "), 2000), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	opts := archiveOptions{format: ArchiveTar, level: -1, cache: true}
+	cached := cacheArchive(newArchiveProvider(root, "docs", opts), opts).(*cachedArchive)
+	if cached.ContentLength() != -1 {
+		t.Errorf("expected unknown length before the first download, got %d", cached.ContentLength())
+	}
+
+	var wg sync.WaitGroup
+	h := &handler{provider: cached, activeDownloads: &wg, downloadComplete: make(chan struct{}, 1), maxDownloads: 2}
+	get := func(rangeHeader string) *http.Response {
+		req := httptest.NewRequest("GET", "/docs.tar", nil)
+		if rangeHeader != "" {
+			req.Header.Set("Range", rangeHeader)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Result()
+	}
+
+	resp := get("")
+	full, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Content-Length"); got != strconv.Itoa(len(full)) {
+		t.Errorf("expected Content-Length %d, got %q", len(full), got)
+	}
+	if cached.ContentLength() != int64(len(full)) {
+		t.Errorf("expected ContentLength %d after build, got %d", len(full), cached.ContentLength())
+	}
+	if h.downloadCount.Load() != 1 {
+		t.Errorf("expected a full download to count, got %d", h.downloadCount.Load())
+	}
+
+	// The start of a resumed download doesn't count; its end does
+	resp = get("bytes=0-99")
+	part, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(part, full[:100]) {
+		t.Errorf("expected the first 100 bytes as 206, got %d with %d bytes", resp.StatusCode, len(part))
+	}
+	if h.downloadCount.Load() != 1 {
+		t.Errorf("expected a partial range not to count, got %d", h.downloadCount.Load())
+	}
+	resp = get("bytes=100-")
+	rest, _ := io.ReadAll(resp.Body)
+	if !bytes.Equal(rest, full[100:]) {
+		t.Errorf("resumed content does not match")
+	}
+	if h.downloadCount.Load() != 2 {
+		t.Errorf("expected the range reaching the end to count, got %d", h.downloadCount.Load())
+	}
+
+	path := cached.path
+	cached.remove()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected temporary file to be removed, got %v", err)
+	}
+}
+
+func TestCachedArchivePrebuild(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.txt"), []byte("alpha"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	opts := archiveOptions{format: ArchiveTarGz, level: -1, cache: true}
+	cached := cacheArchive(newArchiveProvider(root, "docs", opts), opts).(*cachedArchive)
+	defer cached.remove()
+
+	if err := cached.prebuild(); err != nil {
+		t.Fatalf("prebuild failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := cached.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if cached.ContentLength() != int64(buf.Len()) {
+		t.Errorf("expected ContentLength %d, got %d", buf.Len(), cached.ContentLength())
+	}
+	if want := fmt.Sprintf("%x", sha256.Sum256(buf.Bytes())); cached.checksum() != want {
+		t.Errorf("expected checksum %s, got %s", want, cached.checksum())
+	}
+}
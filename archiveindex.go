@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// archiveMember describes one entry of a served archive file
+type archiveMember struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	Dir      bool      `json:"dir"`
+}
+
+// errMemberNotFound is returned when a requested archive member doesn't exist
+var errMemberNotFound = errors.New("archive member not found")
+
+// archiveKind returns the archive type of a file by its name: "zip",
+// "tar", "tar.gz" or "" when it isn't an archive
+func archiveKind(name string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return "zip"
+	case strings.HasSuffix(lower, ".tar"):
+		return "tar"
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return "tar.gz"
+	default:
+		return ""
+	}
+}
+
+// walkArchive calls fn for every member of the archive at filePath. For tar
+// archives, r reads the member's content; for zip archives it is nil and
+// the member can be opened from the returned file entry.
+func walkArchive(filePath, kind string, fn func(m archiveMember, r io.Reader, zf *zip.File) (stop bool, err error)) error {
+	if kind == "zip" {
+		zr, err := zip.OpenReader(filePath)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		for _, f := range zr.File {
+			m := archiveMember{
+				Name:     f.Name,
+				Size:     int64(f.UncompressedSize64),
+				Modified: f.Modified,
+				Dir:      f.FileInfo().IsDir(),
+			}
+			if stop, err := fn(m, nil, f); stop || err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var r io.Reader = file
+	if kind == "tar.gz" {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		m := archiveMember{
+			Name:     header.Name,
+			Size:     header.Size,
+			Modified: header.ModTime,
+			Dir:      header.Typeflag == tar.TypeDir,
+		}
+		if stop, err := fn(m, tr, nil); stop || err != nil {
+			return err
+		}
+	}
+}
+
+// listArchive returns all members of an archive file
+func listArchive(filePath, kind string) ([]archiveMember, error) {
+	members := []archiveMember{}
+	err := walkArchive(filePath, kind, func(m archiveMember, _ io.Reader, _ *zip.File) (bool, error) {
+		members = append(members, m)
+		return false, nil
+	})
+	return members, err
+}
+
+// memberProvider serves a single regular file from inside an archive
+type memberProvider struct {
+	archivePath string
+	kind        string
+	member      archiveMember
+}
+
+// findMember looks up a regular file by its exact name inside an archive
+func findMember(filePath, kind, name string) (*memberProvider, error) {
+	var found *archiveMember
+	err := walkArchive(filePath, kind, func(m archiveMember, _ io.Reader, _ *zip.File) (bool, error) {
+		if m.Name == name && !m.Dir {
+			found = &m
+			return true, nil
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errMemberNotFound
+	}
+	return &memberProvider{archivePath: filePath, kind: kind, member: *found}, nil
+}
+
+func (p *memberProvider) Filename() string {
+	return path.Base(p.member.Name)
+}
+
+func (p *memberProvider) ContentType() string {
+	contentType := mime.TypeByExtension(path.Ext(p.member.Name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	return contentType
+}
+
+func (p *memberProvider) ContentLength() int64 {
+	return p.member.Size
+}
+
+func (p *memberProvider) WriteTo(w io.Writer) (int64, error) {
+	var written int64
+	err := walkArchive(p.archivePath, p.kind, func(m archiveMember, r io.Reader, zf *zip.File) (bool, error) {
+		if m.Name != p.member.Name || m.Dir {
+			return false, nil
+		}
+		if zf != nil {
+			rc, err := zf.Open()
+			if err != nil {
+				return true, err
+			}
+			defer rc.Close()
+			r = rc
+		}
+		var err error
+		written, err = io.Copy(w, r)
+		return true, err
+	})
+	return written, err
+}
+
+// archiveIndexHandler exposes the members of a served archive file: GET
+// /contents lists them as JSON and GET /extract?path= streams one of them.
+// Listings are free; extracting a member counts as a download.
+type archiveIndexHandler struct {
+	downloads *handler
+	extract   bool
+}
+
+func (h *archiveIndexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowReads(w, r) {
+		return
+	}
+	item, _ := h.downloads.status()
+	fp, ok := item.(*fileProvider)
+	var kind string
+	if ok {
+		kind = archiveKind(fp.fileName)
+	}
+	if kind == "" {
+		http.Error(w, "served file is not a zip or tar archive", http.StatusNotFound)
+		return
+	}
+
+	if !h.extract {
+		members, err := listArchive(fp.filePath, kind)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(members)
+		return
+	}
+
+	name := r.URL.Query().Get("path")
+	if name == "" {
+		http.Error(w, "path parameter required", http.StatusBadRequest)
+		return
+	}
+	member, err := findMember(fp.filePath, kind, name)
+	if errors.Is(err, errMemberNotFound) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h.downloads.deliver(w, r, item, member)
+}
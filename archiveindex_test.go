@@ -0,0 +1,137 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+// writeTestArchive creates an archive of the given kind with a directory
+// and two files
+func writeTestArchive(t *testing.T, path, kind string) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("failed to create archive: %v", err)
+	}
+	defer f.Close()
+
+	files := []struct{ name, body string }{
+		{"docs/", ""},
+		{"docs/readme.txt", "read me"},
+		{"data.csv", "a,b\n1,2\n"},
+	}
+
+	if kind == "zip" {
+		zw := zip.NewWriter(f)
+		for _, file := range files {
+			w, err := zw.Create(file.name)
+			if err != nil {
+				t.Fatalf("failed to add zip entry: %v", err)
+			}
+			w.Write([]byte(file.body))
+		}
+		zw.Close()
+		return
+	}
+
+	gw := gzip.NewWriter(f)
+	tw := tar.NewWriter(gw)
+	for _, file := range files {
+		header := &tar.Header{Name: file.name, Mode: 0644, Size: int64(len(file.body)), Typeflag: tar.TypeReg}
+		if file.body == "" {
+			header.Typeflag = tar.TypeDir
+		}
+		tw.WriteHeader(header)
+		tw.Write([]byte(file.body))
+	}
+	tw.Close()
+	gw.Close()
+}
+
+func TestArchiveKind(t *testing.T) {
+	tests := map[string]string{
+		"a.zip":    "zip",
+		"a.TAR":    "tar",
+		"a.tar.gz": "tar.gz",
+		"a.tgz":    "tar.gz",
+		"a.txt":    "",
+	}
+	for name, expected := range tests {
+		if kind := archiveKind(name); kind != expected {
+			t.Errorf("archiveKind(%q) = %q, want %q", name, kind, expected)
+		}
+	}
+}
+
+func TestArchiveIndexHandler(t *testing.T) {
+	for _, name := range []string{"bundle.zip", "bundle.tar.gz"} {
+		path := filepath.Join(t.TempDir(), name)
+		writeTestArchive(t, path, archiveKind(name))
+
+		var wg sync.WaitGroup
+		downloadComplete := make(chan struct{}, 1)
+		h := &handler{
+			provider:         &fileProvider{filePath: path, fileName: name},
+			activeDownloads:  &wg,
+			downloadComplete: downloadComplete,
+			maxDownloads:     1,
+		}
+
+		rec := httptest.NewRecorder()
+		(&archiveIndexHandler{downloads: h}).ServeHTTP(rec, httptest.NewRequest("GET", "/contents", nil))
+		var members []archiveMember
+		if err := json.NewDecoder(rec.Body).Decode(&members); err != nil {
+			t.Fatalf("%s: failed to decode listing: %v", name, err)
+		}
+		if len(members) != 3 || members[1].Name != "docs/readme.txt" || members[1].Size != 7 || !members[0].Dir {
+			t.Errorf("%s: unexpected listing %+v", name, members)
+		}
+
+		rec = httptest.NewRecorder()
+		(&archiveIndexHandler{downloads: h, extract: true}).ServeHTTP(rec, httptest.NewRequest("GET", "/extract?path=docs/missing.txt", nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("%s: expected 404 for missing member, got %d", name, rec.Code)
+		}
+
+		select {
+		case <-downloadComplete:
+			t.Errorf("%s: listing counted as a download", name)
+		default:
+		}
+
+		rec = httptest.NewRecorder()
+		(&archiveIndexHandler{downloads: h, extract: true}).ServeHTTP(rec, httptest.NewRequest("GET", "/extract?path=docs/readme.txt", nil))
+		if body := rec.Body.String(); body != "read me" {
+			t.Errorf("%s: expected member content, got %q", name, body)
+		}
+		if cd := rec.Header().Get("Content-Disposition"); cd != `attachment; filename="readme.txt"` {
+			t.Errorf("%s: unexpected Content-Disposition %q", name, cd)
+		}
+		select {
+		case <-downloadComplete:
+		default:
+			t.Errorf("%s: expected extraction to count as a download", name)
+		}
+	}
+}
+
+func TestArchiveIndexHandlerNotAnArchive(t *testing.T) {
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:        &fileProvider{filePath: "/tmp/notes.txt", fileName: "notes.txt"},
+		activeDownloads: &wg,
+	}
+	rec := httptest.NewRecorder()
+	(&archiveIndexHandler{downloads: h}).ServeHTTP(rec, httptest.NewRequest("GET", "/contents", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for non-archive, got %d", rec.Code)
+	}
+}
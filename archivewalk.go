@@ -0,0 +1,150 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// userveIgnoreFile lists paths to leave out of a directory's archive, in
+// .gitignore syntax, at the root of the directory
+const userveIgnoreFile = ".userveignore"
+
+// Symlink handling modes for --symlinks
+const (
+	symlinksPreserve = "preserve"
+	symlinksFollow   = "follow"
+	symlinksSkip     = "skip"
+)
+
+// walk calls fn for every file, directory and preserved symlink to archive,
+// with its name inside the archive: the path relative to the parent of its
+// root. Roots are always followed when they are symlinks.
+func (p *archiveProvider) walk(fn func(path, name string, info os.FileInfo) error) error {
+	for _, root := range append([]string{p.dirPath}, p.extraPaths...) {
+		info, err := os.Stat(root)
+		if err != nil {
+			return err
+		}
+
+		baseDir := filepath.Base(root)
+		ignores := append(ignoreRules(nil), p.ignores...)
+		visit := func(path, relPath string, info os.FileInfo) error {
+			// Filters see paths relative to the shared directory
+			filterRel := filepath.Join(p.prefix, relPath)
+			if relPath != "." {
+				reason := p.filter.skipReason(filterRel, info)
+				switch {
+				case reason != "":
+				case ignores.ignored(filepath.ToSlash(filterRel), info.IsDir()):
+					reason = "ignored by " + userveIgnoreFile + " or .gitignore"
+				case !p.selected(filepath.ToSlash(filterRel)):
+					reason = "not selected"
+				}
+				if reason != "" {
+					logDebug("entry_skipped", logFields{"path": relPath, "reason": reason}, "Skipped %s: %s", relPath, reason)
+					return filepath.SkipDir
+				}
+			}
+			// The root of a subdirectory archive comes with its rules loaded
+			inherited := relPath == "." && p.prefix != ""
+			if info.IsDir() && relPath == "." && !inherited {
+				if err := ignores.load(filepath.Join(path, userveIgnoreFile), "."); err != nil {
+					return err
+				}
+			}
+			if info.IsDir() && p.filter.useGitignore() && !inherited {
+				if err := ignores.load(filepath.Join(path, ".gitignore"), filepath.ToSlash(filterRel)); err != nil {
+					return err
+				}
+			}
+			if info.IsDir() && !p.filter.keepDirs() {
+				return nil
+			}
+			name := filepath.Join(baseDir, relPath)
+			switch {
+			case info.Mode().IsRegular():
+				logDebug("entry_added", logFields{"path": name, "bytes": info.Size()}, "Archiving %s (%s)", name, formatSize(info.Size()))
+			case info.Mode()&os.ModeSymlink != 0:
+				logDebug("entry_added", logFields{"path": name, "symlink": true}, "Archiving %s as a symlink", name)
+			}
+			return fn(path, name, info)
+		}
+		if err := p.walkEntry(root, ".", info, nil, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkEntry visits an entry and, for directories, everything below it.
+// visit returning filepath.SkipDir leaves the entry's subtree out.
+// ancestors holds the resolved paths of the directories above, to detect
+// loops when following symlinks.
+func (p *archiveProvider) walkEntry(path, relPath string, info os.FileInfo, ancestors []string, visit func(path, relPath string, info os.FileInfo) error) error {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch p.filter.symlinkMode() {
+		case symlinksSkip:
+			logDebug("entry_skipped", logFields{"path": relPath, "reason": "symlink"}, "Skipped %s: symlink (--symlinks skip)", relPath)
+			return nil
+		case symlinksFollow:
+			target, err := os.Stat(path)
+			if err != nil {
+				logSkipped(relPath, "broken symlink")
+				return nil
+			}
+			logDebug("symlink_followed", logFields{"path": relPath}, "Following symlink %s", relPath)
+			info = target
+		}
+	}
+
+	// Sockets, devices and named pipes can't be archived
+	if !info.IsDir() && !info.Mode().IsRegular() && info.Mode()&os.ModeSymlink == 0 {
+		logDebug("entry_skipped", logFields{"path": relPath, "reason": "special file"}, "Skipped %s: not a regular file", relPath)
+		return nil
+	}
+
+	var resolved string
+	if info.IsDir() && p.filter.symlinkMode() == symlinksFollow {
+		var err error
+		if resolved, err = filepath.EvalSymlinks(path); err != nil {
+			return err
+		}
+		if slices.Contains(ancestors, resolved) {
+			logSkipped(relPath, "symlink loop")
+			return nil
+		}
+	}
+
+	err := visit(path, relPath, info)
+	if err == filepath.SkipDir {
+		return nil
+	}
+	if err != nil || !info.IsDir() {
+		return err
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	if resolved != "" {
+		ancestors = append(ancestors[:len(ancestors):len(ancestors)], resolved)
+	}
+	for _, entry := range entries {
+		childInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		childPath := filepath.Join(path, entry.Name())
+		if err := p.walkEntry(childPath, filepath.Join(relPath, entry.Name()), childInfo, ancestors, visit); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// logSkipped reports an entry left out of an archive while it is streamed
+func logSkipped(relPath, reason string) {
+	logEvent("entry_skipped", logFields{"path": relPath, "reason": reason}, "Skipped %s: %s", relPath, reason)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestArchiveSymlinkModes(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("symlinks need extra privileges on Windows")
+	}
+	root := makeTree(t, "data/a.txt")
+	for link, target := range map[string]string{
+		"link.txt": "data/a.txt",
+		"datalink": "data",
+		"loop":     ".",
+		"broken":   "missing",
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatalf("failed to create symlink: %v", err)
+		}
+	}
+
+	tests := []struct {
+		mode     string
+		expected string
+	}{
+		{symlinksPreserve, "project project/broken->missing project/data project/data/a.txt project/datalink->data project/link.txt->data/a.txt project/loop->."},
+		{symlinksSkip, "project project/data project/data/a.txt"},
+		{symlinksFollow, "project project/data project/data/a.txt project/datalink project/datalink/a.txt project/link.txt"},
+	}
+	for _, tt := range tests {
+		p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: &archiveFilter{symlinks: tt.mode}}
+		var buf bytes.Buffer
+		if _, err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: WriteTo failed: %v", tt.mode, err)
+		}
+
+		var entries []string
+		tr := tar.NewReader(&buf)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: failed to read tar: %v", tt.mode, err)
+			}
+			entry := header.Name
+			if header.Typeflag == tar.TypeSymlink {
+				entry += "->" + header.Linkname
+			}
+			if header.Name == "project/link.txt" && header.Typeflag == tar.TypeReg {
+				if body, _ := io.ReadAll(tr); string(body) != "data/a.txt" {
+					t.Errorf("%s: expected followed link to hold the target's content, got %q", tt.mode, body)
+				}
+			}
+			entries = append(entries, entry)
+		}
+		if got := strings.Join(entries, " "); got != tt.expected {
+			t.Errorf("%s:\n got  %s\n want %s", tt.mode, got, tt.expected)
+		}
+	}
+}
+
+func TestArchiveFilterValidateSymlinkMode(t *testing.T) {
+	f := &archiveFilter{symlinks: "copy"}
+	if err := f.validate(); err == nil || !strings.HasPrefix(err.Error(), `invalid symlink mode "copy"`) {
+		t.Errorf("expected invalid mode error, got %v", err)
+	}
+}
+
+func TestArchiveWalkVerbose(t *testing.T) {
+	root := makeTree(t, "keep.txt", "skip.log", ".env", "deep/er/file.txt")
+	buf := captureEvents(t, logText)
+	events.verbose = true
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar,
+		filter: &archiveFilter{exclude: []string{"*.log"}, skipHidden: true, maxDepth: 2}}
+	archiveNames(t, p)
+
+	for _, want := range []string{
+		"Archiving " + filepath.Join("project", "keep.txt") + " (8 B)",
+		"Skipped skip.log: matches --exclude",
+		"Skipped .env: hidden (--skip-hidden)",
+		"Skipped " + filepath.Join("deep", "er", "file.txt") + ": deeper than --max-depth",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %q in the log, got:\n%s", want, buf.String())
+		}
+	}
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// browsePrefix is where the files of a browsed directory are served
+const browsePrefix = "/files/"
+
+// browsePageTemplate lists one directory of a --browse share
+var browsePageTemplate = template.Must(template.New("browse").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="data:,">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; max-width: 48em; margin: 3em auto; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 0.4em 0.6em; text-align: left; border-bottom: 1px solid #e5e7eb; }
+.archive { margin: 1em 0 1.5em; }
+.note { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="archive">Download everything: {{range $i, $a := .Archives}}{{if $i}} · {{end}}<a href="{{$a.Href}}" download>{{$a.Name}}</a>{{end}}
+{{if .FolderArchives}}<br>Download this folder: {{range $i, $a := .FolderArchives}}{{if $i}} · {{end}}<a href="{{$a.Href}}" download>{{$a.Name}}</a>{{end}}{{end}}</p>
+<form method="post" action="/select">
+<table>
+<tr><th></th><th>Name</th><th>Size</th><th>Modified</th></tr>
+{{if .Parent}}<tr><td></td><td><a href="{{.Parent}}">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr><td><input type="checkbox" name="path" value="{{.Rel}}"></td><td><a href="{{.Href}}"{{if not .Dir}} download{{end}}>{{.Name}}{{if .Dir}}/{{end}}</a></td><td>{{.Size}}</td><td>{{.Modified}}</td></tr>
+{{end}}</table>
+{{if .Entries}}<p><button type="submit">Download selected</button> as <select name="format">{{range .Formats}}<option>{{.}}</option>{{end}}</select></p>{{end}}
+</form>
+{{if ne .Remaining -1}}<p class="note">{{.Remaining}} more download(s) before the share closes. Each file or archive counts as one download.</p>{{end}}
+</body>
+</html>
+`))
+
+// browseHandler serves a directory as pages listing its files, which can
+// be downloaded one by one, with the whole archive linked at the top and
+// each subdirectory available as an archive of its own at
+// /files/<dir><extension>. The archive's filter applies to what is listed
+// and served. Each file or subdirectory downloaded counts as a download of
+// the share.
+type browseHandler struct {
+	downloads *handler
+	archive   *archiveProvider
+}
+
+func (b *browseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Only a selection is posted
+	if r.URL.Path != "/select" && !allowReads(w, r) {
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.URL.Path == "/":
+		b.serveDir(w, r, "")
+	case r.URL.Path == "/select":
+		b.serveSelection(w, r)
+	case strings.HasPrefix(r.URL.Path, browsePrefix):
+		b.serveEntry(w, r, strings.TrimPrefix(r.URL.Path, browsePrefix))
+	case name == b.archive.Filename() || b.archive.variant(name) != nil:
+		if _, remaining := b.downloads.status(); remaining == 0 {
+			http.Error(w, "download limit reached", http.StatusGone)
+			return
+		}
+		b.downloads.ServeHTTP(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveEntry lists a subdirectory or downloads a file; rel is the
+// slash-separated path below the shared directory
+func (b *browseHandler) serveEntry(w http.ResponseWriter, r *http.Request, rel string) {
+	rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+	filePath, info, _, ok := b.archive.resolve(rel)
+	if !ok {
+		sub := b.subArchive(rel)
+		if sub == nil {
+			http.NotFound(w, r)
+			return
+		}
+		item, remaining := b.downloads.status()
+		if remaining == 0 {
+			http.Error(w, "download limit reached", http.StatusGone)
+			return
+		}
+		b.downloads.deliver(w, r, item, sub)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			http.Redirect(w, r, r.URL.Path+"/", http.StatusMovedPermanently)
+			return
+		}
+		b.serveDir(w, r, rel)
+		return
+	}
+
+	item, remaining := b.downloads.status()
+	if remaining == 0 {
+		http.Error(w, "download limit reached", http.StatusGone)
+		return
+	}
+	b.downloads.deliver(w, r, item, &fileProvider{filePath: filePath, fileName: info.Name(), fileSize: info.Size()})
+}
+
+func (b *browseHandler) serveDir(w http.ResponseWriter, r *http.Request, rel string) {
+	dirPath, _, ignores, ok := b.archive.resolve(rel)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	dirEntries, err := os.ReadDir(dirPath)
+	if err != nil {
+		http.Error(w, "cannot read directory", http.StatusInternalServerError)
+		return
+	}
+
+	type entry struct {
+		Name, Rel, Href, Size, Modified string
+		Dir                             bool
+	}
+	var entries []entry
+	for _, de := range dirEntries {
+		childRel := path.Join(rel, de.Name())
+		info, ok := b.archive.browsable(filepath.Join(dirPath, de.Name()), childRel, ignores)
+		if !ok {
+			continue
+		}
+		e := entry{
+			Name:     de.Name(),
+			Rel:      childRel,
+			Href:     browseHref(childRel),
+			Modified: info.ModTime().Format("2006-01-02 15:04"),
+			Dir:      info.IsDir(),
+		}
+		if e.Dir {
+			e.Href += "/"
+		} else {
+			e.Size = formatSize(info.Size())
+		}
+		entries = append(entries, e)
+	}
+	// Directories first, then files, each by name
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].Dir && !entries[j].Dir
+	})
+
+	type archiveLink struct{ Name, Href string }
+	var archives, folderArchives []archiveLink
+	var formats []string
+	for _, format := range b.formats() {
+		ext := archiveExtension(format)
+		formats = append(formats, strings.TrimPrefix(ext, "."))
+		name := b.archive.dirName + ext
+		archives = append(archives, archiveLink{name, "/" + url.PathEscape(name)})
+		if rel != "" {
+			folderArchives = append(folderArchives, archiveLink{path.Base(rel) + ext, browseHref(rel) + ext})
+		}
+	}
+
+	title := b.archive.dirName
+	if rel != "" {
+		title += "/" + rel
+	}
+	var parent string
+	switch {
+	case rel == "":
+	case !strings.Contains(rel, "/"):
+		parent = "/"
+	default:
+		parent = browseHref(path.Dir(rel)) + "/"
+	}
+
+	_, remaining := b.downloads.status()
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	browsePageTemplate.Execute(w, map[string]any{
+		"Title":          title,
+		"Parent":         parent,
+		"Entries":        entries,
+		"Archives":       archives,
+		"FolderArchives": folderArchives,
+		"Formats":        formats,
+		"Remaining":      remaining,
+	})
+}
+
+// serveSelection streams an archive of the entries checked on a page,
+// posted as path fields relative to the shared directory
+func (b *browseHandler) serveSelection(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "invalid form", http.StatusBadRequest)
+		return
+	}
+
+	var sub *archiveProvider
+	for _, format := range b.formats() {
+		if strings.TrimPrefix(archiveExtension(format), ".") == r.PostForm.Get("format") {
+			s := *b.archive
+			s.format = format
+			s.dirName += "-selection"
+			sub = &s
+		}
+	}
+	if sub == nil {
+		http.Error(w, "invalid format", http.StatusBadRequest)
+		return
+	}
+	for _, rel := range r.PostForm["path"] {
+		rel = strings.TrimPrefix(path.Clean("/"+rel), "/")
+		if _, _, _, ok := b.archive.resolve(rel); !ok || rel == "" {
+			http.Error(w, "invalid selection", http.StatusBadRequest)
+			return
+		}
+		sub.selection = append(sub.selection, rel)
+	}
+	if len(sub.selection) == 0 {
+		http.Error(w, "nothing selected", http.StatusBadRequest)
+		return
+	}
+
+	item, remaining := b.downloads.status()
+	if remaining == 0 {
+		http.Error(w, "download limit reached", http.StatusGone)
+		return
+	}
+	b.downloads.deliver(w, r, item, sub)
+}
+
+// selected reports whether the slash-separated path rel is part of the
+// selection: a selected entry, inside one, or a directory leading to one
+func (p *archiveProvider) selected(rel string) bool {
+	if p.selection == nil || rel == "." {
+		return true
+	}
+	for _, sel := range p.selection {
+		if rel == sel || strings.HasPrefix(rel, sel+"/") || strings.HasPrefix(sel, rel+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// formats returns the formats archives can be downloaded in, the -a format
+// first
+func (b *browseHandler) formats() []ArchiveFormat {
+	formats := []ArchiveFormat{b.archive.format}
+	if b.archive.zipPassword == "" {
+		for _, format := range variantFormats {
+			if format != b.archive.format {
+				formats = append(formats, format)
+			}
+		}
+	}
+	return formats
+}
+
+// subArchive returns the archive of a subdirectory requested by its path
+// plus an archive extension, or nil
+func (b *browseHandler) subArchive(rel string) *archiveProvider {
+	for _, format := range b.formats() {
+		dirRel, ok := strings.CutSuffix(rel, archiveExtension(format))
+		if !ok || dirRel == "" {
+			continue
+		}
+		dirPath, info, ignores, ok := b.archive.resolve(dirRel)
+		if !ok || !info.IsDir() {
+			continue
+		}
+		sub := *b.archive
+		sub.dirPath, sub.dirName, sub.format = dirPath, info.Name(), format
+		sub.prefix, sub.ignores = filepath.FromSlash(dirRel), ignores
+		return &sub
+	}
+	return nil
+}
+
+// archiveExtension returns the filename extension of an archive format
+func archiveExtension(format ArchiveFormat) string {
+	return (&archiveProvider{format: format}).Filename()
+}
+
+// browseHref returns the URL of a path below the shared directory
+func browseHref(rel string) string {
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	return browsePrefix + strings.Join(parts, "/")
+}
+
+// resolve finds the slash-separated path rel below the shared directory
+// the way walk would reach it, so that entries the archive leaves out
+// can't be listed or downloaded either. It returns the file's path and
+// info, and for directories the ignore rules in effect inside.
+func (p *archiveProvider) resolve(rel string) (string, os.FileInfo, ignoreRules, bool) {
+	filePath := p.dirPath
+	info, err := os.Stat(filePath)
+	if err != nil || !info.IsDir() {
+		return "", nil, nil, false
+	}
+
+	var ignores ignoreRules
+	load := func(dir, base string) bool {
+		if base == "." {
+			if err := ignores.load(filepath.Join(dir, userveIgnoreFile), "."); err != nil {
+				return false
+			}
+		}
+		if p.filter.useGitignore() {
+			if err := ignores.load(filepath.Join(dir, ".gitignore"), base); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	if !load(filePath, ".") {
+		return "", nil, nil, false
+	}
+	if rel == "" {
+		return filePath, info, ignores, true
+	}
+
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		partRel := strings.Join(parts[:i+1], "/")
+		filePath = filepath.Join(filePath, part)
+		var ok bool
+		if info, ok = p.browsable(filePath, partRel, ignores); !ok {
+			return "", nil, nil, false
+		}
+		if i < len(parts)-1 && !info.IsDir() {
+			return "", nil, nil, false
+		}
+		if info.IsDir() && !load(filePath, partRel) {
+			return "", nil, nil, false
+		}
+	}
+	return filePath, info, ignores, true
+}
+
+// browsable returns the info of an entry that a recipient may see.
+// Symlinks are only followed with --symlinks follow, since a preserved
+// link has no content of its own to serve.
+func (p *archiveProvider) browsable(filePath, rel string, ignores ignoreRules) (os.FileInfo, bool) {
+	info, err := os.Lstat(filePath)
+	if err != nil {
+		return nil, false
+	}
+	if info.Mode()&os.ModeSymlink != 0 {
+		if p.filter.symlinkMode() != symlinksFollow {
+			return nil, false
+		}
+		if info, err = os.Stat(filePath); err != nil {
+			return nil, false
+		}
+	}
+	if !info.IsDir() && !info.Mode().IsRegular() {
+		return nil, false
+	}
+	if p.filter.skip(filepath.FromSlash(rel), info) || ignores.ignored(rel, info.IsDir()) {
+		return nil, false
+	}
+	return info, true
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestBrowseHandler(t *testing.T) {
+	root := makeTree(t, "report.pdf", "photos/a.jpg", ".env", "photos/.secret/key")
+	outside := filepath.Join(filepath.Dir(root), "outside.txt")
+	if err := os.WriteFile(outside, []byte("outside"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "link.txt")); err != nil {
+		t.Fatalf("failed to create symlink: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &archiveProvider{dirPath: root, dirName: "project", format: ArchiveZip, filter: &archiveFilter{skipHidden: true}},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+		maxDownloads:     2,
+	}
+	b := &browseHandler{downloads: h, archive: h.provider.(*archiveProvider)}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	page := get("/").Body.String()
+	for _, want := range []string{`href="/files/photos/"`, `href="/files/report.pdf"`, `href="/project.zip"`, `href="/project.tar.gz"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected root page to contain %q", want)
+		}
+	}
+	for _, hidden := range []string{".env", "link.txt"} {
+		if strings.Contains(page, hidden) {
+			t.Errorf("expected root page not to list %s", hidden)
+		}
+	}
+	if sub := get("/files/photos/").Body.String(); !strings.Contains(sub, `href="/files/photos/a.jpg"`) || strings.Contains(sub, ".secret") {
+		t.Errorf("unexpected listing of photos/: %s", sub)
+	}
+	if rec := get("/files/photos"); rec.Code != 301 {
+		t.Errorf("expected a redirect to photos/, got %d", rec.Code)
+	}
+
+	// Filtered, linked and escaping paths are not served
+	for _, target := range []string{"/files/.env", "/files/photos/.secret/key", "/files/link.txt", "/files/../outside.txt", "/favicon.ico"} {
+		if rec := get(target); rec.Code != 404 {
+			t.Errorf("%s: expected 404, got %d", target, rec.Code)
+		}
+	}
+
+	// Each file downloaded counts
+	if rec := get("/files/report.pdf"); rec.Code != 200 || rec.Body.String() != "report.pdf" {
+		t.Errorf("expected report.pdf, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := get("/project.tar.gz"); rec.Code != 200 || rec.Header().Get("Content-Type") != "application/gzip" {
+		t.Errorf("expected the tar.gz archive, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	if rec := get("/files/photos/a.jpg"); rec.Code != 410 {
+		t.Errorf("expected 410 once the downloads are used up, got %d", rec.Code)
+	}
+}
+
+func TestBrowseSubdirectoryArchive(t *testing.T) {
+	root := makeTree(t, "docs/guide/intro.md", "docs/guide/draft.tmp", "docs/guide/.notes", "docs/api.md", "docs/guide.zip/real.txt")
+	if err := os.WriteFile(filepath.Join(root, ".userveignore"), []byte("*.tmp\n"), 0644); err != nil {
+		t.Fatalf("failed to create ignore file: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTarGz, level: -1, filter: &archiveFilter{skipHidden: true}},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+	}
+	b := &browseHandler{downloads: h, archive: h.provider.(*archiveProvider)}
+	get := func(target string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec
+	}
+
+	if page := get("/files/docs/").Body.String(); !strings.Contains(page, `href="/files/docs.zip"`) {
+		t.Errorf("expected the folder page to link its zip archive: %s", page)
+	}
+
+	rec := get("/files/docs/guide.tar")
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/x-tar" {
+		t.Fatalf("expected a tar archive of docs/guide, got %d %s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	names := strings.Join(archiveNames(t, b.subArchive("docs/guide.tar")), " ")
+	// Rules of the shared root and its filter still apply
+	if names != "guide guide/intro.md" {
+		t.Errorf("unexpected entries in subdirectory archive: %s", names)
+	}
+
+	// A real directory with the same name wins
+	if rec := get("/files/docs/guide.zip"); rec.Code != 301 {
+		t.Errorf("expected docs/guide.zip to redirect to its listing, got %d", rec.Code)
+	}
+
+	for _, target := range []string{"/files/docs/../../project.zip", "/files/missing.zip", "/files/docs/api.md.zip"} {
+		if rec := get(target); rec.Code != 404 {
+			t.Errorf("%s: expected 404, got %d", target, rec.Code)
+		}
+	}
+}
+
+func TestBrowseSelection(t *testing.T) {
+	root := makeTree(t, "a.txt", "b.txt", "docs/guide.md", "docs/api.md", "src/main.go")
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTarGz, level: -1},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+	}
+	b := &browseHandler{downloads: h, archive: h.provider.(*archiveProvider)}
+	post := func(form string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/select", strings.NewReader(form))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		b.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post("path=b.txt&path=docs/api.md&format=tar")
+	if rec.Code != 200 || !strings.Contains(rec.Header().Get("Content-Disposition"), "project-selection.tar") {
+		t.Fatalf("expected a selection archive, got %d %s", rec.Code, rec.Header().Get("Content-Disposition"))
+	}
+	p := *b.archive
+	p.format, p.selection = ArchiveTar, []string{"b.txt", "docs/api.md"}
+	if got := strings.Join(archiveNames(t, &p), " "); got != "project project/b.txt project/docs project/docs/api.md" {
+		t.Errorf("unexpected selection entries: %s", got)
+	}
+
+	for _, form := range []string{"format=tar", "path=../etc&format=tar", "path=missing.txt&format=zip", "path=a.txt&format=rar"} {
+		if rec := post(form); rec.Code != 400 {
+			t.Errorf("%s: expected 400, got %d", form, rec.Code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/select", nil))
+	if rec.Code != 405 {
+		t.Errorf("expected 405 for GET /select, got %d", rec.Code)
+	}
+}
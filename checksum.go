@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+)
+
+// errStreamed is returned for content that only exists while it is being
+// downloaded, such as an archive built on the fly
+var errStreamed = errors.New("content is only produced while downloading")
+
+// openPayload opens what p serves, when it is there before any download:
+// a file, a prebuilt archive or text held in memory
+func openPayload(p contentProvider) (io.ReadCloser, error) {
+	switch p := p.(type) {
+	case *fileProvider:
+		return os.Open(p.filePath)
+	case *cachedArchive:
+		if p.checksum() != "" {
+			return p.open()
+		}
+	case *memoryProvider:
+		return io.NopCloser(bytes.NewReader(p.data)), nil
+	}
+	return nil, errStreamed
+}
+
+// payloadChecksum returns the hex SHA-256 of what p serves
+func payloadChecksum(p contentProvider) (string, error) {
+	if cached, ok := p.(*cachedArchive); ok && cached.checksum() != "" {
+		return cached.checksum(), nil
+	}
+	payload, err := openPayload(p)
+	if err != nil {
+		return "", err
+	}
+	defer payload.Close()
+
+	return readerChecksum(payload)
+}
+
+// fileChecksum returns the hex SHA-256 of the file at path
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return readerChecksum(f)
+}
+
+func readerChecksum(r io.Reader) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checksumFile is the content of a .sha256 file for name, in the format
+// sha256sum writes and checks with -c
+func checksumFile(sum, name string) *memoryProvider {
+	return &memoryProvider{
+		name:        name + ".sha256",
+		contentType: "text/plain; charset=utf-8",
+		data:        []byte(sum + "  " + name + "\n"),
+	}
+}
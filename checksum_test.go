@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPayloadChecksum(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hello.txt")
+	if err := os.WriteFile(path, []byte("hello\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	const helloSum = "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03"
+
+	tests := []struct {
+		name     string
+		provider contentProvider
+		want     string
+		wantErr  error
+	}{
+		{"file", &fileProvider{filePath: path, fileName: "hello.txt"}, helloSum, nil},
+		{"text", &memoryProvider{name: textFileName, data: []byte("hello\n")}, helloSum, nil},
+		{"streamed archive", newArchiveProvider(dir, "dir", archiveOptions{}), "", errStreamed},
+	}
+	for _, tt := range tests {
+		got, err := payloadChecksum(tt.provider)
+		if got != tt.want || !errors.Is(err, tt.wantErr) {
+			t.Errorf("%s: expected %q (%v), got %q (%v)", tt.name, tt.want, tt.wantErr, got, err)
+		}
+	}
+}
+
+func TestChecksumFile(t *testing.T) {
+	f := checksumFile("abc123", "release 1.2.tar.gz")
+	if f.Filename() != "release 1.2.tar.gz.sha256" {
+		t.Errorf("unexpected name %q", f.Filename())
+	}
+	// Two spaces, as sha256sum -c expects
+	if got := string(f.data); got != "abc123  release 1.2.tar.gz\n" {
+		t.Errorf("unexpected content %q", got)
+	}
+}
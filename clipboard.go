@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// clipboardCommand describes an external program that writes stdin to the clipboard
+type clipboardCommand struct {
+	name string
+	args []string
+}
+
+// clipboardCommands returns the candidate clipboard programs for the platform,
+// in order of preference
+func clipboardCommands(goos string, getenv func(string) string) []clipboardCommand {
+	switch goos {
+	case "darwin":
+		return []clipboardCommand{{name: "pbcopy"}}
+	case "windows":
+		return []clipboardCommand{{name: "clip"}}
+	default:
+		var cmds []clipboardCommand
+		if getenv("WAYLAND_DISPLAY") != "" {
+			cmds = append(cmds, clipboardCommand{name: "wl-copy"})
+		}
+		return append(cmds,
+			clipboardCommand{name: "xclip", args: []string{"-selection", "clipboard"}},
+			clipboardCommand{name: "xsel", args: []string{"--clipboard", "--input"}},
+		)
+	}
+}
+
+// copyToClipboard puts text on the system clipboard using the first
+// available clipboard program
+func copyToClipboard(text string) error {
+	var tried []string
+	for _, c := range clipboardCommands(runtime.GOOS, os.Getenv) {
+		path, err := exec.LookPath(c.name)
+		if err != nil {
+			tried = append(tried, c.name)
+			continue
+		}
+		cmd := exec.Command(path, c.args...)
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("%s: %v", c.name, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("no clipboard program found (tried %s)", strings.Join(tried, ", "))
+}
+
+// pngMagic is the signature every PNG file starts with
+var pngMagic = []byte("\x89PNG\r\n\x1a\n")
+
+// pasteCommand describes an external program that prints the clipboard
+type pasteCommand struct {
+	name  string
+	image []string // Arguments to print a PNG image; nil if it can't
+	text  []string // Arguments to print text; nil if it can't
+}
+
+// windowsPasteImage prints the clipboard image as PNG, if there is one
+const windowsPasteImage = `Add-Type -AssemblyName System.Windows.Forms, System.Drawing
+$image = [Windows.Forms.Clipboard]::GetImage()
+if ($image) {
+	$buf = New-Object IO.MemoryStream
+	$image.Save($buf, [Drawing.Imaging.ImageFormat]::Png)
+	[Console]::OpenStandardOutput().Write($buf.ToArray(), 0, $buf.Length)
+}`
+
+// pasteCommands returns the candidate programs for reading the clipboard
+// on the platform, in order of preference
+func pasteCommands(goos string, getenv func(string) string) []pasteCommand {
+	switch goos {
+	case "darwin":
+		// pbpaste only handles text; pngpaste is a separate install
+		return []pasteCommand{
+			{name: "pngpaste", image: []string{"-"}},
+			{name: "pbpaste", text: []string{}},
+		}
+	case "windows":
+		return []pasteCommand{{
+			name:  "powershell",
+			image: []string{"-NoProfile", "-STA", "-Command", windowsPasteImage},
+			text:  []string{"-NoProfile", "-Command", "[Console]::OutputEncoding = [Text.Encoding]::UTF8; Get-Clipboard -Raw"},
+		}}
+	default:
+		var cmds []pasteCommand
+		if getenv("WAYLAND_DISPLAY") != "" {
+			cmds = append(cmds, pasteCommand{
+				name:  "wl-paste",
+				image: []string{"--no-newline", "--type", "image/png"},
+				text:  []string{"--no-newline"},
+			})
+		}
+		return append(cmds,
+			pasteCommand{
+				name:  "xclip",
+				image: []string{"-selection", "clipboard", "-t", "image/png", "-o"},
+				text:  []string{"-selection", "clipboard", "-o"},
+			},
+			pasteCommand{name: "xsel", text: []string{"--clipboard", "--output"}},
+		)
+	}
+}
+
+// readClipboard returns the clipboard contents, as clipboard.png if it
+// holds an image and clipboard.txt otherwise, using the first available
+// program of cmds
+func readClipboard(cmds []pasteCommand) (*memoryProvider, error) {
+	var tried []string
+	for _, c := range cmds {
+		path, err := exec.LookPath(c.name)
+		if err != nil {
+			tried = append(tried, c.name)
+			continue
+		}
+		// Asking for an image fails or prints nothing when there is none
+		if c.image != nil {
+			if out, err := exec.Command(path, c.image...).Output(); err == nil && bytes.HasPrefix(out, pngMagic) {
+				return &memoryProvider{name: "clipboard.png", contentType: "image/png", data: out}, nil
+			}
+		}
+		if c.text == nil {
+			continue
+		}
+		out, err := exec.Command(path, c.text...).Output()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", c.name, err)
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("clipboard is empty")
+		}
+		return &memoryProvider{name: "clipboard.txt", contentType: "text/plain; charset=utf-8", data: out}, nil
+	}
+	return nil, fmt.Errorf("no clipboard program found (tried %s)", strings.Join(tried, ", "))
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestClipboardCommands(t *testing.T) {
+	tests := []struct {
+		goos     string
+		wayland  string
+		expected string
+	}{
+		{"darwin", "", "pbcopy"},
+		{"windows", "", "clip"},
+		{"linux", "", "xclip"},
+		{"linux", "wayland-0", "wl-copy"},
+		{"freebsd", "", "xclip"},
+	}
+
+	for _, tt := range tests {
+		getenv := func(key string) string {
+			if key == "WAYLAND_DISPLAY" {
+				return tt.wayland
+			}
+			return ""
+		}
+		cmds := clipboardCommands(tt.goos, getenv)
+		if len(cmds) == 0 {
+			t.Fatalf("clipboardCommands(%q) returned no commands", tt.goos)
+		}
+		if cmds[0].name != tt.expected {
+			t.Errorf("clipboardCommands(%q, WAYLAND_DISPLAY=%q)[0] = %q, want %q", tt.goos, tt.wayland, cmds[0].name, tt.expected)
+		}
+	}
+}
+
+func TestPasteCommands(t *testing.T) {
+	tests := []struct {
+		goos     string
+		wayland  string
+		expected []string
+	}{
+		{"darwin", "", []string{"pngpaste", "pbpaste"}},
+		{"windows", "", []string{"powershell"}},
+		{"linux", "", []string{"xclip", "xsel"}},
+		{"linux", "wayland-0", []string{"wl-paste", "xclip", "xsel"}},
+	}
+
+	for _, tt := range tests {
+		getenv := func(key string) string {
+			if key == "WAYLAND_DISPLAY" {
+				return tt.wayland
+			}
+			return ""
+		}
+		var names []string
+		for _, c := range pasteCommands(tt.goos, getenv) {
+			names = append(names, c.name)
+		}
+		if strings.Join(names, " ") != strings.Join(tt.expected, " ") {
+			t.Errorf("pasteCommands(%q, WAYLAND_DISPLAY=%q) = %v, want %v", tt.goos, tt.wayland, names, tt.expected)
+		}
+	}
+}
+
+func TestReadClipboard(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses shell scripts as clipboard programs")
+	}
+	dir := t.TempDir()
+	// paste prints an image only when asked for one and the clipboard has one
+	script := func(name, image, text string) string {
+		path := filepath.Join(dir, name)
+		body := fmt.Sprintf("#!/bin/sh\nif [ \"$1\" = image ]; then %s; else %s; fi\n", image, text)
+		if err := os.WriteFile(path, []byte(body), 0755); err != nil {
+			t.Fatalf("failed to create script: %v", err)
+		}
+		return path
+	}
+	textOnly := script("text", "exit 1", "printf 'token-123'")
+	withImage := script("image", `printf '\211PNG\r\n\032\nrest'`, "printf 'ignored'")
+	empty := script("empty", "exit 1", "true")
+
+	tests := []struct {
+		name     string
+		cmds     []pasteCommand
+		wantName string
+		wantData string
+		wantErr  bool
+	}{
+		{"text", []pasteCommand{{name: textOnly, image: []string{"image"}, text: []string{}}}, "clipboard.txt", "token-123", false},
+		{"image", []pasteCommand{{name: withImage, image: []string{"image"}, text: []string{}}}, "clipboard.png", "\x89PNG\r\n\x1a\nrest", false},
+		{"image-only program skipped", []pasteCommand{{name: textOnly, image: []string{"image"}}, {name: textOnly, text: []string{}}}, "clipboard.txt", "token-123", false},
+		{"missing program", []pasteCommand{{name: filepath.Join(dir, "missing"), text: []string{}}, {name: textOnly, text: []string{}}}, "clipboard.txt", "token-123", false},
+		{"empty", []pasteCommand{{name: empty, text: []string{}}}, "", "", true},
+		{"none found", []pasteCommand{{name: filepath.Join(dir, "missing"), text: []string{}}}, "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := readClipboard(tt.cmds)
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readClipboard failed: %v", err)
+			}
+			if p.Filename() != tt.wantName || string(p.data) != tt.wantData {
+				t.Errorf("expected %s with %q, got %s with %q", tt.wantName, tt.wantData, p.Filename(), p.data)
+			}
+		})
+	}
+}
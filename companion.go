@@ -0,0 +1,28 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// companionFiles serves small files that go with the download, such as
+// its checksum, at their own URL paths and everything else from next.
+// Fetching them never counts as a download.
+type companionFiles struct {
+	next  http.Handler
+	files map[string]*memoryProvider // URL path -> file
+}
+
+func (c *companionFiles) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	file, ok := c.files[r.URL.Path]
+	if !ok {
+		c.next.ServeHTTP(w, r)
+		return
+	}
+	if !allowReads(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", file.ContentType())
+	w.Header().Set("Content-Length", strconv.Itoa(len(file.data)))
+	w.Write(file.data)
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCompanionFiles(t *testing.T) {
+	download := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("download"))
+	})
+	c := &companionFiles{next: download, files: map[string]*memoryProvider{
+		"/app.zip.sha256": checksumFile("abc123", "app.zip"),
+	}}
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		body   string
+	}{
+		{"GET", "/app.zip.sha256", http.StatusOK, "abc123  app.zip\n"},
+		{"GET", "/app.zip", http.StatusOK, "download"},
+		{"POST", "/app.zip.sha256", http.StatusMethodNotAllowed, "method not allowed\n"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.path, nil))
+		if rec.Code != tt.status || rec.Body.String() != tt.body {
+			t.Errorf("%s %s: expected %d %q, got %d %q", tt.method, tt.path, tt.status, tt.body, rec.Code, rec.Body.String())
+		}
+	}
+}
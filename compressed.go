@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// compressedExtensions are file types whose content is already compressed,
+// so compressing it again costs CPU without making the archive smaller
+var compressedExtensions = map[string]bool{
+	// Images
+	".jpg": true, ".jpeg": true, ".png": true, ".gif": true, ".webp": true,
+	".heic": true, ".heif": true, ".avif": true,
+	// Audio and video
+	".mp3": true, ".aac": true, ".m4a": true, ".ogg": true, ".opus": true,
+	".flac": true, ".mp4": true, ".m4v": true, ".mkv": true, ".mov": true,
+	".webm": true, ".avi": true,
+	// Archives and compressed streams
+	".zip": true, ".gz": true, ".tgz": true, ".bz2": true, ".xz": true,
+	".txz": true, ".zst": true, ".7z": true, ".rar": true, ".lz4": true,
+	// Zip-based documents and packages
+	".jar": true, ".apk": true, ".docx": true, ".xlsx": true, ".pptx": true,
+	".odt": true, ".ods": true, ".epub": true,
+}
+
+// compressedMagic are the leading bytes of compressed formats, for files
+// whose name doesn't tell
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},                       // gzip
+	{'P', 'K', 0x03, 0x04},             // zip
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},   // xz
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c}, // 7z
+	{0x28, 0xb5, 0x2f, 0xfd},           // zstd
+	{'B', 'Z', 'h'},                    // bzip2
+	{'R', 'a', 'r', '!'},               // rar
+	{0x89, 'P', 'N', 'G'},              // png
+	{0xff, 0xd8, 0xff},                 // jpeg
+	{'G', 'I', 'F', '8'},               // gif
+	{0x1a, 0x45, 0xdf, 0xa3},           // matroska, webm
+	{'O', 'g', 'g', 'S'},               // ogg
+	{'f', 'L', 'a', 'C'},               // flac
+}
+
+// isCompressed reports whether the regular file at path holds already
+// compressed data, judged by its extension or else its first bytes
+func isCompressed(path string) bool {
+	if compressedExtensions[strings.ToLower(filepath.Ext(path))] {
+		return true
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	head := make([]byte, 12)
+	n, _ := io.ReadFull(file, head)
+	head = head[:n]
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(head, magic) {
+			return true
+		}
+	}
+	// MP4, MOV and other ISO media files have "ftyp" after the box size
+	return n >= 8 && string(head[4:8]) == "ftyp"
+}
+
+// gzipMembers is a gzip stream, compressed on all cores, that can pass data
+// through uncompressed.
+// Switching modes starts a new gzip member; gzip and tar read
+// concatenated members as a single stream.
+type gzipMembers struct {
+	w      io.Writer
+	level  int
+	gw     io.WriteCloser
+	stored bool
+}
+
+func newGzipMembers(w io.Writer, level int) (*gzipMembers, error) {
+	gw, err := newPgzipWriter(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &gzipMembers{w: w, level: level, gw: gw}, nil
+}
+
+// setStored switches between compressing and storing what follows
+func (g *gzipMembers) setStored(stored bool) error {
+	if stored == g.stored {
+		return nil
+	}
+	if err := g.gw.Close(); err != nil {
+		return err
+	}
+	var err error
+	if stored {
+		g.gw, err = gzip.NewWriterLevel(g.w, gzip.NoCompression)
+	} else {
+		g.gw, err = newPgzipWriter(g.w, g.level)
+	}
+	g.stored = stored
+	return err
+}
+
+func (g *gzipMembers) Write(b []byte) (int, error) {
+	return g.gw.Write(b)
+}
+
+func (g *gzipMembers) Close() error {
+	return g.gw.Close()
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIsCompressed(t *testing.T) {
+	dir := t.TempDir()
+	tests := []struct {
+		name    string
+		content []byte
+		want    bool
+	}{
+		{"photo.JPG", []byte("not really a jpeg"), true},
+		{"backup.tar.gz", nil, true},
+		{"notes.txt", []byte("plain text notes"), false},
+		{"download", []byte{0x1f, 0x8b, 0x08, 0x00}, true},
+		{"clip", append([]byte{0, 0, 0, 0x20}, "ftypisom"...), true},
+		{"tiny", []byte{0x1f}, false},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name)
+		if err := os.WriteFile(path, tt.content, 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+		if got := isCompressed(path); got != tt.want {
+			t.Errorf("isCompressed(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestArchiveStoresCompressedFiles(t *testing.T) {
+	root := t.TempDir()
+	photo := make([]byte, 64*1024)
+	rand.Read(photo)
+	text := bytes.Repeat([]byte("compressible "), 5000)
+	files := map[string][]byte{"a.txt": text, "b.jpg": photo, "c.txt": text}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(root, name), content, 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+
+	t.Run("tar.gz", func(t *testing.T) {
+		p := &archiveProvider{dirPath: root, dirName: "album", format: ArchiveTarGz, level: -1}
+		var buf bytes.Buffer
+		if _, err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		gr, err := gzip.NewReader(&buf)
+		if err != nil {
+			t.Fatalf("failed to read gzip: %v", err)
+		}
+		tr := tar.NewReader(gr)
+		found := 0
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("failed to read tar: %v", err)
+			}
+			want, ok := files[filepath.Base(header.Name)]
+			if !ok || header.Typeflag != tar.TypeReg {
+				continue
+			}
+			got, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("failed to read %s: %v", header.Name, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%s: content differs after round trip", header.Name)
+			}
+			found++
+		}
+		if found != len(files) {
+			t.Errorf("expected %d files, found %d", len(files), found)
+		}
+	})
+
+	t.Run("zip", func(t *testing.T) {
+		p := &archiveProvider{dirPath: root, dirName: "album", format: ArchiveZip, level: -1}
+		var buf bytes.Buffer
+		if _, err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("failed to read zip: %v", err)
+		}
+		methods := map[string]uint16{}
+		for _, f := range zr.File {
+			methods[filepath.Base(f.Name)] = f.Method
+		}
+		if methods["b.jpg"] != zip.Store {
+			t.Errorf("expected b.jpg to be stored, got method %d", methods["b.jpg"])
+		}
+		if methods["a.txt"] != zip.Deflate {
+			t.Errorf("expected a.txt to be deflated, got method %d", methods["a.txt"])
+		}
+	})
+}
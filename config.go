@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// envPrefix starts the environment variables that set flags, e.g.
+// USERVE_PORT or USERVE_MAX_FILE_SIZE
+const envPrefix = "USERVE_"
+
+// configAliases lets config files and environment variables spell out the flags that only have a
+// one-letter name
+var configAliases = map[string]string{
+	"port":      "p",
+	"bind":      "i",
+	"archive":   "a",
+	"downloads": "c",
+}
+
+// profileTable starts the names of the config file's tables that hold
+// profiles, e.g. [profiles.lan]
+const profileTable = "profiles."
+
+// configSetting is a key = value line of a config file; arrays hold one
+// value per element
+type configSetting struct {
+	table  string // Empty at the top level
+	key    string
+	values []string
+	line   int
+}
+
+// defaultConfigPath returns ~/.config/userve/config.toml, or the platform's
+// equivalent
+func defaultConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "userve", "config.toml")
+}
+
+// applyConfig sets the flags named in the config file at path that weren't
+// given on the command line, those of the named profile over the ones at
+// the top level. A missing file is only an error if it was asked for with
+// --config or a profile was.
+func applyConfig(fs *flag.FlagSet, path string, explicit bool, profile string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) && !explicit && profile == "" {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("cannot read config: %v", err)
+	}
+	settings, err := parseConfig(data)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	var selected []configSetting
+	if profile != "" {
+		for _, s := range settings {
+			if s.table == profileTable+profile {
+				selected = append(selected, s)
+			}
+		}
+		if len(selected) == 0 {
+			return fmt.Errorf("%s: no profile %q", path, profile)
+		}
+	}
+	for _, s := range settings {
+		if s.table == "" {
+			selected = append(selected, s)
+		}
+	}
+
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, s := range selected {
+		name := s.key
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		}
+		if fs.Lookup(name) == nil || name == "config" || name == "profile" {
+			return fmt.Errorf("%s:%d: unknown setting %q", path, s.line, s.key)
+		}
+		if given[name] {
+			continue
+		}
+		for _, value := range s.values {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("%s:%d: invalid %s: %v", path, s.line, s.key, err)
+			}
+		}
+		// The top level doesn't add to a profile's excludes and the like
+		given[name] = true
+	}
+	return nil
+}
+
+// applyEnv sets the flags named by USERVE_* variables in environ that weren't
+// given on the command line. Variables that don't name a flag are left
+// alone, as userve has others such as USERVE_STATE_KEY.
+func applyEnv(fs *flag.FlagSet, environ []string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+	for _, kv := range environ {
+		key, value, _ := strings.Cut(kv, "=")
+		name, ok := strings.CutPrefix(key, envPrefix)
+		if !ok {
+			continue
+		}
+		name = strings.ReplaceAll(strings.ToLower(name), "_", "-")
+		if alias, ok := configAliases[name]; ok {
+			name = alias
+		} else if len(name) < 2 {
+			// One-letter flags only have their long names here
+			continue
+		}
+		if fs.Lookup(name) == nil || given[name] {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid %s: %v", key, err)
+		}
+	}
+	return nil
+}
+
+// parseConfig reads the subset of TOML that flags need: key = value lines
+// with strings, numbers, booleans and one-line arrays, [profiles.<name>]
+// tables and # comments
+func parseConfig(data []byte) ([]configSetting, error) {
+	var settings []configSetting
+	table := ""
+	seen := make(map[string]bool) // Keys and tables, with the table before keys
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			header, _, _ := strings.Cut(line, "#")
+			name, ok := strings.CutSuffix(strings.TrimSpace(header[1:]), "]")
+			name = strings.TrimSpace(name)
+			if !ok || strings.HasPrefix(name, "[") {
+				return nil, fmt.Errorf("line %d: expected a [profiles.<name>] table", n)
+			}
+			profile, ok := strings.CutPrefix(name, profileTable)
+			if unquoted, err := strconv.Unquote(profile); err == nil {
+				profile = unquoted
+			}
+			if !ok || profile == "" || strings.Contains(profile, ".") {
+				return nil, fmt.Errorf("line %d: unknown table [%s]; only [profiles.<name>] tables are supported", n, name)
+			}
+			table = profileTable + profile
+			if seen[table] {
+				return nil, fmt.Errorf("line %d: profile %s is defined twice", n, profile)
+			}
+			seen[table] = true
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" {
+			return nil, fmt.Errorf("line %d: expected key = value", n)
+		}
+		if unquoted, err := strconv.Unquote(key); err == nil {
+			key = unquoted
+		}
+		if seen[table+" "+key] {
+			return nil, fmt.Errorf("line %d: %s is set twice", n, key)
+		}
+		seen[table+" "+key] = true
+		values, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		settings = append(settings, configSetting{table: table, key: key, values: values, line: n})
+	}
+	return settings, scanner.Err()
+}
+
+// parseConfigValue returns the value, or the elements of an array, as
+// they would be given on the command line
+func parseConfigValue(s string) ([]string, error) {
+	if strings.HasPrefix(s, "[") {
+		var values []string
+		rest := strings.TrimSpace(s[1:])
+		for {
+			rest = strings.TrimLeft(rest, " \t")
+			if strings.HasPrefix(rest, "]") {
+				if tail := strings.TrimSpace(rest[1:]); tail != "" && !strings.HasPrefix(tail, "#") {
+					return nil, fmt.Errorf("unexpected %q after array", tail)
+				}
+				return values, nil
+			}
+			value, tail, err := configScalar(rest)
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+			tail = strings.TrimLeft(tail, " \t")
+			if strings.HasPrefix(tail, ",") {
+				tail = tail[1:]
+			} else if !strings.HasPrefix(tail, "]") {
+				return nil, fmt.Errorf("arrays must be on one line, with elements separated by commas")
+			}
+			rest = tail
+		}
+	}
+	value, tail, err := configScalar(s)
+	if err != nil {
+		return nil, err
+	}
+	if tail = strings.TrimSpace(tail); tail != "" && !strings.HasPrefix(tail, "#") {
+		return nil, fmt.Errorf("unexpected %q after value", tail)
+	}
+	return []string{value}, nil
+}
+
+// configScalar reads a string, number or boolean from the start of s and
+// returns it with the rest of s
+func configScalar(s string) (value, rest string, err error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		// Basic strings have the escapes of Go's
+		for i := 1; i < len(s); i++ {
+			if s[i] == '\\' {
+				i++
+				continue
+			}
+			if s[i] == '"' {
+				value, err := strconv.Unquote(s[:i+1])
+				if err != nil {
+					return "", "", fmt.Errorf("invalid string %s", s[:i+1])
+				}
+				return value, s[i+1:], nil
+			}
+		}
+		return "", "", fmt.Errorf("unterminated string")
+	case strings.HasPrefix(s, "'"):
+		// Literal strings have no escapes
+		end := strings.IndexByte(s[1:], '\'')
+		if end < 0 {
+			return "", "", fmt.Errorf("unterminated string")
+		}
+		return s[1 : end+1], s[end+2:], nil
+	}
+	end := strings.IndexAny(s, " \t,]#")
+	if end < 0 {
+		end = len(s)
+	}
+	value = s[:end]
+	if value != "true" && value != "false" {
+		if _, err := strconv.ParseFloat(strings.ReplaceAll(value, "_", ""), 64); err != nil {
+			return "", "", fmt.Errorf("invalid value %q; quote strings", value)
+		}
+		value = strings.ReplaceAll(value, "_", "")
+	}
+	return value, s[end:], nil
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseConfig(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected map[string][]string
+		err      string
+	}{
+		{input: "port = 9000\n", expected: map[string][]string{"port": {"9000"}}},
+		{input: "# defaults\narchive = \"zip\" # for Windows\n\ngitignore = true\n", expected: map[string][]string{"archive": {"zip"}, "gitignore": {"true"}}},
+		{input: `exclude = ["*.log", 'node_modules', "a \"b\""]`, expected: map[string][]string{"exclude": {"*.log", "node_modules", `a "b"`}}},
+		{input: "exclude = []", expected: map[string][]string{"exclude": nil}},
+		{input: "max-file-size = \"500M\"\nc = 1_000", expected: map[string][]string{"max-file-size": {"500M"}, "c": {"1000"}}},
+		{input: "port = 1\n[profiles.lan] # at home\nport = 2", expected: map[string][]string{"port": {"1"}, "profiles.lan port": {"2"}}},
+		{input: "[profiles.\"my lan\"]\nc = 0", expected: map[string][]string{"profiles.my lan c": {"0"}}},
+		{input: "archive = zip", err: "quote strings"},
+		{input: "[server]\nport = 1", err: "tables"},
+		{input: "port", err: "key = value"},
+		{input: "port = 1\nport = 2", err: "set twice"},
+		{input: "[profiles.lan]\n[profiles.lan]", err: "defined twice"},
+		{input: "[profiles]\nport = 1", err: "unknown table"},
+		{input: "[[profiles.lan]]", err: "expected a [profiles.<name>] table"},
+		{input: "name = \"open", err: "unterminated"},
+		{input: "exclude = [\"a\"", err: "one line"},
+	}
+	for _, tt := range tests {
+		settings, err := parseConfig([]byte(tt.input))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: expected an error about %s, got %v", tt.input, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.input, err)
+			continue
+		}
+		got := make(map[string][]string)
+		for _, s := range settings {
+			key := s.key
+			if s.table != "" {
+				key = s.table + " " + key
+			}
+			got[key] = s.values
+		}
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%q: expected %v, got %v", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestApplyConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte("port = 9000\narchive = \"zip\"\nexclude = [\"*.log\", \"tmp\"]\n"), 0644)
+
+	fs := flag.NewFlagSet("userve", flag.ContinueOnError)
+	port := fs.Int("p", defaultPort, "")
+	format := fs.String("a", "tar.gz", "")
+	var excludes stringList
+	fs.Var(&excludes, "exclude", "")
+	fs.String("config", "", "")
+	if err := fs.Parse([]string{"-a", "tar"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, path, true, ""); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 9000 || *format != "tar" || strings.Join(excludes, ",") != "*.log,tmp" {
+		t.Errorf("expected the config's port and excludes and the command line's format, got %d, %s, %v", *port, *format, excludes)
+	}
+
+	os.WriteFile(path, []byte("colour = \"blue\"\n"), 0644)
+	if err := applyConfig(fs, path, true, ""); err == nil || !strings.Contains(err.Error(), ":1: unknown setting") {
+		t.Errorf("expected an unknown setting error with its line, got %v", err)
+	}
+	if err := applyConfig(fs, filepath.Join(t.TempDir(), "missing.toml"), false, ""); err != nil {
+		t.Errorf("expected a missing default config to be ignored, got %v", err)
+	}
+	if err := applyConfig(fs, filepath.Join(t.TempDir(), "missing.toml"), true, ""); err == nil {
+		t.Error("expected an error for a missing --config file")
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("userve", flag.ContinueOnError)
+	port := fs.Int("p", defaultPort, "")
+	format := fs.String("a", "tar.gz", "")
+	maxDepth := fs.Int("max-depth", 0, "")
+	gitignore := fs.Bool("gitignore", false, "")
+	quiet := fs.Bool("q", false, "")
+	if err := fs.Parse([]string{"-a", "tar"}); err != nil {
+		t.Fatal(err)
+	}
+	environ := []string{
+		"USERVE_PORT=9000",
+		"USERVE_ARCHIVE=zip",
+		"USERVE_MAX_DEPTH=2",
+		"USERVE_GITIGNORE=1",
+		"USERVE_Q=true",
+		"USERVE_STATE_KEY=secret",
+		"HOME=/home/user",
+	}
+	if err := applyEnv(fs, environ); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 9000 || *format != "tar" || *maxDepth != 2 || !*gitignore || *quiet {
+		t.Errorf("expected the environment's port, depth and gitignore and the command line's format, got %d, %s, %d, %v, %v", *port, *format, *maxDepth, *gitignore, *quiet)
+	}
+
+	fs = flag.NewFlagSet("userve", flag.ContinueOnError)
+	fs.Int("max-depth", 0, "")
+	if err := applyEnv(fs, []string{"USERVE_MAX_DEPTH=deep"}); err == nil || !strings.Contains(err.Error(), "USERVE_MAX_DEPTH") {
+		t.Errorf("expected an error naming the variable, got %v", err)
+	}
+}
+
+func TestApplyConfigProfile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.toml")
+	os.WriteFile(path, []byte(`port = 9000
+archive = "zip"
+exclude = ["*.log"]
+
+[profiles.public]
+tunnel = "cloudflare"
+exclude = [".env"]
+c = 1
+
+[profiles.lan]
+c = 0
+`), 0644)
+
+	fs := flag.NewFlagSet("userve", flag.ContinueOnError)
+	port := fs.Int("p", defaultPort, "")
+	format := fs.String("a", "tar.gz", "")
+	count := fs.Int("c", 1, "")
+	tunnel := fs.String("tunnel", "", "")
+	var excludes stringList
+	fs.Var(&excludes, "exclude", "")
+	if err := fs.Parse([]string{"-c", "3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfig(fs, path, false, "public"); err != nil {
+		t.Fatal(err)
+	}
+	if *port != 9000 || *format != "zip" || *count != 3 || *tunnel != "cloudflare" || strings.Join(excludes, ",") != ".env" {
+		t.Errorf("expected the profile over the top level and the command line over both, got %d, %s, %d, %s, %v", *port, *format, *count, *tunnel, excludes)
+	}
+	if err := applyConfig(fs, path, false, "office"); err == nil || !strings.Contains(err.Error(), `no profile "office"`) {
+		t.Errorf("expected an error for an unknown profile, got %v", err)
+	}
+	if err := applyConfig(fs, filepath.Join(t.TempDir(), "missing.toml"), false, "lan"); err == nil {
+		t.Error("expected an error for a profile without a config file")
+	}
+}
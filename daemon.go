@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+)
+
+// daemonEnv tells the share started by --daemon where to write its pid
+// file once it is listening
+const daemonEnv = "USERVE_DAEMON_PID_FILE"
+
+// daemonPIDFile is where the share running in the background records its
+// process; empty in the foreground
+var daemonPIDFile string
+
+// defaultDaemonPath returns name in ~/.cache/userve, or the platform's
+// equivalent, for the pid and log files of --daemon and the control socket
+// of userve host
+func defaultDaemonPath(name string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "userve", name)
+}
+
+// startDaemon runs userve with args again in the background, logging to
+// logPath, and returns once the share is listening, printing what it logged
+// while starting and, if announce is set, how to stop it. Go can't fork, so
+// the share is a new process that --daemon finds daemonEnv set in.
+func startDaemon(args []string, pidPath, logPath string, announce bool) error {
+	if daemonAttr() == nil {
+		return errors.New("--daemon is not supported on this platform; run userve as a service instead")
+	}
+	if pid, err := readPIDFile(pidPath); err == nil && processAlive(pid) {
+		return fmt.Errorf("userve is already running in the background (pid %d); stop it with %s, or use --pid-file", pid, stopCommand(pidPath))
+	}
+	pidPath, err := filepath.Abs(pidPath)
+	if err != nil {
+		return fmt.Errorf("cannot find pid file: %v", err)
+	}
+	os.Remove(pidPath)
+	for _, path := range []string{pidPath, logPath} {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return fmt.Errorf("cannot create %s: %v", filepath.Dir(path), err)
+		}
+	}
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	defer logFile.Close()
+	// Only this start's lines are shown
+	offset, err := logFile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return fmt.Errorf("cannot open log file: %v", err)
+	}
+	devNull, err := os.Open(os.DevNull)
+	if err != nil {
+		return fmt.Errorf("cannot open %s: %v", os.DevNull, err)
+	}
+	defer devNull.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("cannot find userve executable: %v", err)
+	}
+
+	cmd := exec.Command(exe, args...)
+	cmd.Env = append(os.Environ(), daemonEnv+"="+pidPath)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = devNull, logFile, logFile
+	cmd.SysProcAttr = daemonAttr()
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("cannot start userve in the background: %v", err)
+	}
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+
+	started := waitForDaemon(pidPath, cmd.Process.Pid, exited)
+	if data, err := os.ReadFile(logPath); err == nil && int64(len(data)) >= offset {
+		if started {
+			os.Stdout.Write(data[offset:])
+		} else {
+			os.Stderr.Write(data[offset:])
+		}
+	}
+	if !started {
+		return fmt.Errorf("userve exited while starting in the background; its log is %s", logPath)
+	}
+	if announce {
+		fmt.Printf("Running in the background (pid %d), logging to %s; stop with: %s\n", cmd.Process.Pid, logPath, stopCommand(pidPath))
+	}
+	return nil
+}
+
+// waitForDaemon waits until the process pid has written its pid file,
+// which it does once it is listening, and reports whether it did so
+// before exited was closed
+func waitForDaemon(pidPath string, pid int, exited <-chan struct{}) bool {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if recorded, err := readPIDFile(pidPath); err == nil && recorded == pid {
+			return true
+		}
+		select {
+		case <-exited:
+			return false
+		case <-ticker.C:
+		}
+	}
+}
+
+// stopCommand is the command that stops the share using pidPath
+func stopCommand(pidPath string) string {
+	if pidPath == defaultDaemonPath("daemon.pid") {
+		return "userve stop"
+	}
+	return "userve stop --pid-file " + pidPath
+}
+
+// runningDaemon returns the process of the share in the background that
+// recorded itself at pidPath, removing the pid file of one that is gone
+func runningDaemon(pidPath string) (int, error) {
+	pid, err := readPIDFile(pidPath)
+	if os.IsNotExist(err) {
+		return 0, errors.New("no userve is running in the background")
+	}
+	if err != nil {
+		return 0, err
+	}
+	if !processAlive(pid) {
+		// It didn't get to clean up, e.g. after a reboot
+		os.Remove(pidPath)
+		return 0, errors.New("no userve is running in the background")
+	}
+	return pid, nil
+}
+
+// daemonFlags parses the flags of "userve stop" and "userve status"
+func daemonFlags(command string, args []string) (string, error) {
+	fs := flag.NewFlagSet("userve "+command, flag.ContinueOnError)
+	pidPath := fs.String("pid-file", defaultDaemonPath("daemon.pid"), "pid `file` of the share started with --daemon")
+	if err := fs.Parse(args); err != nil {
+		return "", err
+	}
+	if fs.NArg() > 0 {
+		return "", fmt.Errorf("usage: userve %s [--pid-file <file>]", command)
+	}
+	return *pidPath, nil
+}
+
+// runStop shuts down the share started with --daemon, letting downloads in
+// progress finish like Ctrl+C does
+func runStop(args []string) error {
+	pidPath, err := daemonFlags("stop", args)
+	if err != nil {
+		return err
+	}
+	if stopSignal == nil {
+		return errors.New("stop is not supported on this platform")
+	}
+	pid, err := runningDaemon(pidPath)
+	if err != nil {
+		return err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("cannot find share process: %v", err)
+	}
+	if err := process.Signal(stopSignal); err != nil {
+		return fmt.Errorf("cannot signal share process: %v", err)
+	}
+
+	deadline := time.Now().Add(shutdownTimeout + 5*time.Second)
+	for time.Now().Before(deadline) {
+		if !processAlive(pid) {
+			fmt.Printf("Stopped userve (pid %d)\n", pid)
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	// A second signal skips the wait, as a second Ctrl+C does
+	return fmt.Errorf("userve (pid %d) is still waiting for downloads to finish; run %s again to stop it now", pid, stopCommand(pidPath))
+}
+
+// runStatus tells whether a share started with --daemon is running
+func runStatus(args []string) error {
+	pidPath, err := daemonFlags("status", args)
+	if err != nil {
+		return err
+	}
+	pid, err := runningDaemon(pidPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("userve is running in the background (pid %d)\n", pid)
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestDaemonFlags(t *testing.T) {
+	dir := t.TempDir()
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--pid-file", filepath.Join(dir, "p"), dir}, "--pid-file needs --daemon"},
+		{[]string{"--log-file", filepath.Join(dir, "l"), dir}, "--log-file needs --daemon"},
+		{[]string{"--daemon", "--state", filepath.Join(dir, "s"), dir}, "--daemon can't be used with --state"},
+		{[]string{"--daemon", "--text", "-"}, "--daemon can't be used with --text - or --zip-password -"},
+		{[]string{"--daemon", "-a", "zip", "--zip-password", "-", dir}, "--daemon can't be used with --text - or --zip-password -"},
+	} {
+		if err := run(tc.args); err == nil || err.Error() != tc.want {
+			t.Errorf("%q: expected %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestRunningDaemon(t *testing.T) {
+	if stopSignal == nil {
+		t.Skip("--daemon not supported on this platform")
+	}
+	dir := t.TempDir()
+	pidPath := filepath.Join(dir, "daemon.pid")
+	if _, err := runningDaemon(pidPath); err == nil {
+		t.Error("expected an error without a pid file")
+	}
+
+	if err := writePIDFile(pidPath); err != nil {
+		t.Fatal(err)
+	}
+	if pid, err := runningDaemon(pidPath); err != nil || pid != os.Getpid() {
+		t.Errorf("expected pid %d, got %d, %v", os.Getpid(), pid, err)
+	}
+
+	// A pid that can't be running leaves a stale file, which is removed
+	if err := os.WriteFile(pidPath, []byte(strconv.Itoa(1<<22+1)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runningDaemon(pidPath); err == nil {
+		t.Error("expected an error for a process that is gone")
+	}
+	if _, err := os.Stat(pidPath); !os.IsNotExist(err) {
+		t.Errorf("expected the stale pid file to be removed, got %v", err)
+	}
+}
+
+func TestWaitForDaemon(t *testing.T) {
+	pidPath := filepath.Join(t.TempDir(), "daemon.pid")
+	exited := make(chan struct{})
+	close(exited)
+	if waitForDaemon(pidPath, os.Getpid(), exited) {
+		t.Error("expected a share that exited not to have started")
+	}
+
+	if err := writePIDFile(pidPath); err != nil {
+		t.Fatal(err)
+	}
+	if !waitForDaemon(pidPath, os.Getpid(), make(chan struct{})) {
+		t.Error("expected the share that wrote its pid file to have started")
+	}
+	// Another process's file is left over from an earlier start
+	if waitForDaemon(pidPath, os.Getpid()+1, exited) {
+		t.Error("expected a pid file of another process not to count")
+	}
+}
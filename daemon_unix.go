@@ -0,0 +1,38 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignal asks a share running in the background to shut down, the
+// same as Ctrl+C in the foreground
+var stopSignal os.Signal = syscall.SIGTERM
+
+// daemonAttr starts the background share in a session of its own, so
+// closing the terminal neither hangs it up nor reloads it
+func daemonAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
+
+// processAlive reports whether the process pid exists
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return process.Signal(syscall.Signal(0)) == nil
+}
+
+// hasTerminal reports whether the process has a controlling terminal,
+// which can hang it up when closed
+func hasTerminal() bool {
+	tty, err := os.Open("/dev/tty")
+	if err != nil {
+		return false
+	}
+	tty.Close()
+	return true
+}
@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// stopSignal is nil because Windows can't ask another process to shut down
+// gracefully; --daemon and "userve stop" aren't supported there
+var stopSignal os.Signal
+
+func daemonAttr() *syscall.SysProcAttr {
+	return nil
+}
+
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+func hasTerminal() bool {
+	return true
+}
@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dlnaPrefix is where the media server's descriptions, control endpoints
+// and media are served
+const dlnaPrefix = "/dlna/"
+
+// UPnP AV device and service types, and the DLNA flags that tell TVs they
+// can seek in a file with Range requests
+const (
+	dlnaDeviceType        = "urn:schemas-upnp-org:device:MediaServer:1"
+	dlnaContentDirectory  = "urn:schemas-upnp-org:service:ContentDirectory:1"
+	dlnaConnectionManager = "urn:schemas-upnp-org:service:ConnectionManager:1"
+	dlnaFeatures          = "DLNA.ORG_OP=01;DLNA.ORG_CI=0;DLNA.ORG_FLAGS=01700000000000000000000000000000"
+	dlnaMaxAge            = 1800 // Seconds announcements are good for
+	dlnaRootID            = "0"
+)
+
+// dlnaMediaTypes are the files a media server lists, by extension. TVs go
+// by the MIME type, so it doesn't depend on the system's MIME database.
+var dlnaMediaTypes = map[string]string{
+	".mp4": "video/mp4", ".m4v": "video/mp4", ".mkv": "video/x-matroska", ".webm": "video/webm",
+	".avi": "video/x-msvideo", ".mov": "video/quicktime", ".mpg": "video/mpeg", ".mpeg": "video/mpeg",
+	".ts": "video/mp2t", ".m2ts": "video/mp2t", ".wmv": "video/x-ms-wmv", ".3gp": "video/3gpp",
+	".mp3": "audio/mpeg", ".flac": "audio/flac", ".m4a": "audio/mp4", ".aac": "audio/aac",
+	".ogg": "audio/ogg", ".opus": "audio/ogg", ".wav": "audio/wav", ".wma": "audio/x-ms-wma",
+	".jpg": "image/jpeg", ".jpeg": "image/jpeg", ".png": "image/png", ".gif": "image/gif",
+	".webp": "image/webp", ".heic": "image/heic", ".bmp": "image/bmp",
+}
+
+// dlnaServer serves the shared media file or directory as a UPnP media
+// server, which smart TVs, set-top boxes and apps such as VLC list among
+// their sources once it is announced over SSDP. Folders are browsed as
+// they are on disk, showing only media files, filtered like the archive.
+// TVs fetch a file in many pieces as they play and seek, which can't be
+// told from a download, so playback never counts towards the limit.
+type dlnaServer struct {
+	*shareTree
+	downloads *handler
+	uuid      string
+	name      string
+}
+
+// dlnaObject is a folder or media file as a ContentDirectory object
+type dlnaObject struct {
+	entry     treeEntry
+	ignores   ignoreRules
+	mediaType string
+}
+
+func newDLNAServer(tree *shareTree) *dlnaServer {
+	hostname, _ := os.Hostname()
+	var source string
+	if tree.archive != nil {
+		source = tree.archive.dirPath
+	} else {
+		source = tree.file.filePath
+	}
+	return &dlnaServer{shareTree: tree, uuid: dlnaUUID(hostname, source), name: dlnaName(tree.name(), hostname)}
+}
+
+// dlnaName is the name TVs list the share under
+func dlnaName(share, hostname string) string {
+	if hostname = strings.TrimSuffix(hostname, ".local"); hostname == "" {
+		return share
+	}
+	return share + " on " + hostname
+}
+
+// dlnaUUID identifies the media server, the same for the same share on the
+// same computer so that TVs don't list it again each time it is started
+func dlnaUUID(hostname, source string) string {
+	sum := sha1.Sum([]byte("userve dlna\x00" + hostname + "\x00" + source))
+	sum[6] = sum[6]&0x0f | 0x50 // UUID version 5
+	sum[8] = sum[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", sum[0:4], sum[4:6], sum[6:8], sum[8:10], sum[10:16])
+}
+
+// dlnaMediaType returns the MIME type of a media file, or "" for others
+func dlnaMediaType(name string) string {
+	return dlnaMediaTypes[strings.ToLower(filepath.Ext(name))]
+}
+
+// hasMedia reports whether the share has anything to play: a media file,
+// or a directory that may hold some
+func (d *dlnaServer) hasMedia() bool {
+	return d.archive != nil || dlnaMediaType(d.file.fileName) != ""
+}
+
+func (d *dlnaServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch p := strings.TrimPrefix(r.URL.Path, dlnaPrefix); {
+	case p == "device.xml":
+		d.serveXML(w, r, d.deviceDescription())
+	case p == "ContentDirectory.xml":
+		d.serveXML(w, r, dlnaContentDirectorySCPD)
+	case p == "ConnectionManager.xml":
+		d.serveXML(w, r, dlnaConnectionManagerSCPD)
+	case strings.HasPrefix(p, "control/"):
+		d.control(w, r)
+	case strings.HasPrefix(p, "event/"):
+		d.subscribe(w, r)
+	case strings.HasPrefix(p, "media/"):
+		d.serveMedia(w, r, strings.TrimPrefix(p, "media/"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (d *dlnaServer) serveXML(w http.ResponseWriter, r *http.Request, doc string) {
+	if !allowReads(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	io.WriteString(w, doc)
+}
+
+func (d *dlnaServer) deviceDescription() string {
+	service := func(serviceType, name string) string {
+		return "<service><serviceType>" + serviceType + "</serviceType><serviceId>urn:upnp-org:serviceId:" + name + "</serviceId>" +
+			"<SCPDURL>" + dlnaPrefix + name + ".xml</SCPDURL><controlURL>" + dlnaPrefix + "control/" + name + "</controlURL>" +
+			"<eventSubURL>" + dlnaPrefix + "event/" + name + "</eventSubURL></service>"
+	}
+	return `<?xml version="1.0" encoding="utf-8"?>` +
+		`<root xmlns="urn:schemas-upnp-org:device-1-0" xmlns:dlna="urn:schemas-dlna-org:device-1-0">` +
+		`<specVersion><major>1</major><minor>0</minor></specVersion><device>` +
+		"<deviceType>" + dlnaDeviceType + "</deviceType><friendlyName>" + xmlText(d.name) + "</friendlyName>" +
+		"<manufacturer>userve</manufacturer><modelName>userve</modelName><UDN>uuid:" + d.uuid + "</UDN>" +
+		"<dlna:X_DLNADOC>DMS-1.50</dlna:X_DLNADOC><serviceList>" +
+		service(dlnaContentDirectory, "ContentDirectory") + service(dlnaConnectionManager, "ConnectionManager") +
+		"</serviceList></device></root>"
+}
+
+// control answers a SOAP action of either service
+func (d *dlnaServer) control(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	service, action, _ := strings.Cut(strings.Trim(r.Header.Get("SOAPAction"), `"`), "#")
+	args, err := soapValues(io.LimitReader(r.Body, 64<<10))
+	if err != nil {
+		d.fault(w, 402, "Invalid Args")
+		return
+	}
+	var out [][2]string
+	switch service + "#" + action {
+	case dlnaContentDirectory + "#Browse":
+		result, returned, total, ok := d.browse(r, args)
+		if !ok {
+			d.fault(w, 701, "No such object")
+			return
+		}
+		out = [][2]string{{"Result", result}, {"NumberReturned", strconv.Itoa(returned)}, {"TotalMatches", strconv.Itoa(total)}, {"UpdateID", "1"}}
+	case dlnaContentDirectory + "#GetSystemUpdateID":
+		out = [][2]string{{"Id", "1"}}
+	case dlnaContentDirectory + "#GetSearchCapabilities":
+		out = [][2]string{{"SearchCaps", ""}}
+	case dlnaContentDirectory + "#GetSortCapabilities":
+		out = [][2]string{{"SortCaps", ""}}
+	case dlnaConnectionManager + "#GetProtocolInfo":
+		out = [][2]string{{"Source", dlnaProtocols()}, {"Sink", ""}}
+	case dlnaConnectionManager + "#GetCurrentConnectionIDs":
+		out = [][2]string{{"ConnectionIDs", "0"}}
+	case dlnaConnectionManager + "#GetCurrentConnectionInfo":
+		out = [][2]string{{"RcsID", "-1"}, {"AVTransportID", "-1"}, {"ProtocolInfo", ""}, {"PeerConnectionManager", ""},
+			{"PeerConnectionID", "-1"}, {"Direction", "Output"}, {"Status", "OK"}}
+	default:
+		d.fault(w, 401, "Invalid Action")
+		return
+	}
+
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%sResponse xmlns:u="%s">`, action, service)
+	for _, arg := range out {
+		fmt.Fprintf(&body, "<%s>%s</%s>", arg[0], xmlText(arg[1]), arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%sResponse></s:Body></s:Envelope>`, action)
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.Write(body.Bytes())
+}
+
+// fault answers with a UPnP error
+func (d *dlnaServer) fault(w http.ResponseWriter, code int, description string) {
+	w.Header().Set("Content-Type", `text/xml; charset="utf-8"`)
+	w.WriteHeader(http.StatusInternalServerError)
+	fmt.Fprintf(w, `<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`+
+		`<s:Fault><faultcode>s:Client</faultcode><faultstring>UPnPError</faultstring><detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0">`+
+		`<errorCode>%d</errorCode><errorDescription>%s</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`, code, description)
+}
+
+// subscribe accepts event subscriptions, which some TVs insist on before
+// they browse. Nothing ever changes, so no events are sent.
+func (d *dlnaServer) subscribe(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "SUBSCRIBE":
+		sid := r.Header.Get("SID")
+		if sid == "" {
+			sid = "uuid:" + dlnaUUID(d.uuid, time.Now().String())
+		}
+		w.Header().Set("SID", sid)
+		w.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(dlnaMaxAge))
+	case "UNSUBSCRIBE":
+	default:
+		w.Header().Set("Allow", "SUBSCRIBE, UNSUBSCRIBE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// browse answers a Browse action with the DIDL-Lite listing of an object
+// or of its children, and the number of objects listed and in all
+func (d *dlnaServer) browse(r *http.Request, args map[string]string) (string, int, int, bool) {
+	object, ok := d.object(args["ObjectID"])
+	if !ok {
+		return "", 0, 0, false
+	}
+	objects := []dlnaObject{object}
+	if args["BrowseFlag"] == "BrowseDirectChildren" {
+		if !object.entry.info.IsDir() {
+			return "", 0, 0, false
+		}
+		objects = d.objects(object)
+	}
+	total := len(objects)
+	start, _ := strconv.Atoi(args["StartingIndex"])
+	objects = objects[min(max(start, 0), total):]
+	if count, _ := strconv.Atoi(args["RequestedCount"]); count > 0 && count < len(objects) {
+		objects = objects[:count]
+	}
+
+	var didl strings.Builder
+	didl.WriteString(`<DIDL-Lite xmlns="urn:schemas-upnp-org:metadata-1-0/DIDL-Lite/" xmlns:dc="http://purl.org/dc/elements/1.1/" xmlns:upnp="urn:schemas-upnp-org:metadata-1-0/upnp/">`)
+	for _, o := range objects {
+		d.writeObject(&didl, r, o)
+	}
+	didl.WriteString("</DIDL-Lite>")
+	return didl.String(), len(objects), total, true
+}
+
+// object finds the folder or media file of an object id, which is the
+// path below the share's root after the root's own id
+func (d *dlnaServer) object(id string) (dlnaObject, bool) {
+	rel, ok := strings.CutPrefix(id, dlnaRootID)
+	if !ok || (rel != "" && !strings.HasPrefix(rel, "/")) {
+		return dlnaObject{}, false
+	}
+	rel = strings.TrimPrefix(rel, "/")
+	if rel != path.Clean("/" + rel)[1:] {
+		return dlnaObject{}, false
+	}
+	entry, ignores, ok := d.lookup(rel)
+	if !ok {
+		return dlnaObject{}, false
+	}
+	o := dlnaObject{entry: entry, ignores: ignores, mediaType: dlnaMediaType(entry.rel)}
+	if !entry.info.IsDir() && o.mediaType == "" {
+		return dlnaObject{}, false
+	}
+	return o, true
+}
+
+// objects lists the folders and media files of a folder, folders first
+func (d *dlnaServer) objects(dir dlnaObject) []dlnaObject {
+	var objects []dlnaObject
+	for _, e := range d.children(dir.entry, dir.ignores) {
+		if e.info.IsDir() {
+			if _, ignores, ok := d.lookup(e.rel); ok {
+				objects = append(objects, dlnaObject{entry: e, ignores: ignores})
+			}
+		} else if mediaType := dlnaMediaType(e.rel); mediaType != "" && e.info.Mode().IsRegular() {
+			objects = append(objects, dlnaObject{entry: e, mediaType: mediaType})
+		}
+	}
+	slices.SortStableFunc(objects, func(a, b dlnaObject) int {
+		switch {
+		case a.entry.info.IsDir() == b.entry.info.IsDir():
+			return 0
+		case a.entry.info.IsDir():
+			return -1
+		}
+		return 1
+	})
+	return objects
+}
+
+func (d *dlnaServer) writeObject(didl *strings.Builder, r *http.Request, o dlnaObject) {
+	id, parent := dlnaRootID, "-1"
+	title := d.name
+	if o.entry.rel != "" {
+		id = dlnaRootID + "/" + o.entry.rel
+		parent = dlnaRootID
+		if dir := path.Dir(o.entry.rel); dir != "." {
+			parent = dlnaRootID + "/" + dir
+		}
+		title = path.Base(o.entry.rel)
+	}
+	if o.entry.info.IsDir() {
+		fmt.Fprintf(didl, `<container id="%s" parentID="%s" restricted="1" childCount="%d"><dc:title>%s</dc:title><upnp:class>object.container.storageFolder</upnp:class></container>`,
+			xmlText(id), xmlText(parent), len(d.objects(o)), xmlText(title))
+		return
+	}
+	class := "object.item.imageItem.photo"
+	switch {
+	case strings.HasPrefix(o.mediaType, "video/"):
+		class = "object.item.videoItem"
+	case strings.HasPrefix(o.mediaType, "audio/"):
+		class = "object.item.audioItem.musicTrack"
+	}
+	media := "http://" + r.Host + dlnaPrefix + "media/" + strings.TrimPrefix(davHref(o.entry.rel, false), "/")
+	fmt.Fprintf(didl, `<item id="%s" parentID="%s" restricted="1"><dc:title>%s</dc:title><upnp:class>%s</upnp:class><dc:date>%s</dc:date>`+
+		`<res protocolInfo="http-get:*:%s:%s" size="%d">%s</res></item>`,
+		xmlText(id), xmlText(parent), xmlText(strings.TrimSuffix(title, path.Ext(title))), class, o.entry.info.ModTime().UTC().Format(time.RFC3339),
+		o.mediaType, dlnaFeatures, o.entry.info.Size(), xmlText(media))
+}
+
+// serveMedia plays a media file, answering the Range requests TVs seek
+// with. Shutdown waits for playback as for a download.
+func (d *dlnaServer) serveMedia(w http.ResponseWriter, r *http.Request, rel string) {
+	if !allowReads(w, r) {
+		return
+	}
+	o, ok := d.object(dlnaRootID + "/" + rel)
+	if !ok || o.entry.info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	file, err := os.Open(o.entry.path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+	d.downloads.activeDownloads.Add(1)
+	defer d.downloads.activeDownloads.Done()
+
+	// Seeking and probing for the index at the end of a file aren't worth
+	// a line each
+	if rng := r.Header.Get("Range"); r.Method == http.MethodGet && (rng == "" || strings.HasPrefix(rng, "bytes=0-")) {
+		logEvent("playback_started", logFields{"client": r.RemoteAddr, "file": o.entry.rel}, "Playback started from %s: %s", r.RemoteAddr, o.entry.rel)
+	}
+	w.Header().Set("Content-Type", o.mediaType)
+	w.Header().Set("contentFeatures.dlna.org", dlnaFeatures)
+	if strings.HasPrefix(o.mediaType, "image/") {
+		w.Header().Set("transferMode.dlna.org", "Interactive")
+	} else {
+		w.Header().Set("transferMode.dlna.org", "Streaming")
+	}
+	http.ServeContent(w, r, "", o.entry.info.ModTime(), file)
+}
+
+// dlnaProtocols lists the formats the server sends, for GetProtocolInfo
+func dlnaProtocols() string {
+	var types []string
+	for _, t := range dlnaMediaTypes {
+		if !slices.Contains(types, t) {
+			types = append(types, t)
+		}
+	}
+	slices.Sort(types)
+	for i, t := range types {
+		types[i] = "http-get:*:" + t + ":*"
+	}
+	return strings.Join(types, ",")
+}
+
+// xmlText escapes s for XML text and attributes
+func xmlText(s string) string {
+	var b bytes.Buffer
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// ssdpAnnouncer announces the media server on the LAN over SSDP: it tells
+// the network when it starts and stops, again before the announcement
+// expires, and answers the searches of TVs that are turned on later
+type ssdpAnnouncer struct {
+	conn     *net.UDPConn
+	uuid     string
+	location string
+	server   string
+
+	once sync.Once
+	done chan struct{}
+}
+
+// startSSDP announces the device described at location, which must be on
+// an IPv4 address
+func startSSDP(uuid, location, host string) (*ssdpAnnouncer, error) {
+	ip4 := net.ParseIP(host).To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("DLNA requires an IPv4 address, got %s", host)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", interfaceOf(ip4), ssdpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("cannot join SSDP group: %v", err)
+	}
+	s := &ssdpAnnouncer{
+		conn:     conn,
+		uuid:     uuid,
+		location: location,
+		server:   runtime.GOOS + "/1.0 UPnP/1.0 userve/" + currentVersion().version,
+		done:     make(chan struct{}),
+	}
+	if err := s.notify("ssdp:alive"); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot announce DLNA server: %v", err)
+	}
+	go s.serve()
+	go s.renew()
+	return s, nil
+}
+
+// interfaceOf returns the network interface with address ip, so that the
+// announcements go out where the URL is reachable, or nil if none has it
+func interfaceOf(ip net.IP) *net.Interface {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	for _, iface := range ifaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+				return &iface
+			}
+		}
+	}
+	return nil
+}
+
+// Close tells the network the server is gone
+func (s *ssdpAnnouncer) Close() error {
+	s.once.Do(func() {
+		close(s.done)
+		s.notify("ssdp:byebye")
+	})
+	return s.conn.Close()
+}
+
+// targets are what the device answers searches for: the root device, the
+// device itself, its type and its services
+func (s *ssdpAnnouncer) targets() []string {
+	return []string{"upnp:rootdevice", "uuid:" + s.uuid, dlnaDeviceType, dlnaContentDirectory, dlnaConnectionManager}
+}
+
+// usn is the unique name of the device for a target
+func (s *ssdpAnnouncer) usn(target string) string {
+	if target == "uuid:"+s.uuid {
+		return target
+	}
+	return "uuid:" + s.uuid + "::" + target
+}
+
+func (s *ssdpAnnouncer) notify(nts string) error {
+	for _, target := range s.targets() {
+		msg := "NOTIFY * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"NT: " + target + "\r\n" +
+			"NTS: " + nts + "\r\n" +
+			"USN: " + s.usn(target) + "\r\n"
+		if nts == "ssdp:alive" {
+			msg += "CACHE-CONTROL: max-age=" + strconv.Itoa(dlnaMaxAge) + "\r\n" +
+				"LOCATION: " + s.location + "\r\n" +
+				"SERVER: " + s.server + "\r\n"
+		}
+		if _, err := s.conn.WriteToUDP([]byte(msg+"\r\n"), ssdpAddr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// renew announces the server again before TVs forget it
+func (s *ssdpAnnouncer) renew() {
+	ticker := time.NewTicker(dlnaMaxAge / 2 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.notify("ssdp:alive")
+		case <-s.done:
+			return
+		}
+	}
+}
+
+func (s *ssdpAnnouncer) serve() {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:n])))
+		if err != nil || req.Method != "M-SEARCH" || req.Header.Get("MAN") != `"ssdp:discover"` {
+			continue
+		}
+		for _, reply := range s.replies(req.Header.Get("ST")) {
+			s.conn.WriteToUDP(reply, src)
+		}
+	}
+}
+
+// replies are the answers to a search for target
+func (s *ssdpAnnouncer) replies(target string) [][]byte {
+	var replies [][]byte
+	for _, t := range s.targets() {
+		if target != "ssdp:all" && target != t {
+			continue
+		}
+		replies = append(replies, []byte("HTTP/1.1 200 OK\r\n"+
+			"CACHE-CONTROL: max-age="+strconv.Itoa(dlnaMaxAge)+"\r\n"+
+			"DATE: "+time.Now().UTC().Format(http.TimeFormat)+"\r\n"+
+			"EXT:\r\n"+
+			"LOCATION: "+s.location+"\r\n"+
+			"SERVER: "+s.server+"\r\n"+
+			"ST: "+t+"\r\n"+
+			"USN: "+s.usn(t)+"\r\n\r\n"))
+	}
+	return replies
+}
+
+// dlnaLocation is the URL of the device description
+func dlnaLocation(host string, port int) string {
+	return httpURL(host, port, strings.TrimPrefix(dlnaPrefix, "/")+"device.xml")
+}
+
+// The service descriptions, listing the actions each service answers
+const (
+	dlnaContentDirectorySCPD = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>` +
+		`<action><name>Browse</name><argumentList>` +
+		`<argument><name>ObjectID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ObjectID</relatedStateVariable></argument>` +
+		`<argument><name>BrowseFlag</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_BrowseFlag</relatedStateVariable></argument>` +
+		`<argument><name>Filter</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Filter</relatedStateVariable></argument>` +
+		`<argument><name>StartingIndex</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Index</relatedStateVariable></argument>` +
+		`<argument><name>RequestedCount</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>` +
+		`<argument><name>SortCriteria</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_SortCriteria</relatedStateVariable></argument>` +
+		`<argument><name>Result</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Result</relatedStateVariable></argument>` +
+		`<argument><name>NumberReturned</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>` +
+		`<argument><name>TotalMatches</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Count</relatedStateVariable></argument>` +
+		`<argument><name>UpdateID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_UpdateID</relatedStateVariable></argument>` +
+		`</argumentList></action>` +
+		`<action><name>GetSearchCapabilities</name><argumentList><argument><name>SearchCaps</name><direction>out</direction><relatedStateVariable>SearchCapabilities</relatedStateVariable></argument></argumentList></action>` +
+		`<action><name>GetSortCapabilities</name><argumentList><argument><name>SortCaps</name><direction>out</direction><relatedStateVariable>SortCapabilities</relatedStateVariable></argument></argumentList></action>` +
+		`<action><name>GetSystemUpdateID</name><argumentList><argument><name>Id</name><direction>out</direction><relatedStateVariable>SystemUpdateID</relatedStateVariable></argument></argumentList></action>` +
+		`</actionList><serviceStateTable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_ObjectID</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_BrowseFlag</name><dataType>string</dataType><allowedValueList><allowedValue>BrowseMetadata</allowedValue><allowedValue>BrowseDirectChildren</allowedValue></allowedValueList></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_Filter</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_Index</name><dataType>ui4</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_Count</name><dataType>ui4</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_SortCriteria</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_Result</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_UpdateID</name><dataType>ui4</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>SearchCapabilities</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>SortCapabilities</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="yes"><name>SystemUpdateID</name><dataType>ui4</dataType></stateVariable>` +
+		`</serviceStateTable></scpd>`
+
+	dlnaConnectionManagerSCPD = `<?xml version="1.0" encoding="utf-8"?>` +
+		`<scpd xmlns="urn:schemas-upnp-org:service-1-0"><specVersion><major>1</major><minor>0</minor></specVersion><actionList>` +
+		`<action><name>GetProtocolInfo</name><argumentList>` +
+		`<argument><name>Source</name><direction>out</direction><relatedStateVariable>SourceProtocolInfo</relatedStateVariable></argument>` +
+		`<argument><name>Sink</name><direction>out</direction><relatedStateVariable>SinkProtocolInfo</relatedStateVariable></argument>` +
+		`</argumentList></action>` +
+		`<action><name>GetCurrentConnectionIDs</name><argumentList><argument><name>ConnectionIDs</name><direction>out</direction><relatedStateVariable>CurrentConnectionIDs</relatedStateVariable></argument></argumentList></action>` +
+		`<action><name>GetCurrentConnectionInfo</name><argumentList>` +
+		`<argument><name>ConnectionID</name><direction>in</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>` +
+		`<argument><name>RcsID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_RcsID</relatedStateVariable></argument>` +
+		`<argument><name>AVTransportID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_AVTransportID</relatedStateVariable></argument>` +
+		`<argument><name>ProtocolInfo</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ProtocolInfo</relatedStateVariable></argument>` +
+		`<argument><name>PeerConnectionManager</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionManager</relatedStateVariable></argument>` +
+		`<argument><name>PeerConnectionID</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionID</relatedStateVariable></argument>` +
+		`<argument><name>Direction</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_Direction</relatedStateVariable></argument>` +
+		`<argument><name>Status</name><direction>out</direction><relatedStateVariable>A_ARG_TYPE_ConnectionStatus</relatedStateVariable></argument>` +
+		`</argumentList></action>` +
+		`</actionList><serviceStateTable>` +
+		`<stateVariable sendEvents="yes"><name>SourceProtocolInfo</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="yes"><name>SinkProtocolInfo</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="yes"><name>CurrentConnectionIDs</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionStatus</name><dataType>string</dataType><allowedValueList><allowedValue>OK</allowedValue><allowedValue>ContentFormatMismatch</allowedValue><allowedValue>InsufficientBandwidth</allowedValue><allowedValue>UnreliableChannel</allowedValue><allowedValue>Unknown</allowedValue></allowedValueList></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionManager</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_Direction</name><dataType>string</dataType><allowedValueList><allowedValue>Input</allowedValue><allowedValue>Output</allowedValue></allowedValueList></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_ProtocolInfo</name><dataType>string</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_ConnectionID</name><dataType>i4</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_AVTransportID</name><dataType>i4</dataType></stateVariable>` +
+		`<stateVariable sendEvents="no"><name>A_ARG_TYPE_RcsID</name><dataType>i4</dataType></stateVariable>` +
+		`</serviceStateTable></scpd>`
+)
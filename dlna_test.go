@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDLNANames(t *testing.T) {
+	id := dlnaUUID("laptop", "/home/me/Movies")
+	if !regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-5[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`).MatchString(id) {
+		t.Errorf("unexpected UUID %q", id)
+	}
+	if dlnaUUID("laptop", "/home/me/Movies") != id || dlnaUUID("laptop", "/home/me/Music") == id {
+		t.Error("expected the UUID to depend on the share only")
+	}
+	for _, tc := range []struct{ share, hostname, want string }{
+		{"Movies", "laptop.local", "Movies on laptop"},
+		{"Movies", "", "Movies"},
+	} {
+		if got := dlnaName(tc.share, tc.hostname); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+	if dlnaMediaType("Film.MKV") != "video/x-matroska" || dlnaMediaType("notes.txt") != "" {
+		t.Error("unexpected media types")
+	}
+}
+
+// testDLNA serves a media directory with a subfolder and files that aren't
+// listed
+func testDLNA(t *testing.T) (*dlnaServer, *httptest.Server) {
+	t.Helper()
+	share := filepath.Join(t.TempDir(), "Movies")
+	os.MkdirAll(filepath.Join(share, "Holiday"), 0755)
+	os.WriteFile(filepath.Join(share, "film & co.mp4"), []byte("0123456789"), 0644)
+	os.WriteFile(filepath.Join(share, "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(share, ".hidden.mkv"), []byte("hidden"), 0644)
+	os.WriteFile(filepath.Join(share, "Holiday", "beach.jpg"), []byte("jpeg"), 0644)
+	archive := newArchiveProvider(share, "Movies", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	d := newDLNAServer(&shareTree{archive: archive})
+	d.downloads = &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 1}
+	mux := http.NewServeMux()
+	mux.Handle(dlnaPrefix, d)
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+// dlnaAction invokes a SOAP action and returns the status and the leaf
+// elements of the answer
+func dlnaAction(t *testing.T, srv *httptest.Server, service, action string, args [][2]string) (int, map[string]string) {
+	t.Helper()
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`)
+	body.WriteString(`<u:` + action + ` xmlns:u="` + service + `">`)
+	for _, arg := range args {
+		body.WriteString("<" + arg[0] + ">" + xmlText(arg[1]) + "</" + arg[0] + ">")
+	}
+	body.WriteString(`</u:` + action + `></s:Body></s:Envelope>`)
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/dlna/control/ContentDirectory", strings.NewReader(body.String()))
+	req.Header.Set("SOAPAction", `"`+service+"#"+action+`"`)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	values, err := soapValues(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, values
+}
+
+func browse(id, flag string) [][2]string {
+	return [][2]string{{"ObjectID", id}, {"BrowseFlag", flag}, {"Filter", "*"}, {"StartingIndex", "0"}, {"RequestedCount", "0"}, {"SortCriteria", ""}}
+}
+
+func TestDLNABrowse(t *testing.T) {
+	d, srv := testDLNA(t)
+	resp, err := http.Get(srv.URL + "/dlna/device.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	description, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if !bytes.Contains(description, []byte("<UDN>uuid:"+d.uuid+"</UDN>")) || !bytes.Contains(description, []byte("<controlURL>/dlna/control/ContentDirectory</controlURL>")) {
+		t.Errorf("unexpected device description %s", description)
+	}
+
+	// Folders come first, and only media files are listed
+	status, values := dlnaAction(t, srv, dlnaContentDirectory, "Browse", browse("0", "BrowseDirectChildren"))
+	result := values["Result"]
+	if status != http.StatusOK || values["NumberReturned"] != "2" || values["TotalMatches"] != "2" {
+		t.Fatalf("unexpected answer %d %v", status, values)
+	}
+	folder := strings.Index(result, `<container id="0/Holiday" parentID="0" restricted="1" childCount="1"><dc:title>Holiday</dc:title>`)
+	film := strings.Index(result, `<item id="0/film &amp; co.mp4" parentID="0" restricted="1"><dc:title>film &amp; co</dc:title><upnp:class>object.item.videoItem</upnp:class>`)
+	if folder < 0 || film < folder {
+		t.Errorf("unexpected listing %s", result)
+	}
+	if want := `<res protocolInfo="http-get:*:video/mp4:` + dlnaFeatures + `" size="10">` + srv.URL + `/dlna/media/film%20&amp;%20co.mp4</res>`; !strings.Contains(result, want) {
+		t.Errorf("expected %s in %s", want, result)
+	}
+	if strings.Contains(result, "notes") || strings.Contains(result, "hidden") {
+		t.Errorf("expected other files to be left out: %s", result)
+	}
+
+	_, values = dlnaAction(t, srv, dlnaContentDirectory, "Browse", [][2]string{{"ObjectID", "0"}, {"BrowseFlag", "BrowseDirectChildren"}, {"StartingIndex", "1"}, {"RequestedCount", "5"}})
+	if values["NumberReturned"] != "1" || values["TotalMatches"] != "2" || !strings.Contains(values["Result"], "film") {
+		t.Errorf("expected the second object, got %v", values)
+	}
+	_, values = dlnaAction(t, srv, dlnaContentDirectory, "Browse", browse("0/Holiday/beach.jpg", "BrowseMetadata"))
+	if !strings.Contains(values["Result"], `parentID="0/Holiday"`) || !strings.Contains(values["Result"], "object.item.imageItem.photo") {
+		t.Errorf("unexpected metadata %v", values)
+	}
+	for _, id := range []string{"0/notes.txt", "0/.hidden.mkv", "0/../Movies", "01", "Holiday"} {
+		if status, values := dlnaAction(t, srv, dlnaContentDirectory, "Browse", browse(id, "BrowseMetadata")); status != http.StatusInternalServerError || values["errorCode"] != "701" {
+			t.Errorf("%s: expected no such object, got %d %v", id, status, values)
+		}
+	}
+	if _, values := dlnaAction(t, srv, dlnaConnectionManager, "GetProtocolInfo", nil); !strings.Contains(values["Source"], "http-get:*:video/x-matroska:*") {
+		t.Errorf("unexpected protocol info %v", values)
+	}
+	if status, values := dlnaAction(t, srv, dlnaContentDirectory, "DestroyObject", nil); status != http.StatusInternalServerError || values["errorCode"] != "401" {
+		t.Errorf("expected an unknown action to fail, got %d %v", status, values)
+	}
+
+	req, _ := http.NewRequest("SUBSCRIBE", srv.URL+"/dlna/event/ContentDirectory", nil)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("SID"), "uuid:") {
+		t.Errorf("expected the subscription to be taken, got %v", err)
+	}
+}
+
+func TestDLNAMedia(t *testing.T) {
+	d, srv := testDLNA(t)
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/dlna/media/film%20&%20co.mp4", nil)
+	req.Header.Set("Range", "bytes=4-")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent || string(body) != "456789" || resp.Header.Get("Content-Type") != "video/mp4" ||
+		resp.Header.Get("transferMode.dlna.org") != "Streaming" || resp.Header.Get("contentFeatures.dlna.org") != dlnaFeatures {
+		t.Errorf("unexpected response %d %q %v", resp.StatusCode, body, resp.Header)
+	}
+	resp, _ = http.Get(srv.URL + "/dlna/media/film%20&%20co.mp4")
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if remaining := d.downloads.remaining(); remaining != 1 {
+		t.Errorf("expected playback not to count, got %d remaining", remaining)
+	}
+
+	for _, p := range []string{"notes.txt", ".hidden.mkv", "Holiday", "../film%20&%20co.mp4"} {
+		if resp, _ := http.Get(srv.URL + "/dlna/media/" + p); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: expected 404, got %d", p, resp.StatusCode)
+		}
+	}
+}
+
+func TestSSDPSearch(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ssdpAnnouncer{conn: conn, uuid: "1234", location: "http://192.0.2.1:8080/dlna/device.xml", server: "test", done: make(chan struct{})}
+	go s.serve()
+	defer s.Close()
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	search := func(target string) []*http.Response {
+		client.WriteToUDP([]byte("M-SEARCH * HTTP/1.1\r\nHOST: 239.255.255.250:1900\r\nMAN: \"ssdp:discover\"\r\nMX: 1\r\nST: "+target+"\r\n\r\n"), conn.LocalAddr().(*net.UDPAddr))
+		var replies []*http.Response
+		buf := make([]byte, 2048)
+		for {
+			client.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+			n, _, err := client.ReadFromUDP(buf)
+			if err != nil {
+				return replies
+			}
+			resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			replies = append(replies, resp)
+		}
+	}
+	replies := search(dlnaDeviceType)
+	if len(replies) != 1 || replies[0].Header.Get("USN") != "uuid:1234::"+dlnaDeviceType || replies[0].Header.Get("Location") != s.location {
+		t.Fatalf("unexpected replies %v", replies)
+	}
+	if replies := search("uuid:1234"); len(replies) != 1 || replies[0].Header.Get("USN") != "uuid:1234" {
+		t.Errorf("unexpected replies %v", replies)
+	}
+	if replies := search("ssdp:all"); len(replies) != 5 {
+		t.Errorf("expected an answer for each target, got %d", len(replies))
+	}
+	if replies := search("urn:schemas-upnp-org:device:InternetGatewayDevice:1"); len(replies) != 0 {
+		t.Errorf("expected no answer for another device, got %d", len(replies))
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveFilter decides which entries of a directory go into its archive.
+// A nil filter keeps everything.
+type archiveFilter struct {
+	exclude []string // glob patterns for names or relative paths to leave out
+	include []string // if set, only files matching one of these are packed
+
+	gitignore  bool // honor .gitignore files and leave out .git
+	skipHidden bool // leave out dotfiles and dot-directories
+
+	symlinks string // symlinksPreserve, symlinksFollow or symlinksSkip
+	maxDepth int    // if set, entries nested deeper are left out
+
+	maxFileSize int64 // if set, larger files are left out and logged
+}
+
+// validate checks that all patterns and modes are well-formed
+func (f *archiveFilter) validate() error {
+	switch f.symlinks {
+	case "", symlinksPreserve, symlinksFollow, symlinksSkip:
+	default:
+		return fmt.Errorf("invalid symlink mode %q: valid modes are preserve, follow, skip", f.symlinks)
+	}
+	if f.maxDepth < 0 {
+		return fmt.Errorf("invalid max depth %d", f.maxDepth)
+	}
+	for _, list := range []struct {
+		kind     string
+		patterns []string
+	}{{"exclude", f.exclude}, {"include", f.include}} {
+		for _, p := range list.patterns {
+			if _, err := path.Match(p, ""); err != nil {
+				return fmt.Errorf("invalid %s pattern %q", list.kind, p)
+			}
+		}
+	}
+	return nil
+}
+
+// skip reports whether the entry at relPath, relative to the archived
+// directory, is left out. Skipping a directory skips its whole subtree.
+func (f *archiveFilter) skip(relPath string, info os.FileInfo) bool {
+	return f.skipReason(relPath, info) != ""
+}
+
+// skipReason returns why the entry at relPath is left out, or "" if it
+// isn't
+func (f *archiveFilter) skipReason(relPath string, info os.FileInfo) string {
+	if f == nil {
+		return ""
+	}
+	rel := filepath.ToSlash(relPath)
+	if f.maxDepth > 0 && strings.Count(rel, "/")+1 > f.maxDepth {
+		return "deeper than --max-depth"
+	}
+	if f.gitignore && info.IsDir() && info.Name() == ".git" {
+		return "git repository (--gitignore)"
+	}
+	if f.skipHidden && strings.HasPrefix(info.Name(), ".") {
+		return "hidden (--skip-hidden)"
+	}
+	if f.maxFileSize > 0 && info.Mode().IsRegular() && info.Size() > f.maxFileSize {
+		reason := fmt.Sprintf("%s is over the size limit", formatSize(info.Size()))
+		logSkipped(relPath, reason)
+		return reason
+	}
+	if matchAny(f.exclude, rel) {
+		return "matches --exclude"
+	}
+	if len(f.include) > 0 && !info.IsDir() && !matchAny(f.include, rel) {
+		return "doesn't match --include"
+	}
+	return ""
+}
+
+// useGitignore reports whether .gitignore files are read during the walk
+func (f *archiveFilter) useGitignore() bool {
+	return f != nil && f.gitignore
+}
+
+// symlinkMode returns how symlinks inside archived directories are handled
+func (f *archiveFilter) symlinkMode() string {
+	if f == nil || f.symlinks == "" {
+		return symlinksPreserve
+	}
+	return f.symlinks
+}
+
+// keepDirs reports whether directory entries are written. With include
+// patterns they are left out, so the archive holds only the matching files
+// instead of a tree of mostly empty directories.
+func (f *archiveFilter) keepDirs() bool {
+	return f == nil || len(f.include) == 0
+}
+
+// matchAny reports whether a slash-separated relative path or its last
+// element matches one of the glob patterns
+func matchAny(patterns []string, rel string) bool {
+	base := path.Base(rel)
+	for _, p := range patterns {
+		if ok, _ := path.Match(p, base); ok {
+			return true
+		}
+		if ok, _ := path.Match(p, rel); ok {
+			return true
+		}
+	}
+	return false
+}
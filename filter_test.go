@@ -0,0 +1,170 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// archiveNames writes the provider's tar archive and returns its entry names
+func archiveNames(t *testing.T, p *archiveProvider) []string {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return names
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		names = append(names, filepath.ToSlash(header.Name))
+	}
+}
+
+// makeTree creates files (and their parent directories) under a new
+// directory named "project"
+func makeTree(t *testing.T, files ...string) string {
+	t.Helper()
+	root := filepath.Join(t.TempDir(), "project")
+	for _, name := range files {
+		path := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatalf("failed to create directory: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+	return root
+}
+
+func TestArchiveFilterExclude(t *testing.T) {
+	root := makeTree(t, "main.go", "debug.log", "node_modules/pkg/index.js", "build/tmp/x.o", "build/out.bin")
+
+	tests := []struct {
+		exclude  []string
+		expected string
+	}{
+		{nil, "project project/build project/build/out.bin project/build/tmp project/build/tmp/x.o project/debug.log project/main.go project/node_modules project/node_modules/pkg project/node_modules/pkg/index.js"},
+		{[]string{"node_modules", "*.log"}, "project project/build project/build/out.bin project/build/tmp project/build/tmp/x.o project/main.go"},
+		{[]string{"build/tmp"}, "project project/build project/build/out.bin project/debug.log project/main.go project/node_modules project/node_modules/pkg project/node_modules/pkg/index.js"},
+	}
+	for _, tt := range tests {
+		filter := &archiveFilter{exclude: tt.exclude}
+		p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: filter}
+		if got := strings.Join(archiveNames(t, p), " "); got != tt.expected {
+			t.Errorf("exclude %q:\n got  %s\n want %s", tt.exclude, got, tt.expected)
+		}
+	}
+}
+
+func TestArchiveFilterInclude(t *testing.T) {
+	root := makeTree(t, "a.jpg", "notes.txt", "2024/b.jpg", "2024/raw/c.cr2", "node_modules/d.jpg")
+
+	filter := &archiveFilter{include: []string{"*.jpg"}, exclude: []string{"node_modules"}}
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: filter}
+	if got := strings.Join(archiveNames(t, p), " "); got != "project/2024/b.jpg project/a.jpg" {
+		t.Errorf("unexpected archive entries: %s", got)
+	}
+}
+
+func TestArchiveFilterGitignore(t *testing.T) {
+	root := makeTree(t,
+		".gitignore", ".git/HEAD", "main.go", "app.log",
+		"target/app", "web/.gitignore", "web/index.html", "web/dist/app.js",
+	)
+	if err := os.WriteFile(filepath.Join(root, ".gitignore"), []byte("*.log\ntarget/\n"), 0644); err != nil {
+		t.Fatalf("failed to write .gitignore: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "web", ".gitignore"), []byte("dist/\n"), 0644); err != nil {
+		t.Fatalf("failed to write .gitignore: %v", err)
+	}
+
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: &archiveFilter{gitignore: true}}
+	expected := "project project/.gitignore project/main.go project/web project/web/.gitignore project/web/index.html"
+	if got := strings.Join(archiveNames(t, p), " "); got != expected {
+		t.Errorf("unexpected archive entries:\n got  %s\n want %s", got, expected)
+	}
+}
+
+func TestUserveIgnoreFile(t *testing.T) {
+	root := makeTree(t, ".userveignore", "main.go", "secrets/key.pem", "sub/.userveignore", "sub/a.tmp")
+	if err := os.WriteFile(filepath.Join(root, ".userveignore"), []byte("secrets/\n*.tmp\n"), 0644); err != nil {
+		t.Fatalf("failed to write .userveignore: %v", err)
+	}
+
+	// Only the file at the root of the served directory is read; no flag needed
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar}
+	expected := "project project/.userveignore project/main.go project/sub project/sub/.userveignore"
+	if got := strings.Join(archiveNames(t, p), " "); got != expected {
+		t.Errorf("unexpected archive entries:\n got  %s\n want %s", got, expected)
+	}
+}
+
+func TestArchiveFilterSkipHidden(t *testing.T) {
+	root := makeTree(t, ".env", ".ssh/id_ed25519", "src/.cache/x", "src/main.go")
+
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: &archiveFilter{skipHidden: true}}
+	if got := strings.Join(archiveNames(t, p), " "); got != "project project/src project/src/main.go" {
+		t.Errorf("unexpected archive entries: %s", got)
+	}
+}
+
+func TestArchiveFilterMaxDepth(t *testing.T) {
+	root := makeTree(t, "top.txt", "a/mid.txt", "a/b/deep.txt", "a/b/c/deeper.txt")
+
+	tests := []struct {
+		depth    int
+		expected string
+	}{
+		{1, "project project/a project/top.txt"},
+		{2, "project project/a project/a/b project/a/mid.txt project/top.txt"},
+		{0, "project project/a project/a/b project/a/b/c project/a/b/c/deeper.txt project/a/b/deep.txt project/a/mid.txt project/top.txt"},
+	}
+	for _, tt := range tests {
+		p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: &archiveFilter{maxDepth: tt.depth}}
+		if got := strings.Join(archiveNames(t, p), " "); got != tt.expected {
+			t.Errorf("max depth %d:\n got  %s\n want %s", tt.depth, got, tt.expected)
+		}
+	}
+}
+
+func TestArchiveFilterMaxFileSize(t *testing.T) {
+	root := makeTree(t, "small.txt")
+	if err := os.WriteFile(filepath.Join(root, "large.bin"), make([]byte, 2048), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTar, filter: &archiveFilter{maxFileSize: 1024}}
+	if got := strings.Join(archiveNames(t, p), " "); got != "project project/small.txt" {
+		t.Errorf("unexpected archive entries: %s", got)
+	}
+}
+
+func TestArchiveFilterValidate(t *testing.T) {
+	tests := []struct {
+		filter  archiveFilter
+		wantErr string
+	}{
+		{archiveFilter{exclude: []string{"*.log"}, include: []string{"*.jpg"}}, ""},
+		{archiveFilter{exclude: []string{"[a-"}}, `invalid exclude pattern "[a-"`},
+		{archiveFilter{include: []string{"[a-"}}, `invalid include pattern "[a-"`},
+		{archiveFilter{maxDepth: -1}, "invalid max depth -1"},
+	}
+	for _, tt := range tests {
+		err := tt.filter.validate()
+		if tt.wantErr == "" && err != nil || tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr) {
+			t.Errorf("validate() = %v, want %q", err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+// followPollInterval is how often --follow checks the file for new data
+const followPollInterval = 500 * time.Millisecond
+
+// streamingContent is implemented by providers whose content keeps coming
+// until the request ends, so a transfer never completes
+type streamingContent interface {
+	contentProvider
+	// stream writes the content and then whatever is added to it, until
+	// ctx is done or writing fails
+	stream(ctx context.Context, w http.ResponseWriter) error
+}
+
+// followProvider serves a growing file, such as a log, like tail -f: the
+// content so far and then new data as it is appended
+type followProvider struct {
+	filePath string
+	fileName string
+}
+
+func (p *followProvider) Filename() string {
+	return p.fileName
+}
+
+func (p *followProvider) ContentType() string {
+	return "text/plain; charset=utf-8"
+}
+
+func (p *followProvider) ContentLength() int64 {
+	return -1 // Still growing
+}
+
+func (p *followProvider) WriteTo(w io.Writer) (int64, error) {
+	file, err := os.Open(p.filePath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	return io.Copy(w, file)
+}
+
+func (p *followProvider) stream(ctx context.Context, w http.ResponseWriter) error {
+	file, err := os.Open(p.filePath)
+	if err != nil {
+		return err
+	}
+	defer func() { file.Close() }()
+
+	rc := http.NewResponseController(w)
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	for {
+		n, err := io.Copy(w, file)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			if err := rc.Flush(); err != nil {
+				return err
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		// Start over if the file was truncated, or replaced as by log
+		// rotation once the old one has been read to the end
+		info, err := os.Stat(p.filePath)
+		if err != nil {
+			continue // Not recreated yet
+		}
+		if current, err := file.Stat(); err == nil && !os.SameFile(info, current) {
+			if reopened, err := os.Open(p.filePath); err == nil {
+				file.Close()
+				file = reopened
+			}
+			continue
+		}
+		if pos, err := file.Seek(0, io.SeekCurrent); err == nil && info.Size() < pos {
+			file.Seek(0, io.SeekStart)
+		}
+	}
+}
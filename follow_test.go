@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFollowProvider(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "build.log")
+	if err := os.WriteFile(logPath, []byte("step 1\n"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &followProvider{filePath: logPath, fileName: "build.log"},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/build.log")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if got := resp.Header.Get("Content-Disposition"); got != `inline; filename="build.log"` {
+		t.Errorf("expected inline disposition, got %q", got)
+	}
+	if resp.ContentLength != -1 {
+		t.Errorf("expected a chunked response, got length %d", resp.ContentLength)
+	}
+
+	lines := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(resp.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+		close(lines)
+	}()
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("expected %q, got %q", want, got)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatalf("timed out waiting for %q", want)
+		}
+	}
+	expect("step 1")
+
+	file, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("failed to open log: %v", err)
+	}
+	file.WriteString("step 2\n")
+	file.Close()
+	expect("step 2")
+
+	// A truncated log is followed from its new start
+	if err := os.WriteFile(logPath, []byte("new\n"), 0644); err != nil {
+		t.Fatalf("failed to truncate log: %v", err)
+	}
+	expect("new")
+
+	// A rotated log is replaced by a new file of the same name
+	if err := os.Rename(logPath, logPath+".1"); err != nil {
+		t.Fatalf("failed to rotate log: %v", err)
+	}
+	if err := os.WriteFile(logPath, []byte("rotated\n"), 0644); err != nil {
+		t.Fatalf("failed to create new log: %v", err)
+	}
+	expect("rotated")
+
+	resp.Body.Close()
+	server.Close()
+	if h.downloadCount.Load() != 0 {
+		t.Errorf("expected a stream not to count as a download, got %d", h.downloadCount.Load())
+	}
+}
+
+func TestFollowEndsOnShutdown(t *testing.T) {
+	logPath := filepath.Join(t.TempDir(), "build.log")
+	if err := os.WriteFile(logPath, []byte("step 1\n"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	stopping, stop := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &followProvider{filePath: logPath, fileName: "build.log"},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+		stopping:         stopping,
+	}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "/build.log")
+	if err != nil {
+		t.Fatalf("GET failed: %v", err)
+	}
+	defer resp.Body.Close()
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(resp.Body)
+		done <- err
+	}()
+
+	stop()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("expected the stream to end cleanly, got %v", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("expected the stream to end when the share stops")
+	}
+}
+
+func TestRunFollowConflicts(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"--follow", dir},
+		{"--follow", "-c", "2", filepath.Join(dir, "x.log")},
+		{"--follow", "--bundle", dir},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "--follow") {
+			t.Errorf("%v: expected a --follow error, got %v", args, err)
+		}
+	}
+}
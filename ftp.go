@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultFTPPort is where --ftp listens; ports below 1024 need root
+const defaultFTPPort = 2121
+
+// ftpDataTimeout bounds how long a client may take to open the data
+// connection it asked for with PASV or EPSV
+const ftpDataTimeout = 30 * time.Second
+
+// ftpServer serves the share's file tree read-only over FTP, for devices
+// that can't fetch over HTTP. Logins are anonymous, as HTTP downloads are,
+// and only passive mode is offered, since active mode connects back to the
+// client through its firewall. Files are sent by the HTTP handler, so each
+// one counts towards the share's limit and is waited for at shutdown like
+// any other download.
+type ftpServer struct {
+	tree      *shareTree
+	downloads *handler
+	listener  net.Listener
+
+	mu       sync.Mutex
+	sessions map[*ftpSession]bool
+	closed   bool
+}
+
+// ftpSession is one client's control connection
+type ftpSession struct {
+	server   *ftpServer
+	conn     net.Conn
+	reader   *bufio.Reader
+	cwd      string // Slash-separated path below the root, "" at the root
+	passive  net.Listener
+	offset   int64 // From REST, for the next RETR
+	user     bool  // USER was sent
+	loggedIn bool
+}
+
+func newFTPServer(listener net.Listener, tree *shareTree, downloads *handler) *ftpServer {
+	return &ftpServer{tree: tree, downloads: downloads, listener: listener, sessions: make(map[*ftpSession]bool)}
+}
+
+// serve accepts control connections until the server is closed
+func (s *ftpServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		session := &ftpSession{server: s, conn: conn, reader: bufio.NewReader(conn)}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.sessions[session] = true
+		s.mu.Unlock()
+		go session.run()
+	}
+}
+
+// Close stops taking connections and ends each session once the command
+// it is running, such as a download, is done
+func (s *ftpServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for session := range s.sessions {
+		// Wakes a session waiting for its next command
+		session.conn.SetReadDeadline(time.Now())
+	}
+	return s.listener.Close()
+}
+
+func (c *ftpSession) reply(code int, format string, args ...any) {
+	fmt.Fprintf(c.conn, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+func (c *ftpSession) run() {
+	defer func() {
+		c.closePassive()
+		c.conn.Close()
+		c.server.mu.Lock()
+		delete(c.server.sessions, c)
+		c.server.mu.Unlock()
+	}()
+	c.reply(220, "userve ready, read-only")
+	for {
+		// Clients that go quiet are dropped, as idle HTTP connections are
+		c.conn.SetReadDeadline(time.Now().Add(defaultIdleTimeout))
+		c.server.mu.Lock()
+		closed := c.server.closed
+		c.server.mu.Unlock()
+		if closed {
+			c.reply(421, "Share closed")
+			return
+		}
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		if !c.handle(strings.ToUpper(command), arg) {
+			return
+		}
+	}
+}
+
+// handle runs a command and reports whether the session goes on
+func (c *ftpSession) handle(command, arg string) bool {
+	switch command {
+	case "USER":
+		c.user = true
+		c.reply(331, "Any password will do")
+		return true
+	case "PASS":
+		if !c.user {
+			c.reply(503, "Send USER first")
+			return true
+		}
+		c.loggedIn = true
+		c.reply(230, "Logged in")
+		return true
+	case "QUIT":
+		c.reply(221, "Bye")
+		return false
+	case "NOOP":
+		c.reply(200, "OK")
+		return true
+	case "FEAT":
+		fmt.Fprintf(c.conn, "211-Features:\r\n EPSV\r\n PASV\r\n SIZE\r\n MDTM\r\n REST STREAM\r\n UTF8\r\n211 End\r\n")
+		return true
+	case "SYST":
+		c.reply(215, "UNIX Type: L8")
+		return true
+	}
+	if !c.loggedIn {
+		c.reply(530, "Log in with USER and PASS")
+		return true
+	}
+
+	switch command {
+	case "OPTS":
+		if strings.EqualFold(arg, "UTF8 ON") {
+			c.reply(200, "Always in UTF8")
+		} else {
+			c.reply(501, "Unknown option")
+		}
+	case "TYPE":
+		// Files are always sent as they are
+		c.reply(200, "Type set")
+	case "MODE", "STRU":
+		if strings.EqualFold(arg, "S") || strings.EqualFold(arg, "F") {
+			c.reply(200, "OK")
+		} else {
+			c.reply(504, "Only stream mode and file structure")
+		}
+	case "PWD", "XPWD":
+		c.reply(257, "%q is the current directory", "/"+c.cwd)
+	case "CWD", "XCWD":
+		c.changeDir(arg)
+	case "CDUP", "XCUP":
+		c.changeDir("..")
+	case "PASV":
+		c.enterPassive(false)
+	case "EPSV":
+		c.enterPassive(true)
+	case "PORT", "EPRT":
+		c.reply(502, "Only passive mode is supported; use PASV")
+	case "LIST", "NLST":
+		c.list(arg, command == "NLST")
+	case "SIZE":
+		if entry, ok := c.file(arg); ok {
+			c.reply(213, "%d", entry.info.Size())
+		}
+	case "MDTM":
+		if entry, ok := c.file(arg); ok {
+			c.reply(213, "%s", entry.info.ModTime().UTC().Format("20060102150405"))
+		}
+	case "REST":
+		offset, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil || offset < 0 {
+			c.reply(501, "Invalid offset")
+		} else {
+			c.offset = offset
+			c.reply(350, "Restarting at %d", offset)
+		}
+	case "RETR":
+		c.retrieve(arg)
+	case "ABOR":
+		c.reply(226, "Nothing to abort")
+	case "STOR", "STOU", "APPE", "DELE", "MKD", "XMKD", "RMD", "XRMD", "RNFR", "RNTO", "SITE":
+		c.reply(550, "The share is read-only")
+	default:
+		c.reply(502, "Command not implemented")
+	}
+	return true
+}
+
+// resolve returns the slash-separated path below the root named by arg,
+// relative to the current directory unless it starts with a slash
+func (c *ftpSession) resolve(arg string) string {
+	if !strings.HasPrefix(arg, "/") {
+		arg = path.Join("/"+c.cwd, arg)
+	}
+	return strings.TrimPrefix(path.Clean("/"+arg), "/")
+}
+
+func (c *ftpSession) changeDir(arg string) {
+	rel := c.resolve(arg)
+	entry, _, ok := c.server.tree.lookup(rel)
+	if !ok || !entry.info.IsDir() {
+		c.reply(550, "No such directory")
+		return
+	}
+	c.cwd = rel
+	c.reply(250, "Directory changed to /%s", rel)
+}
+
+// file looks up the file named by arg, replying to the client if there is
+// none
+func (c *ftpSession) file(arg string) (treeEntry, bool) {
+	entry, _, ok := c.server.tree.lookup(c.resolve(arg))
+	if !ok || entry.info.IsDir() {
+		c.reply(550, "No such file")
+		return treeEntry{}, false
+	}
+	return entry, true
+}
+
+// enterPassive opens a port for the next data connection
+func (c *ftpSession) enterPassive(extended bool) {
+	c.closePassive()
+	local := c.conn.LocalAddr().(*net.TCPAddr)
+	if !extended && local.IP.To4() == nil {
+		c.reply(425, "Use EPSV over IPv6")
+		return
+	}
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: local.IP, Zone: local.Zone})
+	if err != nil {
+		c.reply(425, "Cannot open data connection")
+		return
+	}
+	c.passive = l
+	port := l.Addr().(*net.TCPAddr).Port
+	if extended {
+		c.reply(229, "Entering extended passive mode (|||%d|)", port)
+		return
+	}
+	ip := local.IP.To4()
+	c.reply(227, "Entering passive mode (%d,%d,%d,%d,%d,%d)", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+}
+
+func (c *ftpSession) closePassive() {
+	if c.passive != nil {
+		c.passive.Close()
+		c.passive = nil
+	}
+}
+
+// dataConn accepts the data connection of a transfer. Only the client of
+// the session may connect, so no one else can grab the file.
+func (c *ftpSession) dataConn() (net.Conn, error) {
+	if c.passive == nil {
+		return nil, fmt.Errorf("use PASV first")
+	}
+	l := c.passive.(*net.TCPListener)
+	defer c.closePassive()
+	l.SetDeadline(time.Now().Add(ftpDataTimeout))
+	client := c.conn.RemoteAddr().(*net.TCPAddr).IP
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return nil, fmt.Errorf("no data connection")
+		}
+		if conn.RemoteAddr().(*net.TCPAddr).IP.Equal(client) {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// list sends the entries of a directory, or a file's own, over the data
+// connection; NLST sends only the names
+func (c *ftpSession) list(arg string, namesOnly bool) {
+	// Options such as -a or -l are for ls, which clients expect to run
+	for _, field := range strings.Fields(arg) {
+		if !strings.HasPrefix(field, "-") {
+			arg = field
+			break
+		}
+		arg = ""
+	}
+	entry, ignores, ok := c.server.tree.lookup(c.resolve(arg))
+	if !ok {
+		c.reply(550, "No such file or directory")
+		return
+	}
+	entries := []treeEntry{entry}
+	if entry.info.IsDir() {
+		entries = c.server.tree.children(entry, ignores)
+	}
+	var listing bytes.Buffer
+	for _, e := range entries {
+		name := path.Base("/" + e.rel)
+		if namesOnly {
+			fmt.Fprintf(&listing, "%s\r\n", name)
+		} else {
+			fmt.Fprintf(&listing, "%s\r\n", ftpListLine(e.info.IsDir(), e.info.Size(), e.info.ModTime(), name, time.Now()))
+		}
+	}
+
+	conn, err := c.dataConn()
+	if err != nil {
+		c.reply(425, "%v", err)
+		return
+	}
+	c.reply(150, "Sending directory listing")
+	_, err = conn.Write(listing.Bytes())
+	conn.Close()
+	if err != nil {
+		c.reply(426, "Listing interrupted")
+		return
+	}
+	c.reply(226, "Listing sent")
+}
+
+// ftpListLine formats an entry the way ls -l does, which is what FTP
+// clients parse
+func ftpListLine(dir bool, size int64, modified time.Time, name string, now time.Time) string {
+	mode := "-r--r--r--"
+	if dir {
+		mode, size = "dr-xr-xr-x", 0
+	}
+	// ls shows the year instead of the time for dates over half a year away
+	date := modified.Format("Jan _2 15:04")
+	if modified.Before(now.AddDate(0, -6, 0)) || modified.After(now.AddDate(0, 0, 1)) {
+		date = modified.Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 userve userve %12d %s %s", mode, size, date, name)
+}
+
+// retrieve sends a file over the data connection through the share's
+// handler, which counts it as a download
+func (c *ftpSession) retrieve(arg string) {
+	offset := c.offset
+	c.offset = 0
+	entry, ok := c.file(arg)
+	if !ok {
+		return
+	}
+	item, remaining := c.server.downloads.fileStatus()
+	if remaining == 0 {
+		c.reply(550, "Download limit reached")
+		return
+	}
+	conn, err := c.dataConn()
+	if err != nil {
+		c.reply(425, "%v", err)
+		return
+	}
+	defer conn.Close()
+	c.reply(150, "Sending %s (%d bytes)", path.Base("/"+entry.rel), entry.info.Size()-offset)
+
+	w := &treeResponse{out: conn, header: make(http.Header), skip: offset}
+	c.server.downloads.deliver(w, treeRequest(c.conn.RemoteAddr().String(), "/"+entry.rel), item, c.server.tree.content(entry))
+	switch {
+	case w.status >= 300:
+		c.reply(550, "%s", strings.TrimSpace(w.message.String()))
+	case w.err != nil:
+		c.reply(426, "Transfer interrupted")
+	default:
+		c.reply(226, "Transfer complete")
+	}
+}
+
+// ftpListener opens the --ftp port next to the HTTP one
+func ftpListener(host string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if isAddrInUse(err) {
+		return nil, fmt.Errorf("FTP port %d is in use; pick another with --ftp-port", port)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for FTP: %v", err)
+	}
+	return l, nil
+}
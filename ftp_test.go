@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFTPListLine(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		dir      bool
+		size     int64
+		modified time.Time
+		want     string
+	}{
+		{false, 42, time.Date(2024, 5, 3, 9, 30, 0, 0, time.UTC), "-r--r--r-- 1 userve userve           42 May  3 09:30 notes.txt"},
+		{true, 4096, time.Date(2024, 5, 3, 9, 30, 0, 0, time.UTC), "dr-xr-xr-x 1 userve userve            0 May  3 09:30 notes.txt"},
+		{false, 1, time.Date(2023, 11, 20, 9, 30, 0, 0, time.UTC), "-r--r--r-- 1 userve userve            1 Nov 20  2023 notes.txt"},
+		{false, 1, time.Date(2024, 8, 1, 9, 30, 0, 0, time.UTC), "-r--r--r-- 1 userve userve            1 Aug  1  2024 notes.txt"},
+	} {
+		if got := ftpListLine(tc.dir, tc.size, tc.modified, "notes.txt", now); got != tc.want {
+			t.Errorf("expected %q, got %q", tc.want, got)
+		}
+	}
+}
+
+// ftpClient is a minimal FTP client for the tests
+type ftpClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// cmd sends a command and returns the final line of its reply
+func (c *ftpClient) cmd(format string, args ...any) string {
+	c.t.Helper()
+	if format != "" {
+		fmt.Fprintf(c.conn, format+"\r\n", args...)
+	}
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatalf("cannot read reply: %v", err)
+		}
+		// Multi-line replies end with "code " after lines starting "code-"
+		if len(line) >= 4 && line[3] == ' ' {
+			return strings.TrimRight(line, "\r\n")
+		}
+	}
+}
+
+// transfer opens a passive data connection, sends the command and returns
+// what came over the data connection with the final reply
+func (c *ftpClient) transfer(command string) (string, string) {
+	c.t.Helper()
+	reply := c.cmd("EPSV")
+	var port int
+	if _, err := fmt.Sscanf(reply[strings.Index(reply, "(|||"):], "(|||%d|)", &port); err != nil {
+		c.t.Fatalf("unexpected EPSV reply %q", reply)
+	}
+	data, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	defer data.Close()
+	if reply := c.cmd(command); !strings.HasPrefix(reply, "150") {
+		return "", reply
+	}
+	body, _ := io.ReadAll(data)
+	return string(body), c.cmd("")
+}
+
+func TestFTPSession(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "inner.txt"), []byte("inner"), 0644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := newArchiveProvider(dir, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	h := &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 2}
+	s := newFTPServer(l, &shareTree{archive: archive}, h)
+	go s.serve()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c := &ftpClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	if reply := c.cmd(""); !strings.HasPrefix(reply, "220") {
+		t.Fatalf("expected a greeting, got %q", reply)
+	}
+	if reply := c.cmd("LIST"); !strings.HasPrefix(reply, "530") {
+		t.Errorf("expected a login to be needed, got %q", reply)
+	}
+	c.cmd("USER anonymous")
+	if reply := c.cmd("PASS guest"); !strings.HasPrefix(reply, "230") {
+		t.Fatalf("expected an anonymous login, got %q", reply)
+	}
+
+	listing, reply := c.transfer("LIST")
+	if !strings.HasPrefix(reply, "226") || !strings.Contains(listing, " notes.txt\r\n") || !strings.Contains(listing, "dr-xr-xr-x") || strings.Contains(listing, ".env") {
+		t.Errorf("expected the unfiltered entries of the root, got %q %q", listing, reply)
+	}
+	if reply := c.cmd("CWD sub"); !strings.HasPrefix(reply, "250") {
+		t.Errorf("expected to enter sub, got %q", reply)
+	}
+	if reply := c.cmd("PWD"); reply != `257 "/sub" is the current directory` {
+		t.Errorf("unexpected PWD reply %q", reply)
+	}
+	if names, _ := c.transfer("NLST"); names != "inner.txt\r\n" {
+		t.Errorf("expected the names in sub, got %q", names)
+	}
+	if reply := c.cmd("SIZE /notes.txt"); reply != "213 5" {
+		t.Errorf("unexpected SIZE reply %q", reply)
+	}
+	if reply := c.cmd("CWD /.env"); !strings.HasPrefix(reply, "550") {
+		t.Errorf("expected a filtered entry to be missing, got %q", reply)
+	}
+	for _, command := range []string{"STOR up.txt", "DELE /notes.txt", "MKD new"} {
+		if reply := c.cmd(command); reply != "550 The share is read-only" {
+			t.Errorf("%s: expected the share to be read-only, got %q", command, reply)
+		}
+	}
+
+	// Each file counts towards the limit
+	if body, reply := c.transfer("RETR inner.txt"); body != "inner" || !strings.HasPrefix(reply, "226") {
+		t.Errorf("expected the file, got %q %q", body, reply)
+	}
+	c.cmd("REST 2")
+	if body, reply := c.transfer("RETR /notes.txt"); body != "tes" || !strings.HasPrefix(reply, "226") {
+		t.Errorf("expected the rest of the file, got %q %q", body, reply)
+	}
+	if _, reply := c.transfer("RETR /notes.txt"); !strings.HasPrefix(reply, "550") {
+		t.Errorf("expected the download limit to be reached, got %q", reply)
+	}
+	if reply := c.cmd("QUIT"); !strings.HasPrefix(reply, "221") {
+		t.Errorf("expected a goodbye, got %q", reply)
+	}
+}
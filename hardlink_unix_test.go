@@ -0,0 +1,48 @@
+//go:build !windows
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarArchiveHardlinks(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), []byte("snapshot data"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := os.Link(filepath.Join(root, "a.bin"), filepath.Join(root, "b.bin")); err != nil {
+		t.Fatalf("failed to create hardlink: %v", err)
+	}
+
+	p := &archiveProvider{dirPath: root, dirName: "snap", format: ArchiveTar}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	base := filepath.Base(root)
+	entries := map[string]*tar.Header{}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		entries[header.Name] = header
+	}
+	if a := entries[base+"/a.bin"]; a == nil || a.Typeflag != tar.TypeReg || a.Size != 13 {
+		t.Errorf("expected a.bin as a regular file with content, got %+v", a)
+	}
+	if b := entries[base+"/b.bin"]; b == nil || b.Typeflag != tar.TypeLink || b.Linkname != base+"/a.bin" || b.Size != 0 {
+		t.Errorf("expected b.bin as a hardlink to a.bin, got %+v", b)
+	}
+}
@@ -0,0 +1,11 @@
+package main
+
+import "os"
+
+// fileID identifies a file; hardlinks aren't detected on Windows, where
+// FileInfo carries no file index
+type fileID struct{}
+
+func hardlinkID(info os.FileInfo) (fileID, bool) {
+	return fileID{}, false
+}
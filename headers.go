@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// parseHeaders turns --header values of the form "Key: Value" into the
+// headers to add to every response
+func parseHeaders(values []string) (http.Header, error) {
+	headers := make(http.Header)
+	for _, value := range values {
+		key, v, ok := strings.Cut(value, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid header %q: expected \"Key: Value\"", value)
+		}
+		headers.Add(key, strings.TrimSpace(v))
+	}
+	return headers, nil
+}
+
+// withHeaders adds headers to every response from next. They replace
+// headers of the same name that next sets itself.
+func withHeaders(next http.Handler, headers http.Header) http.Handler {
+	if len(headers) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, headers: headers}, r)
+	})
+}
+
+// headerWriter sets its headers just before the response goes out, after
+// the handler has set its own
+type headerWriter struct {
+	http.ResponseWriter
+	headers http.Header
+	written bool
+}
+
+func (hw *headerWriter) WriteHeader(code int) {
+	if !hw.written && code >= 200 {
+		hw.written = true
+		for key, values := range hw.headers {
+			hw.ResponseWriter.Header()[key] = append([]string(nil), values...)
+		}
+	}
+	hw.ResponseWriter.WriteHeader(code)
+}
+
+func (hw *headerWriter) Write(b []byte) (int, error) {
+	if !hw.written {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// a --follow stream
+func (hw *headerWriter) Unwrap() http.ResponseWriter {
+	return hw.ResponseWriter
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseHeaders(t *testing.T) {
+	tests := []struct {
+		values  []string
+		key     string
+		want    []string
+		wantErr bool
+	}{
+		{[]string{"X-Trace-Id: abc123"}, "X-Trace-Id", []string{"abc123"}, false},
+		{[]string{"x-custom:one", "X-Custom: two"}, "X-Custom", []string{"one", "two"}, false},
+		{[]string{"Empty:"}, "Empty", []string{""}, false},
+		{[]string{"no colon"}, "", nil, true},
+		{[]string{": value"}, "", nil, true},
+		{[]string{"Bad Key: value"}, "", nil, true},
+	}
+
+	for _, tt := range tests {
+		headers, err := parseHeaders(tt.values)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: expected an error", tt.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%q: %v", tt.values, err)
+		}
+		if got := headers.Values(tt.key); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+			t.Errorf("%q: expected %s %q, got %q", tt.values, tt.key, tt.want, got)
+		}
+	}
+}
+
+func TestWithHeaders(t *testing.T) {
+	headers := http.Header{"Cache-Control": {"max-age=60"}, "X-Trace-Id": {"abc123"}}
+	h := withHeaders(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "no-store")
+		http.NotFound(w, r)
+	}), headers)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected status 404, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("X-Trace-Id"); got != "abc123" {
+		t.Errorf("expected X-Trace-Id abc123, got %q", got)
+	}
+	if got := rec.Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("expected the given Cache-Control to win, got %q", got)
+	}
+}
+
+func TestRunCacheControlConflict(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "app.zip")
+	os.WriteFile(file, []byte("zip"), 0644)
+	err := run([]string{"--cache-control", "max-age=60", "--header", "Cache-Control: no-cache", file})
+	if err == nil || !strings.Contains(err.Error(), "--cache-control") {
+		t.Errorf("expected a --cache-control error, got %v", err)
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// healthPath is where scripts check whether the share is still live
+const healthPath = "/healthz"
+
+// healthHandler reports the state of the share as JSON. Requests to it
+// don't count as downloads.
+type healthHandler struct {
+	started   time.Time
+	remaining func() int32 // Downloads left, or -1 if unlimited
+	uploads   bool         // remaining counts uploads, see --receive
+}
+
+func (h *healthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowReads(w, r) {
+		return
+	}
+	// state is "serving", or "exhausted" once nothing is left; the count
+	// is null when unlimited, and uptime is in seconds
+	body := map[string]any{"state": "serving", "uptime": int64(time.Since(h.started).Seconds())}
+	var remaining *int32
+	if n := h.remaining(); n >= 0 {
+		remaining = &n
+		if n == 0 {
+			body["state"] = "exhausted"
+		}
+	}
+	if h.uploads {
+		body["remainingUploads"] = remaining
+	} else {
+		body["remainingDownloads"] = remaining
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestHealthHandler(t *testing.T) {
+	tests := []struct {
+		name      string
+		remaining int32
+		uploads   bool
+		expected  string
+	}{
+		{"serving", 2, false, `{"remainingDownloads":2,"state":"serving","uptime":90}`},
+		{"exhausted", 0, false, `{"remainingDownloads":0,"state":"exhausted","uptime":90}`},
+		{"unlimited", -1, false, `{"remainingDownloads":null,"state":"serving","uptime":90}`},
+		{"receiving", 3, true, `{"remainingUploads":3,"state":"serving","uptime":90}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &healthHandler{
+				started:   time.Now().Add(-90 * time.Second),
+				remaining: func() int32 { return tt.remaining },
+				uploads:   tt.uploads,
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/healthz", nil))
+			if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("expected 200 with JSON, got %d %q", rec.Code, rec.Header().Get("Content-Type"))
+			}
+			if got := strings.TrimSpace(rec.Body.String()); got != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestHandlerRemainingWithQueue(t *testing.T) {
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &memoryProvider{name: "a.txt"},
+		queue:            []contentProvider{&memoryProvider{name: "b.txt"}, &memoryProvider{name: "c.txt"}},
+		maxDownloads:     2,
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+	}
+	h.downloadCount.Store(1)
+	if got := h.remaining(); got != 5 {
+		t.Errorf("expected 5 downloads left, got %d", got)
+	}
+}
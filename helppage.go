@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// helpPageTemplate is the landing page shown to recipients at the root URL.
+// The empty icon keeps browsers from requesting /favicon.ico, which would
+// otherwise be served as a download.
+var helpPageTemplate = template.Must(template.New("help").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="data:,">
+<title>Download {{.Name}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; max-width: 36em; margin: 3em auto; padding: 0 1em; color: #222; }
+.button { display: inline-block; padding: 0.8em 2em; font-size: 1.3em; background: #2563eb; color: #fff; border-radius: 0.4em; text-decoration: none; }
+code { background: #f3f4f6; padding: 0.1em 0.3em; word-break: break-all; }
+.note { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>{{.Name}}</h1>
+<p>Size: {{.Size}}</p>
+<p><a class="button" href="{{.Href}}" download>Download</a></p>
+<p>{{if eq .Remaining -1}}This link can be used any number of times.{{else}}This link expires after {{.Remaining}} more download(s).{{end}}</p>
+{{if .Checksum}}<p>SHA-256: <code>{{.Checksum}}</code></p>
+<p class="note">To verify the file, run <code>sha256sum {{.Name}}</code> (Linux), <code>shasum -a 256 {{.Name}}</code> (macOS) or <code>certutil -hashfile {{.Name}} SHA256</code> (Windows) and compare the result.</p>{{end}}
+<p class="note">Command line: <code>curl -O {{.Href}}</code></p>
+</body>
+</html>
+`))
+
+// helpPageHandler shows a landing page at the root URL and passes every
+// other request on to the download handler
+type helpPageHandler struct {
+	downloads *handler
+
+	mu        sync.Mutex
+	checksums map[string]string // file path, size and mtime -> SHA-256
+}
+
+func (h *helpPageHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowReads(w, r) {
+		return
+	}
+	if r.URL.Path != "/" {
+		h.downloads.ServeHTTP(w, r)
+		return
+	}
+
+	provider, remaining := h.downloads.status()
+
+	size := "unknown"
+	if length := provider.ContentLength(); length >= 0 {
+		size = formatSize(length)
+	}
+
+	var checksum string
+	switch p := provider.(type) {
+	case *fileProvider:
+		var err error
+		if checksum, err = h.checksum(p.filePath); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	case *cachedArchive:
+		checksum = p.checksum()
+	case *memoryProvider:
+		checksum, _ = payloadChecksum(p)
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	helpPageTemplate.Execute(w, map[string]any{
+		"Name":      provider.Filename(),
+		"Size":      size,
+		"Href":      "/" + url.PathEscape(provider.Filename()),
+		"Remaining": remaining,
+		"Checksum":  checksum,
+	})
+}
+
+// checksum returns the SHA-256 of a file, computing it again only when the
+// file has changed, as a --live file may
+func (h *helpPageHandler) checksum(path string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("%s %d %d", path, info.Size(), info.ModTime().UnixNano())
+	if sum, ok := h.checksums[key]; ok {
+		return sum, nil
+	}
+
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return "", err
+	}
+
+	if h.checksums == nil {
+		h.checksums = make(map[string]string)
+	}
+	h.checksums[key] = sum
+	return sum, nil
+}
+
+// formatSize renders a byte count using binary units
+func formatSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// parseSize parses a byte count with an optional binary unit suffix, e.g.
+// 512, 64K, 500M or 2GiB
+func parseSize(s string) (int64, error) {
+	value := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	shift := 0
+	if i := strings.IndexAny(value, "KMGTPE"); i >= 0 && i == len(value)-1 {
+		shift = 10 * (strings.IndexByte("KMGTPE", value[i]) + 1)
+		value = value[:i]
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64>>shift {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
+
+// byteSize is a flag holding a size given as accepted by parseSize
+type byteSize int64
+
+func (b *byteSize) String() string {
+	return strconv.FormatInt(int64(*b), 10)
+}
+
+func (b *byteSize) Set(value string) error {
+	n, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*b = byteSize(n)
+	return nil
+}
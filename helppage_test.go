@@ -0,0 +1,115 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHelpPageHandler(t *testing.T) {
+	tmpDir := t.TempDir()
+	testFile := filepath.Join(tmpDir, "report.pdf")
+	if err := os.WriteFile(testFile, []byte("Hello, World!"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	downloadComplete := make(chan struct{}, 1)
+	h := &helpPageHandler{downloads: &handler{
+		provider: &fileProvider{
+			filePath: testFile,
+			fileName: "report.pdf",
+			fileSize: 13,
+		},
+		activeDownloads:  &wg,
+		downloadComplete: downloadComplete,
+		maxDownloads:     1,
+	}}
+
+	// The page itself doesn't count as a download
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("expected Content-Type text/html, got %q", ct)
+	}
+	page := rec.Body.String()
+	for _, want := range []string{
+		"report.pdf",
+		"13 B",
+		`href="/report.pdf"`,
+		"dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f",
+		"1 more download(s)",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected page to contain %q", want)
+		}
+	}
+	select {
+	case <-downloadComplete:
+		t.Error("help page counted as a download")
+	default:
+	}
+
+	// The direct URL still downloads the file
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/report.pdf", nil))
+	if body := rec.Body.String(); body != "Hello, World!" {
+		t.Errorf("expected file content, got %q", body)
+	}
+	select {
+	case <-downloadComplete:
+	default:
+		t.Error("expected direct download to count")
+	}
+}
+
+func TestFormatSize(t *testing.T) {
+	tests := []struct {
+		size     int64
+		expected string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KiB"},
+		{1536, "1.5 KiB"},
+		{5 << 20, "5.0 MiB"},
+		{3 << 30, "3.0 GiB"},
+	}
+
+	for _, tt := range tests {
+		if result := formatSize(tt.size); result != tt.expected {
+			t.Errorf("formatSize(%d) = %q, want %q", tt.size, result, tt.expected)
+		}
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+		wantErr  bool
+	}{
+		{"512", 512, false},
+		{"64K", 64 << 10, false},
+		{"500M", 500 << 20, false},
+		{"500m", 500 << 20, false},
+		{"2GiB", 2 << 30, false},
+		{"1GB", 1 << 30, false},
+		{"10B", 10, false},
+		{"", 0, true},
+		{"-1M", 0, true},
+		{"1.5G", 0, true},
+		{"M", 0, true},
+		{"9999999E", 0, true},
+	}
+
+	for _, tt := range tests {
+		n, err := parseSize(tt.input)
+		if (err != nil) != tt.wantErr || n != tt.expected {
+			t.Errorf("parseSize(%q) = %d, %v; want %d (error: %v)", tt.input, n, err, tt.expected, tt.wantErr)
+		}
+	}
+}
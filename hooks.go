@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// commandHook runs a shell command when a download starts or completes,
+// see --on-start and --on-complete. The command learns about the download
+// from USERVE_* environment variables.
+type commandHook struct {
+	flag    string // --on-start or --on-complete, for the logs
+	kind    string // Event that runs the command
+	command string
+	running sync.WaitGroup
+}
+
+// notify runs the command for events of its kind, without holding up the
+// download
+func (c *commandHook) notify(e event) {
+	if e.kind != c.kind {
+		return
+	}
+	env := append(os.Environ(), "USERVE_EVENT="+e.kind)
+	if client, ok := e.fields["client"].(string); ok {
+		env = append(env, "USERVE_CLIENT="+clientIP(client))
+	}
+	for _, key := range []string{"file", "bytes", "duration"} {
+		if value, ok := e.fields[key]; ok {
+			env = append(env, fmt.Sprintf("USERVE_%s=%v", strings.ToUpper(key), value))
+		}
+	}
+
+	c.running.Add(1)
+	go func() {
+		defer c.running.Done()
+		cmd := shellCommand(c.command)
+		cmd.Env = env
+		// Standard output is kept for the share's own, e.g. with -q
+		cmd.Stdout, cmd.Stderr = os.Stderr, os.Stderr
+		if err := cmd.Run(); err != nil {
+			logEvent("hook_failed", logFields{"command": c.command, "error": err}, "%s command failed: %v", c.flag, err)
+		}
+	}()
+}
+
+// wait lets commands still running finish, giving up after the shutdown
+// timeout
+func (c *commandHook) wait() {
+	done := make(chan struct{})
+	go func() {
+		c.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(shutdownTimeout):
+	}
+}
+
+// shellCommand runs command with the system's shell
+func shellCommand(command string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		return exec.Command("cmd", "/C", command)
+	}
+	return exec.Command("sh", "-c", command)
+}
+
+// clientIP returns the IP address of a client's host:port
+func clientIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestCommandHook(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the test command needs sh")
+	}
+	captureEvents(t, logText)
+	out := filepath.Join(t.TempDir(), "env.txt")
+	hook := &commandHook{flag: "--on-complete", kind: "download_completed",
+		command: `echo "$USERVE_EVENT $USERVE_CLIENT $USERVE_FILE $USERVE_BYTES $USERVE_DURATION" >> ` + out}
+	stop := events.listen(hook.notify)
+	logEvent("download_started", logFields{"client": "192.0.2.1:1234", "file": "notes.txt"}, "Download started")
+	logEvent("download_completed", logFields{"client": "192.0.2.1:1234", "file": "notes.txt", "bytes": int64(5), "duration": 0.25}, "Download completed")
+	stop()
+	hook.wait()
+
+	got, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "download_completed 192.0.2.1 notes.txt 5 0.25\n" {
+		t.Errorf("expected the command to run once with the download's details, got %q", got)
+	}
+}
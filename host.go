@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
+	"time"
+)
+
+// "userve host" keeps one server running for many shares, each at a path
+// of its own under a random token, e.g. /3f9a1c0e7b2d4a65/build.zip.
+// "userve add", "list" and "remove" manage them through a control socket
+// that only the user can open.
+
+// shareHost is the server of "userve host" and the shares it has
+type shareHost struct {
+	opts    archiveOptions // How added directories are archived
+	urlHost string
+	port    int
+
+	activeDownloads sync.WaitGroup
+
+	mu     sync.Mutex
+	shares map[string]*hostedShare
+}
+
+// hostedShare is one share of a host, with its own download limit and
+// expiry
+type hostedShare struct {
+	token    string
+	path     string // File or directory on disk
+	handler  *handler
+	added    time.Time
+	expires  time.Time // Zero if the share doesn't expire
+	timer    *time.Timer
+	provider contentProvider
+	removed  chan struct{}
+}
+
+// shareRequest asks the host to add a share
+type shareRequest struct {
+	Path      string  `json:"path"`
+	Name      string  `json:"name,omitempty"`
+	Downloads int     `json:"downloads"`
+	Expire    float64 `json:"expire,omitempty"` // Seconds; 0 for never
+}
+
+// shareInfo describes a share to the control socket's clients
+type shareInfo struct {
+	Token     string `json:"token"`
+	URL       string `json:"url"`
+	Path      string `json:"path"`
+	Remaining int32  `json:"remaining"` // -1 when unlimited
+	Expires   string `json:"expires,omitempty"`
+}
+
+func newShareHost(opts archiveOptions, urlHost string, port int) *shareHost {
+	return &shareHost{opts: opts, urlHost: urlHost, port: port, shares: make(map[string]*hostedShare)}
+}
+
+// add starts serving the file or directory of req
+func (sh *shareHost) add(req shareRequest) (*hostedShare, error) {
+	switch {
+	case !filepath.IsAbs(req.Path):
+		return nil, fmt.Errorf("path must be absolute: %s", req.Path)
+	case req.Downloads < 0:
+		return nil, fmt.Errorf("invalid download count %d: use 0 for unlimited", req.Downloads)
+	case req.Expire < 0:
+		return nil, fmt.Errorf("invalid expiry %v: use 0 for never", req.Expire)
+	}
+	provider, err := newProvider(req.Path, sh.opts)
+	if err != nil {
+		return nil, err
+	}
+	if req.Name != "" {
+		rename(provider, req.Name, sh.opts.format)
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	token := hex.EncodeToString(random)
+
+	done := make(chan struct{}, 1)
+	share := &hostedShare{
+		token: token,
+		path:  req.Path,
+		handler: &handler{
+			path:             "/" + token + "/" + provider.Filename(),
+			provider:         provider,
+			activeDownloads:  &sh.activeDownloads,
+			downloadComplete: done,
+			maxDownloads:     int32(req.Downloads),
+		},
+		provider: provider,
+		added:    time.Now(),
+		removed:  make(chan struct{}),
+	}
+	if req.Expire > 0 {
+		expire := time.Duration(req.Expire * float64(time.Second))
+		share.expires = time.Now().Add(expire)
+		share.timer = time.AfterFunc(expire, func() { sh.remove(token, "expired") })
+	}
+	go func() {
+		select {
+		case <-done:
+			sh.remove(token, "download limit")
+		case <-share.removed:
+		}
+	}()
+
+	sh.mu.Lock()
+	sh.shares[token] = share
+	sh.mu.Unlock()
+	logNotice("share_added", logFields{"token": token, "path": req.Path, "url": sh.url(share), "limit": req.Downloads}, "Added %s at %s", req.Path, sh.url(share))
+	return share, nil
+}
+
+// remove stops serving the share with token, reporting whether there was
+// one
+func (sh *shareHost) remove(token, reason string) bool {
+	sh.mu.Lock()
+	share, ok := sh.shares[token]
+	delete(sh.shares, token)
+	sh.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if share.timer != nil {
+		share.timer.Stop()
+	}
+	close(share.removed)
+	if cached, ok := share.provider.(*cachedArchive); ok {
+		cached.remove()
+	}
+	logNotice("share_removed", logFields{"token": token, "path": share.path, "reason": reason}, "Removed %s (%s)", share.path, reason)
+	return true
+}
+
+func (sh *shareHost) url(share *hostedShare) string {
+	return httpURL(sh.urlHost, sh.port, share.token+"/"+url.PathEscape(share.provider.Filename()))
+}
+
+func (sh *shareHost) info(share *hostedShare) shareInfo {
+	info := shareInfo{Token: share.token, URL: sh.url(share), Path: share.path, Remaining: share.handler.remaining()}
+	if !share.expires.IsZero() {
+		info.Expires = share.expires.Format(time.RFC3339)
+	}
+	return info
+}
+
+// list returns the shares, oldest first
+func (sh *shareHost) list() []shareInfo {
+	sh.mu.Lock()
+	var shares []*hostedShare
+	for _, share := range sh.shares {
+		shares = append(shares, share)
+	}
+	sh.mu.Unlock()
+	slices.SortFunc(shares, func(a, b *hostedShare) int { return a.added.Compare(b.added) })
+	infos := make([]shareInfo, 0, len(shares))
+	for _, share := range shares {
+		infos = append(infos, sh.info(share))
+	}
+	return infos
+}
+
+// ServeHTTP passes requests for /<token>/... to the share with token
+func (sh *shareHost) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	token, _, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	sh.mu.Lock()
+	share := sh.shares[token]
+	sh.mu.Unlock()
+	if share == nil {
+		http.NotFound(w, r)
+		return
+	}
+	share.handler.ServeHTTP(w, r)
+}
+
+// close removes the shares left when the host exits
+func (sh *shareHost) close() {
+	sh.mu.Lock()
+	var tokens []string
+	for token := range sh.shares {
+		tokens = append(tokens, token)
+	}
+	sh.mu.Unlock()
+	for _, token := range tokens {
+		sh.remove(token, "host stopped")
+	}
+}
+
+// controlHandler answers "userve add", "list" and "remove"
+func (sh *shareHost) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /shares", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, sh.list())
+	})
+	mux.HandleFunc("POST /shares", func(w http.ResponseWriter, r *http.Request) {
+		var req shareRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		share, err := sh.add(req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		writeJSON(w, http.StatusCreated, sh.info(share))
+	})
+	mux.HandleFunc("DELETE /shares/{token}", func(w http.ResponseWriter, r *http.Request) {
+		if !sh.remove(r.PathValue("token"), "removed") {
+			http.Error(w, fmt.Sprintf("no share %s", r.PathValue("token")), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+	return mux
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// listenControl opens the control socket at path, taking over the file of
+// a host that is gone. Anyone who can connect can share the user's files,
+// so the socket is made private from the start, in a directory that is
+// private too.
+func listenControl(path string) (net.Listener, error) {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("cannot create %s: %v", dir, err)
+	}
+	if err := checkControlDir(dir); err != nil {
+		return nil, err
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("a userve host is already running at %s", path)
+	}
+	os.Remove(path)
+	l, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open control socket: %v", err)
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("cannot open control socket: %v", err)
+	}
+	return l, nil
+}
+
+// runHost serves shares added with "userve add" until it is interrupted
+func runHost(args []string) error {
+	fs := flag.NewFlagSet("userve host", flag.ContinueOnError)
+	port := fs.Int("p", defaultPort, "port to listen on")
+	portFallback := fs.Bool("port-fallback", false, "if the port is in use, try the next ports and then a random free one")
+	bindIP := fs.String("i", "", "IP address to bind to (default: all interfaces)")
+	archiveFormat := fs.String("a", "tar.gz", "archive format for directories: tar.gz, zip, tar, tar.xz, 7z")
+	controlPath := fs.String("control", defaultDaemonPath("control.sock"), "control socket `file` for userve add, list and remove")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: userve host [options]\n\n")
+		fmt.Fprintf(os.Stderr, "Serve the shares added with userve add from one long-running process.\n\n")
+		fmt.Fprintf(os.Stderr, "Options:\n")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() > 0 {
+		fs.Usage()
+		return errors.New("userve host takes no files; add them with userve add")
+	}
+	if *controlPath == "" {
+		return errors.New("userve host needs --control")
+	}
+	format, err := parseArchiveFormat(*archiveFormat)
+	if err != nil {
+		return err
+	}
+
+	bindAddr := strings.TrimSuffix(strings.TrimPrefix(*bindIP, "["), "]")
+	urlHost := bindAddr
+	if urlHost == "" {
+		candidates, err := candidateAddrs("")
+		if err != nil {
+			return err
+		}
+		urlHost = getLocalIP()
+		for _, c := range candidates {
+			if c.best {
+				urlHost = c.ip.String()
+			}
+		}
+	}
+	listener, err := listen(bindAddr, *port, *portFallback)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	*port = listener.Addr().(*net.TCPAddr).Port
+	control, err := listenControl(*controlPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(*controlPath)
+
+	sh := newShareHost(archiveOptions{format: format, level: -1}, urlHost, *port)
+	defer sh.close()
+	server := &http.Server{
+		Handler:           withTimeouts(sh, defaultReadTimeout, defaultWriteTimeout),
+		ReadHeaderTimeout: headerTimeout,
+		IdleTimeout:       defaultIdleTimeout,
+	}
+	controlServer := &http.Server{Handler: sh.controlHandler(), ReadHeaderTimeout: headerTimeout}
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+	errChan := make(chan error, 2)
+	go func() { errChan <- server.Serve(listener) }()
+	go func() { errChan <- controlServer.Serve(control) }()
+
+	say("Hosting shares at %s\n", httpURL(urlHost, *port, ""))
+	say("Add one with: userve add <file|directory>\n")
+	say("Press Ctrl+C to stop\n")
+	if events.logsStartup() {
+		logNotice("startup", logFields{"url": httpURL(urlHost, *port, ""), "control": *controlPath}, "Hosting shares at %s", httpURL(urlHost, *port, ""))
+	}
+
+	select {
+	case sig := <-sigChan:
+		logNotice("shutdown", logFields{"reason": "signal", "signal": sig.String()}, "\nReceived %v, shutting down...", sig)
+	case err := <-errChan:
+		return fmt.Errorf("server error: %v", err)
+	}
+
+	// No shares are added while downloads in progress finish
+	controlServer.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	server.Shutdown(ctx)
+	done := make(chan struct{})
+	go func() {
+		sh.activeDownloads.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logNotice("stopped", logFields{"timeout": true}, "Shutdown timeout reached")
+	case sig := <-sigChan:
+		logNotice("stopped", logFields{"signal": sig.String()}, "Received %v, stopping without waiting for downloads", sig)
+	}
+	return nil
+}
+
+// controlClient talks to the host at the control socket path
+func controlClient(path string) *http.Client {
+	return &http.Client{
+		Timeout: time.Minute,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+}
+
+// callHost sends a request to the host at path and decodes the JSON it
+// answers with into out, if it isn't nil
+func callHost(path, method, endpoint string, body any, out any) error {
+	var payload io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		payload = bytes.NewReader(data)
+	}
+	// The host name is ignored; the socket is dialled
+	req, err := http.NewRequest(method, "http://userve"+endpoint, payload)
+	if err != nil {
+		return err
+	}
+	resp, err := controlClient(path).Do(req)
+	var dialErr *net.OpError
+	if errors.As(err, &dialErr) && dialErr.Op == "dial" {
+		return fmt.Errorf("no userve host is running at %s; start one with: userve host", path)
+	}
+	if err != nil {
+		return fmt.Errorf("cannot reach userve host: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return errors.New(strings.TrimSpace(string(message)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// runAdd adds a share to the running host and prints its URL
+func runAdd(args []string) error {
+	fs := flag.NewFlagSet("userve add", flag.ContinueOnError)
+	count := fs.Int("c", 1, "number of downloads allowed (0 for unlimited)")
+	expire := fs.Duration("expire", 0, "stop sharing after this `duration`, e.g. 2h (0 for never)")
+	var name string
+	fs.StringVar(&name, "n", "", "shorthand for --name")
+	fs.StringVar(&name, "name", "", "serve under `name`, in the URL and as the download's file name")
+	controlPath := fs.String("control", defaultDaemonPath("control.sock"), "control socket `file` of userve host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: userve add [-c <n>] [--expire <duration>] [--name <name>] <file|directory>")
+	}
+	if *count < 0 {
+		return fmt.Errorf("invalid -c %d: use 0 for unlimited", *count)
+	}
+	if *expire < 0 {
+		return fmt.Errorf("invalid --expire %s: use 0 for never", *expire)
+	}
+	path, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("cannot access file: %v", err)
+	}
+	var info shareInfo
+	req := shareRequest{Path: path, Name: name, Downloads: *count, Expire: expire.Seconds()}
+	if err := callHost(*controlPath, http.MethodPost, "/shares", req, &info); err != nil {
+		return err
+	}
+	// Only the URL, for URL=$(userve add file)
+	fmt.Println(info.URL)
+	return nil
+}
+
+// runList prints the shares of the running host
+func runList(args []string) error {
+	fs := flag.NewFlagSet("userve list", flag.ContinueOnError)
+	controlPath := fs.String("control", defaultDaemonPath("control.sock"), "control socket `file` of userve host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var infos []shareInfo
+	if err := callHost(*controlPath, http.MethodGet, "/shares", nil, &infos); err != nil {
+		return err
+	}
+	if len(infos) == 0 {
+		fmt.Println("No shares; add one with: userve add <file|directory>")
+		return nil
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TOKEN\tDOWNLOADS\tEXPIRES\tPATH\tURL")
+	for _, info := range infos {
+		remaining, expires := "unlimited", "never"
+		if info.Remaining >= 0 {
+			remaining = fmt.Sprint(info.Remaining)
+		}
+		if t, err := time.Parse(time.RFC3339, info.Expires); err == nil {
+			expires = t.Local().Format("2006-01-02 15:04")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", info.Token, remaining, expires, info.Path, info.URL)
+	}
+	return tw.Flush()
+}
+
+// runRemove stops a share of the running host
+func runRemove(args []string) error {
+	fs := flag.NewFlagSet("userve remove", flag.ContinueOnError)
+	controlPath := fs.String("control", defaultDaemonPath("control.sock"), "control socket `file` of userve host")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("usage: userve remove <token>")
+	}
+	return callHost(*controlPath, http.MethodDelete, "/shares/"+url.PathEscape(fs.Arg(0)), nil, nil)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// hostGet downloads the path of a share's URL from sh
+func hostGet(sh *shareHost, shareURL string) *httptest.ResponseRecorder {
+	u, _ := url.Parse(shareURL)
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, httptest.NewRequest("GET", u.Path, nil))
+	return rec
+}
+
+// waitRemoved waits for the share with token to be removed from sh
+func waitRemoved(t *testing.T, sh *shareHost, token string) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		sh.mu.Lock()
+		_, ok := sh.shares[token]
+		sh.mu.Unlock()
+		if !ok {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("share %s was not removed", token)
+}
+
+func TestShareHost(t *testing.T) {
+	dir := t.TempDir()
+	first, second := filepath.Join(dir, "first.txt"), filepath.Join(dir, "second.txt")
+	os.WriteFile(first, []byte("first"), 0644)
+	os.WriteFile(second, []byte("second"), 0644)
+	sh := newShareHost(archiveOptions{format: ArchiveTarGz, level: -1}, "192.0.2.1", 8080)
+	defer sh.close()
+
+	once, err := sh.add(shareRequest{Path: first, Downloads: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	twice, err := sh.add(shareRequest{Path: second, Name: "renamed.txt", Downloads: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if once.token == twice.token {
+		t.Fatal("expected each share to have its own token")
+	}
+	if want := "http://192.0.2.1:8080/" + twice.token + "/renamed.txt"; sh.url(twice) != want {
+		t.Errorf("expected URL %s, got %s", want, sh.url(twice))
+	}
+
+	// Each share counts its own downloads
+	if rec := hostGet(sh, sh.url(once)); rec.Code != http.StatusOK || rec.Body.String() != "first" {
+		t.Fatalf("expected the first file, got %d %q", rec.Code, rec.Body.String())
+	}
+	waitRemoved(t, sh, once.token)
+	if rec := hostGet(sh, sh.url(once)); rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 once the download limit is reached, got %d", rec.Code)
+	}
+	if rec := hostGet(sh, sh.url(twice)); rec.Code != http.StatusOK || rec.Body.String() != "second" {
+		t.Errorf("expected the second file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if infos := sh.list(); len(infos) != 1 || infos[0].Token != twice.token || infos[0].Remaining != 1 {
+		t.Errorf("expected the second share with 1 download left, got %+v", infos)
+	}
+
+	// Only the share's own path is served under its token
+	rec := httptest.NewRecorder()
+	sh.ServeHTTP(rec, httptest.NewRequest("GET", "/"+twice.token+"/other.txt", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for another name under the token, got %d", rec.Code)
+	}
+}
+
+func TestShareHostExpiry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file.txt")
+	os.WriteFile(file, []byte("data"), 0644)
+	sh := newShareHost(archiveOptions{format: ArchiveTarGz, level: -1}, "192.0.2.1", 8080)
+	defer sh.close()
+
+	share, err := sh.add(shareRequest{Path: file, Downloads: 0, Expire: 0.05})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos := sh.list(); len(infos) != 1 || infos[0].Expires == "" || infos[0].Remaining != -1 {
+		t.Errorf("expected an unlimited share that expires, got %+v", infos)
+	}
+	waitRemoved(t, sh, share.token)
+}
+
+func TestShareHostRejects(t *testing.T) {
+	dir := t.TempDir()
+	sh := newShareHost(archiveOptions{format: ArchiveTarGz, level: -1}, "192.0.2.1", 8080)
+	for _, tc := range []struct {
+		req  shareRequest
+		want string
+	}{
+		{shareRequest{Path: "relative.txt", Downloads: 1}, "path must be absolute"},
+		{shareRequest{Path: dir, Downloads: -1}, "invalid download count"},
+		{shareRequest{Path: dir, Downloads: 1, Expire: -1}, "invalid expiry"},
+		{shareRequest{Path: filepath.Join(dir, "missing"), Downloads: 1}, "file not found"},
+	} {
+		if _, err := sh.add(tc.req); err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("%+v: expected %q, got %v", tc.req, tc.want, err)
+		}
+	}
+}
+
+func TestControlSocket(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "file.txt")
+	os.WriteFile(file, []byte("data"), 0644)
+	if _, err := listenControl(filepath.Join(dir, "control.sock")); runtime.GOOS != "windows" && (err == nil || !strings.Contains(err.Error(), "other users can get into")) {
+		t.Errorf("expected a directory other users can enter to be refused, got %v", err)
+	}
+	socket := filepath.Join(dir, "private", "control.sock")
+	if err := callHost(socket, http.MethodGet, "/shares", nil, nil); err == nil || !strings.HasPrefix(err.Error(), "no userve host is running") {
+		t.Errorf("expected no host to be running, got %v", err)
+	}
+
+	l, err := listenControl(socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(socket); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("expected the socket to be private, got %v, %v", info.Mode(), err)
+	}
+	sh := newShareHost(archiveOptions{format: ArchiveTarGz, level: -1}, "192.0.2.1", 8080)
+	defer sh.close()
+	server := &http.Server{Handler: sh.controlHandler()}
+	go server.Serve(l)
+	defer server.Close()
+	if _, err := listenControl(socket); err == nil || !strings.HasPrefix(err.Error(), "a userve host is already running") {
+		t.Errorf("expected a second host to be refused, got %v", err)
+	}
+
+	var added shareInfo
+	if err := callHost(socket, http.MethodPost, "/shares", shareRequest{Path: file, Downloads: 3}, &added); err != nil {
+		t.Fatal(err)
+	}
+	if added.Remaining != 3 || !strings.HasSuffix(added.URL, "/"+added.Token+"/file.txt") {
+		t.Errorf("unexpected share %+v", added)
+	}
+	var infos []shareInfo
+	if err := callHost(socket, http.MethodGet, "/shares", nil, &infos); err != nil || len(infos) != 1 || infos[0].Token != added.Token {
+		t.Errorf("expected the added share, got %+v, %v", infos, err)
+	}
+	if err := callHost(socket, http.MethodPost, "/shares", shareRequest{Path: filepath.Join(dir, "missing"), Downloads: 1}, nil); err == nil || !strings.HasPrefix(err.Error(), "file not found") {
+		t.Errorf("expected the host's error, got %v", err)
+	}
+	if err := callHost(socket, http.MethodDelete, "/shares/"+added.Token, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := callHost(socket, http.MethodDelete, "/shares/"+added.Token, nil, nil); err == nil || err.Error() != "no share "+added.Token {
+		t.Errorf("expected the share to be gone, got %v", err)
+	}
+}
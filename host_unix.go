@@ -0,0 +1,35 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// checkControlDir makes sure only the user can get into dir, where the
+// control socket goes: it must be theirs and closed to everyone else
+func checkControlDir(dir string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("cannot open control socket: %v", err)
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok && int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("cannot open control socket: %s belongs to another user", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("cannot open control socket: other users can get into %s; chmod 700 it or pick another --control", dir)
+	}
+	return nil
+}
+
+// listenUnixPrivate listens on a socket at path that only the user can
+// connect to from the moment it exists. The umask is process-wide, which
+// is fine while the host is starting up.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	old := syscall.Umask(0177)
+	defer syscall.Umask(old)
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,15 @@
+//go:build windows
+
+package main
+
+import "net"
+
+// checkControlDir leaves it to the ACLs of the user's profile, where the
+// control socket goes by default
+func checkControlDir(dir string) error {
+	return nil
+}
+
+func listenUnixPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// hostChecker refuses requests whose Host header names none of the
+// addresses the share is reachable at. A DNS rebinding attack makes a
+// browser on the LAN talk to the server under the attacker's domain, and
+// that domain is what its requests carry as Host.
+type hostChecker struct {
+	next  http.Handler
+	hosts map[string]bool // Lowercase host or host:port as sent by clients
+}
+
+// newHostChecker allows the given host names and IP addresses on port,
+// the loopback names and the hosts of the transports' URLs
+func newHostChecker(next http.Handler, names []string, port int, transports []transport) *hostChecker {
+	c := &hostChecker{next: next, hosts: make(map[string]bool)}
+	for _, name := range append(names, "localhost", "127.0.0.1", "::1") {
+		if name != "" {
+			c.hosts[strings.ToLower(net.JoinHostPort(name, strconv.Itoa(port)))] = true
+		}
+	}
+	for _, t := range transports {
+		if u, err := url.Parse(t.URL()); err == nil {
+			c.hosts[strings.ToLower(u.Host)] = true
+		}
+	}
+	return c
+}
+
+func (c *hostChecker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Browsers always send a Host, so only other clients may leave it out
+	if r.Host != "" && !c.hosts[strings.ToLower(r.Host)] {
+		logEvent("host_refused", logFields{"client": r.RemoteAddr, "host": r.Host}, "Refused request for host %q from %s", r.Host, r.RemoteAddr)
+		http.Error(w, "unknown host", http.StatusMisdirectedRequest)
+		return
+	}
+	c.next.ServeHTTP(w, r)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// fakeTransport is a transport with a fixed URL
+type fakeTransport string
+
+func (t fakeTransport) Name() string { return "Fake" }
+func (t fakeTransport) URL() string  { return string(t) }
+func (t fakeTransport) Close() error { return nil }
+
+func TestHostChecker(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	c := newHostChecker(ok, []string{"192.168.1.20", "laptop.local", "fe80::1"}, 8080,
+		[]transport{fakeTransport("https://share.example.net")})
+
+	tests := []struct {
+		host   string
+		status int
+	}{
+		{"192.168.1.20:8080", http.StatusOK},
+		{"LAPTOP.local:8080", http.StatusOK},
+		{"[fe80::1]:8080", http.StatusOK},
+		{"localhost:8080", http.StatusOK},
+		{"127.0.0.1:8080", http.StatusOK},
+		{"share.example.net", http.StatusOK},
+		{"", http.StatusOK},
+		{"attacker.example.com:8080", http.StatusMisdirectedRequest},
+		{"192.168.1.20:9090", http.StatusMisdirectedRequest},
+		{"192.168.1.20", http.StatusMisdirectedRequest},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/file.txt", nil)
+		req.Host = tt.host
+		rec := httptest.NewRecorder()
+		c.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("host %q: expected status %d, got %d", tt.host, tt.status, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"strings"
+)
+
+// ignoreRule is one pattern line of a .gitignore file
+type ignoreRule struct {
+	base     string   // directory of the ignore file, relative to the archive root
+	segments []string // pattern split at slashes
+	anchored bool     // pattern contains a slash, so it is relative to base
+	dirOnly  bool     // pattern ended with a slash
+	negate   bool     // pattern started with "!"
+}
+
+// ignoreRules are the rules of all ignore files loaded during a walk. Later
+// rules take precedence, so files in subdirectories override their parents.
+type ignoreRules []ignoreRule
+
+// load reads the ignore file at filePath, whose rules apply below base
+// (slash-separated, "." for the root). A missing file is not an error.
+func (rules *ignoreRules) load(filePath, base string) error {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if rule, ok := parseIgnoreRule(scanner.Text(), base); ok {
+			*rules = append(*rules, rule)
+		}
+	}
+	return scanner.Err()
+}
+
+// parseIgnoreRule parses a .gitignore line; ok is false for blank lines
+// and comments
+func parseIgnoreRule(line, base string) (rule ignoreRule, ok bool) {
+	line = strings.TrimRight(line, " \t\r")
+	if line == "" || strings.HasPrefix(line, "#") {
+		return rule, false
+	}
+	if base != "." {
+		rule.base = base
+	}
+	if strings.HasPrefix(line, "!") {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, `\`) {
+		// Escaped leading "#" or "!"
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return rule, false
+	}
+	rule.segments = strings.Split(line, "/")
+	return rule, true
+}
+
+// ignored reports whether the slash-separated path rel, relative to the
+// archive root, is ignored
+func (rules ignoreRules) ignored(rel string, isDir bool) bool {
+	ignored := false
+	for _, rule := range rules {
+		if rule.negate == ignored && rule.matches(rel, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule ignoreRule) matches(rel string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.base != "" {
+		sub, ok := strings.CutPrefix(rel, rule.base+"/")
+		if !ok {
+			return false
+		}
+		rel = sub
+	}
+	if !rule.anchored {
+		return len(rule.segments) == 1 && matchSegments(rule.segments, []string{path.Base(rel)})
+	}
+	return matchSegments(rule.segments, strings.Split(rel, "/"))
+}
+
+// matchSegments matches path segments against pattern segments, where
+// "**" stands for any number of segments
+func matchSegments(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchSegments(pattern[1:], name[1:])
+}
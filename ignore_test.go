@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIgnoreRules(t *testing.T) {
+	var rules ignoreRules
+	for _, line := range strings.Split(`# build output
+target/
+*.log
+!keep.log
+/vendor
+docs/**/*.pdf
+\#notes
+`, "\n") {
+		if rule, ok := parseIgnoreRule(line, "."); ok {
+			rules = append(rules, rule)
+		}
+	}
+	// Rules from web/.gitignore only apply below web/
+	if rule, ok := parseIgnoreRule("dist", "web"); ok {
+		rules = append(rules, rule)
+	}
+
+	tests := []struct {
+		path    string
+		isDir   bool
+		ignored bool
+	}{
+		{"target", true, true},
+		{"src/target", true, true},
+		{"target", false, false}, // only directories
+		{"debug.log", false, true},
+		{"sub/debug.log", false, true},
+		{"keep.log", false, false},
+		{"vendor", true, true},
+		{"src/vendor", true, false}, // anchored to the root
+		{"docs/a.pdf", false, true},
+		{"docs/x/y/a.pdf", false, true},
+		{"other/a.pdf", false, false},
+		{"#notes", false, true},
+		{"web/dist", true, true},
+		{"dist", true, false},
+		{"main.go", false, false},
+	}
+	for _, tt := range tests {
+		if got := rules.ignored(tt.path, tt.isDir); got != tt.ignored {
+			t.Errorf("ignored(%q, dir=%v) = %v, want %v", tt.path, tt.isDir, got, tt.ignored)
+		}
+	}
+}
+
+func TestParseIgnoreRuleSkipsBlankAndComments(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/"} {
+		if _, ok := parseIgnoreRule(line, "."); ok {
+			t.Errorf("expected %q to be skipped", line)
+		}
+	}
+}
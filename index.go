@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// indexPageTemplate lists the files of a multi-file share
+var indexPageTemplate = template.Must(template.New("index").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="data:,">
+<title>Shared files</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; max-width: 40em; margin: 3em auto; padding: 0 1em; color: #222; }
+table { border-collapse: collapse; width: 100%; }
+td, th { padding: 0.4em 0.6em; text-align: left; border-bottom: 1px solid #e5e7eb; }
+.note { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Shared files</h1>
+<table>
+<tr><th>Name</th><th>Size</th>{{if .PerFile}}<th>Downloads left</th>{{end}}</tr>
+{{range .Files}}<tr><td>{{if eq .Remaining 0}}{{.Name}}{{else}}<a href="{{.Href}}" download>{{.Name}}</a>{{end}}</td><td>{{.Size}}</td>{{if $.PerFile}}<td>{{if eq .Remaining -1}}unlimited{{else}}{{.Remaining}}{{end}}</td>{{end}}</tr>
+{{end}}</table>
+{{if not .PerFile}}<p class="note">{{if eq .Remaining -1}}These links can be used any number of times.{{else}}{{.Remaining}} more download(s) of any file before the share closes.{{end}}</p>{{end}}
+</body>
+</html>
+`))
+
+// indexHandler serves several files, each at /<name>, with a page listing
+// them at the root. The download limit applies to each file when perFile
+// is set and to the downloads of all files together otherwise.
+type indexHandler struct {
+	files   []*handler
+	byName  map[string]*handler
+	limit   int32
+	perFile bool
+
+	total    atomic.Int32 // downloads of all files
+	finished atomic.Int32 // files that used up their limit
+}
+
+// newIndexHandler creates a handler per provider; downloadComplete is
+// signaled once the whole share is used up
+func newIndexHandler(providers []contentProvider, limit int32, perFile bool, activeDownloads *sync.WaitGroup, downloadComplete chan struct{}) (*indexHandler, error) {
+	ix := &indexHandler{byName: make(map[string]*handler), limit: limit, perFile: perFile}
+	for _, provider := range providers {
+		name := provider.Filename()
+		if _, ok := ix.byName[name]; ok {
+			return nil, fmt.Errorf("duplicate file name %s", name)
+		}
+		h := &handler{
+			provider:        provider,
+			activeDownloads: activeDownloads,
+		}
+		if perFile {
+			h.maxDownloads = limit
+		}
+		h.onDownload = func(_ int, downloads int32) {
+			if limit == 0 {
+				return
+			}
+			var done bool
+			if perFile {
+				done = downloads == limit && ix.finished.Add(1) == int32(len(providers))
+			} else {
+				done = ix.total.Add(1) == limit
+			}
+			if done {
+				select {
+				case downloadComplete <- struct{}{}:
+				default:
+				}
+			}
+		}
+		ix.files = append(ix.files, h)
+		ix.byName[name] = h
+	}
+	return ix, nil
+}
+
+// served reports whether a path is one of the file URLs
+func (ix *indexHandler) served(path string) bool {
+	_, ok := ix.byName[strings.TrimPrefix(path, "/")]
+	return ok
+}
+
+// remaining returns the downloads left of the whole share, or -1 when
+// unlimited or counted per file
+func (ix *indexHandler) remaining() int32 {
+	if ix.limit == 0 || ix.perFile {
+		return -1
+	}
+	return max(ix.limit-ix.total.Load(), 0)
+}
+
+func (ix *indexHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowReads(w, r) {
+		return
+	}
+	if r.URL.Path == "/" {
+		ix.servePage(w)
+		return
+	}
+
+	h, ok := ix.byName[strings.TrimPrefix(r.URL.Path, "/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if _, remaining := h.status(); remaining == 0 || ix.remaining() == 0 {
+		http.Error(w, "download limit reached", http.StatusGone)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
+
+func (ix *indexHandler) servePage(w http.ResponseWriter) {
+	type entry struct {
+		Name, Href, Size string
+		Remaining        int32
+	}
+	var files []entry
+	for _, h := range ix.files {
+		provider, remaining := h.status()
+		size := "unknown"
+		if length := provider.ContentLength(); length >= 0 {
+			size = formatSize(length)
+		}
+		if ix.remaining() == 0 {
+			remaining = 0
+		}
+		files = append(files, entry{
+			Name:      provider.Filename(),
+			Href:      "/" + url.PathEscape(provider.Filename()),
+			Size:      size,
+			Remaining: remaining,
+		})
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	indexPageTemplate.Execute(w, map[string]any{
+		"Files":     files,
+		"PerFile":   ix.perFile,
+		"Remaining": ix.remaining(),
+	})
+}
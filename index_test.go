@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testProviders creates one small file per name
+func testProviders(t *testing.T, names ...string) []contentProvider {
+	t.Helper()
+	tmpDir := t.TempDir()
+	var providers []contentProvider
+	for _, name := range names {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+		providers = append(providers, &fileProvider{filePath: path, fileName: name, fileSize: int64(len(name))})
+	}
+	return providers
+}
+
+func TestIndexHandlerPage(t *testing.T) {
+	var wg sync.WaitGroup
+	ix, err := newIndexHandler(testProviders(t, "report.pdf", "data.csv"), 2, false, &wg, make(chan struct{}, 1))
+	if err != nil {
+		t.Fatalf("newIndexHandler failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	ix.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	page := rec.Body.String()
+	for _, want := range []string{`href="/report.pdf"`, `href="/data.csv"`, "10 B", "2 more download(s)"} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected page to contain %q", want)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	ix.ServeHTTP(rec, httptest.NewRequest("GET", "/missing.txt", nil))
+	if rec.Code != 404 {
+		t.Errorf("expected 404 for unknown file, got %d", rec.Code)
+	}
+}
+
+func TestIndexHandlerLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		perFile bool
+		paths   []string
+		codes   []int
+	}{
+		// Two downloads in total, whichever files they are
+		{"whole set", false, []string{"/a.txt", "/a.txt", "/b.txt"}, []int{200, 200, 410}},
+		// Two downloads of each file
+		{"per file", true, []string{"/a.txt", "/a.txt", "/a.txt", "/b.txt", "/b.txt"}, []int{200, 200, 410, 200, 200}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var wg sync.WaitGroup
+			downloadComplete := make(chan struct{}, 1)
+			ix, err := newIndexHandler(testProviders(t, "a.txt", "b.txt"), 2, tt.perFile, &wg, downloadComplete)
+			if err != nil {
+				t.Fatalf("newIndexHandler failed: %v", err)
+			}
+
+			for i, path := range tt.paths {
+				rec := httptest.NewRecorder()
+				ix.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+				if rec.Code != tt.codes[i] {
+					t.Errorf("request %d (%s): expected %d, got %d", i+1, path, tt.codes[i], rec.Code)
+				}
+			}
+
+			select {
+			case <-downloadComplete:
+			default:
+				t.Error("expected downloadComplete once the share is used up")
+			}
+		})
+	}
+}
+
+func TestIndexHandlerDuplicateNames(t *testing.T) {
+	providers := append(testProviders(t, "a.txt"), testProviders(t, "a.txt")...)
+	var wg sync.WaitGroup
+	if _, err := newIndexHandler(providers, 1, false, &wg, make(chan struct{}, 1)); err == nil || err.Error() != "duplicate file name a.txt" {
+		t.Errorf("expected duplicate name error, got %v", err)
+	}
+}
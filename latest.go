@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// latestPollInterval is how often --latest looks for a newer file to log.
+// Downloads never wait for it: each one looks up the newest file itself.
+const latestPollInterval = 2 * time.Second
+
+// partialSuffixes mark files that are still being written, e.g. by a
+// browser or a build, which --latest never picks
+var partialSuffixes = []string{".part", ".partial", ".crdownload", ".download", ".tmp"}
+
+// latestProvider serves the most recently modified file in a directory,
+// looked up again for every download so a new file is picked up at once
+type latestProvider struct {
+	dirPath string
+	filter  *archiveFilter
+}
+
+// current returns the newest file, or nil if there is none. Hidden and
+// partial files and those the filter leaves out are not considered.
+func (p *latestProvider) current() *fileProvider {
+	entries, err := os.ReadDir(p.dirPath)
+	if err != nil {
+		return nil
+	}
+	var newest os.FileInfo
+	for _, entry := range entries {
+		if strings.HasPrefix(entry.Name(), ".") || hasPartialSuffix(entry.Name()) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(p.dirPath, entry.Name()))
+		if err != nil || !info.Mode().IsRegular() || p.filter.skip(entry.Name(), info) {
+			continue
+		}
+		if newest == nil || info.ModTime().After(newest.ModTime()) {
+			newest = info
+		}
+	}
+	if newest == nil {
+		return nil
+	}
+	return &fileProvider{
+		filePath: filepath.Join(p.dirPath, newest.Name()),
+		fileName: newest.Name(),
+		fileSize: newest.Size(),
+	}
+}
+
+func hasPartialSuffix(name string) bool {
+	for _, suffix := range partialSuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// watch logs whenever a different file becomes the newest, until ctx is done
+func (p *latestProvider) watch(ctx context.Context) {
+	var last string
+	for {
+		name := ""
+		if file := p.current(); file != nil {
+			name = file.fileName
+		}
+		if name != last && name != "" {
+			logEvent("now_serving", logFields{"file": name}, "Now serving %s", name)
+		}
+		last = name
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(latestPollInterval):
+		}
+	}
+}
+
+// The provider itself stands for whatever file is newest; downloads are
+// served from a snapshot taken by current.
+
+func (p *latestProvider) Filename() string {
+	if file := p.current(); file != nil {
+		return file.Filename()
+	}
+	return filepath.Base(p.dirPath)
+}
+
+func (p *latestProvider) ContentType() string {
+	if file := p.current(); file != nil {
+		return file.ContentType()
+	}
+	return "application/octet-stream"
+}
+
+func (p *latestProvider) ContentLength() int64 {
+	if file := p.current(); file != nil {
+		return file.ContentLength()
+	}
+	return -1
+}
+
+func (p *latestProvider) WriteTo(w io.Writer) (int64, error) {
+	file := p.current()
+	if file == nil {
+		return 0, fmt.Errorf("no file in %s yet", p.dirPath)
+	}
+	return file.WriteTo(w)
+}
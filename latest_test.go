@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLatestProviderCurrent(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"old.log":          3 * time.Hour,
+		"build-2.zip":      time.Hour,
+		"build-3.zip.part": 0, // Still being written
+		".hidden":          0, // Dotfile
+		"notes.txt":        time.Minute,
+		"skipped.bak":      0, // Excluded by the filter
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, now.Add(-age), now.Add(-age))
+	}
+	os.Mkdir(filepath.Join(dir, "newer-dir"), 0755)
+
+	p := &latestProvider{dirPath: dir, filter: &archiveFilter{exclude: []string{"*.bak"}}}
+	file := p.current()
+	if file == nil || file.fileName != "notes.txt" {
+		t.Fatalf("expected notes.txt, got %+v", file)
+	}
+
+	empty := &latestProvider{dirPath: t.TempDir()}
+	if file := empty.current(); file != nil {
+		t.Errorf("expected no file in an empty directory, got %s", file.fileName)
+	}
+}
+
+func TestLatestHandler(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &latestProvider{dirPath: dir},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 2),
+		maxDownloads:     2,
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != 404 {
+		t.Errorf("expected 404 before any file exists, got %d", rec.Code)
+	}
+
+	past := time.Now().Add(-time.Minute)
+	for i, name := range []string{"first.txt", "second.txt"} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(name), 0644)
+		if i == 0 {
+			os.Chtimes(path, past, past)
+		}
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if rec.Body.String() != name {
+			t.Errorf("expected %s, got %q", name, rec.Body.String())
+		}
+		if !strings.Contains(rec.Header().Get("Content-Disposition"), name) {
+			t.Errorf("expected %s in Content-Disposition, got %q", name, rec.Header().Get("Content-Disposition"))
+		}
+	}
+}
+
+func TestRunLatestConflicts(t *testing.T) {
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"--latest", dir, "file.txt"},
+		{"--latest", dir, "--text", "hello"},
+		{"--latest", dir, "--browse"},
+		{"--latest", filepath.Join(dir, "missing")},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "--latest") && !strings.Contains(err.Error(), "directory") {
+			t.Errorf("%v: expected a --latest error, got %v", args, err)
+		}
+	}
+}
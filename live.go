@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// liveSnapshot is a --live file as it was when a download started. The file
+// stays open for the whole download and its length comes from the open
+// file, so a rebuild that replaces it can't change the body midway.
+type liveSnapshot struct {
+	fileProvider
+	file *os.File
+}
+
+// snapshot opens a --live file and takes its current size
+func (p *fileProvider) snapshot() (*liveSnapshot, error) {
+	file, err := os.Open(p.filePath)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	if !info.Mode().IsRegular() {
+		file.Close()
+		return nil, fmt.Errorf("%s is no longer a regular file", p.filePath)
+	}
+	s := &liveSnapshot{fileProvider: *p, file: file}
+	s.fileSize = info.Size()
+	s.live = false
+	return s, nil
+}
+
+// WriteTo sends at most the length taken at the start, so a file truncated
+// or appended to in place gives a cut-off or complete body, never one that
+// disagrees with Content-Length
+func (s *liveSnapshot) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, io.LimitReader(s.file, s.fileSize))
+	if err == nil && n < s.fileSize {
+		err = fmt.Errorf("file shrank to %s while being sent", formatSize(n))
+	}
+	return n, err
+}
+
+func (s *liveSnapshot) Close() error {
+	return s.file.Close()
+}
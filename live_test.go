@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLiveFileRebuilt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.bin")
+	os.WriteFile(path, []byte("original"), 0644)
+	provider, err := newProvider(path, archiveOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	provider.(*fileProvider).live = true
+
+	// Rebuilt after the share started
+	const rebuilt = "rebuilt artifact, longer"
+	os.WriteFile(path, []byte(rebuilt), 0644)
+
+	var wg sync.WaitGroup
+	h := &handler{provider: provider, activeDownloads: &wg, downloadComplete: make(chan struct{}, 1)}
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/app.bin", nil))
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(rebuilt)) {
+		t.Errorf("expected Content-Length %d, got %s", len(rebuilt), got)
+	}
+	if rec.Body.String() != rebuilt {
+		t.Errorf("expected %q, got %q", rebuilt, rec.Body.String())
+	}
+
+	os.Remove(path)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/app.bin", nil))
+	if rec.Code != 503 {
+		t.Errorf("expected 503 while the file is missing, got %d", rec.Code)
+	}
+}
+
+func TestLiveSnapshotShrinks(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "app.bin")
+	os.WriteFile(path, []byte("0123456789"), 0644)
+	snapshot, err := (&fileProvider{filePath: path, fileName: "app.bin", live: true}).snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Close()
+	if snapshot.ContentLength() != 10 {
+		t.Fatalf("expected length 10, got %d", snapshot.ContentLength())
+	}
+
+	// Truncated in place after the download started
+	os.Truncate(path, 4)
+	var buf bytes.Buffer
+	if _, err := snapshot.WriteTo(&buf); err == nil {
+		t.Error("expected an error for a file that shrank")
+	}
+}
+
+func TestRunLiveConflicts(t *testing.T) {
+	for _, args := range [][]string{
+		{"--live", "--text", "hello"},
+		{"--live", "--follow", "build.log"},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "--live") {
+			t.Errorf("%v: expected a --live error, got %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Formats for --log-format
+const (
+	logText = "text" // Timestamped lines for people
+	logJSON = "json" // One JSON object per line for scripts
+)
+
+// Destinations for --log-dest
+const (
+	logStdout = "stdout"
+	logSyslog = "syslog" // The system log, which is the journal under systemd
+)
+
+// severity ranks events in the system log
+type severity int
+
+const (
+	severityDebug severity = iota
+	severityInfo
+	severityWarning
+	severityError
+)
+
+// systemLog takes events instead of standard output with --log-dest
+// syslog; the summary printed at startup still goes to standard output
+type systemLog interface {
+	log(sev severity, message string) error
+	Close() error
+}
+
+// eventLog writes what happens during a share to standard output or the
+// system log
+type eventLog struct {
+	mu       sync.Mutex
+	out      io.Writer
+	system   systemLog      // Replaces out for events if set
+	progress *progressBoard // Drawn below the log lines on a terminal
+	format   string
+	quiet    bool // Only the URL is printed, see -q
+	verbose  bool // Debug events are printed too, see -v
+
+	// listeners are told of every event, e.g. to call a --webhook
+	listeners map[int]func(event)
+	nextID    int
+}
+
+// events is where the whole program logs to; serve sets its format
+var events = &eventLog{out: os.Stdout, format: logText}
+
+// event is something that happened during a share, as told to listeners
+type event struct {
+	kind    string
+	time    time.Time
+	message string
+	fields  logFields
+}
+
+// logFields are the details of an event that JSON logs carry besides its
+// message, e.g. the client and the bytes sent
+type logFields map[string]any
+
+// logEvent logs an event as a timestamped line, or with --log-format json
+// as an object with the event's kind, time, message and fields
+func logEvent(kind string, fields logFields, format string, args ...any) {
+	events.write(kind, fields, fmt.Sprintf(format, args...), true, severityOf(kind))
+}
+
+// severityOf ranks an event by its kind: ones that end something early,
+// like download_failed, are errors and ones that turn a client away are
+// warnings
+func severityOf(kind string) severity {
+	switch {
+	case strings.HasSuffix(kind, "_failed"):
+		return severityError
+	case strings.HasSuffix(kind, "_interrupted"), strings.HasSuffix(kind, "_refused"), strings.HasSuffix(kind, "_skipped"):
+		return severityWarning
+	}
+	return severityInfo
+}
+
+// logNotice logs an event about the share as a whole, such as it shutting
+// down, which text logs show without a timestamp
+func logNotice(kind string, fields logFields, format string, args ...any) {
+	events.write(kind, fields, fmt.Sprintf(format, args...), false, severityInfo)
+}
+
+// logDebug logs an event only with -v, for details such as why a file was
+// left out of an archive
+func logDebug(kind string, fields logFields, format string, args ...any) {
+	if events.debug() {
+		events.write(kind, fields, fmt.Sprintf(format, args...), true, severityDebug)
+	}
+}
+
+// say prints the summary of the share shown at startup, which JSON logs
+// replace with a single startup event
+func say(format string, args ...any) {
+	events.mu.Lock()
+	summary := events.format == logText && !events.quiet
+	events.mu.Unlock()
+	if summary {
+		events.print(fmt.Sprintf(format, args...))
+	}
+}
+
+// sayURL prints the share's URL, which is all that -q prints
+func sayURL(url string) {
+	events.mu.Lock()
+	quiet := events.quiet
+	events.mu.Unlock()
+	if quiet {
+		events.print(url + "\n")
+		return
+	}
+	say("URL: %s\n", url)
+}
+
+func (l *eventLog) configure(format string, quiet, verbose bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.format, l.quiet, l.verbose = format, quiet, verbose
+}
+
+func (l *eventLog) debug() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.verbose
+}
+
+// logsStartup reports whether the share's start is logged as an event,
+// for logs that don't show the summary printed at startup
+func (l *eventLog) logsStartup() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.format == logJSON || l.system != nil
+}
+
+// useSystemLog sends events to the system log until the returned function
+// is called
+func (l *eventLog) useSystemLog(system systemLog) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.system = system
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.system.Close()
+		l.system = nil
+	}
+}
+
+func (l *eventLog) print(s string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.progress.clear(l.out)
+	io.WriteString(l.out, s)
+	l.progress.draw(l.out)
+}
+
+func (l *eventLog) write(kind string, fields logFields, message string, timestamp bool, sev severity) {
+	now := time.Now()
+	l.mu.Lock()
+	l.output(kind, fields, message, timestamp, sev, now)
+	listeners := slices.Collect(maps.Values(l.listeners))
+	l.mu.Unlock()
+
+	// Listeners may log events of their own
+	e := event{kind: kind, time: now, message: strings.TrimSpace(message), fields: fields}
+	for _, listener := range listeners {
+		listener(e)
+	}
+}
+
+// listen calls f with every event until the returned function is called
+func (l *eventLog) listen(f func(event)) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.listeners == nil {
+		l.listeners = make(map[int]func(event))
+	}
+	id := l.nextID
+	l.nextID++
+	l.listeners[id] = f
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		delete(l.listeners, id)
+	}
+}
+
+func (l *eventLog) output(kind string, fields logFields, message string, timestamp bool, sev severity, now time.Time) {
+	if l.system != nil {
+		// The system log keeps its own time
+		if l.format == logJSON {
+			message = string(jsonEvent(kind, fields, message, now))
+		}
+		l.system.log(sev, strings.TrimSpace(message))
+		return
+	}
+	if l.quiet {
+		return
+	}
+	if l.format != logJSON {
+		if timestamp {
+			message = fmt.Sprintf("[%s] %s", now.Format("15:04:05"), message)
+		}
+		l.progress.clear(l.out)
+		fmt.Fprintln(l.out, message)
+		l.progress.draw(l.out)
+		return
+	}
+	l.out.Write(append(jsonEvent(kind, fields, message, now), '\n'))
+}
+
+// jsonEvent encodes an event as a JSON object
+func jsonEvent(kind string, fields logFields, message string, now time.Time) []byte {
+	entry := map[string]any{}
+	for key, value := range fields {
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		entry[key] = value
+	}
+	entry["time"] = now.Format(time.RFC3339Nano)
+	entry["event"] = kind
+	entry["message"] = strings.TrimSpace(message)
+	line, _ := json.Marshal(entry)
+	return line
+}
+
+// transfer describes a download or stream for the logs: who it went to,
+// what was sent, how much of the body and how long it took
+func transfer(client, file string, sent *sentWriter, start time.Time) logFields {
+	return logFields{
+		"client":   client,
+		"file":     file,
+		"bytes":    sent.n.Load(),
+		"duration": time.Since(start).Round(time.Millisecond).Seconds(),
+	}
+}
+
+// with adds a field, e.g. the error that ended a download
+func (f logFields) with(key string, value any) logFields {
+	f[key] = value
+	return f
+}
+
+// sentWriter counts the body bytes of a response, which progress lines
+// read while it is sent
+type sentWriter struct {
+	http.ResponseWriter
+	n       atomic.Int64
+	length  atomic.Int64 // Content-Length, or -1 if unknown
+	started bool
+}
+
+func (s *sentWriter) WriteHeader(code int) {
+	s.start()
+	s.ResponseWriter.WriteHeader(code)
+}
+
+func (s *sentWriter) Write(b []byte) (int, error) {
+	s.start()
+	n, err := s.ResponseWriter.Write(b)
+	s.n.Add(int64(n))
+	return n, err
+}
+
+// start records the length of the body as the response goes out
+func (s *sentWriter) start() {
+	if s.started {
+		return
+	}
+	s.started = true
+	length, err := strconv.ParseInt(s.Header().Get("Content-Length"), 10, 64)
+	if err != nil {
+		length = -1
+	}
+	s.length.Store(length)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// a --follow stream
+func (s *sentWriter) Unwrap() http.ResponseWriter {
+	return s.ResponseWriter
+}
+
+// redactedHeaders carry credentials, which -v doesn't print
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie"}
+
+// logRequests logs every request with its headers before next handles it
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers := r.Header.Clone()
+		for _, key := range redactedHeaders {
+			if headers.Get(key) != "" {
+				headers.Set(key, "[redacted]")
+			}
+		}
+		var b strings.Builder
+		fmt.Fprintf(&b, "\n  Host: %s", r.Host)
+		for _, key := range slices.Sorted(maps.Keys(headers)) {
+			for _, value := range headers[key] {
+				fmt.Fprintf(&b, "\n  %s: %s", key, value)
+			}
+		}
+		fields := logFields{"client": r.RemoteAddr, "method": r.Method, "uri": r.RequestURI, "proto": r.Proto, "host": r.Host, "headers": headers}
+		logDebug("request", fields, "%s %s %s from %s%s", r.Method, r.RequestURI, r.Proto, r.RemoteAddr, b.String())
+		next.ServeHTTP(w, r)
+	})
+}
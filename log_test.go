@@ -0,0 +1,203 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureEvents sends the event log to a buffer in format until the test ends
+func captureEvents(t *testing.T, format string) *bytes.Buffer {
+	var buf bytes.Buffer
+	saved := events
+	events = &eventLog{out: &buf, format: format}
+	t.Cleanup(func() { events = saved })
+	return &buf
+}
+
+func TestLogEventText(t *testing.T) {
+	tests := []struct {
+		name  string
+		log   func()
+		match string
+	}{
+		{"event", func() { logEvent("download_started", nil, "Download started from %s", "1.2.3.4:5") }, `^\[\d\d:\d\d:\d\d\] Download started from 1\.2\.3\.4:5\n$`},
+		{"notice", func() { logNotice("stopped", nil, "All downloads completed") }, `^All downloads completed\n$`},
+		{"say", func() { say("URL: %s\n", "http://x/") }, `^URL: http://x/\n$`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := captureEvents(t, logText)
+			tt.log()
+			if !regexp.MustCompile(tt.match).MatchString(buf.String()) {
+				t.Errorf("expected output matching %s, got %q", tt.match, buf.String())
+			}
+		})
+	}
+}
+
+func TestLogEventJSON(t *testing.T) {
+	buf := captureEvents(t, logJSON)
+	say("URL: %s\n", "http://x/")
+	logNotice("shutdown", logFields{"reason": "signal"}, "\nReceived interrupt, shutting down...")
+	logEvent("download_interrupted", logFields{"client": "1.2.3.4:5", "bytes": int64(42), "error": errors.New("broken pipe")}, "Download interrupted")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 JSON lines without the startup summary, got %q", buf.String())
+	}
+	var shutdown, interrupted map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &shutdown); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &interrupted); err != nil {
+		t.Fatal(err)
+	}
+	if shutdown["event"] != "shutdown" || shutdown["message"] != "Received interrupt, shutting down..." || shutdown["reason"] != "signal" {
+		t.Errorf("unexpected shutdown event %v", shutdown)
+	}
+	if interrupted["time"] == nil || interrupted["client"] != "1.2.3.4:5" || interrupted["bytes"] != 42.0 || interrupted["error"] != "broken pipe" {
+		t.Errorf("unexpected interruption event %v", interrupted)
+	}
+}
+
+func TestDeliverLogsTransfer(t *testing.T) {
+	buf := captureEvents(t, logJSON)
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &memoryProvider{name: "notes.txt", data: []byte("hello")},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+	}
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/notes.txt", nil))
+
+	var completed map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]any
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("invalid JSON line %q: %v", line, err)
+		}
+		if entry["event"] == "download_completed" {
+			completed = entry
+		}
+	}
+	if completed == nil {
+		t.Fatalf("no download_completed event in %q", buf.String())
+	}
+	if completed["bytes"] != 5.0 || completed["client"] != "192.0.2.1:1234" {
+		t.Errorf("unexpected completion event %v", completed)
+	}
+	if _, ok := completed["duration"].(float64); !ok {
+		t.Errorf("expected a duration, got %v", completed["duration"])
+	}
+}
+
+func TestRunLogFlagErrors(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--log-format", "xml", "x"}, "log format"},
+		{[]string{"-q", "-v", "x"}, "-v"},
+		{[]string{"-q", "--json", "x"}, "-q"},
+		{[]string{"--json", "--log-format", "text", "x"}, "--json"},
+		{[]string{"--log-dest", "file", "x"}, "log destination"},
+		{[]string{"-q", "--log-format", "json", "x"}, "-q"},
+	} {
+		if err := run(tt.args); err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%v: expected an error about %s, got %v", tt.args, tt.want, err)
+		}
+	}
+}
+
+func TestQuietPrintsOnlyURL(t *testing.T) {
+	buf := captureEvents(t, logText)
+	events.quiet = true
+	say("Serving %s\n", "notes.txt")
+	sayURL("http://192.0.2.2:8080/notes.txt")
+	logEvent("download_started", nil, "Download started from %s", "192.0.2.1:1234")
+	logNotice("shutdown", nil, "Download limit reached, shutting down...")
+	if got := buf.String(); got != "http://192.0.2.2:8080/notes.txt\n" {
+		t.Errorf("expected only the URL, got %q", got)
+	}
+}
+
+func TestLogRequestsVerbose(t *testing.T) {
+	buf := captureEvents(t, logText)
+	events.verbose = true
+	r := httptest.NewRequest("GET", "/notes.txt", nil)
+	r.Header.Set("User-Agent", "curl/8.0")
+	r.Header.Set("Authorization", "Basic c2VjcmV0")
+	logRequests(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+
+	got := buf.String()
+	for _, want := range []string{"GET /notes.txt HTTP/1.1 from 192.0.2.1:1234", "  Host: example.com", "  User-Agent: curl/8.0", "  Authorization: [redacted]"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in the log, got:\n%s", want, got)
+		}
+	}
+	if strings.Contains(got, "c2VjcmV0") {
+		t.Errorf("expected credentials to be left out, got:\n%s", got)
+	}
+
+	// Without -v nothing is logged
+	buf.Reset()
+	events.verbose = false
+	logRequests(http.NotFoundHandler()).ServeHTTP(httptest.NewRecorder(), r)
+	if buf.Len() != 0 {
+		t.Errorf("expected no request log without -v, got %q", buf.String())
+	}
+}
+
+// fakeSystemLog records what would go to syslog
+type fakeSystemLog struct {
+	entries []string
+	closed  bool
+}
+
+func (f *fakeSystemLog) log(sev severity, message string) error {
+	f.entries = append(f.entries, fmt.Sprintf("%d %s", sev, message))
+	return nil
+}
+
+func (f *fakeSystemLog) Close() error {
+	f.closed = true
+	return nil
+}
+
+func TestSystemLog(t *testing.T) {
+	buf := captureEvents(t, logText)
+	system := &fakeSystemLog{}
+	stop := events.useSystemLog(system)
+	say("URL: %s\n", "http://x/")
+	logEvent("download_completed", nil, "Download completed from %s", "192.0.2.1:1234")
+	logEvent("download_interrupted", nil, "Download interrupted from %s", "192.0.2.1:1234")
+	logEvent("download_failed", nil, "Download failed from %s", "192.0.2.1:1234")
+	logNotice("shutdown", nil, "\nReceived interrupt, shutting down...")
+	logDebug("request", nil, "GET / HTTP/1.1")
+	stop()
+
+	expected := []string{
+		fmt.Sprintf("%d Download completed from 192.0.2.1:1234", severityInfo),
+		fmt.Sprintf("%d Download interrupted from 192.0.2.1:1234", severityWarning),
+		fmt.Sprintf("%d Download failed from 192.0.2.1:1234", severityError),
+		fmt.Sprintf("%d Received interrupt, shutting down...", severityInfo),
+	}
+	if strings.Join(system.entries, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected system log entries:\n%s\ngot:\n%s", strings.Join(expected, "\n"), strings.Join(system.entries, "\n"))
+	}
+	if !system.closed {
+		t.Error("expected the system log to be closed")
+	}
+	// The startup summary stays on standard output
+	if buf.String() != "URL: http://x/\n" {
+		t.Errorf("expected only the summary on stdout, got %q", buf.String())
+	}
+}
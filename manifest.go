@@ -0,0 +1,90 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// manifestName is the checksum list's name inside an archive
+const manifestName = "SHA256SUMS"
+
+// Where --manifest puts the checksum list
+const (
+	manifestEmbed = "embed" // At the root of the archive
+	manifestServe = "serve" // At /<archive>.sha256sums, next to the archive
+)
+
+// buildManifest hashes every file the archive holds and lists them in the
+// format of sha256sum, by their paths in the archive, so that running
+// sha256sum -c where it was extracted checks them all
+func (p *archiveProvider) buildManifest() ([]byte, error) {
+	var buf bytes.Buffer
+	err := p.walk(func(path, name string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		sum, err := fileChecksum(path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(&buf, "%s  %s\n", sum, filepath.ToSlash(name))
+		return nil
+	})
+	return buf.Bytes(), err
+}
+
+// writeTarManifest adds the embedded manifest, if any, as the last entry
+func (p *archiveProvider) writeTarManifest(tw *tar.Writer) error {
+	if p.manifest == nil {
+		return nil
+	}
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     manifestName,
+		Mode:     0644,
+		Size:     int64(len(p.manifest)),
+		ModTime:  time.Now(),
+	}
+	setOwner(header, ownerAnonymous)
+	if p.reproducible {
+		normalizeTarHeader(header)
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err := tw.Write(p.manifest)
+	return err
+}
+
+// writeZipManifest adds the embedded manifest, if any, as the last entry
+func (p *archiveProvider) writeZipManifest(zw *zip.Writer) error {
+	if p.manifest == nil {
+		return nil
+	}
+	header := &zip.FileHeader{Name: manifestName, Method: zip.Deflate, Modified: time.Now()}
+	header.SetMode(0644)
+	if p.reproducible {
+		normalizeZipHeader(header)
+	}
+	if p.zipPassword != "" {
+		ew, err := createEncryptedEntry(zw, header, p.zipPassword, true, p.level)
+		if err != nil {
+			return err
+		}
+		if _, err := ew.Write(p.manifest); err != nil {
+			return err
+		}
+		return ew.Close()
+	}
+	writer, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = writer.Write(p.manifest)
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBuildManifest(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	os.MkdirAll(filepath.Join(root, "docs"), 0755)
+	os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello\n"), 0644)
+	os.WriteFile(filepath.Join(root, "docs", "empty.md"), nil, 0644)
+
+	p := newArchiveProvider(root, "release", archiveOptions{})
+	manifest, err := p.buildManifest()
+	if err != nil {
+		t.Fatalf("buildManifest failed: %v", err)
+	}
+	want := "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855  release/docs/empty.md\n" +
+		"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03  release/hello.txt\n"
+	if string(manifest) != want {
+		t.Errorf("unexpected manifest:\n%s", manifest)
+	}
+}
+
+func TestEmbeddedManifest(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "release")
+	os.Mkdir(root, 0755)
+	os.WriteFile(filepath.Join(root, "hello.txt"), []byte("hello\n"), 0644)
+
+	for _, format := range []ArchiveFormat{ArchiveTarGz, ArchiveZip} {
+		p := newArchiveProvider(root, "release", archiveOptions{format: format})
+		p.manifest = []byte("sums\n")
+		var buf bytes.Buffer
+		if _, err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("%s: WriteTo failed: %v", p.Filename(), err)
+		}
+
+		var names []string
+		var content string
+		if format == ArchiveZip {
+			zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, f := range zr.File {
+				names = append(names, f.Name)
+				if f.Name == manifestName {
+					rc, _ := f.Open()
+					data, _ := io.ReadAll(rc)
+					content = string(data)
+				}
+			}
+		} else {
+			gz, err := gzip.NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			tr := tar.NewReader(gz)
+			for {
+				header, err := tr.Next()
+				if err != nil {
+					break
+				}
+				names = append(names, header.Name)
+				if header.Name == manifestName {
+					data, _ := io.ReadAll(tr)
+					content = string(data)
+				}
+			}
+		}
+		if len(names) == 0 || names[len(names)-1] != manifestName || content != "sums\n" {
+			t.Errorf("%s: expected %s last with the manifest, got %v with %q", p.Filename(), manifestName, names, content)
+		}
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+const (
+	mdnsPort     = 5353
+	mdnsTTL      = 120
+	dnsTypeA     = 1
+	dnsTypeANY   = 255
+	dnsClassIN   = 1
+	dnsCacheFlag = 0x8000 // cache-flush bit in the class of mDNS answers
+	dnsQUBit     = 0x8000 // unicast-response bit in the class of mDNS questions
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: mdnsPort}
+
+// dnsQuestion is a single entry of the question section of a DNS message
+type dnsQuestion struct {
+	name  string
+	qtype uint16
+	class uint16
+}
+
+// mdnsResponder answers multicast DNS queries for a single .local hostname
+type mdnsResponder struct {
+	host string // fully qualified, e.g. "userve.local."
+	ip   net.IP
+	conn *net.UDPConn
+}
+
+// startMDNS announces name.local as ip on the local network and keeps
+// answering queries for it until Close is called
+func startMDNS(name string, host string) (*mdnsResponder, error) {
+	ip4 := net.ParseIP(host).To4()
+	if ip4 == nil {
+		return nil, fmt.Errorf("mDNS requires an IPv4 address, got %s", host)
+	}
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		return nil, fmt.Errorf("cannot join mDNS group: %v", err)
+	}
+
+	r := &mdnsResponder{
+		host: strings.ToLower(strings.TrimSuffix(name, ".local")) + ".local.",
+		ip:   ip4,
+		conn: conn,
+	}
+
+	// Unsolicited announcement so caches pick up the name immediately
+	if _, err := conn.WriteToUDP(buildMDNSResponse(0, r.host, r.ip, false), mdnsGroup); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot announce mDNS name: %v", err)
+	}
+
+	go r.serve()
+	return r, nil
+}
+
+// Hostname returns the advertised name without the trailing dot
+func (r *mdnsResponder) Hostname() string {
+	return strings.TrimSuffix(r.host, ".")
+}
+
+func (r *mdnsResponder) Close() error {
+	return r.conn.Close()
+}
+
+func (r *mdnsResponder) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := r.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		msg := buf[:n]
+		questions, err := parseDNSQuestions(msg)
+		if err != nil {
+			continue
+		}
+
+		if !r.wants(questions) {
+			continue
+		}
+		id := binary.BigEndian.Uint16(msg[0:2])
+		switch {
+		case src.Port != mdnsPort:
+			// Legacy unicast query (e.g. from a plain resolver)
+			r.conn.WriteToUDP(buildMDNSResponse(id, r.host, r.ip, true), src)
+		case r.wantsUnicast(questions):
+			r.conn.WriteToUDP(buildMDNSResponse(0, r.host, r.ip, false), src)
+		default:
+			r.conn.WriteToUDP(buildMDNSResponse(0, r.host, r.ip, false), mdnsGroup)
+		}
+	}
+}
+
+// wants reports whether any question asks for our address record
+func (r *mdnsResponder) wants(questions []dnsQuestion) bool {
+	for _, q := range questions {
+		if q.name == r.host && (q.qtype == dnsTypeA || q.qtype == dnsTypeANY) {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsUnicast reports whether every question asking for our address
+// requested a unicast reply
+func (r *mdnsResponder) wantsUnicast(questions []dnsQuestion) bool {
+	for _, q := range questions {
+		if q.name == r.host && q.class&dnsQUBit == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// parseDNSQuestions extracts the question section of a DNS query
+func parseDNSQuestions(msg []byte) ([]dnsQuestion, error) {
+	if len(msg) < 12 {
+		return nil, errors.New("message too short")
+	}
+	if msg[2]&0x80 != 0 {
+		return nil, errors.New("not a query")
+	}
+	count := int(binary.BigEndian.Uint16(msg[4:6]))
+
+	off := 12
+	questions := make([]dnsQuestion, 0, count)
+	for i := 0; i < count; i++ {
+		name, next, err := readDNSName(msg, off)
+		if err != nil {
+			return nil, err
+		}
+		if next+4 > len(msg) {
+			return nil, errors.New("truncated question")
+		}
+		questions = append(questions, dnsQuestion{
+			name:  strings.ToLower(name),
+			qtype: binary.BigEndian.Uint16(msg[next : next+2]),
+			class: binary.BigEndian.Uint16(msg[next+2 : next+4]),
+		})
+		off = next + 4
+	}
+	return questions, nil
+}
+
+// readDNSName decodes a possibly compressed domain name starting at off and
+// returns it with a trailing dot along with the offset following it
+func readDNSName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	next := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errors.New("name out of bounds")
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if next < 0 {
+				next = off + 1
+			}
+			return strings.Join(labels, ".") + ".", next, nil
+		case l&0xC0 == 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, errors.New("truncated pointer")
+			}
+			if jumps++; jumps > 16 {
+				return "", 0, errors.New("too many compression pointers")
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:off+2]) & 0x3FFF)
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errors.New("label out of bounds")
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// buildMDNSResponse builds an authoritative answer mapping host to ip.
+// Replies to legacy unicast queries must repeat the question.
+func buildMDNSResponse(id uint16, host string, ip net.IP, question bool) []byte {
+	msg := make([]byte, 12, 96)
+	binary.BigEndian.PutUint16(msg[0:2], id)
+	binary.BigEndian.PutUint16(msg[2:4], 0x8400) // response, authoritative
+	binary.BigEndian.PutUint16(msg[6:8], 1)      // one answer
+
+	if question {
+		binary.BigEndian.PutUint16(msg[4:6], 1)
+		msg = appendDNSName(msg, host)
+		msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+		msg = binary.BigEndian.AppendUint16(msg, dnsClassIN)
+	}
+
+	msg = appendDNSName(msg, host)
+	msg = binary.BigEndian.AppendUint16(msg, dnsTypeA)
+	msg = binary.BigEndian.AppendUint16(msg, dnsClassIN|dnsCacheFlag)
+	msg = binary.BigEndian.AppendUint32(msg, mdnsTTL)
+	msg = binary.BigEndian.AppendUint16(msg, 4)
+	return append(msg, ip.To4()...)
+}
+
+func appendDNSName(msg []byte, name string) []byte {
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+// buildDNSQuery builds a query with a single question for name
+func buildDNSQuery(name string, qtype, class uint16) []byte {
+	msg := make([]byte, 12)
+	binary.BigEndian.PutUint16(msg[4:6], 1)
+	msg = appendDNSName(msg, name)
+	msg = binary.BigEndian.AppendUint16(msg, qtype)
+	return binary.BigEndian.AppendUint16(msg, class)
+}
+
+func TestParseDNSQuestions(t *testing.T) {
+	questions, err := parseDNSQuestions(buildDNSQuery("UServe.local", dnsTypeA, dnsClassIN|dnsQUBit))
+	if err != nil {
+		t.Fatalf("parseDNSQuestions failed: %v", err)
+	}
+	if len(questions) != 1 {
+		t.Fatalf("expected 1 question, got %d", len(questions))
+	}
+	q := questions[0]
+	if q.name != "userve.local." {
+		t.Errorf("expected name userve.local., got %q", q.name)
+	}
+	if q.qtype != dnsTypeA {
+		t.Errorf("expected type A, got %d", q.qtype)
+	}
+	if q.class&dnsQUBit == 0 {
+		t.Error("expected unicast-response bit to be preserved")
+	}
+}
+
+func TestParseDNSQuestionsRejectsMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"short":     {0, 1, 2},
+		"response":  {0, 0, 0x84, 0, 0, 0, 0, 0, 0, 0, 0, 0},
+		"truncated": buildDNSQuery("userve.local", dnsTypeA, dnsClassIN)[:16],
+		"loop":      {0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1},
+	}
+
+	for name, msg := range tests {
+		if _, err := parseDNSQuestions(msg); err == nil {
+			t.Errorf("%s: expected error", name)
+		}
+	}
+}
+
+func TestBuildMDNSResponse(t *testing.T) {
+	msg := buildMDNSResponse(42, "userve.local.", net.ParseIP("192.168.1.10"), false)
+
+	if id := binary.BigEndian.Uint16(msg[0:2]); id != 42 {
+		t.Errorf("expected id 42, got %d", id)
+	}
+	if answers := binary.BigEndian.Uint16(msg[6:8]); answers != 1 {
+		t.Errorf("expected 1 answer, got %d", answers)
+	}
+	name, off, err := readDNSName(msg, 12)
+	if err != nil {
+		t.Fatalf("readDNSName failed: %v", err)
+	}
+	if name != "userve.local." {
+		t.Errorf("expected answer name userve.local., got %q", name)
+	}
+	if ip := net.IP(msg[off+10:]); !ip.Equal(net.ParseIP("192.168.1.10")) {
+		t.Errorf("expected address 192.168.1.10, got %v", ip)
+	}
+}
+
+func TestBuildMDNSResponseLegacyUnicast(t *testing.T) {
+	msg := buildMDNSResponse(42, "userve.local.", net.ParseIP("192.168.1.10"), true)
+
+	if questions := binary.BigEndian.Uint16(msg[4:6]); questions != 1 {
+		t.Fatalf("expected question to be repeated, got %d questions", questions)
+	}
+	name, off, err := readDNSName(msg, 12)
+	if err != nil {
+		t.Fatalf("readDNSName failed: %v", err)
+	}
+	if name != "userve.local." {
+		t.Errorf("expected question name userve.local., got %q", name)
+	}
+	if name, _, err := readDNSName(msg, off+4); err != nil || name != "userve.local." {
+		t.Errorf("expected answer for userve.local., got %q (%v)", name, err)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// mediaTypeAliases are other MIME types clients send for archive formats
+var mediaTypeAliases = map[string]string{
+	"application/x-gzip":           "application/gzip",
+	"application/x-zip-compressed": "application/zip",
+}
+
+// negotiateFormat picks the format an archive is served in for r: the
+// extension of the URL, then the format query parameter, then the Accept
+// header. It returns p when none of them asks for another format.
+func negotiateFormat(p *archiveProvider, r *http.Request) *archiveProvider {
+	if v := p.variant(strings.TrimPrefix(r.URL.Path, "/")); v != nil {
+		return v
+	}
+	if format := r.URL.Query().Get("format"); format != "" {
+		if v := p.variant(p.dirName + "." + format); v != nil {
+			return v
+		}
+		return p
+	}
+
+	best, bestQ := p, 0.0
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		if alias, ok := mediaTypeAliases[mediaType]; ok {
+			mediaType = alias
+		}
+		q := 1.0
+		if s, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(s, 64); err != nil {
+				continue
+			}
+		}
+		if q <= bestQ {
+			continue
+		}
+		// Earlier types win ties
+		if mediaType == p.ContentType() {
+			best, bestQ = p, q
+			continue
+		}
+		for _, name := range p.variantNames() {
+			if v := p.variant(name); v.ContentType() == mediaType {
+				best, bestQ = v, q
+			}
+		}
+	}
+	return best
+}
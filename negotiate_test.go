@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestNegotiateFormat(t *testing.T) {
+	tests := []struct {
+		target string
+		accept string
+		want   string
+	}{
+		{"/", "", "share.tar.gz"},
+		{"/", "text/html,application/xhtml+xml,*/*;q=0.8", "share.tar.gz"},
+		{"/", "application/zip", "share.zip"},
+		{"/", "application/x-zip-compressed", "share.zip"},
+		{"/", "application/zip;q=0.5, application/x-tar", "share.tar"},
+		{"/", "application/gzip, application/zip", "share.tar.gz"},
+		{"/", "application/zip;q=0", "share.tar.gz"},
+		{"/?format=tar", "application/zip", "share.tar"},
+		{"/?format=rar", "application/zip", "share.tar.gz"},
+		{"/share.zip?format=tar", "", "share.zip"},
+	}
+
+	p := &archiveProvider{dirName: "share", format: ArchiveTarGz}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		if got := negotiateFormat(p, r).Filename(); got != tt.want {
+			t.Errorf("%s with Accept %q: got %s, want %s", tt.target, tt.accept, got, tt.want)
+		}
+	}
+}
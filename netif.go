@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// candidateAddr is a local address recipients may be able to reach
+type candidateAddr struct {
+	iface string
+	ip    net.IP
+	best  bool
+}
+
+// virtualIfacePrefixes name container and VM bridges, which are never
+// reachable from other machines
+var virtualIfacePrefixes = []string{"docker", "br-", "veth", "virbr", "vboxnet", "vmnet", "cni", "flannel", "podman", "lxc", "lxd"}
+
+// vpnIfacePrefixes name tunnel interfaces, which usually lead to a
+// different network than the recipient's
+var vpnIfacePrefixes = []string{"tun", "tap", "utun", "wg", "ppp", "tailscale", "zt", "ipsec"}
+
+// candidateAddrs lists the usable IPv4 and IPv6 addresses of all running
+// non-loopback interfaces, or only of the named interface, with the best
+// one marked
+func candidateAddrs(ifaceName string) ([]candidateAddr, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates []candidateAddr
+	found := false
+	for _, iface := range ifaces {
+		if ifaceName != "" && iface.Name != ifaceName {
+			continue
+		}
+		found = true
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			// IPv6 link-local addresses need a zone and are rarely what
+			// recipients can use, so they are only advertised when given via -i
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || (ipNet.IP.To4() == nil && ipNet.IP.IsLinkLocalUnicast()) {
+				continue
+			}
+			candidates = append(candidates, candidateAddr{iface: iface.Name, ip: ipNet.IP})
+		}
+	}
+	if ifaceName != "" && !found {
+		return nil, fmt.Errorf("network interface not found: %s", ifaceName)
+	}
+	if ifaceName != "" && len(candidates) == 0 {
+		return nil, fmt.Errorf("network interface %s has no usable address", ifaceName)
+	}
+
+	markBestCandidate(candidates, net.ParseIP(getLocalIP()))
+	return candidates, nil
+}
+
+// markBestCandidate flags the address most likely reachable by recipients:
+// a private IPv4 address on a physical interface, preferring the one used
+// for outbound traffic
+func markBestCandidate(candidates []candidateAddr, outbound net.IP) {
+	best, bestScore := -1, -1
+	for i, c := range candidates {
+		score := candidateScore(c)
+		if score > 0 && c.ip.Equal(outbound) {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	if best >= 0 {
+		candidates[best].best = true
+	}
+}
+
+func candidateScore(c candidateAddr) int {
+	switch {
+	case hasAnyPrefix(c.iface, virtualIfacePrefixes), c.ip.IsLinkLocalUnicast():
+		return 0
+	case hasAnyPrefix(c.iface, vpnIfacePrefixes):
+		return 1
+	case c.ip.To4() == nil:
+		// Unique local before global IPv6 addresses
+		if c.ip.IsPrivate() {
+			return 3
+		}
+		return 2
+	case c.ip.IsPrivate():
+		return 4
+	default:
+		return 2
+	}
+}
+
+// httpURL builds a URL for host and port, bracketing IPv6 addresses and
+// escaping their zone, e.g. http://[fe80::1%25en0]:8080/file
+func httpURL(host string, port int, path string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + strings.Replace(host, "%", "%25", 1) + "]"
+	}
+	return fmt.Sprintf("http://%s:%d/%s", host, port, path)
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, p := range prefixes {
+		if strings.HasPrefix(s, p) {
+			return true
+		}
+	}
+	return false
+}
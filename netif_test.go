@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestMarkBestCandidate(t *testing.T) {
+	tests := []struct {
+		name       string
+		candidates []candidateAddr
+		outbound   string
+		expected   string
+	}{
+		{
+			name: "outbound address on physical NIC",
+			candidates: []candidateAddr{
+				{iface: "eth0", ip: net.ParseIP("192.168.1.20")},
+				{iface: "wlan0", ip: net.ParseIP("192.168.2.30")},
+			},
+			outbound: "192.168.2.30",
+			expected: "192.168.2.30",
+		},
+		{
+			name: "VPN holds the default route",
+			candidates: []candidateAddr{
+				{iface: "tun0", ip: net.ParseIP("10.8.0.2")},
+				{iface: "docker0", ip: net.ParseIP("172.17.0.1")},
+				{iface: "en0", ip: net.ParseIP("192.168.1.20")},
+			},
+			outbound: "10.8.0.2",
+			expected: "192.168.1.20",
+		},
+		{
+			name: "IPv4 preferred over IPv6",
+			candidates: []candidateAddr{
+				{iface: "eth0", ip: net.ParseIP("2001:db8::20")},
+				{iface: "eth0", ip: net.ParseIP("fd00::20")},
+				{iface: "eth0", ip: net.ParseIP("192.168.1.20")},
+			},
+			outbound: "127.0.0.1",
+			expected: "192.168.1.20",
+		},
+		{
+			name: "IPv6-only network",
+			candidates: []candidateAddr{
+				{iface: "eth0", ip: net.ParseIP("2001:db8::20")},
+				{iface: "eth0", ip: net.ParseIP("fd00::20")},
+			},
+			outbound: "127.0.0.1",
+			expected: "fd00::20",
+		},
+		{
+			name: "only bridges and link-local",
+			candidates: []candidateAddr{
+				{iface: "br-1a2b", ip: net.ParseIP("172.18.0.1")},
+				{iface: "eth0", ip: net.ParseIP("169.254.10.1")},
+			},
+			outbound: "127.0.0.1",
+			expected: "172.18.0.1",
+		},
+	}
+
+	for _, tt := range tests {
+		markBestCandidate(tt.candidates, net.ParseIP(tt.outbound))
+		var best []string
+		for _, c := range tt.candidates {
+			if c.best {
+				best = append(best, c.ip.String())
+			}
+		}
+		if len(best) != 1 || best[0] != tt.expected {
+			t.Errorf("%s: best = %v, want %s", tt.name, best, tt.expected)
+		}
+	}
+}
+
+func TestCandidateAddrsUnknownInterface(t *testing.T) {
+	_, err := candidateAddrs("userve-no-such-iface0")
+	if err == nil || !strings.Contains(err.Error(), "not found") {
+		t.Errorf("expected interface not found error, got %v", err)
+	}
+}
+
+func TestHTTPURL(t *testing.T) {
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{"192.168.1.20", "http://192.168.1.20:8080/file.txt"},
+		{"userve.local", "http://userve.local:8080/file.txt"},
+		{"2001:db8::1", "http://[2001:db8::1]:8080/file.txt"},
+		{"fe80::1%en0", "http://[fe80::1%25en0]:8080/file.txt"},
+	}
+
+	for _, tt := range tests {
+		if result := httpURL(tt.host, 8080, "file.txt"); result != tt.expected {
+			t.Errorf("httpURL(%q) = %q, want %q", tt.host, result, tt.expected)
+		}
+	}
+}
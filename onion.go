@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultTorControl = "127.0.0.1:9051"
+
+// onionService is an ephemeral Tor onion service forwarding to the local
+// server. Tor removes it when the control connection closes.
+type onionService struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	serviceID string
+	once      sync.Once
+}
+
+// startOnionService asks the Tor daemon listening on controlAddr to publish
+// an onion service whose port 80 forwards to localAddr
+func startOnionService(controlAddr, localAddr string) (*onionService, error) {
+	conn, err := net.DialTimeout("tcp", controlAddr, 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to Tor control port: %v", err)
+	}
+	s := &onionService{conn: conn, reader: bufio.NewReader(conn)}
+
+	if err := s.authenticate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	lines, err := s.command("ADD_ONION NEW:ED25519-V3 Flags=DiscardPK Port=80," + localAddr)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot create onion service: %v", err)
+	}
+	for _, line := range lines {
+		if id, ok := strings.CutPrefix(line, "ServiceID="); ok {
+			s.serviceID = id
+		}
+	}
+	if s.serviceID == "" {
+		conn.Close()
+		return nil, fmt.Errorf("Tor did not return an onion service ID")
+	}
+	return s, nil
+}
+
+// authenticate uses the first method offered by PROTOCOLINFO that we
+// support: no authentication, the cookie file or TOR_CONTROL_PASSWD
+func (s *onionService) authenticate() error {
+	lines, err := s.command("PROTOCOLINFO 1")
+	if err != nil {
+		return fmt.Errorf("Tor PROTOCOLINFO failed: %v", err)
+	}
+
+	var methods []string
+	var cookieFile string
+	for _, line := range lines {
+		rest, ok := strings.CutPrefix(line, "AUTH METHODS=")
+		if !ok {
+			continue
+		}
+		list, params, _ := strings.Cut(rest, " ")
+		methods = strings.Split(list, ",")
+		if v, ok := strings.CutPrefix(params, "COOKIEFILE="); ok {
+			if cookieFile, err = strconv.Unquote(v); err != nil {
+				return fmt.Errorf("invalid Tor cookie file path %s", v)
+			}
+		}
+	}
+
+	auth := ""
+	for _, m := range methods {
+		switch m {
+		case "NULL":
+			auth = "AUTHENTICATE"
+		case "COOKIE":
+			cookie, err := os.ReadFile(cookieFile)
+			if err != nil {
+				return fmt.Errorf("cannot read Tor auth cookie: %v", err)
+			}
+			auth = "AUTHENTICATE " + hex.EncodeToString(cookie)
+		case "HASHEDPASSWORD":
+			if pw := os.Getenv("TOR_CONTROL_PASSWD"); pw != "" {
+				auth = "AUTHENTICATE " + strconv.Quote(pw)
+			}
+		}
+		if auth != "" {
+			break
+		}
+	}
+	if auth == "" {
+		return fmt.Errorf("no supported Tor authentication method among %s (set TOR_CONTROL_PASSWD for password auth)", strings.Join(methods, ", "))
+	}
+
+	if _, err := s.command(auth); err != nil {
+		return fmt.Errorf("Tor authentication failed: %v", err)
+	}
+	return nil
+}
+
+// command sends a control command and returns the reply lines without
+// their status prefix
+func (s *onionService) command(cmd string) ([]string, error) {
+	s.conn.SetDeadline(time.Now().Add(30 * time.Second))
+	defer s.conn.SetDeadline(time.Time{})
+
+	if _, err := fmt.Fprintf(s.conn, "%s\r\n", cmd); err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) < 4 {
+			return nil, fmt.Errorf("malformed reply %q", line)
+		}
+		code, sep, text := line[:3], line[3], line[4:]
+		if code != "250" {
+			return nil, fmt.Errorf("%s %s", code, text)
+		}
+		if sep == '+' {
+			// Data reply, terminated by a line containing a single dot
+			for {
+				data, err := s.reader.ReadString('\n')
+				if err != nil {
+					return nil, err
+				}
+				if strings.TrimRight(data, "\r\n") == "." {
+					break
+				}
+			}
+		}
+		lines = append(lines, text)
+		if sep == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+func (s *onionService) Name() string {
+	return "Onion"
+}
+
+func (s *onionService) URL() string {
+	return "http://" + s.serviceID + ".onion"
+}
+
+func (s *onionService) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.command("DEL_ONION " + s.serviceID)
+		err = s.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeTorControl answers control commands with the replies in script,
+// keyed by command prefix, and records the commands it receives
+func fakeTorControl(t *testing.T, script map[string]string) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	commands := make(chan string, 16)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(commands)
+				return
+			}
+			cmd := strings.TrimRight(line, "\r\n")
+			commands <- cmd
+			reply := "510 Unrecognized command\r\n"
+			for prefix, r := range script {
+				if strings.HasPrefix(cmd, prefix) {
+					reply = r
+				}
+			}
+			fmt.Fprint(conn, reply)
+		}
+	}()
+	return ln.Addr().String(), commands
+}
+
+func TestStartOnionServiceCookieAuth(t *testing.T) {
+	cookieFile := filepath.Join(t.TempDir(), "control_auth_cookie")
+	if err := os.WriteFile(cookieFile, []byte{0xde, 0xad, 0xbe, 0xef}, 0600); err != nil {
+		t.Fatalf("failed to write cookie: %v", err)
+	}
+
+	addr, commands := fakeTorControl(t, map[string]string{
+		"PROTOCOLINFO":              fmt.Sprintf("250-PROTOCOLINFO 1\r\n250-AUTH METHODS=COOKIE,SAFECOOKIE COOKIEFILE=%q\r\n250-VERSION Tor=\"0.4.8.10\"\r\n250 OK\r\n", cookieFile),
+		"AUTHENTICATE deadbeef":     "250 OK\r\n",
+		"ADD_ONION NEW:ED25519-V3 ": "250-ServiceID=exampleonionaddress\r\n250 OK\r\n",
+		"DEL_ONION":                 "250 OK\r\n",
+	})
+
+	s, err := startOnionService(addr, "127.0.0.1:8080")
+	if err != nil {
+		t.Fatalf("startOnionService failed: %v", err)
+	}
+	if url := s.URL(); url != "http://exampleonionaddress.onion" {
+		t.Errorf("expected onion URL, got %q", url)
+	}
+	s.Close()
+
+	var got []string
+	for cmd := range commands {
+		got = append(got, cmd)
+	}
+	want := []string{
+		"PROTOCOLINFO 1",
+		"AUTHENTICATE deadbeef",
+		"ADD_ONION NEW:ED25519-V3 Flags=DiscardPK Port=80,127.0.0.1:8080",
+		"DEL_ONION exampleonionaddress",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("unexpected control commands:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+func TestStartOnionServiceErrors(t *testing.T) {
+	addr, _ := fakeTorControl(t, map[string]string{
+		"PROTOCOLINFO": "250-AUTH METHODS=HASHEDPASSWORD\r\n250 OK\r\n",
+	})
+	t.Setenv("TOR_CONTROL_PASSWD", "")
+	if _, err := startOnionService(addr, "127.0.0.1:8080"); err == nil || !strings.Contains(err.Error(), "TOR_CONTROL_PASSWD") {
+		t.Errorf("expected unsupported authentication error, got %v", err)
+	}
+
+	addr, _ = fakeTorControl(t, map[string]string{
+		"PROTOCOLINFO": "250-AUTH METHODS=NULL\r\n250 OK\r\n",
+		"AUTHENTICATE": "250 OK\r\n",
+		"ADD_ONION":    "512 Invalid argument\r\n",
+	})
+	if _, err := startOnionService(addr, "127.0.0.1:8080"); err == nil || !strings.Contains(err.Error(), "Invalid argument") {
+		t.Errorf("expected ADD_ONION error, got %v", err)
+	}
+}
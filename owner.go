@@ -0,0 +1,21 @@
+package main
+
+import "archive/tar"
+
+// Ownership modes for tar entries
+const (
+	ownerNumeric   = "numeric"   // --numeric-owner: IDs without account names
+	ownerAnonymous = "anonymous" // --anonymize-owner: root, without names
+)
+
+// setOwner rewrites the ownership of a tar entry for mode; an empty mode
+// keeps the local IDs and account names
+func setOwner(header *tar.Header, mode string) {
+	switch mode {
+	case ownerAnonymous:
+		header.Uid, header.Gid = 0, 0
+		fallthrough
+	case ownerNumeric:
+		header.Uname, header.Gname = "", ""
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"archive/tar"
+	"testing"
+)
+
+func TestSetOwner(t *testing.T) {
+	tests := []struct {
+		mode     string
+		uid, gid int
+		names    string
+	}{
+		{"", 1000, 100, "alice:users"},
+		{ownerNumeric, 1000, 100, ":"},
+		{ownerAnonymous, 0, 0, ":"},
+	}
+
+	for _, tt := range tests {
+		header := &tar.Header{Uid: 1000, Gid: 100, Uname: "alice", Gname: "users"}
+		setOwner(header, tt.mode)
+		if header.Uid != tt.uid || header.Gid != tt.gid || header.Uname+":"+header.Gname != tt.names {
+			t.Errorf("mode %q: got %d/%d %s:%s", tt.mode, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+	}
+
+	if err := run([]string{"-a", "zip", "--anonymize-owner", t.TempDir()}); err == nil || err.Error() != "--anonymize-owner needs a tar format" {
+		t.Errorf("expected --anonymize-owner to need a tar format, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// headerTimeout bounds how long a client may take to send a request's
+// headers, against slowloris clients trickling them to hold a connection
+const headerTimeout = 10 * time.Second
+
+// defaultMaxPending is the default for --max-pending
+const defaultMaxPending = 64
+
+// pendingLimit closes new connections while too many others haven't sent
+// a request yet, so clients holding sockets open can't use up the file
+// descriptors of a long-running share. Connections busy with a download
+// or idle between requests don't count.
+type pendingLimit struct {
+	max int
+
+	mu      sync.Mutex
+	pending map[net.Conn]bool
+}
+
+func newPendingLimit(max int) *pendingLimit {
+	return &pendingLimit{max: max, pending: make(map[net.Conn]bool)}
+}
+
+// connState is the server's ConnState hook
+func (p *pendingLimit) connState(c net.Conn, state http.ConnState) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if state != http.StateNew {
+		delete(p.pending, c)
+		return
+	}
+	if len(p.pending) >= p.max {
+		c.Close()
+		logDebug("connection_refused", logFields{"client": c.RemoteAddr().String(), "pending": len(p.pending)}, "Closed connection from %s: %d connections haven't sent a request yet", c.RemoteAddr(), len(p.pending))
+		return
+	}
+	p.pending[c] = true
+}
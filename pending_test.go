@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPendingLimit(t *testing.T) {
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "ok")
+	}))
+	limit := newPendingLimit(2)
+	srv.Config.ConnState = limit.connState
+	srv.Start()
+	defer srv.Close()
+
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return conn
+	}
+	waitPending := func(n int) {
+		for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			limit.mu.Lock()
+			pending := len(limit.pending)
+			limit.mu.Unlock()
+			if pending == n {
+				return
+			}
+		}
+		t.Fatalf("expected %d pending connections", n)
+	}
+	closed := func(conn net.Conn, wait time.Duration) bool {
+		conn.SetReadDeadline(time.Now().Add(wait))
+		_, err := conn.Read(make([]byte, 1))
+		return err == io.EOF
+	}
+
+	first := dial()
+	waitPending(1)
+	dial()
+	waitPending(2)
+	if third := dial(); !closed(third, 2*time.Second) {
+		t.Error("expected a third pending connection to be closed")
+	}
+
+	// A connection that sent its request no longer counts
+	fmt.Fprint(first, "GET / HTTP/1.1\r\nHost: x\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(first), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	waitPending(1)
+	fourth := dial()
+	waitPending(2)
+	if closed(fourth, 200*time.Millisecond) {
+		t.Error("expected a connection to be accepted once another sent a request")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"runtime"
+)
+
+// pgzipBlockSize is the amount of input each worker compresses at a time
+const pgzipBlockSize = 1 << 20
+
+// pgzipDictSize is the deflate window; each block is primed with this much
+// of the input before it, so splitting costs almost no compression ratio
+const pgzipDictSize = 32 << 10
+
+// pgzipWriter is a gzip writer that compresses blocks of input on all cores,
+// like pigz. Each block is deflated independently and ends byte-aligned
+// with a sync flush, so the outputs concatenate into one ordinary gzip
+// member that any gzip reader can decompress.
+type pgzipWriter struct {
+	w       io.Writer
+	level   int
+	block   []byte
+	dict    []byte
+	pending []chan pgzipResult
+	workers int
+	crc     uint32
+	size    uint32
+	started bool
+	err     error
+}
+
+type pgzipResult struct {
+	data []byte
+	err  error
+}
+
+func newPgzipWriter(w io.Writer, level int) (*pgzipWriter, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, fmt.Errorf("invalid compression level %d", level)
+	}
+	return &pgzipWriter{
+		w:       w,
+		level:   level,
+		block:   make([]byte, 0, pgzipBlockSize),
+		workers: runtime.GOMAXPROCS(0),
+	}, nil
+}
+
+func (z *pgzipWriter) Write(b []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	z.crc = crc32.Update(z.crc, crc32.IEEETable, b)
+	z.size += uint32(len(b))
+
+	n := len(b)
+	for len(b) > 0 {
+		k := copy(z.block[len(z.block):cap(z.block)], b)
+		z.block = z.block[:len(z.block)+k]
+		b = b[k:]
+		if len(z.block) == cap(z.block) {
+			if err := z.dispatch(false); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return n, nil
+}
+
+// dispatch hands the current block to a worker, first writing out the
+// oldest finished block if all workers are busy
+func (z *pgzipWriter) dispatch(last bool) error {
+	result := make(chan pgzipResult, 1)
+	go compressBlock(z.block, z.dict, z.level, last, result)
+	z.pending = append(z.pending, result)
+
+	// The next block is primed with the end of this one
+	tail := z.block[max(0, len(z.block)-pgzipDictSize):]
+	z.dict = append([]byte(nil), tail...)
+	z.block = make([]byte, 0, pgzipBlockSize)
+
+	for len(z.pending) >= z.workers || (last && len(z.pending) > 0) {
+		if err := z.writeOldest(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (z *pgzipWriter) writeOldest() error {
+	res := <-z.pending[0]
+	z.pending = z.pending[1:]
+	if res.err != nil {
+		z.err = res.err
+		return res.err
+	}
+	if !z.started {
+		// Header: deflate, no flags or timestamp, unknown OS
+		if _, err := z.w.Write([]byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}); err != nil {
+			z.err = err
+			return err
+		}
+		z.started = true
+	}
+	if _, err := z.w.Write(res.data); err != nil {
+		z.err = err
+		return err
+	}
+	return nil
+}
+
+func compressBlock(block, dict []byte, level int, last bool, result chan<- pgzipResult) {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriterDict(&buf, level, dict)
+	if err != nil {
+		result <- pgzipResult{err: err}
+		return
+	}
+	if _, err := fw.Write(block); err != nil {
+		result <- pgzipResult{err: err}
+		return
+	}
+	// Only the last block may carry the final-block bit
+	if last {
+		err = fw.Close()
+	} else {
+		err = fw.Flush()
+	}
+	result <- pgzipResult{data: buf.Bytes(), err: err}
+}
+
+// Close compresses the remaining input and writes the gzip trailer
+func (z *pgzipWriter) Close() error {
+	if z.err != nil {
+		return z.err
+	}
+	if err := z.dispatch(true); err != nil {
+		return err
+	}
+	trailer := make([]byte, 8)
+	binary.LittleEndian.PutUint32(trailer[0:], z.crc)
+	binary.LittleEndian.PutUint32(trailer[4:], z.size)
+	_, err := z.w.Write(trailer)
+	z.err = io.ErrClosedPipe
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"os/exec"
+	"testing"
+)
+
+func TestPgzipRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	text := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 80000)
+	noise := make([]byte, 3*pgzipBlockSize+123)
+	rng.Read(noise)
+
+	tests := []struct {
+		name  string
+		input []byte
+		level int
+	}{
+		{"empty", nil, -1},
+		{"small", []byte("hello"), -1},
+		{"exact block", text[:pgzipBlockSize], 6},
+		{"several blocks", text, 1},
+		{"incompressible", noise, 9},
+		{"stored", text, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			zw, err := newPgzipWriter(&buf, tt.level)
+			if err != nil {
+				t.Fatalf("newPgzipWriter failed: %v", err)
+			}
+			// Odd-sized writes cross block boundaries
+			for rest := tt.input; len(rest) > 0; {
+				n := min(len(rest), 70001)
+				if _, err := zw.Write(rest[:n]); err != nil {
+					t.Fatalf("Write failed: %v", err)
+				}
+				rest = rest[n:]
+			}
+			if err := zw.Close(); err != nil {
+				t.Fatalf("Close failed: %v", err)
+			}
+			compressed := buf.Bytes()
+
+			gr, err := gzip.NewReader(bytes.NewReader(compressed))
+			if err != nil {
+				t.Fatalf("failed to read gzip header: %v", err)
+			}
+			// A single member, not one per block
+			gr.Multistream(false)
+			got, err := io.ReadAll(gr)
+			if err != nil {
+				t.Fatalf("failed to decompress: %v", err)
+			}
+			if !bytes.Equal(got, tt.input) {
+				t.Fatalf("decompressed %d bytes, want %d", len(got), len(tt.input))
+			}
+			if tt.name == "several blocks" && len(compressed) > len(tt.input)/20 {
+				t.Errorf("expected repetitive text to compress well, got %d bytes", len(compressed))
+			}
+
+			if _, err := exec.LookPath("gzip"); err == nil {
+				cmd := exec.Command("gzip", "-t")
+				cmd.Stdin = bytes.NewReader(compressed)
+				if out, err := cmd.CombinedOutput(); err != nil {
+					t.Errorf("gzip -t rejected the stream: %v: %s", err, out)
+				}
+			}
+		})
+	}
+
+	if _, err := newPgzipWriter(io.Discard, 10); err == nil {
+		t.Error("expected error for invalid level")
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// portMapping is a port forwarded by the local router
+type portMapping interface {
+	// ExternalIP returns the router's public address
+	ExternalIP() net.IP
+	// ExternalPort returns the public port forwarded to us
+	ExternalPort() int
+	// Close removes the mapping from the router
+	Close() error
+}
+
+// mapPort asks the router to forward a public TCP port to localIP:port,
+// trying NAT-PMP first and falling back to UPnP IGD
+func mapPort(localIP net.IP, port int) (portMapping, error) {
+	var errs []string
+
+	if gw, err := defaultGateway(); err != nil {
+		errs = append(errs, fmt.Sprintf("NAT-PMP: %v", err))
+	} else {
+		m, err := mapPortNATPMP(&net.UDPAddr{IP: gw, Port: natpmpPort}, port)
+		if err == nil {
+			return m, nil
+		}
+		errs = append(errs, fmt.Sprintf("NAT-PMP: %v", err))
+	}
+
+	m, err := mapPortUPnP(localIP, port)
+	if err == nil {
+		return m, nil
+	}
+	errs = append(errs, fmt.Sprintf("UPnP: %v", err))
+
+	return nil, fmt.Errorf("cannot map port %d: %s", port, strings.Join(errs, "; "))
+}
+
+// defaultGateway returns the IPv4 address of the default router
+func defaultGateway() (net.IP, error) {
+	switch runtime.GOOS {
+	case "linux":
+		f, err := os.Open("/proc/net/route")
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		return parseLinuxRoutes(f)
+	case "darwin", "freebsd", "openbsd", "netbsd":
+		out, err := exec.Command("route", "-n", "get", "default").Output()
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range strings.Split(string(out), "\n") {
+			if k, v, ok := strings.Cut(strings.TrimSpace(line), ":"); ok && k == "gateway" {
+				if ip := net.ParseIP(strings.TrimSpace(v)); ip != nil {
+					return ip, nil
+				}
+			}
+		}
+		return nil, errors.New("no default gateway")
+	default:
+		return nil, fmt.Errorf("gateway discovery not supported on %s", runtime.GOOS)
+	}
+}
+
+// parseLinuxRoutes finds the default gateway in /proc/net/route format
+func parseLinuxRoutes(r io.Reader) (net.IP, error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		raw, err := hex.DecodeString(fields[2])
+		if err != nil || len(raw) != 4 {
+			continue
+		}
+		// Addresses are in host byte order, which is little-endian here
+		return net.IPv4(raw[3], raw[2], raw[1], raw[0]), nil
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, errors.New("no default gateway")
+}
+
+const (
+	natpmpPort     = 5351
+	natpmpLifetime = 3600 // seconds; renewed at half-life
+)
+
+// natpmpMapping is a TCP mapping created via NAT-PMP (RFC 6886)
+type natpmpMapping struct {
+	gateway      *net.UDPAddr
+	internalPort int
+	externalPort int
+	externalIP   net.IP
+	stop         chan struct{}
+	once         sync.Once
+}
+
+func mapPortNATPMP(gateway *net.UDPAddr, port int) (*natpmpMapping, error) {
+	resp, err := natpmpRequest(gateway, []byte{0, 0}, 12)
+	if err != nil {
+		return nil, err
+	}
+	m := &natpmpMapping{
+		gateway:      gateway,
+		internalPort: port,
+		externalIP:   net.IP(resp[8:12]),
+		stop:         make(chan struct{}),
+	}
+
+	if m.externalPort, err = m.request(port, natpmpLifetime); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		ticker := time.NewTicker(natpmpLifetime / 2 * time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.request(m.externalPort, natpmpLifetime)
+			case <-m.stop:
+				return
+			}
+		}
+	}()
+	return m, nil
+}
+
+// request creates, renews or (with zero lifetime) deletes the mapping and
+// returns the external port granted by the gateway
+func (m *natpmpMapping) request(externalPort int, lifetime uint32) (int, error) {
+	req := make([]byte, 12)
+	req[1] = 2 // map TCP
+	binary.BigEndian.PutUint16(req[4:6], uint16(m.internalPort))
+	binary.BigEndian.PutUint16(req[6:8], uint16(externalPort))
+	binary.BigEndian.PutUint32(req[8:12], lifetime)
+
+	resp, err := natpmpRequest(m.gateway, req, 16)
+	if err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint16(resp[10:12])), nil
+}
+
+func (m *natpmpMapping) ExternalIP() net.IP { return m.externalIP }
+func (m *natpmpMapping) ExternalPort() int  { return m.externalPort }
+
+func (m *natpmpMapping) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.stop)
+		_, err = m.request(0, 0)
+	})
+	return err
+}
+
+// natpmpRequest sends req to the gateway, retrying with exponential
+// backoff, and validates the response header
+func natpmpRequest(gateway *net.UDPAddr, req []byte, respLen int) ([]byte, error) {
+	conn, err := net.DialUDP("udp4", nil, gateway)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+	timeout := 250 * time.Millisecond
+	for attempt := 0; attempt < 4; attempt++ {
+		if _, err := conn.Write(req); err != nil {
+			return nil, err
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		n, err := conn.Read(buf)
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				timeout *= 2
+				continue
+			}
+			return nil, err
+		}
+		if n < respLen || buf[0] != 0 || buf[1] != req[1]+128 {
+			continue
+		}
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			return nil, fmt.Errorf("gateway returned result code %d", code)
+		}
+		return buf[:n], nil
+	}
+	return nil, errors.New("no response from gateway")
+}
+
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// upnpMapping is a TCP mapping created via a UPnP Internet Gateway Device
+type upnpMapping struct {
+	controlURL string
+	service    string
+	port       int
+	externalIP net.IP
+	once       sync.Once
+}
+
+func mapPortUPnP(localIP net.IP, port int) (*upnpMapping, error) {
+	location, err := discoverIGD(3 * time.Second)
+	if err != nil {
+		return nil, err
+	}
+	controlURL, service, err := fetchIGDControl(location)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &upnpMapping{controlURL: controlURL, service: service, port: port}
+
+	resp, err := m.soap("GetExternalIPAddress", nil)
+	if err != nil {
+		return nil, err
+	}
+	if m.externalIP = net.ParseIP(resp["NewExternalIPAddress"]); m.externalIP == nil {
+		return nil, errors.New("router did not report an external address")
+	}
+
+	_, err = m.soap("AddPortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(port)},
+		{"NewProtocol", "TCP"},
+		{"NewInternalPort", strconv.Itoa(port)},
+		{"NewInternalClient", localIP.String()},
+		{"NewEnabled", "1"},
+		{"NewPortMappingDescription", "userve"},
+		{"NewLeaseDuration", "0"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *upnpMapping) ExternalIP() net.IP { return m.externalIP }
+func (m *upnpMapping) ExternalPort() int  { return m.port }
+
+func (m *upnpMapping) Close() error {
+	var err error
+	m.once.Do(func() {
+		_, err = m.soap("DeletePortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(m.port)},
+			{"NewProtocol", "TCP"},
+		})
+	})
+	return err
+}
+
+// soap invokes an action on the WAN connection service and returns the
+// leaf elements of the response
+func (m *upnpMapping) soap(action string, args [][2]string) (map[string]string, error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?><s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/"><s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, action, m.service)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, action)
+
+	req, err := http.NewRequest("POST", m.controlURL, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, m.service, action))
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	values, err := soapValues(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("%s: invalid response: %v", action, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		if desc := values["errorDescription"]; desc != "" {
+			return nil, fmt.Errorf("%s: %s", action, desc)
+		}
+		return nil, fmt.Errorf("%s: %s", action, resp.Status)
+	}
+	return values, nil
+}
+
+// soapValues returns the leaf elements of a SOAP message by local name,
+// which is all that the actions of UPnP services carry
+func soapValues(r io.Reader) (map[string]string, error) {
+	values := make(map[string]string)
+	dec := xml.NewDecoder(r)
+	var current string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return values, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			current = t.Name.Local
+		case xml.CharData:
+			if current != "" {
+				values[current] += string(t)
+			}
+		case xml.EndElement:
+			current = ""
+		}
+	}
+}
+
+// discoverIGD searches the network for an Internet Gateway Device via SSDP
+// and returns the URL of its device description
+func discoverIGD(timeout time.Duration) (string, error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	search := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: 239.255.255.250:1900\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"MX: 2\r\n" +
+		"ST: urn:schemas-upnp-org:device:InternetGatewayDevice:1\r\n\r\n"
+	if _, err := conn.WriteToUDP([]byte(search), ssdpAddr); err != nil {
+		return "", err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return "", errors.New("no UPnP gateway found")
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if location := resp.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// igdDevice is the subset of a UPnP device description we need
+type igdDevice struct {
+	URLBase string `xml:"URLBase"`
+	Device  struct {
+		Services []igdService `xml:"serviceList>service"`
+		Devices  []igdNode    `xml:"deviceList>device"`
+	} `xml:"device"`
+}
+
+type igdNode struct {
+	Services []igdService `xml:"serviceList>service"`
+	Devices  []igdNode    `xml:"deviceList>device"`
+}
+
+type igdService struct {
+	ServiceType string `xml:"serviceType"`
+	ControlURL  string `xml:"controlURL"`
+}
+
+// fetchIGDControl loads a device description and returns the absolute
+// control URL and type of its WAN connection service
+func fetchIGDControl(location string) (string, string, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(location)
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+
+	var desc igdDevice
+	if err := xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return "", "", fmt.Errorf("invalid device description: %v", err)
+	}
+
+	svc, ok := findWANService(igdNode{Services: desc.Device.Services, Devices: desc.Device.Devices})
+	if !ok {
+		return "", "", errors.New("gateway has no WAN connection service")
+	}
+
+	base := desc.URLBase
+	if base == "" {
+		base = location
+	}
+	baseURL, err := url.Parse(base)
+	if err != nil {
+		return "", "", err
+	}
+	ref, err := url.Parse(svc.ControlURL)
+	if err != nil {
+		return "", "", err
+	}
+	return baseURL.ResolveReference(ref).String(), svc.ServiceType, nil
+}
+
+func findWANService(node igdNode) (igdService, bool) {
+	for _, svc := range node.Services {
+		if strings.Contains(svc.ServiceType, ":WANIPConnection:") || strings.Contains(svc.ServiceType, ":WANPPPConnection:") {
+			return svc, true
+		}
+	}
+	for _, child := range node.Devices {
+		if svc, ok := findWANService(child); ok {
+			return svc, true
+		}
+	}
+	return igdService{}, false
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseLinuxRoutes(t *testing.T) {
+	routes := `Iface	Destination	Gateway 	Flags	RefCnt	Use	Metric	Mask		MTU	Window	IRTT
+docker0	000011AC	00000000	0001	0	0	0	0000FFFF	0	0	0
+eth0	00000000	0101A8C0	0003	0	0	100	00000000	0	0	0
+`
+	ip, err := parseLinuxRoutes(strings.NewReader(routes))
+	if err != nil {
+		t.Fatalf("parseLinuxRoutes failed: %v", err)
+	}
+	if !ip.Equal(net.ParseIP("192.168.1.1")) {
+		t.Errorf("expected gateway 192.168.1.1, got %v", ip)
+	}
+
+	if _, err := parseLinuxRoutes(strings.NewReader("Iface\tDestination\tGateway\n")); err == nil {
+		t.Error("expected error when there is no default route")
+	}
+}
+
+func TestMapPortNATPMP(t *testing.T) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	// Fake gateway granting external port 40000 for every mapping
+	requests := make(chan []byte, 4)
+	go func() {
+		buf := make([]byte, 16)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			req := append([]byte(nil), buf[:n]...)
+			requests <- req
+			resp := make([]byte, 16)
+			resp[1] = req[1] + 128
+			if req[1] == 0 {
+				copy(resp[8:12], net.IPv4(203, 0, 113, 7).To4())
+				conn.WriteToUDP(resp[:12], src)
+				continue
+			}
+			copy(resp[8:10], req[4:6])
+			binary.BigEndian.PutUint16(resp[10:12], 40000)
+			copy(resp[12:16], req[8:12])
+			conn.WriteToUDP(resp, src)
+		}
+	}()
+
+	m, err := mapPortNATPMP(conn.LocalAddr().(*net.UDPAddr), 8080)
+	if err != nil {
+		t.Fatalf("mapPortNATPMP failed: %v", err)
+	}
+	if !m.ExternalIP().Equal(net.ParseIP("203.0.113.7")) {
+		t.Errorf("expected external IP 203.0.113.7, got %v", m.ExternalIP())
+	}
+	if m.ExternalPort() != 40000 {
+		t.Errorf("expected external port 40000, got %d", m.ExternalPort())
+	}
+
+	<-requests // external address
+	mapReq := <-requests
+	if port := binary.BigEndian.Uint16(mapReq[4:6]); port != 8080 {
+		t.Errorf("expected internal port 8080 in request, got %d", port)
+	}
+
+	if err := m.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if lifetime := binary.BigEndian.Uint32((<-requests)[8:12]); lifetime != 0 {
+		t.Errorf("expected delete request with zero lifetime, got %d", lifetime)
+	}
+}
+
+func TestUPnPMapping(t *testing.T) {
+	var actions []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList><device>
+      <deviceList><device>
+        <serviceList><service>
+          <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+          <controlURL>/ctl/IPConn</controlURL>
+        </service></serviceList>
+      </device></deviceList>
+    </device></deviceList>
+  </device>
+</root>`)
+	})
+	mux.HandleFunc("/ctl/IPConn", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		action := r.Header.Get("SOAPAction")
+		actions = append(actions, action)
+		if strings.Contains(action, "GetExternalIPAddress") {
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:GetExternalIPAddressResponse><NewExternalIPAddress>198.51.100.2</NewExternalIPAddress></u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+			return
+		}
+		if strings.Contains(action, "AddPortMapping") && !strings.Contains(string(body), "<NewInternalClient>192.168.1.20</NewInternalClient>") {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope><s:Body><s:Fault><detail><UPnPError><errorCode>402</errorCode><errorDescription>Invalid Args</errorDescription></UPnPError></detail></s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		fmt.Fprint(w, `<s:Envelope><s:Body/></s:Envelope>`)
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	controlURL, service, err := fetchIGDControl(srv.URL + "/desc.xml")
+	if err != nil {
+		t.Fatalf("fetchIGDControl failed: %v", err)
+	}
+	if controlURL != srv.URL+"/ctl/IPConn" {
+		t.Errorf("expected control URL %s/ctl/IPConn, got %s", srv.URL, controlURL)
+	}
+
+	m := &upnpMapping{controlURL: controlURL, service: service, port: 8080}
+	resp, err := m.soap("GetExternalIPAddress", nil)
+	if err != nil {
+		t.Fatalf("GetExternalIPAddress failed: %v", err)
+	}
+	if ip := resp["NewExternalIPAddress"]; ip != "198.51.100.2" {
+		t.Errorf("expected external IP 198.51.100.2, got %q", ip)
+	}
+
+	if _, err := m.soap("AddPortMapping", [][2]string{{"NewInternalClient", "10.0.0.1"}}); err == nil || !strings.Contains(err.Error(), "Invalid Args") {
+		t.Errorf("expected UPnP fault to be reported, got %v", err)
+	}
+	if _, err := m.soap("AddPortMapping", [][2]string{{"NewInternalClient", "192.168.1.20"}}); err != nil {
+		t.Errorf("AddPortMapping failed: %v", err)
+	}
+	if err := m.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+	if last := actions[len(actions)-1]; !strings.Contains(last, "#DeletePortMapping") {
+		t.Errorf("expected DeletePortMapping on close, got %s", last)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// probePaths are fetched by browsers and crawlers on their own, e.g. the
+// favicon when the download link is opened. Since the download is served
+// at any path, they would otherwise take a download from the limit.
+var probePaths = []string{"/favicon.ico", "/robots.txt", "/apple-touch-icon", "/.well-known/"}
+
+// previewAgents appear in the User-Agent of bots that fetch a link posted
+// in a chat to show a preview of it; Teams previews come as SkypeUriPreview
+var previewAgents = []string{
+	"slackbot", "skypeuripreview", "discordbot", "telegrambot", "whatsapp",
+	"twitterbot", "facebookexternalhit", "linkedinbot", "mattermost", "iframely",
+	"embedly", "redditbot", "applebot", "googlebot", "bingbot",
+}
+
+// isProbePath reports whether path is one browsers and crawlers request
+// unasked
+func isProbePath(path string) bool {
+	for _, p := range probePaths {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// unattended returns why a request was made by software rather than
+// someone who opened the link, or "" if it wasn't: a link-preview bot or
+// a browser prefetching a page it only guesses will be visited
+func unattended(r *http.Request) string {
+	if r.Header.Get("Sec-Purpose") != "" || r.Header.Get("Purpose") == "prefetch" || r.Header.Get("X-Moz") == "prefetch" {
+		return "prefetch"
+	}
+	agent := strings.ToLower(r.UserAgent())
+	for _, bot := range previewAgents {
+		if strings.Contains(agent, bot) {
+			return "link preview"
+		}
+	}
+	return ""
+}
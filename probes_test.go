@@ -0,0 +1,86 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestUnattended(t *testing.T) {
+	tests := []struct {
+		header string
+		value  string
+		want   string
+	}{
+		{"User-Agent", "Mozilla/5.0 (X11; Linux x86_64) Firefox/128.0", ""},
+		{"User-Agent", "Slackbot-LinkExpanding 1.0 (+https://api.slack.com/robots)", "link preview"},
+		{"User-Agent", "Mozilla/5.0 (Windows NT 6.1; WOW64) SkypeUriPreview Preview/0.5", "link preview"},
+		{"User-Agent", "Mozilla/5.0 (compatible; Discordbot/2.0; +https://discordapp.com)", "link preview"},
+		{"Sec-Purpose", "prefetch", "prefetch"},
+		{"Purpose", "prefetch", "prefetch"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/file.txt", nil)
+		r.Header.Set(tt.header, tt.value)
+		if got := unattended(r); got != tt.want {
+			t.Errorf("%s: %s: expected %q, got %q", tt.header, tt.value, tt.want, got)
+		}
+	}
+}
+
+func TestProbesDontCount(t *testing.T) {
+	buf := captureEvents(t, logText)
+	path := filepath.Join(t.TempDir(), "file.txt")
+	os.WriteFile(path, []byte("content"), 0644)
+
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &fileProvider{filePath: path, fileName: "file.txt", fileSize: 7},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+		maxDownloads:     1,
+	}
+
+	probes := []struct {
+		method string
+		path   string
+		agent  string
+		status int
+	}{
+		{"GET", "/favicon.ico", "", http.StatusNotFound},
+		{"GET", "/apple-touch-icon-precomposed.png", "", http.StatusNotFound},
+		{"GET", "/file.txt", "TelegramBot (like TwitterBot)", http.StatusOK},
+		{"HEAD", "/file.txt", "", http.StatusOK},
+	}
+	for _, p := range probes {
+		r := httptest.NewRequest(p.method, p.path, nil)
+		r.Header.Set("User-Agent", p.agent)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, r)
+		if rec.Code != p.status {
+			t.Errorf("%s %s: expected status %d, got %d", p.method, p.path, p.status, rec.Code)
+		}
+		if p.status == http.StatusOK && rec.Body.Len() != 0 {
+			t.Errorf("%s %s: expected only headers, got %q", p.method, p.path, rec.Body.String())
+		}
+	}
+	if got := h.downloadCount.Load(); got != 0 {
+		t.Fatalf("expected probes not to count, got %d downloads", got)
+	}
+	if strings.Contains(buf.String(), "Download started") {
+		t.Fatalf("expected probes not to start a download, got %q", buf.String())
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/file.txt", nil))
+	if rec.Body.String() != "content" || h.downloadCount.Load() != 1 {
+		t.Errorf("expected the one download to go to the browser, got %q", rec.Body.String())
+	}
+	if got := strings.Count(buf.String(), "Download started"); got != 1 {
+		t.Errorf("expected one download start, got %d", got)
+	}
+}
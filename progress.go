@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"time"
+)
+
+// progressInterval is how often progress lines are redrawn
+const progressInterval = 500 * time.Millisecond
+
+// progressBoard is the block of lines at the bottom of the terminal that
+// shows each download in progress. Log lines are printed above it.
+type progressBoard struct {
+	transfers []*progressLine
+	drawn     int // Lines on screen, to move back over
+}
+
+// progressLine is one download in progress
+type progressLine struct {
+	client string
+	file   string
+	start  time.Time
+	sent   *sentWriter
+}
+
+// clear removes the lines drawn last, leaving the cursor where they began
+func (b *progressBoard) clear(w io.Writer) {
+	if b == nil {
+		return
+	}
+	for ; b.drawn > 0; b.drawn-- {
+		io.WriteString(w, "\x1b[1A\x1b[2K")
+	}
+}
+
+func (b *progressBoard) draw(w io.Writer) {
+	if b == nil {
+		return
+	}
+	for _, t := range b.transfers {
+		fmt.Fprintf(w, "  %s\n", t.status(time.Now()))
+	}
+	b.drawn = len(b.transfers)
+}
+
+// status describes how far the download has got, e.g.
+// "build.zip to 192.168.1.20: 45% of 1.2 GiB, 12.3 MiB/s, 1m2s left"
+func (t *progressLine) status(now time.Time) string {
+	sent, length := t.sent.n.Load(), t.sent.length.Load()
+	elapsed := now.Sub(t.start).Seconds()
+	var speed float64
+	if elapsed > 0 {
+		speed = float64(sent) / elapsed
+	}
+	s := fmt.Sprintf("%s to %s: ", t.file, clientIP(t.client))
+	if length <= 0 {
+		return s + fmt.Sprintf("%s, %s/s", formatSize(sent), formatSize(int64(speed)))
+	}
+	s += fmt.Sprintf("%d%% of %s, %s/s", sent*100/length, formatSize(length), formatSize(int64(speed)))
+	if speed > 0 && sent < length {
+		left := time.Duration(float64(length-sent) / speed * float64(time.Second))
+		s += fmt.Sprintf(", %s left", left.Round(time.Second))
+	}
+	return s
+}
+
+// showProgress keeps progress lines for downloads under the log until ctx
+// is done
+func (l *eventLog) showProgress(ctx context.Context) {
+	l.mu.Lock()
+	l.progress = &progressBoard{}
+	l.mu.Unlock()
+
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			l.mu.Lock()
+			l.progress.clear(l.out)
+			l.progress = nil
+			l.mu.Unlock()
+			return
+		case <-ticker.C:
+			l.mu.Lock()
+			l.progress.clear(l.out)
+			l.progress.draw(l.out)
+			l.mu.Unlock()
+		}
+	}
+}
+
+// track shows a progress line for a download until the returned function
+// is called
+func (l *eventLog) track(client, file string, sent *sentWriter) func() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.progress == nil {
+		return func() {}
+	}
+	line := &progressLine{client: client, file: file, start: time.Now(), sent: sent}
+	l.progress.transfers = append(l.progress.transfers, line)
+	return func() {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		if l.progress == nil {
+			return
+		}
+		l.progress.clear(l.out)
+		l.progress.transfers = slices.DeleteFunc(l.progress.transfers, func(t *progressLine) bool { return t == line })
+		l.progress.draw(l.out)
+	}
+}
+
+// isTerminal reports whether f is a terminal, where lines can be redrawn
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
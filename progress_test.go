@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestProgressStatus(t *testing.T) {
+	tests := []struct {
+		name     string
+		sent     int64
+		length   int64
+		expected string
+	}{
+		{"under way", 1 << 20, 4 << 20, "big.iso to 192.0.2.1: 25% of 4.0 MiB, 512.0 KiB/s, 6s left"},
+		{"done", 4 << 20, 4 << 20, "big.iso to 192.0.2.1: 100% of 4.0 MiB, 2.0 MiB/s"},
+		{"unknown length", 1 << 20, -1, "big.iso to 192.0.2.1: 1.0 MiB, 512.0 KiB/s"},
+	}
+	start := time.Now()
+	for _, tt := range tests {
+		sent := &sentWriter{ResponseWriter: httptest.NewRecorder()}
+		sent.n.Store(tt.sent)
+		sent.length.Store(tt.length)
+		line := &progressLine{client: "192.0.2.1:1234", file: "big.iso", start: start, sent: sent}
+		if got := line.status(start.Add(2 * time.Second)); got != tt.expected {
+			t.Errorf("%s: expected %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+}
+
+func TestProgressBelowLog(t *testing.T) {
+	buf := captureEvents(t, logText)
+	events.progress = &progressBoard{}
+	sent := &sentWriter{ResponseWriter: httptest.NewRecorder()}
+	done := events.track("192.0.2.1:1234", "big.iso", sent)
+	logNotice("test", nil, "first")
+	logNotice("test", nil, "second")
+	done()
+
+	// Each log line first moves back over the progress line, which is then
+	// drawn again below it
+	expected := "first\n  big.iso to 192.0.2.1: 0 B, 0 B/s\n" +
+		"\x1b[1A\x1b[2Ksecond\n  big.iso to 192.0.2.1: 0 B, 0 B/s\n" +
+		"\x1b[1A\x1b[2K"
+	if got := buf.String(); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+	if len(events.progress.transfers) != 0 {
+		t.Error("expected the finished download's line to be removed")
+	}
+}
+
+func TestProgressLengthFromHeader(t *testing.T) {
+	sent := &sentWriter{ResponseWriter: httptest.NewRecorder()}
+	sent.Header().Set("Content-Length", "42")
+	sent.Write(bytes.Repeat([]byte("x"), 10))
+	if sent.length.Load() != 42 || sent.n.Load() != 10 {
+		t.Errorf("expected 10 of 42 bytes, got %d of %d", sent.n.Load(), sent.length.Load())
+	}
+}
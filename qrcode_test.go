@@ -0,0 +1,85 @@
+package main
+
+import (
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEncodeQRVersionSelection(t *testing.T) {
+	tests := []struct {
+		length   int
+		expected int
+	}{
+		{1, 21},   // version 1
+		{14, 21},  // version 1 capacity at level M
+		{15, 25},  // version 2
+		{100, 41}, // version 6
+		{666, 97}, // version 20
+	}
+
+	for _, tt := range tests {
+		q, err := encodeQR([]byte(strings.Repeat("a", tt.length)))
+		if err != nil {
+			t.Fatalf("encodeQR(%d bytes) failed: %v", tt.length, err)
+		}
+		if q.size != tt.expected {
+			t.Errorf("encodeQR(%d bytes) size = %d, want %d", tt.length, q.size, tt.expected)
+		}
+	}
+}
+
+func TestEncodeQRTooLong(t *testing.T) {
+	if _, err := encodeQR([]byte(strings.Repeat("a", 667))); err == nil {
+		t.Error("expected error for data exceeding QR capacity")
+	}
+}
+
+func TestEncodeQRFinderPatterns(t *testing.T) {
+	q, err := encodeQR([]byte("http://192.168.1.10:8080/file.txt"))
+	if err != nil {
+		t.Fatalf("encodeQR failed: %v", err)
+	}
+
+	// Each finder pattern has a dark outer ring, light ring and dark core
+	for _, origin := range [][2]int{{0, 0}, {q.size - 7, 0}, {0, q.size - 7}} {
+		x, y := origin[0], origin[1]
+		if !q.modules[y][x] || q.modules[y+1][x+1] || !q.modules[y+3][x+3] {
+			t.Errorf("finder pattern at (%d, %d) is malformed", x, y)
+		}
+	}
+}
+
+func TestQRHandler(t *testing.T) {
+	q, err := encodeQR([]byte("http://192.168.1.10:8080/file.txt"))
+	if err != nil {
+		t.Fatalf("encodeQR failed: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	(&qrHandler{code: q}).ServeHTTP(rec, httptest.NewRequest("GET", "/qr", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected status 200, got %d", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("expected Content-Type image/png, got %q", ct)
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("failed to decode PNG: %v", err)
+	}
+	if want := (q.size + 2*qrQuietZone) * 8; img.Bounds().Dx() != want {
+		t.Errorf("expected image width %d, got %d", want, img.Bounds().Dx())
+	}
+
+	rec = httptest.NewRecorder()
+	(&qrHandler{code: q, svg: true}).ServeHTTP(rec, httptest.NewRequest("GET", "/qr.svg", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "image/svg+xml" {
+		t.Errorf("expected Content-Type image/svg+xml, got %q", ct)
+	}
+	if !strings.HasPrefix(rec.Body.String(), "<svg") {
+		t.Errorf("expected SVG document, got %q", rec.Body.String())
+	}
+}
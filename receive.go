@@ -0,0 +1,506 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// receivePageTemplate is the upload page shown to browsers in receive
+// mode. Files dropped on it or picked are uploaded one at a time with a
+// progress bar each, resuming after connection drops; without JavaScript
+// the form posts them all at once.
+var receivePageTemplate = template.Must(template.New("receive").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<link rel="icon" href="data:,">
+<title>Send files</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", sans-serif; max-width: 36em; margin: 3em auto; padding: 0 1em; color: #222; }
+#drop { display: block; border: 2px dashed #9ca3af; border-radius: 0.6em; padding: 3em 1em; text-align: center; cursor: pointer; }
+#drop.over { border-color: #2563eb; background: #eff6ff; }
+.file { margin: 1em 0; }
+.file progress { width: 100%; }
+.ok { color: #15803d; }
+.failed { color: #b91c1c; }
+.note { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Send files</h1>
+{{if .Download}}<p>You have a file waiting: <a href="{{.Download}}">download it</a>.</p>
+{{end}}<form id="form" method="post" action="{{.Base}}/" enctype="multipart/form-data">
+<label id="drop">Drop files here or tap to choose<br><input id="input" type="file" name="file" multiple required{{if .Accept}} accept="{{.Accept}}"{{end}}></label>
+<noscript><p><button type="submit">Upload</button></p></noscript>
+</form>
+<div id="files"></div>
+{{if or .MaxSize .Accept}}<p class="note">{{if .MaxSize}}Files up to {{.MaxSize}}.{{end}}{{if .Accept}} Accepted types: {{.Accept}}{{end}}</p>{{end}}
+{{if ne .Remaining -1}}<p class="note">{{.Remaining}} more file(s) can be sent before the share closes.</p>{{end}}
+<script>
+(function () {
+  var drop = document.getElementById("drop");
+  var input = document.getElementById("input");
+  var list = document.getElementById("files");
+  var base = {{.Base}};
+  var queue = [];
+  var busy = false;
+  input.style.display = "none";
+
+  function add(files) {
+    for (var i = 0; i < files.length; i++) {
+      var row = document.createElement("div");
+      row.className = "file";
+      var name = document.createElement("div");
+      name.textContent = files[i].name;
+      var bar = document.createElement("progress");
+      bar.max = files[i].size || 1;
+      bar.value = 0;
+      var status = document.createElement("div");
+      status.className = "note";
+      status.textContent = "Waiting";
+      row.appendChild(name);
+      row.appendChild(bar);
+      row.appendChild(status);
+      list.appendChild(row);
+      queue.push({file: files[i], bar: bar, status: status, offset: 0, retries: 0});
+    }
+    next();
+  }
+
+  function next() {
+    if (busy || queue.length === 0) {
+      return;
+    }
+    busy = true;
+    create(queue.shift());
+  }
+
+  // Uploads use tus, so a dropped connection resumes where it stopped
+  function send(method, url, headers, body, item, done) {
+    var xhr = new XMLHttpRequest();
+    xhr.open(method, url);
+    xhr.setRequestHeader("Tus-Resumable", "1.0.0");
+    for (var h in headers) {
+      xhr.setRequestHeader(h, headers[h]);
+    }
+    if (body) {
+      xhr.upload.onprogress = function (e) {
+        progress(item, item.offset + e.loaded);
+      };
+    }
+    xhr.onload = function () { done(xhr); };
+    xhr.onerror = function () { done(null); };
+    xhr.send(body);
+  }
+
+  function create(item) {
+    item.status.textContent = "Uploading";
+    var name = btoa(unescape(encodeURIComponent(item.file.name)));
+    send("POST", base + "/uploads/", {"Upload-Length": item.file.size, "Upload-Metadata": "filename " + name}, null, item, function (xhr) {
+      if (!xhr) {
+        return retry(item, create);
+      }
+      if (xhr.status !== 201) {
+        return done(item, false, xhr.responseText);
+      }
+      item.url = xhr.getResponseHeader("Location");
+      if (item.file.size === 0) {
+        return done(item, true, receipt(xhr));
+      }
+      patch(item);
+    });
+  }
+
+  function patch(item) {
+    var headers = {"Upload-Offset": item.offset, "Content-Type": "application/offset+octet-stream"};
+    send("PATCH", item.url, headers, item.file.slice(item.offset), item, function (xhr) {
+      if (xhr && xhr.status === 204) {
+        return done(item, true, receipt(xhr));
+      }
+      if (xhr && xhr.status >= 400 && xhr.status < 500 && xhr.status !== 409) {
+        return done(item, false, xhr.responseText);
+      }
+      retry(item, resume);
+    });
+  }
+
+  function resume(item) {
+    send("HEAD", item.url, {}, null, item, function (xhr) {
+      if (!xhr) {
+        return retry(item, resume);
+      }
+      if (xhr.status !== 200) {
+        return done(item, false, "upload expired");
+      }
+      item.offset = parseInt(xhr.getResponseHeader("Upload-Offset"), 10);
+      item.retries = 0;
+      patch(item);
+    });
+  }
+
+  function retry(item, again) {
+    if (item.retries++ >= 30) {
+      return done(item, false, "connection lost");
+    }
+    item.status.textContent = "Connection lost, retrying";
+    setTimeout(function () { again(item); }, 2000);
+  }
+
+  // The last response of an upload carries its receipt
+  function receipt(xhr) {
+    var size = parseInt(xhr.getResponseHeader("X-Upload-Size"), 10);
+    var received = new Date(xhr.getResponseHeader("X-Upload-Received"));
+    return "Received " + size.toLocaleString() + " bytes at " + received.toLocaleString() + ", SHA-256 " + xhr.getResponseHeader("X-Upload-Sha256");
+  }
+
+  function progress(item, loaded) {
+    item.bar.value = loaded;
+    item.status.textContent = Math.floor(100 * loaded / item.bar.max) + "%";
+  }
+
+  function done(item, ok, message) {
+    if (ok) {
+      item.bar.value = item.bar.max;
+    }
+    item.status.className = ok ? "ok" : "failed";
+    item.status.textContent = ok ? message : "Failed: " + message;
+    busy = false;
+    next();
+  }
+
+  input.addEventListener("change", function () {
+    add(input.files);
+    input.value = "";
+  });
+  drop.addEventListener("dragover", function (e) {
+    e.preventDefault();
+    drop.className = "over";
+  });
+  drop.addEventListener("dragleave", function () {
+    drop.className = "";
+  });
+  drop.addEventListener("drop", function (e) {
+    e.preventDefault();
+    drop.className = "";
+    add(e.dataTransfer.files);
+  });
+})();
+</script>
+</body>
+</html>
+`))
+
+// uploadPrefix is where --two-way mounts the receiving side
+const uploadPrefix = "/upload/"
+
+// receivePage is the data for receivePageTemplate
+type receivePage struct {
+	Base      string // URL path the handler is mounted at
+	Download  string // Link to the share's download, if any
+	Remaining int32  // -1 for unlimited
+	MaxSize   string
+	Accept    string // Accepted extensions, comma-separated
+}
+
+// receiveHandler accepts uploads into a directory: files of a multipart
+// POST to the root, the raw body of a PUT to /<name>, or resumable tus
+// uploads under tusPrefix. Names are sanitized, and the policy decides
+// which files are accepted and what happens when a name is taken. Each
+// received file counts as an upload towards the limit.
+type receiveHandler struct {
+	dir              string
+	base             string // URL path the handler is mounted at, without the trailing slash
+	download         string // Link to the download served alongside, if any
+	maxUploads       int32
+	policy           uploadPolicy
+	activeDownloads  *sync.WaitGroup
+	downloadComplete chan<- struct{}
+	onReceive        func() // Called after each received file, if set
+
+	mu       sync.Mutex
+	started  int32 // uploads received or in progress
+	received int32
+	uploads  map[string]*tusUpload
+}
+
+func (rh *receiveHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if strings.HasPrefix(r.URL.Path, tusPrefix) {
+		rh.serveTus(w, r)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		remaining := int32(-1)
+		if rh.maxUploads > 0 {
+			rh.mu.Lock()
+			remaining = rh.maxUploads - rh.started
+			rh.mu.Unlock()
+		}
+		page := receivePage{Base: rh.base, Download: rh.download, Remaining: remaining, Accept: strings.Join(rh.policy.extensions, ",")}
+		if rh.policy.maxSize > 0 {
+			page.MaxSize = formatSize(rh.policy.maxSize)
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		receivePageTemplate.Execute(w, page)
+	case http.MethodPost:
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		rh.receiveForm(w, r)
+	case http.MethodPut:
+		rh.receivePut(w, r)
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// receiveForm saves every file of a multipart upload
+func (rh *receiveHandler) receiveForm(w http.ResponseWriter, r *http.Request) {
+	rh.activeDownloads.Add(1)
+	defer rh.activeDownloads.Done()
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		http.Error(w, "expected a multipart/form-data upload", http.StatusBadRequest)
+		return
+	}
+	var receipts []string
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logEvent("upload_interrupted", logFields{"client": r.RemoteAddr, "error": err}, "Upload interrupted from %s: %v", r.RemoteAddr, err)
+			http.Error(w, "cannot read upload", http.StatusBadRequest)
+			return
+		}
+		if part.FileName() == "" {
+			continue // Other form fields
+		}
+		receipt, status, err := rh.receive(part.FileName(), -1, part, r.RemoteAddr)
+		part.Close()
+		if err != nil {
+			http.Error(w, err.Error(), status)
+			return
+		}
+		receipts = append(receipts, receipt)
+	}
+	if len(receipts) == 0 {
+		http.Error(w, "no files in upload", http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, strings.Join(receipts, "\n")+"\n")
+}
+
+// receivePut saves the body of a PUT request under the name in its path
+func (rh *receiveHandler) receivePut(w http.ResponseWriter, r *http.Request) {
+	rh.activeDownloads.Add(1)
+	defer rh.activeDownloads.Done()
+
+	receipt, status, err := rh.receive(strings.TrimPrefix(r.URL.Path, "/"), r.ContentLength, r.Body, r.RemoteAddr)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusCreated)
+	fmt.Fprintln(w, receipt)
+}
+
+// receive writes one uploaded file of size bytes, or -1 if unknown, and
+// counts it. On failure it returns the HTTP status and a message for the
+// client.
+func (rh *receiveHandler) receive(name string, size int64, body io.Reader, remoteAddr string) (receipt string, status int, err error) {
+	name, ok := sanitizeUploadName(name)
+	if !ok {
+		return "", http.StatusBadRequest, fmt.Errorf("invalid file name")
+	}
+	if err := rh.policy.check(rh.dir, name, size); err != nil {
+		logEvent("upload_refused", logFields{"client": remoteAddr, "file": name, "error": err}, "Upload of %s refused from %s: %v", name, remoteAddr, err)
+		status, message := uploadStatus(err)
+		return "", status, errors.New(message)
+	}
+	if !rh.reserve() {
+		return "", http.StatusGone, fmt.Errorf("upload limit reached")
+	}
+
+	saved, err := saveUpload(rh.dir, name, body, rh.policy)
+	if err != nil {
+		rh.release()
+		logEvent("upload_failed", logFields{"client": remoteAddr, "file": name, "error": err}, "Upload of %s failed from %s: %v", name, remoteAddr, err)
+		status, message := uploadStatus(err)
+		return "", status, errors.New(message)
+	}
+	return rh.complete(saved, remoteAddr).String(), 0, nil
+}
+
+// remaining returns the uploads left, or -1 when unlimited
+func (rh *receiveHandler) remaining() int32 {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	if rh.maxUploads == 0 {
+		return -1
+	}
+	return rh.maxUploads - rh.received
+}
+
+// reserve takes a place for an upload about to start, or reports false if
+// the limit is used up. Uploads in progress hold their place, so
+// concurrent ones can't exceed the limit.
+func (rh *receiveHandler) reserve() bool {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	if rh.maxUploads > 0 && rh.started >= rh.maxUploads {
+		return false
+	}
+	rh.started++
+	return true
+}
+
+// release gives back the place of an upload that failed
+func (rh *receiveHandler) release() {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	rh.started--
+}
+
+// uploadReceipt describes a received file, for the sender and the log
+type uploadReceipt struct {
+	name     string // Name the file was saved under
+	size     int64
+	sha256   string // Hex digest of the content
+	received time.Time
+}
+
+func (r uploadReceipt) String() string {
+	return fmt.Sprintf("Received %s (%s) at %s, SHA-256 %s", r.name, formatSize(r.size), r.received.Format(time.RFC3339), r.sha256)
+}
+
+// complete logs and counts a received file and returns its receipt, timed
+// now
+func (rh *receiveHandler) complete(receipt uploadReceipt, remoteAddr string) uploadReceipt {
+	receipt.received = time.Now()
+	logEvent("upload_completed", logFields{"client": remoteAddr, "file": receipt.name, "bytes": receipt.size, "sha256": receipt.sha256, "received": receipt.received.Format(time.RFC3339)}, "Received %s (%s, SHA-256 %s) from %s", receipt.name, formatSize(receipt.size), receipt.sha256, remoteAddr)
+
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	rh.received++
+	if rh.maxUploads > 0 {
+		if remaining := rh.maxUploads - rh.received; remaining > 0 {
+			logEvent("uploads_remaining", logFields{"remaining": remaining}, "%d upload(s) remaining", remaining)
+		} else {
+			select {
+			case rh.downloadComplete <- struct{}{}:
+			default:
+			}
+		}
+	}
+	if rh.onReceive != nil {
+		rh.onReceive()
+	}
+	return receipt
+}
+
+// saveUpload writes body to a part file in dir, hashing it on the way,
+// and once it is all there gives it its name as policy says
+func saveUpload(dir, name string, body io.Reader, policy uploadPolicy) (receipt uploadReceipt, err error) {
+	file, err := createPart(dir, name)
+	if err != nil {
+		return uploadReceipt{}, err
+	}
+	if policy.maxSize > 0 {
+		body = io.LimitReader(body, policy.maxSize+1)
+	}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(file, hash), body)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && policy.maxSize > 0 && size > policy.maxSize {
+		err = errUploadTooLarge
+	}
+	var saved string
+	if err == nil {
+		saved, err = policy.place(dir, file.Name(), name)
+	}
+	if err != nil {
+		// Don't leave partial files behind
+		os.Remove(file.Name())
+		return uploadReceipt{}, err
+	}
+	return uploadReceipt{name: saved, size: size, sha256: hex.EncodeToString(hash.Sum(nil))}, nil
+}
+
+// createPart creates the file an upload of name is written to until it is
+// complete, name.part unless that is taken
+func createPart(dir, name string) (file *os.File, err error) {
+	_, err = uniqueName(dir, name+".part", func(path string) (err error) {
+		file, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		return err
+	})
+	return file, err
+}
+
+// uniqueName calls create with the path of name in dir and, while create
+// fails because the file exists, with a number added as in
+// "name (1).ext". It returns the name that create succeeded with.
+func uniqueName(dir, name string, create func(path string) error) (string, error) {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := range 1000 {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s (%d)%s", base, i, ext)
+		}
+		err := create(filepath.Join(dir, candidate))
+		if os.IsExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return candidate, nil
+	}
+	return "", fmt.Errorf("too many files named %s", name)
+}
+
+// sanitizeUploadName reduces a client-supplied name to a plain file name:
+// directories are dropped, whether given with / or \, and characters that
+// are invalid on Windows or control characters become underscores. It
+// reports false if nothing usable is left.
+func sanitizeUploadName(name string) (string, bool) {
+	name = path.Base(strings.ReplaceAll(name, `\`, "/"))
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f || strings.ContainsRune(`<>:"|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	// Windows drops trailing dots and spaces, which also rules out ".."
+	name = strings.TrimRight(name, ". ")
+	return name, name != ""
+}
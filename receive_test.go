@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSanitizeUploadName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+		ok   bool
+	}{
+		{"report.pdf", "report.pdf", true},
+		{"../../etc/passwd", "passwd", true},
+		{`C:\Users\me\notes.txt`, "notes.txt", true},
+		{"what?.txt", "what_.txt", true},
+		{"line\nbreak", "line_break", true},
+		{"trailing. ", "trailing", true},
+		{"..", "", false},
+		{"dir/", "dir", true},
+		{"", "", false},
+	}
+
+	for _, tt := range tests {
+		got, ok := sanitizeUploadName(tt.name)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("sanitizeUploadName(%q) = %q, %v; want %q, %v", tt.name, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestReceiveHandler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("existing"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	var wg sync.WaitGroup
+	done := make(chan struct{}, 1)
+	rh := &receiveHandler{dir: dir, maxUploads: 3, activeDownloads: &wg, downloadComplete: done}
+
+	rec := httptest.NewRecorder()
+	rh.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	for _, want := range []string{`type="file"`, `id="drop"`, "upload.onprogress", "3 more file(s)"} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("expected the upload page to contain %q", want)
+		}
+	}
+
+	// A form upload of two files; the taken name gets a number
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, content := range map[string]string{"notes.txt": "new notes", "../photo.jpg": "jpeg"} {
+		part, _ := mw.CreateFormFile("file", name)
+		part.Write([]byte(content))
+	}
+	mw.Close()
+	req := httptest.NewRequest("POST", "/", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("expected 200 for form upload, got %d: %s", rec.Code, rec.Body.String())
+	}
+	for name, want := range map[string]string{"notes.txt": "existing", "notes (1).txt": "new notes", "photo.jpg": "jpeg"} {
+		if got, err := os.ReadFile(filepath.Join(dir, name)); err != nil || string(got) != want {
+			t.Errorf("%s: expected %q, got %q (%v)", name, want, got, err)
+		}
+	}
+
+	// A raw PUT is the third and last upload
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, httptest.NewRequest("PUT", "/data.csv", strings.NewReader("a,b\n")))
+	if rec.Code != 201 {
+		t.Fatalf("expected 201 for PUT, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "data.csv")); string(got) != "a,b\n" {
+		t.Errorf("expected PUT body to be saved, got %q", got)
+	}
+	receipt := regexp.MustCompile(`^Received data\.csv \(4 B\) at \d{4}-\d\d-\d\dT\S+, SHA-256 5be08c9684a1d25efcee09318204824278b08bbfb4aef973ffefd0b9d7478313\n$`)
+	if !receipt.MatchString(rec.Body.String()) {
+		t.Errorf("expected a receipt with the time and SHA-256, got %q", rec.Body.String())
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("expected the upload limit to signal completion")
+	}
+
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, httptest.NewRequest("PUT", "/more.txt", strings.NewReader("more")))
+	if rec.Code != 410 {
+		t.Errorf("expected 410 after the limit, got %d", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "more.txt")); !os.IsNotExist(err) {
+		t.Errorf("expected no file after the limit, got %v", err)
+	}
+
+	for _, tt := range []struct {
+		method, target string
+		code           int
+	}{
+		{"PUT", "/", 400},
+		{"PUT", "/..", 400},
+		{"DELETE", "/notes.txt", 405},
+		{"GET", "/notes.txt", 404},
+	} {
+		rec := httptest.NewRecorder()
+		rh.ServeHTTP(rec, httptest.NewRequest(tt.method, tt.target, strings.NewReader("x")))
+		if rec.Code != tt.code {
+			t.Errorf("%s %s: expected %d, got %d", tt.method, tt.target, tt.code, rec.Code)
+		}
+	}
+}
+
+func TestRunReceiveNeedsDirectory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(file, []byte("x"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	for _, args := range [][]string{
+		{"--receive", file},
+		{"--receive", t.TempDir(), t.TempDir()},
+		{"--receive", "--browse", t.TempDir()},
+		{"--overwrite", "replace", t.TempDir()},
+		{"--accept-ext", "pdf", file},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "--receive") {
+			t.Errorf("%v: expected a --receive error, got %v", args, err)
+		}
+	}
+}
+
+func TestReceiveHandlerTwoWay(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	received := 0
+	rh := &receiveHandler{
+		dir:              dir,
+		base:             "/upload",
+		download:         "/build.zip",
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+		onReceive:        func() { received++ },
+	}
+	mounted := http.StripPrefix(rh.base, rh)
+	do := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		mounted.ServeHTTP(rec, req)
+		return rec
+	}
+
+	page := do(httptest.NewRequest("GET", "/upload/", nil)).Body.String()
+	for _, want := range []string{`href="/build.zip"`, `action="/upload/"`, `var base = "/upload"`} {
+		if !strings.Contains(page, want) {
+			t.Errorf("expected the upload page to contain %q", want)
+		}
+	}
+
+	if rec := do(httptest.NewRequest("PUT", "/upload/log.txt", strings.NewReader("log"))); rec.Code != 201 {
+		t.Fatalf("expected 201, got %d", rec.Code)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "log.txt")); string(got) != "log" || received != 1 {
+		t.Errorf("expected log.txt to be received once, got %q and %d", got, received)
+	}
+
+	req := httptest.NewRequest("POST", "/upload"+tusPrefix, nil)
+	req.Header.Set("Tus-Resumable", tusVersion)
+	req.Header.Set("Upload-Length", "3")
+	req.Header.Set("Upload-Metadata", "filename YS50eHQ=")
+	if location := do(req).Header().Get("Location"); !strings.HasPrefix(location, "/upload"+tusPrefix) {
+		t.Errorf("expected tus Location under /upload, got %q", location)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// errReload ends a share that SIGHUP asked to start over, see serve
+var errReload = errors.New("reload")
+
+// serve runs a share until its download limit is reached or it is
+// interrupted. A non-nil resumed state continues a suspended share.
+//
+// SIGHUP, when no terminal can send it, starts the share over on the
+// same listening socket: paths are looked at again, the config file and
+// USERVE_* variables are re-read and the download counts start from zero.
+// The old share first lets downloads in progress finish, up to
+// --drain-timeout. Connections made meanwhile aren't accepted until the
+// new share starts: they wait in the socket's backlog, and a client may
+// give up first if the wait is long.
+func serve(args []string, resumed *shareState) error {
+	var listener *reloadableListener
+	for {
+		err := serveShare(args, resumed, &listener)
+		if err != errReload {
+			if daemonPIDFile != "" {
+				os.Remove(daemonPIDFile)
+			}
+			return err
+		}
+		resumed = nil
+	}
+}
+
+// reloadableListener is the share's listening socket, which survives a
+// reload: while one is under way, closing the listener only wakes the old
+// server's Accept, so connections wait in the backlog for the new one
+type reloadableListener struct {
+	*net.TCPListener
+
+	mu        sync.Mutex
+	reloading bool
+}
+
+func (l *reloadableListener) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.reloading {
+		// The server sees it is shutting down and returns
+		return l.SetDeadline(time.Now())
+	}
+	return l.TCPListener.Close()
+}
+
+// keep makes the next Close leave the socket open for a reload
+func (l *reloadableListener) keep() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reloading = true
+}
+
+// reuse makes the listener accept connections again after a reload
+func (l *reloadableListener) reuse() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.reloading = false
+	return l.SetDeadline(time.Time{})
+}
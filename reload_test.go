@@ -0,0 +1,63 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestReloadableListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &reloadableListener{TCPListener: l.(*net.TCPListener)}
+	defer listener.Close()
+	url := fmt.Sprintf("http://%s/", listener.Addr())
+
+	// Each server answers with its generation, like a share and its reload
+	for generation := 1; generation <= 2; generation++ {
+		if generation > 1 {
+			if err := listener.reuse(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, generation)
+		})}
+		served := make(chan error, 1)
+		go func() { served <- server.Serve(listener) }()
+
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatalf("generation %d: %v", generation, err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != fmt.Sprint(generation) {
+			t.Errorf("expected generation %d to answer, got %q", generation, body)
+		}
+
+		listener.keep()
+		server.Close()
+		select {
+		case err := <-served:
+			if !errors.Is(err, http.ErrServerClosed) {
+				t.Errorf("expected the server to stop, got %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("expected closing a kept listener to stop the server")
+		}
+	}
+
+	// Without keep, Close closes the socket
+	listener.reuse()
+	listener.Close()
+	if _, err := net.DialTimeout("tcp", listener.Addr().String(), time.Second); err == nil {
+		t.Error("expected the socket to be closed")
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"time"
+)
+
+// reproducibleTime is the timestamp of every entry with --reproducible:
+// the earliest date a zip archive can store
+var reproducibleTime = time.Date(1980, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// normalizeTarHeader drops the metadata that differs between two copies
+// of the same tree: timestamps and ownership. Entries are already walked
+// in name order.
+func normalizeTarHeader(header *tar.Header) {
+	header.ModTime = reproducibleTime
+	header.AccessTime = time.Time{}
+	header.ChangeTime = time.Time{}
+	setOwner(header, ownerAnonymous)
+}
+
+// normalizeZipHeader gives a zip entry the fixed timestamp
+func normalizeZipHeader(header *zip.FileHeader) {
+	header.Modified = reproducibleTime
+}
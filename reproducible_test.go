@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReproducibleArchives(t *testing.T) {
+	root := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "src"), 0755); err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	for _, name := range []string{"README", "src/main.go", "src/util.go"} {
+		if err := os.WriteFile(filepath.Join(root, name), []byte("content of "+name), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+	touch := func(when time.Time) {
+		filepath.Walk(root, func(path string, _ os.FileInfo, _ error) error {
+			return os.Chtimes(path, when, when)
+		})
+	}
+
+	formats := []ArchiveFormat{ArchiveTarGz, ArchiveZip, ArchiveTar}
+	if _, err := exec.LookPath("xz"); err == nil {
+		formats = append(formats, ArchiveTarXz)
+	}
+	for _, format := range formats {
+		build := func(when time.Time) []byte {
+			touch(when)
+			p := newArchiveProvider(root, "project", archiveOptions{format: format, level: -1, reproducible: true})
+			var buf bytes.Buffer
+			if _, err := p.WriteTo(&buf); err != nil {
+				t.Fatalf("%s: WriteTo failed: %v", p.Filename(), err)
+			}
+			return buf.Bytes()
+		}
+		first := build(time.Date(2020, 5, 1, 12, 0, 0, 0, time.UTC))
+		second := build(time.Date(2024, 9, 30, 8, 0, 0, 0, time.UTC))
+		if !bytes.Equal(first, second) {
+			t.Errorf("format %v: archives differ after touching the files", format)
+		}
+	}
+}
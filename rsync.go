@@ -0,0 +1,1531 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/bits"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultRsyncPort is where --rsyncd listens: rsync's own port, 873, needs
+// root
+const defaultRsyncPort = 8873
+
+// The rsync daemon protocol, version 30 (rsync 3.0 and later): message
+// tags of the multiplexed stream (MSG_*), file list flags (XMIT_*) and the
+// flags of a file request (ITEM_*)
+const (
+	rsyncProtocol = 30
+
+	rsyncMuxBase      = 7
+	rsyncMsgData      = 0
+	rsyncMsgErrorXfer = 1
+	rsyncMsgInfo      = 2
+	rsyncMsgError     = 3
+	rsyncMsgNoSend    = 102
+
+	rsyncXmitTopDir        = 1 << 0
+	rsyncXmitSameMode      = 1 << 1
+	rsyncXmitExtendedFlags = 1 << 2
+	rsyncXmitSameUID       = 1 << 3
+	rsyncXmitSameGID       = 1 << 4
+	rsyncXmitSameName      = 1 << 5
+	rsyncXmitLongName      = 1 << 6
+	rsyncXmitSameTime      = 1 << 7
+	rsyncXmitNoContentDir  = 1 << 8
+
+	rsyncItemBasisTypeFollows = 1 << 11
+	rsyncItemXnameFollows     = 1 << 12
+	rsyncItemTransfer         = 1 << 15
+
+	rsyncNdxDone      = -1
+	rsyncMaxBlockSize = 1 << 17
+	rsyncChunkSize    = 32 << 10
+	rsyncBufferSize   = 64 << 10
+	rsyncMaxFilter    = 4096
+)
+
+// rsyncUnsupported are the client options that would need more than a
+// read-only sender speaking protocol 30, by their short and long names
+var rsyncUnsupported = map[string]string{
+	"z": "--compress", "R": "--relative", "A": "--acls", "X": "--xattrs", "U": "--atimes",
+	"N": "--crtimes", "C": "--cvs-exclude", "s": "--protect-args",
+	"compress": "", "zc": "", "compress-choice": "", "new-compress": "", "old-compress": "", "relative": "",
+	"acls": "", "xattrs": "", "atimes": "", "crtimes": "", "protect-args": "", "secluded-args": "",
+	"iconv": "", "files-from": "", "remove-source-files": "", "remove-sent-files": "",
+}
+
+// rsyncEscape is a character escaped with a backslash in a path
+var rsyncEscape = regexp.MustCompile(`\\(.)`)
+
+// rsyncServer serves the share's file tree as a read-only rsync module, so
+// that a large directory can be pulled with rsync: files already there are
+// skipped, changed ones are sent as differences, and an interrupted pull
+// picks up where it stopped. It speaks rsync's own daemon protocol, with no
+// login, as FTP does. Files are sent by the HTTP handler, so each one counts
+// towards the share's limit and is waited for at shutdown like any other
+// download.
+type rsyncServer struct {
+	tree      *shareTree
+	downloads *handler
+	listener  net.Listener
+	module    string
+
+	mu       sync.Mutex
+	sessions map[*rsyncSession]bool
+	closed   bool
+}
+
+// rsyncSession is one client's connection
+type rsyncSession struct {
+	server *rsyncServer
+	conn   net.Conn
+	in     *rsyncReader
+	out    *rsyncWriter
+	opts   rsyncOptions
+	files  []rsyncFile
+	busy   bool // Sending files, which shutdown waits for; guarded by server.mu
+}
+
+// rsyncOptions are the client's options that change what is sent
+type rsyncOptions struct {
+	sender     bool // The client pulls
+	recurse    bool
+	dirs       bool // -d: directories without their contents
+	owner      bool
+	group      bool
+	numericIDs bool
+	checksum   bool // File checksums in the file list, for -c
+	dryRun     bool
+	inplace    bool // Blocks only match at or after where they go
+	appendMode int  // 1 for --append, 2 for --append-verify
+	seed       int32
+}
+
+// rsyncFile is an entry of the file list, under the name the client gets
+type rsyncFile struct {
+	name  string
+	entry treeEntry
+	flags int // rsyncXmitTopDir or rsyncXmitNoContentDir, for directories
+}
+
+// rsyncRule is a filter rule the client sent for --exclude and --include
+type rsyncRule struct {
+	include bool
+	negate  bool
+	dirOnly bool
+	pattern *regexp.Regexp
+}
+
+// rsyncRequest is the client asking for a file, with the item flags and
+// basis it echoes back in the reply
+type rsyncRequest struct {
+	ndx    int32
+	iflags int
+	basis  byte
+	xname  []byte
+}
+
+// rsyncSums are the block checksums of the client's copy of a file
+type rsyncSums struct {
+	count     int32
+	blength   int32
+	s2length  int32
+	remainder int32
+	flength   int64 // Length of the client's copy, for --append
+	weak      []uint32
+	strong    []byte // s2length bytes for each block
+}
+
+func newRsyncServer(listener net.Listener, tree *shareTree, downloads *handler) *rsyncServer {
+	return &rsyncServer{tree: tree, downloads: downloads, listener: listener, module: tree.name(), sessions: make(map[*rsyncSession]bool)}
+}
+
+// serve accepts connections until the server is closed
+func (s *rsyncServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		session := &rsyncSession{
+			server: s,
+			conn:   conn,
+			in:     &rsyncReader{r: bufio.NewReader(conn), prevNdx: -1, prevNeg: 1},
+			out:    &rsyncWriter{w: conn, prevNdx: -1},
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.sessions[session] = true
+		s.mu.Unlock()
+		go session.run()
+	}
+}
+
+// Close stops taking connections and ends the sessions that aren't sending
+// files; the others refuse any file after the one they are sending
+func (s *rsyncServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for session := range s.sessions {
+		if !session.busy {
+			session.conn.Close()
+		}
+	}
+	return s.listener.Close()
+}
+
+func (c *rsyncSession) run() {
+	defer func() {
+		c.conn.Close()
+		c.server.mu.Lock()
+		delete(c.server.sessions, c)
+		busy := c.busy
+		c.server.mu.Unlock()
+		if busy {
+			c.server.downloads.activeDownloads.Done()
+		}
+	}()
+	args, ok := c.greet()
+	if !ok {
+		return
+	}
+	// The client may take a while to check its own files before asking for
+	// one, so only the greeting has a deadline
+	c.conn.SetReadDeadline(time.Time{})
+	opts, paths, err := parseRsyncArgs(args)
+	c.opts = opts
+	if c.opts.seed == 0 {
+		var b [4]byte
+		rand.Read(b[:])
+		c.opts.seed = int32(binary.LittleEndian.Uint32(b[:]) >> 1)
+	}
+	// Compatibility flags, none of which are used, and the checksum seed come
+	// before the stream is multiplexed
+	c.out.varint(0)
+	c.out.int32(c.opts.seed)
+	if c.out.flush() != nil {
+		return
+	}
+	c.out.mux, c.in.mux = true, true
+	switch {
+	case err != nil:
+		c.fail("ERROR: " + err.Error())
+		return
+	case !c.opts.sender:
+		c.fail("ERROR: module is read only")
+		return
+	}
+
+	rules := c.readFilters()
+	if c.in.err != nil {
+		return
+	}
+	started := time.Now()
+	c.files = c.fileList(paths, rules)
+	c.sendFileList()
+	built := time.Since(started)
+	if c.out.flush() != nil || len(c.files) == 0 {
+		return
+	}
+	if err := c.transfer(); err != nil {
+		return
+	}
+	c.out.ndx(rsyncNdxDone)
+	var size int64
+	for _, f := range c.files {
+		if f.entry.info.Mode().IsRegular() {
+			size += f.entry.info.Size()
+		}
+	}
+	c.out.varlong(c.in.read, 3)
+	c.out.varlong(c.out.written, 3)
+	c.out.varlong(size, 3)
+	c.out.varlong(built.Milliseconds(), 3)
+	c.out.varlong(0, 3)
+	if c.out.flush() != nil {
+		return
+	}
+	// The client says goodbye before closing
+	c.in.ndx()
+}
+
+// greet exchanges protocol versions and the module name, and returns the
+// client's arguments, or false once it has been answered
+func (c *rsyncSession) greet() ([]string, bool) {
+	c.conn.SetReadDeadline(time.Now().Add(defaultIdleTimeout))
+	fmt.Fprintf(c.conn, "@RSYNCD: %d.0\n", rsyncProtocol)
+	line, err := c.in.r.ReadString('\n')
+	if err != nil {
+		return nil, false
+	}
+	var version int
+	if _, err := fmt.Sscanf(line, "@RSYNCD: %d", &version); err != nil {
+		fmt.Fprintf(c.conn, "@ERROR: protocol startup error\n")
+		return nil, false
+	}
+	if version < rsyncProtocol {
+		fmt.Fprintf(c.conn, "@ERROR: protocol version mismatch -- this server needs rsync 3.0 or later\n")
+		return nil, false
+	}
+	if line, err = c.in.r.ReadString('\n'); err != nil {
+		return nil, false
+	}
+	switch module := strings.TrimRight(line, "\r\n"); module {
+	case "", "#list":
+		fmt.Fprintf(c.conn, "%-15s\t%s\n@RSYNCD: EXIT\n", c.server.module, "userve share (read-only)")
+		return nil, false
+	case c.server.module:
+	default:
+		fmt.Fprintf(c.conn, "@ERROR: Unknown module '%s'\n", module)
+		return nil, false
+	}
+	fmt.Fprintf(c.conn, "@RSYNCD: OK\n")
+
+	// Arguments end with an empty one
+	var args []string
+	for {
+		arg, err := c.in.r.ReadString(0)
+		if err != nil {
+			return nil, false
+		}
+		if arg = strings.TrimSuffix(arg, "\x00"); arg == "" {
+			return args, true
+		}
+		args = append(args, arg)
+	}
+}
+
+// fail sends the client an error and ends the session. Closing with its
+// input unread could reset the connection before the error arrives.
+func (c *rsyncSession) fail(message string) {
+	c.out.message(rsyncMsgError, []byte(message+"\n"))
+	if conn, ok := c.conn.(interface{ CloseWrite() error }); ok {
+		conn.CloseWrite()
+	}
+	c.conn.SetReadDeadline(time.Now().Add(time.Second))
+	io.Copy(io.Discard, c.conn)
+}
+
+// parseRsyncArgs returns the options the client runs the server with and
+// the paths it asks for, which follow a "." argument
+func parseRsyncArgs(args []string) (rsyncOptions, []string, error) {
+	var opts rsyncOptions
+	for i, arg := range args {
+		if arg == "." {
+			return opts, args[i+1:], nil
+		}
+		if name, ok := strings.CutPrefix(arg, "--"); ok {
+			name, value, _ := strings.Cut(name, "=")
+			if _, ok := rsyncUnsupported[name]; ok {
+				return opts, nil, fmt.Errorf("--%s isn't supported", name)
+			}
+			switch name {
+			case "sender":
+				opts.sender = true
+			case "numeric-ids":
+				opts.numericIDs = true
+			case "inplace":
+				opts.inplace = true
+			case "append":
+				opts.appendMode++
+			case "checksum-seed":
+				seed, _ := strconv.ParseInt(value, 10, 32)
+				opts.seed = int32(seed)
+			case "checksum-choice", "cc":
+				for _, choice := range strings.Split(value, ",") {
+					if choice != "md5" && choice != "auto" {
+						return opts, nil, fmt.Errorf("--checksum-choice=%s isn't supported; only md5 is", value)
+					}
+				}
+			}
+			continue
+		}
+		if !strings.HasPrefix(arg, "-") {
+			continue
+		}
+		for j := 1; j < len(arg); j++ {
+			if long, ok := rsyncUnsupported[arg[j:j+1]]; ok {
+				return opts, nil, fmt.Errorf("%s (-%c) isn't supported", long, arg[j])
+			}
+			switch arg[j] {
+			case 'e':
+				// The rest tells what the client can do, which is protocol 30
+				// or more anyway
+				j = len(arg)
+			case 'r':
+				opts.recurse = true
+			case 'd':
+				opts.dirs = true
+			case 'o':
+				opts.owner = true
+			case 'g':
+				opts.group = true
+			case 'c':
+				opts.checksum = true
+			case 'n':
+				opts.dryRun = true
+			}
+		}
+	}
+	return opts, nil, errors.New("malformed arguments")
+}
+
+// readFilters reads the client's filter rules, for --exclude, --include
+// and --filter
+func (c *rsyncSession) readFilters() []rsyncRule {
+	var rules []rsyncRule
+	for {
+		n := c.in.int32()
+		if n == 0 || c.in.err != nil {
+			return rules
+		}
+		if n < 0 || n > rsyncMaxFilter {
+			c.in.err = errors.New("filter rule too long")
+			return nil
+		}
+		rule, ok, clear := parseRsyncRule(string(c.in.take(int(n))))
+		switch {
+		case clear:
+			rules = nil
+		case ok:
+			rules = append(rules, rule)
+		}
+	}
+}
+
+// parseRsyncRule parses a rule as clients send them: a prefix, modifiers,
+// a space and the pattern. It returns ok false for a rule that doesn't apply
+// to the sender, and clear true for one that empties the list.
+func parseRsyncRule(s string) (rule rsyncRule, ok, clear bool) {
+	prefix, pattern, _ := strings.Cut(s, " ")
+	if prefix == "" {
+		return rule, false, false
+	}
+	switch prefix[0] {
+	case '+':
+		rule.include = true
+	case '-':
+	case '!':
+		return rule, false, true
+	default:
+		// Merge files and such are read by the client's side
+		return rule, false, false
+	}
+	for _, m := range prefix[1:] {
+		switch m {
+		case '!':
+			rule.negate = true
+		case 'r', 'x', 'C', '/':
+			return rule, false, false
+		}
+	}
+	if pattern == "" {
+		return rule, false, false
+	}
+	if p, found := strings.CutSuffix(pattern, "/"); found && p != "" {
+		rule.dirOnly, pattern = true, p
+	}
+	rule.pattern = rsyncPattern(pattern)
+	return rule, true, false
+}
+
+// rsyncPattern compiles a filter pattern. A pattern with a leading slash is
+// anchored at the top of the transfer, and "dir/***" takes in dir and all
+// below it. Others match the end of a path: "*" and "?" don't match a slash
+// but "**" does, so a pattern without one only matches the base name.
+func rsyncPattern(p string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^(?:.*/)?")
+	if anchored, found := strings.CutPrefix(p, "/"); found {
+		b.Reset()
+		b.WriteString("^")
+		p = anchored
+	}
+	suffix := "$"
+	if trimmed, found := strings.CutSuffix(p, "/***"); found {
+		p, suffix = trimmed, "(?:/.*)?$"
+	}
+	for i := 0; i < len(p); i++ {
+		switch c := p[i]; c {
+		case '*':
+			if i+1 < len(p) && p[i+1] == '*' {
+				for i+1 < len(p) && p[i+1] == '*' {
+					i++
+				}
+				b.WriteString(".*")
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			j := i + 1
+			if j < len(p) && (p[j] == '!' || p[j] == '^') {
+				j++
+			}
+			if j < len(p) && p[j] == ']' {
+				j++
+			}
+			for j < len(p) && p[j] != ']' {
+				j++
+			}
+			if j >= len(p) {
+				b.WriteString(`\[`)
+				continue
+			}
+			class := p[i+1 : j]
+			b.WriteString("[")
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteString("^")
+				class = class[1:]
+			}
+			b.WriteString(regexp.QuoteMeta(class) + "]")
+			i = j
+		case '\\':
+			if i+1 < len(p) {
+				i++
+			}
+			b.WriteString(regexp.QuoteMeta(p[i : i+1]))
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(suffix)
+	return regexp.MustCompile(b.String())
+}
+
+// rsyncExcluded reports whether the rules leave out the file list entry
+// name; the first rule that matches decides
+func rsyncExcluded(rules []rsyncRule, name string, dir bool) bool {
+	for _, rule := range rules {
+		matched := (dir || !rule.dirOnly) && rule.pattern.MatchString(name)
+		if matched != rule.negate {
+			return !rule.include
+		}
+	}
+	return false
+}
+
+// source returns the path below the root that a client's path names, and
+// whether it names a directory's contents rather than the directory. The
+// client sends the module on its own as "module/".
+func (s *rsyncServer) source(arg string) (string, bool) {
+	if rest, ok := strings.CutPrefix(arg, s.module); ok && (rest == "" || rest[0] == '/') {
+		arg = rest
+	}
+	contents := arg == "" || arg == "." || strings.HasSuffix(arg, "/") || strings.HasSuffix(arg, "/.")
+	return strings.TrimPrefix(path.Clean("/"+arg), "/"), contents
+}
+
+// expand returns the paths below the root that rel matches. As with rsync's
+// own daemon, wildcards in the paths a client asks for are expanded by the
+// server, and a backslash escapes the next character.
+func (s *rsyncServer) expand(rel string) []string {
+	matches := []string{""}
+	for _, segment := range strings.Split(rel, "/") {
+		var next []string
+		for _, m := range matches {
+			if !strings.ContainsAny(segment, "*?[") {
+				next = append(next, path.Join(m, rsyncEscape.ReplaceAllString(segment, "$1")))
+				continue
+			}
+			dir, ignores, ok := s.tree.lookup(m)
+			if !ok || !dir.info.IsDir() {
+				continue
+			}
+			for _, child := range s.tree.children(dir, ignores) {
+				if ok, _ := path.Match(segment, path.Base(child.rel)); ok {
+					next = append(next, child.rel)
+				}
+			}
+		}
+		matches = next
+	}
+	slices.Sort(matches)
+	return matches
+}
+
+// fileList returns the files and directories the client asked for, in the
+// order rsync sorts them in
+func (c *rsyncSession) fileList(paths []string, rules []rsyncRule) []rsyncFile {
+	tree := c.server.tree
+	if len(paths) == 0 {
+		paths = []string{"."}
+	}
+	var files []rsyncFile
+	for _, arg := range paths {
+		rel, contents := c.server.source(arg)
+		// A single file is the only content of its module
+		if rel == "" && tree.archive == nil {
+			rel = tree.name()
+		}
+		found := false
+		for _, rel := range c.server.expand(rel) {
+			entry, ignores, ok := tree.lookup(rel)
+			if !ok {
+				continue
+			}
+			found = true
+			if contents && entry.info.IsDir() {
+				files = append(files, rsyncFile{name: ".", entry: entry, flags: rsyncXmitTopDir})
+				if c.opts.recurse || c.opts.dirs {
+					files = c.addChildren(files, entry, ignores, "", rules, nil)
+				}
+				continue
+			}
+			name := path.Base(rel)
+			switch {
+			case !entry.info.IsDir():
+				if !rsyncExcluded(rules, name, false) {
+					files = append(files, rsyncFile{name: name, entry: entry})
+				}
+			case rsyncExcluded(rules, name, true):
+			case c.opts.recurse:
+				files = append(files, rsyncFile{name: name, entry: entry, flags: rsyncXmitTopDir})
+				files = c.addChildren(files, entry, ignores, name, rules, nil)
+			case c.opts.dirs:
+				files = append(files, rsyncFile{name: name, entry: entry, flags: rsyncXmitNoContentDir})
+			default:
+				c.out.message(rsyncMsgInfo, []byte("skipping directory "+name+"\n"))
+			}
+		}
+		if !found {
+			c.out.message(rsyncMsgErrorXfer, []byte("rsync: file not found in the share: "+arg+"\n"))
+		}
+	}
+
+	slices.SortStableFunc(files, rsyncCompare)
+	// Paths that overlap can name a file twice
+	unique := files[:0]
+	for i, f := range files {
+		if i == 0 || f.name != files[i-1].name {
+			unique = append(unique, f)
+		}
+	}
+	return unique
+}
+
+// addChildren adds the entries of the directory dir, named below prefix,
+// and with -r theirs as well. A symbolic link back to a directory above is
+// left out.
+func (c *rsyncSession) addChildren(files []rsyncFile, dir treeEntry, ignores ignoreRules, prefix string, rules []rsyncRule, above []os.FileInfo) []rsyncFile {
+	above = append(above, dir.info)
+	tree := c.server.tree
+	for _, child := range tree.children(dir, ignores) {
+		name := path.Join(prefix, path.Base(child.rel))
+		isDir := child.info.IsDir()
+		if rsyncExcluded(rules, name, isDir) {
+			continue
+		}
+		if !isDir {
+			files = append(files, rsyncFile{name: name, entry: child})
+			continue
+		}
+		if !c.opts.recurse {
+			files = append(files, rsyncFile{name: name, entry: child, flags: rsyncXmitNoContentDir})
+			continue
+		}
+		loop := false
+		for _, info := range above {
+			loop = loop || os.SameFile(info, child.info)
+		}
+		if loop {
+			continue
+		}
+		files = append(files, rsyncFile{name: name, entry: child})
+		if _, childIgnores, ok := tree.lookup(child.rel); ok {
+			files = c.addChildren(files, child, childIgnores, name, rules, above)
+		}
+	}
+	return files
+}
+
+// rsyncCompare orders file list entries as rsync does, since the client
+// sorts the list it gets and asks for files by their place in it: "." first,
+// then a directory's files before its subdirectories, byte by byte, as if
+// directory names ended in a slash. It is a port of rsync's f_name_cmp.
+func rsyncCompare(a, b rsyncFile) int {
+	c1, c2 := newRsyncCursor(a), newRsyncCursor(b)
+	if c1.item != c2.item {
+		return c1.order()
+	}
+	for {
+		if c1.end() {
+			c1.next()
+			if !c2.end() && c1.item != c2.item {
+				return c1.order()
+			}
+		}
+		if c2.end() {
+			c2.next()
+			if c1.item != c2.item {
+				return c1.order()
+			}
+		}
+		if c1.end() && c2.end() {
+			return 0
+		}
+		if d := c1.char() - c2.char(); d != 0 {
+			return d
+		}
+		c1.i++
+		c2.i++
+	}
+}
+
+// rsyncCursor walks a file list name for rsyncCompare: the directory part,
+// a slash, the base name, and a trailing slash for a directory
+type rsyncCursor struct {
+	s     string
+	i     int
+	state int // 0 to 3 for each of those parts
+	item  bool
+	base  string
+	dir   bool
+}
+
+func newRsyncCursor(f rsyncFile) *rsyncCursor {
+	c := &rsyncCursor{dir: f.entry.info != nil && f.entry.info.IsDir()}
+	dir, base := "", f.name
+	if i := strings.LastIndexByte(f.name, '/'); i >= 0 {
+		dir, base = f.name[:i], f.name[i+1:]
+	}
+	c.base = base
+	if dir == "" {
+		c.startBase()
+	} else {
+		c.s = dir
+	}
+	return c
+}
+
+func (c *rsyncCursor) startBase() {
+	c.s, c.i, c.state, c.item = c.base, 0, 2, !c.dir
+	if c.dir && c.base == "." {
+		c.s, c.state, c.item = "", 3, true
+	}
+}
+
+func (c *rsyncCursor) next() {
+	switch c.state {
+	case 0:
+		c.s, c.i, c.state = "/", 0, 1
+	case 1:
+		c.startBase()
+	case 2:
+		c.state = 3
+		if !c.item {
+			c.s, c.i = "/", 0
+			return
+		}
+		c.item = true
+	case 3:
+		c.item = true
+	}
+}
+
+func (c *rsyncCursor) end() bool {
+	return c.i >= len(c.s)
+}
+
+func (c *rsyncCursor) char() int {
+	if c.end() {
+		return 0
+	}
+	return int(c.s[c.i])
+}
+
+// order is the result when the names differ in kind: a path sorts after an
+// item
+func (c *rsyncCursor) order() int {
+	if c.item {
+		return -1
+	}
+	return 1
+}
+
+// rsyncMode is a file's mode as rsync sends it, with Unix type bits
+func rsyncMode(info os.FileInfo) int32 {
+	mode := info.Mode()
+	bits := int32(mode.Perm())
+	if mode&os.ModeSetuid != 0 {
+		bits |= 04000
+	}
+	if mode&os.ModeSetgid != 0 {
+		bits |= 02000
+	}
+	if mode&os.ModeSticky != 0 {
+		bits |= 01000
+	}
+	if mode.IsDir() {
+		return bits | 040000
+	}
+	return bits | 0100000
+}
+
+// rsyncID is a user or group of the file list, sent with its name so the
+// client can map it to its own
+type rsyncID struct {
+	id   int
+	name string
+}
+
+// sendFileList sends the file list, each entry leaving out what it shares
+// with the one before
+func (c *rsyncSession) sendFileList() {
+	w := c.out
+	owner := ""
+	if c.server.tree.archive != nil {
+		owner = c.server.tree.archive.owner
+	}
+	var last struct {
+		name     string
+		mode     int32
+		mtime    int64
+		uid, gid int
+	}
+	var users, groups []rsyncID
+	add := func(ids []rsyncID, id int, name string) []rsyncID {
+		// Root isn't mapped
+		if id == 0 || name == "" || slices.Contains(ids, rsyncID{id, name}) {
+			return ids
+		}
+		return append(ids, rsyncID{id, name})
+	}
+	for _, f := range c.files {
+		info := f.entry.info
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			header = &tar.Header{}
+		}
+		setOwner(header, owner)
+		mode, mtime := rsyncMode(info), info.ModTime().Unix()
+
+		xflags := 0
+		if info.IsDir() {
+			xflags = f.flags
+		}
+		if mode == last.mode {
+			xflags |= rsyncXmitSameMode
+		} else {
+			last.mode = mode
+		}
+		if !c.opts.owner || header.Uid == last.uid && last.name != "" {
+			xflags |= rsyncXmitSameUID
+		} else {
+			last.uid = header.Uid
+			users = add(users, header.Uid, header.Uname)
+		}
+		if !c.opts.group || header.Gid == last.gid && last.name != "" {
+			xflags |= rsyncXmitSameGID
+		} else {
+			last.gid = header.Gid
+			groups = add(groups, header.Gid, header.Gname)
+		}
+		if mtime == last.mtime {
+			xflags |= rsyncXmitSameTime
+		} else {
+			last.mtime = mtime
+		}
+		common := 0
+		for common < len(last.name) && common < len(f.name) && common < 255 && f.name[common] == last.name[common] {
+			common++
+		}
+		rest := f.name[common:]
+		if common > 0 {
+			xflags |= rsyncXmitSameName
+		}
+		if len(rest) > 255 {
+			xflags |= rsyncXmitLongName
+		}
+		// A zero flag byte ends the list, so a file sets a flag that means
+		// nothing for it
+		if xflags == 0 && !info.IsDir() {
+			xflags |= rsyncXmitTopDir
+		}
+		if xflags&0xFF00 != 0 || xflags == 0 {
+			w.shortint(xflags | rsyncXmitExtendedFlags)
+		} else {
+			w.byte(byte(xflags))
+		}
+		if xflags&rsyncXmitSameName != 0 {
+			w.byte(byte(common))
+		}
+		if xflags&rsyncXmitLongName != 0 {
+			w.varint(int32(len(rest)))
+		} else {
+			w.byte(byte(len(rest)))
+		}
+		w.Write([]byte(rest))
+		w.varlong(info.Size(), 3)
+		if xflags&rsyncXmitSameTime == 0 {
+			w.varlong(mtime, 4)
+		}
+		if xflags&rsyncXmitSameMode == 0 {
+			w.int32(mode)
+		}
+		if xflags&rsyncXmitSameUID == 0 {
+			w.varint(int32(header.Uid))
+		}
+		if xflags&rsyncXmitSameGID == 0 {
+			w.varint(int32(header.Gid))
+		}
+		if c.opts.checksum && info.Mode().IsRegular() {
+			w.Write(rsyncFileSum(f.entry.path))
+		}
+		last.name = f.name
+	}
+	w.byte(0)
+
+	if c.opts.numericIDs {
+		return
+	}
+	for _, list := range []struct {
+		send bool
+		ids  []rsyncID
+	}{{c.opts.owner, users}, {c.opts.group, groups}} {
+		if !list.send {
+			continue
+		}
+		for _, id := range list.ids {
+			if len(id.name) > 255 {
+				continue
+			}
+			w.varint(int32(id.id))
+			w.byte(byte(len(id.name)))
+			w.Write([]byte(id.name))
+		}
+		w.varint(0)
+	}
+}
+
+// rsyncFileSum is the MD5 of a file for -c, or zeros if it can't be read,
+// which the client takes as a change
+func rsyncFileSum(filePath string) []byte {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return make([]byte, md5.Size)
+	}
+	defer f.Close()
+	sum := md5.New()
+	if _, err := io.Copy(sum, f); err != nil {
+		return make([]byte, md5.Size)
+	}
+	return sum.Sum(nil)
+}
+
+// transfer answers the client's requests until it is done. The client asks
+// for files in up to three phases, the later ones to send again those that
+// failed to verify.
+func (c *rsyncSession) transfer() error {
+	for phase := 0; ; {
+		if err := c.out.flush(); err != nil {
+			return err
+		}
+		ndx := c.in.ndx()
+		if c.in.err != nil {
+			return c.in.err
+		}
+		if ndx == rsyncNdxDone {
+			if phase++; phase > 2 {
+				return nil
+			}
+			c.out.ndx(rsyncNdxDone)
+			continue
+		}
+		if ndx < 0 || int(ndx) >= len(c.files) {
+			return fmt.Errorf("invalid file index %d", ndx)
+		}
+		req := rsyncRequest{ndx: ndx, iflags: c.in.shortint()}
+		if req.iflags&rsyncItemBasisTypeFollows != 0 {
+			req.basis = c.in.byte()
+		}
+		if req.iflags&rsyncItemXnameFollows != 0 {
+			req.xname = c.in.vstring()
+		}
+		// Requests without a transfer are echoed for the client's log
+		if req.iflags&rsyncItemTransfer == 0 || c.opts.dryRun {
+			c.out.request(req)
+			continue
+		}
+		if !c.files[ndx].entry.info.Mode().IsRegular() || phase == 2 {
+			return fmt.Errorf("unexpected request for %s", c.files[ndx].name)
+		}
+		sums, err := c.readSums()
+		if err != nil {
+			return err
+		}
+		if err := c.sendFile(req, sums); err != nil {
+			return err
+		}
+	}
+}
+
+// readSums reads the checksums of the blocks of the client's copy of a file
+func (c *rsyncSession) readSums() (*rsyncSums, error) {
+	s := &rsyncSums{count: c.in.int32(), blength: c.in.int32(), s2length: c.in.int32(), remainder: c.in.int32()}
+	switch {
+	case c.in.err != nil:
+		return nil, c.in.err
+	case s.count < 0, s.blength < 0, s.blength > rsyncMaxBlockSize, s.count > 0 && s.blength == 0,
+		s.s2length < 0, s.s2length > md5.Size, s.remainder < 0, s.remainder > s.blength:
+		return nil, errors.New("invalid checksum header")
+	}
+	s.flength = int64(s.count) * int64(s.blength)
+	if s.remainder != 0 {
+		s.flength -= int64(s.blength - s.remainder)
+	}
+	// --append doesn't need them
+	if c.opts.appendMode > 0 {
+		return s, nil
+	}
+	for i := int32(0); i < s.count && c.in.err == nil; i++ {
+		s.weak = append(s.weak, uint32(c.in.int32()))
+		s.strong = append(s.strong, c.in.take(int(s.s2length))...)
+	}
+	return s, c.in.err
+}
+
+// sendFile downloads the file req names through the share's handler and
+// sends it as the differences from the client's copy
+func (c *rsyncSession) sendFile(req rsyncRequest, sums *rsyncSums) error {
+	f := c.files[req.ndx]
+	item, remaining := c.server.downloads.fileStatus()
+	switch {
+	case remaining == 0:
+		return c.refuse(req.ndx, "Download limit reached")
+	case !c.begin():
+		return c.refuse(req.ndx, "Share closed")
+	}
+
+	reader, writer := io.Pipe()
+	response := &treeResponse{out: writer, header: make(http.Header)}
+	if c.opts.appendMode == 1 {
+		response.skip = sums.flength
+	}
+	done := make(chan struct{})
+	go func() {
+		c.server.downloads.deliver(response, treeRequest(c.conn.RemoteAddr().String(), "/"+f.entry.rel), item, c.server.tree.content(f.entry))
+		writer.Close()
+		close(done)
+	}()
+	defer func() {
+		reader.Close()
+		<-done
+	}()
+	data := bufio.NewReaderSize(reader, rsyncBufferSize)
+	if _, err := data.Peek(1); err != nil {
+		<-done
+		if response.status >= 300 {
+			return c.refuse(req.ndx, strings.TrimSpace(response.message.String()))
+		}
+	}
+
+	c.out.request(req)
+	c.out.int32(sums.count)
+	c.out.int32(sums.blength)
+	c.out.int32(sums.s2length)
+	c.out.int32(sums.remainder)
+	sum, n := c.sendDelta(data, sums)
+	<-done
+	// A transfer cut short gets a checksum that can't match, so the client
+	// asks for the file again
+	want := f.entry.info.Size()
+	if c.opts.appendMode == 1 {
+		want -= sums.flength
+	}
+	if response.status >= 300 || n < want {
+		sum[0] ^= 0xFF
+		c.out.message(rsyncMsgErrorXfer, []byte("rsync: transfer interrupted: "+f.name+"\n"))
+	}
+	c.out.Write(sum)
+	return c.out.err
+}
+
+// begin marks the session as sending files, which shutdown waits for until
+// the session ends, or reports false once the server is closed
+func (c *rsyncSession) begin() bool {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	if c.server.closed {
+		return false
+	}
+	if !c.busy {
+		c.busy = true
+		c.server.downloads.activeDownloads.Add(1)
+	}
+	return true
+}
+
+// refuse tells the client a file it asked for won't be sent, and why
+func (c *rsyncSession) refuse(ndx int32, reason string) error {
+	c.out.message(rsyncMsgErrorXfer, []byte(fmt.Sprintf("rsync: %s: %s\n", reason, c.files[ndx].name)))
+	c.out.message(rsyncMsgNoSend, binary.LittleEndian.AppendUint32(nil, uint32(ndx)))
+	return c.out.err
+}
+
+// sendDelta sends data as literal bytes and references to the blocks of
+// the client's copy that match, rsync's block search, and returns the MD5
+// of the data with the number of bytes read. Both ends checksum with signed
+// bytes and the seed after each block.
+func (c *rsyncSession) sendDelta(data io.Reader, sums *rsyncSums) ([]byte, int64) {
+	sum := md5.New()
+	counter := &countingReader{r: data}
+	data = io.TeeReader(counter, sum)
+	w := c.out
+	literal := func(b []byte) {
+		for len(b) > 0 {
+			n := min(len(b), rsyncChunkSize)
+			w.int32(int32(n))
+			w.Write(b[:n])
+			b = b[n:]
+		}
+	}
+
+	// --append-verify checks the whole file but sends what the client lacks
+	if c.opts.appendMode == 2 {
+		io.CopyN(io.Discard, data, sums.flength)
+	}
+	if c.opts.appendMode > 0 || sums.count == 0 {
+		buf := make([]byte, rsyncChunkSize)
+		for {
+			n, err := io.ReadFull(data, buf)
+			literal(buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		w.int32(0)
+		return sum.Sum(nil), counter.n
+	}
+
+	blocks := make(map[uint32][]int32, sums.count)
+	for i, weak := range sums.weak {
+		blocks[weak] = append(blocks[weak], int32(i))
+	}
+	blockLen := func(i int32) int64 {
+		if i == sums.count-1 && sums.remainder != 0 {
+			return int64(sums.remainder)
+		}
+		return int64(sums.blength)
+	}
+	seed := binary.LittleEndian.AppendUint32(nil, uint32(c.opts.seed))
+	strong := func(b []byte) []byte {
+		h := md5.New()
+		h.Write(b)
+		if c.opts.seed != 0 {
+			h.Write(seed)
+		}
+		return h.Sum(nil)[:sums.s2length]
+	}
+
+	// buf holds the data from offset base on: the literal bytes not yet sent,
+	// from lit, and the block being checked, from pos
+	blength := int64(sums.blength)
+	var buf []byte
+	var base, lit, pos int64
+	eof := false
+	fill := func(end int64) {
+		for !eof && base+int64(len(buf)) < end {
+			if lit > base {
+				buf = buf[:copy(buf, buf[lit-base:])]
+				base = lit
+			}
+			if cap(buf)-len(buf) < rsyncBufferSize {
+				buf = append(buf[:cap(buf)], make([]byte, 2*rsyncBufferSize)...)[:len(buf)]
+			}
+			n, err := data.Read(buf[len(buf):cap(buf)])
+			buf = buf[:len(buf)+n]
+			eof = err != nil
+		}
+	}
+	var s1, s2 uint32
+	fresh := true
+	for {
+		fill(pos + blength + 1)
+		k := min(blength, base+int64(len(buf))-pos)
+		if k <= 0 {
+			break
+		}
+		window := buf[pos-base : pos-base+k]
+		if fresh {
+			s1, s2 = rsyncWeakSums(window)
+			fresh = false
+		}
+		if candidates, ok := blocks[s1&0xFFFF|s2<<16]; ok {
+			var got []byte
+			matched := int32(-1)
+			for _, i := range candidates {
+				if blockLen(i) != k || c.opts.inplace && int64(i)*blength < pos {
+					continue
+				}
+				if got == nil {
+					got = strong(window)
+				}
+				if bytes.Equal(got, sums.strong[int(i)*int(sums.s2length):int(i+1)*int(sums.s2length)]) {
+					matched = i
+					break
+				}
+			}
+			if matched >= 0 {
+				literal(buf[lit-base : pos-base])
+				w.int32(-(matched + 1))
+				pos += k
+				lit, fresh = pos, true
+				continue
+			}
+		}
+		// Roll the block on by a byte; past the end of the data it shrinks
+		x := uint32(int32(int8(window[0])))
+		s1 -= x
+		s2 -= uint32(k) * x
+		if pos+k < base+int64(len(buf)) {
+			s1 += uint32(int32(int8(buf[pos+k-base])))
+			s2 += s1
+		}
+		pos++
+		if pos-lit >= rsyncChunkSize {
+			literal(buf[lit-base : pos-base])
+			lit = pos
+		}
+	}
+	literal(buf[lit-base:])
+	w.int32(0)
+	return sum.Sum(nil), counter.n
+}
+
+// rsyncWeakSums are the two halves of rsync's rolling checksum of a block
+func rsyncWeakSums(b []byte) (uint32, uint32) {
+	var s1, s2 uint32
+	for _, x := range b {
+		s1 += uint32(int32(int8(x)))
+		s2 += s1
+	}
+	return s1, s2
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rsyncReader reads what the client sends. Once the stream is multiplexed
+// it reads the data and skips the client's messages, which are for its own
+// log. Errors stick, so a message can be read field by field and checked
+// once.
+type rsyncReader struct {
+	r       *bufio.Reader
+	mux     bool
+	left    int // Bytes left of the data message being read
+	prevNdx int32
+	prevNeg int32
+	read    int64
+	err     error
+}
+
+func (r *rsyncReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	for r.mux && r.left == 0 {
+		var head [4]byte
+		if _, err := io.ReadFull(r.r, head[:]); err != nil {
+			r.err = err
+			return 0, err
+		}
+		h := binary.LittleEndian.Uint32(head[:])
+		tag, n := int(h>>24)-rsyncMuxBase, int(h&0xFFFFFF)
+		r.read += 4
+		switch {
+		case tag < 0:
+			r.err = errors.New("unexpected data from the client")
+			return 0, r.err
+		case tag == rsyncMsgData:
+			r.left = n
+		default:
+			if _, err := io.CopyN(io.Discard, r.r, int64(n)); err != nil {
+				r.err = err
+				return 0, err
+			}
+			r.read += int64(n)
+		}
+	}
+	if r.mux {
+		p = p[:min(len(p), r.left)]
+	}
+	n, err := r.r.Read(p)
+	if r.mux {
+		r.left -= n
+	}
+	r.read += int64(n)
+	if err != nil {
+		r.err = err
+	}
+	return n, err
+}
+
+func (r *rsyncReader) take(n int) []byte {
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil && r.err == nil {
+		r.err = err
+	}
+	return b
+}
+
+func (r *rsyncReader) byte() byte {
+	return r.take(1)[0]
+}
+
+func (r *rsyncReader) shortint() int {
+	return int(binary.LittleEndian.Uint16(r.take(2)))
+}
+
+func (r *rsyncReader) int32() int32 {
+	return int32(binary.LittleEndian.Uint32(r.take(4)))
+}
+
+// varlong reads a number of at least min bytes; the leading one bits of
+// the first byte count the bytes that follow
+func (r *rsyncReader) varlong(min int) int64 {
+	head := r.take(min)
+	var b [9]byte
+	copy(b[:], head[1:])
+	extra := bits.LeadingZeros8(^head[0])
+	if extra > 6 {
+		extra = 6
+	}
+	if extra > 0 {
+		if min+extra > 9 {
+			r.err = errors.New("overlong number")
+			return 0
+		}
+		copy(b[min-1:], r.take(extra))
+		b[min+extra-1] = head[0] & (byte(1)<<(8-extra) - 1)
+	} else {
+		b[min-1] = head[0]
+	}
+	return int64(binary.LittleEndian.Uint64(b[:8]))
+}
+
+func (r *rsyncReader) varint() int32 {
+	return int32(r.varlong(1))
+}
+
+// vstring reads a string of up to 32767 bytes
+func (r *rsyncReader) vstring() []byte {
+	n := int(r.byte())
+	if n&0x80 != 0 {
+		n = (n&0x7F)<<8 | int(r.byte())
+	}
+	return r.take(n)
+}
+
+// ndx reads a file index, sent as the difference from the one before of
+// the same sign
+func (r *rsyncReader) ndx() int32 {
+	b := r.byte()
+	prev := &r.prevNdx
+	switch b {
+	case 0:
+		return rsyncNdxDone
+	case 0xFF:
+		b, prev = r.byte(), &r.prevNeg
+	}
+	var n int32
+	if b == 0xFE {
+		x := r.take(2)
+		if x[0]&0x80 != 0 {
+			y := r.take(2)
+			n = int32(uint32(x[1]) | uint32(y[0])<<8 | uint32(y[1])<<16 | uint32(x[0]&0x7F)<<24)
+		} else {
+			n = int32(x[0])<<8 | int32(x[1]) + *prev
+		}
+	} else {
+		n = int32(b) + *prev
+	}
+	*prev = n
+	if prev == &r.prevNeg {
+		return -n
+	}
+	return n
+}
+
+// rsyncWriter buffers what is sent to the client, as data messages once
+// the stream is multiplexed. Errors stick, as with rsyncReader.
+type rsyncWriter struct {
+	w       io.Writer
+	buf     []byte
+	mux     bool
+	prevNdx int32
+	written int64
+	err     error
+}
+
+func (w *rsyncWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= rsyncBufferSize {
+		w.flush()
+	}
+	return len(p), w.err
+}
+
+func (w *rsyncWriter) flush() error {
+	if len(w.buf) > 0 {
+		if w.mux {
+			w.send(rsyncMsgData, w.buf)
+		} else {
+			w.raw(w.buf)
+		}
+		w.buf = w.buf[:0]
+	}
+	return w.err
+}
+
+func (w *rsyncWriter) raw(b []byte) {
+	if w.err == nil {
+		var n int
+		n, w.err = w.w.Write(b)
+		w.written += int64(n)
+	}
+}
+
+func (w *rsyncWriter) send(tag int, payload []byte) {
+	frame := binary.LittleEndian.AppendUint32(make([]byte, 0, 4+len(payload)), uint32(rsyncMuxBase+tag)<<24|uint32(len(payload)))
+	w.raw(append(frame, payload...))
+}
+
+// message sends the client a message after the data before it
+func (w *rsyncWriter) message(tag int, payload []byte) {
+	w.flush()
+	w.send(tag, payload)
+	w.flush()
+}
+
+func (w *rsyncWriter) byte(b byte) {
+	w.Write([]byte{b})
+}
+
+func (w *rsyncWriter) shortint(v int) {
+	w.Write(binary.LittleEndian.AppendUint16(nil, uint16(v)))
+}
+
+func (w *rsyncWriter) int32(v int32) {
+	w.Write(binary.LittleEndian.AppendUint32(nil, uint32(v)))
+}
+
+func (w *rsyncWriter) varlong(v int64, min int) {
+	w.Write(appendRsyncVarlong(nil, v, min))
+}
+
+func (w *rsyncWriter) varint(v int32) {
+	w.Write(appendRsyncVarlong(nil, int64(uint32(v)), 1))
+}
+
+func (w *rsyncWriter) vstring(s []byte) {
+	if len(s) > 0x7F {
+		w.byte(byte(len(s)>>8) | 0x80)
+	}
+	w.byte(byte(len(s)))
+	w.Write(s)
+}
+
+// ndx sends a file index as the difference from the one before
+func (w *rsyncWriter) ndx(n int32) {
+	if n == rsyncNdxDone {
+		w.byte(0)
+		return
+	}
+	diff := n - w.prevNdx
+	w.prevNdx = n
+	switch {
+	case diff > 0 && diff < 0xFE:
+		w.byte(byte(diff))
+	case diff < 0 || diff > 0x7FFF:
+		w.Write([]byte{0xFE, byte(n>>24) | 0x80, byte(n), byte(n >> 8), byte(n >> 16)})
+	default:
+		w.Write([]byte{0xFE, byte(diff >> 8), byte(diff)})
+	}
+}
+
+// request echoes a file request in a reply
+func (w *rsyncWriter) request(req rsyncRequest) {
+	w.ndx(req.ndx)
+	w.shortint(req.iflags)
+	if req.iflags&rsyncItemBasisTypeFollows != 0 {
+		w.byte(req.basis)
+	}
+	if req.iflags&rsyncItemXnameFollows != 0 {
+		w.vstring(req.xname)
+	}
+}
+
+// appendRsyncVarlong appends v in at least min bytes, the first of which
+// counts the bytes that follow with its leading one bits
+func appendRsyncVarlong(dst []byte, v int64, min int) []byte {
+	var b [9]byte
+	binary.LittleEndian.PutUint64(b[1:], uint64(v))
+	n := 8
+	for n > min && b[n] == 0 {
+		n--
+	}
+	bit := byte(1) << (7 - n + min)
+	switch {
+	case b[n] >= bit:
+		n++
+		b[0] = ^(bit - 1)
+	case n > min:
+		b[0] = b[n] | ^(bit*2 - 1)
+	default:
+		b[0] = b[n]
+	}
+	return append(dst, b[:n]...)
+}
+
+// rsyncListener opens the --rsyncd port next to the HTTP one
+func rsyncListener(host string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if isAddrInUse(err) {
+		return nil, fmt.Errorf("rsync port %d is in use; pick another with --rsyncd-port", port)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for rsync: %v", err)
+	}
+	return l, nil
+}
+
+// rsyncURL is the address of the share's module
+func rsyncURL(host string, port int, module string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("rsync://%s:%d/%s/", host, port, module)
+}
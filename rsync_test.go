@@ -0,0 +1,447 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRsyncEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		v    int64
+		min  int
+		want []byte
+	}{
+		{0, 1, []byte{0}},
+		{0x7F, 1, []byte{0x7F}},
+		{0x80, 1, []byte{0x80, 0x80}},
+		{0x3FFF, 1, []byte{0xBF, 0xFF}},
+		{1, 3, []byte{0, 1, 0}},
+		{1 << 40, 3, []byte{0xE1, 0, 0, 0, 0, 0}},
+	} {
+		if got := appendRsyncVarlong(nil, tc.v, tc.min); !bytes.Equal(got, tc.want) {
+			t.Errorf("%d in %d bytes: expected %x, got %x", tc.v, tc.min, tc.want, got)
+		}
+	}
+
+	var wire bytes.Buffer
+	w := &rsyncWriter{w: &wire, prevNdx: -1}
+	numbers := []int64{0, 1, 0x7F, 0x80, 0xFFFF, 1 << 31, 1<<62 + 5, -1}
+	for _, v := range numbers {
+		w.varlong(v, 3)
+		w.varlong(v, 4)
+		w.varint(int32(v))
+	}
+	ndxs := []int32{0, 1, 2, 300, 299, 70000, 70001, rsyncNdxDone, 5}
+	for _, n := range ndxs {
+		w.ndx(n)
+	}
+	w.vstring(bytes.Repeat([]byte("x"), 200))
+	w.flush()
+
+	r := &rsyncReader{r: bufio.NewReader(&wire), prevNdx: -1, prevNeg: 1}
+	for _, v := range numbers {
+		if a, b, c := r.varlong(3), r.varlong(4), r.varint(); a != v || b != v || c != int32(v) {
+			t.Errorf("expected %d back, got %d, %d and %d", v, a, b, c)
+		}
+	}
+	for _, n := range ndxs {
+		if got := r.ndx(); got != n {
+			t.Errorf("expected index %d, got %d", n, got)
+		}
+	}
+	if got := r.vstring(); len(got) != 200 || r.err != nil {
+		t.Errorf("expected the long string back, got %d bytes, %v", len(got), r.err)
+	}
+}
+
+func TestRsyncArgs(t *testing.T) {
+	opts, paths, err := parseRsyncArgs([]string{"--server", "--sender", "-vlogDtpre.iLsfxCIvu", "--numeric-ids", "--append", "--append", ".", "share/", "share/sub"})
+	if err != nil || !opts.sender || !opts.recurse || !opts.owner || !opts.group || !opts.numericIDs || opts.appendMode != 2 || opts.dirs {
+		t.Errorf("unexpected options %+v, %v", opts, err)
+	}
+	if strings.Join(paths, " ") != "share/ share/sub" {
+		t.Errorf("unexpected paths %q", paths)
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--server", "--sender", "-vlogDtprze.iLsfxC", ".", "share/"}, "--compress (-z) isn't supported"},
+		{[]string{"--server", "--sender", "-a", "--iconv=utf8", ".", "share/"}, "--iconv isn't supported"},
+		{[]string{"--server", "--sender", "--checksum-choice=xxh128", ".", "share/"}, "--checksum-choice=xxh128 isn't supported; only md5 is"},
+		{[]string{"--server", "--sender", "-r"}, "malformed arguments"},
+	} {
+		if _, _, err := parseRsyncArgs(tc.args); err == nil || err.Error() != tc.want {
+			t.Errorf("%q: expected %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestRsyncFilters(t *testing.T) {
+	var rules []rsyncRule
+	for _, s := range []string{"- old/", "! ", "+ keep.iso", "- *.iso", "-r protected", ": .rsync-filter", "- /build/", "- cache/***", "- src/*.o", "- **/tmp/*.log", "- [ab]?.txt"} {
+		if rule, ok, clear := parseRsyncRule(s); clear {
+			rules = nil
+		} else if ok {
+			rules = append(rules, rule)
+		}
+	}
+	for _, tc := range []struct {
+		name     string
+		dir      bool
+		excluded bool
+	}{
+		{"old", true, false},
+		{"keep.iso", false, false},
+		{"disk.iso", false, true},
+		{"sub/disk.iso", false, true},
+		{"protected", false, false},
+		{"build", true, true},
+		{"build", false, false},
+		{"src/build", true, false},
+		{"cache", true, true},
+		{"x/cache/a/b", false, true},
+		{"src/a.o", false, true},
+		{"x/src/a.o", false, true},
+		{"src/sub/a.o", false, false},
+		{"a/b/tmp/run.log", false, true},
+		{"a1.txt", false, true},
+		{"c1.txt", false, false},
+		{"a12.txt", false, false},
+	} {
+		if got := rsyncExcluded(rules, tc.name, tc.dir); got != tc.excluded {
+			t.Errorf("%s (dir %v): expected excluded %v", tc.name, tc.dir, tc.excluded)
+		}
+	}
+
+	// Only directories pass "- ! */"
+	rule, _, _ := parseRsyncRule("-! */")
+	if !rsyncExcluded([]rsyncRule{rule}, "a.txt", false) || rsyncExcluded([]rsyncRule{rule}, "sub", true) {
+		t.Error("expected a negated rule to exclude what doesn't match")
+	}
+}
+
+func TestRsyncFileList(t *testing.T) {
+	dir := t.TempDir()
+	share := filepath.Join(dir, "share")
+	os.MkdirAll(filepath.Join(share, "sub", "deep"), 0755)
+	for _, name := range []string{"top.txt", "b.txt", ".env", "sub/inner.txt", "sub/deep/x.bin", "sub.txt"} {
+		os.WriteFile(filepath.Join(share, name), []byte(name), 0644)
+	}
+	os.Symlink("..", filepath.Join(share, "sub", "deep", "up"))
+	file := filepath.Join(dir, "file.bin")
+	os.WriteFile(file, []byte("file"), 0644)
+
+	archive := newArchiveProvider(share, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	dirShare := &rsyncServer{tree: &shareTree{archive: archive}, module: "share"}
+	fileShare := &rsyncServer{tree: &shareTree{file: &fileProvider{filePath: file, fileName: "file.bin"}}, module: "file.bin"}
+	deep, _, _ := parseRsyncRule("- deep/")
+	for _, tc := range []struct {
+		server  *rsyncServer
+		opts    rsyncOptions
+		paths   []string
+		rules   []rsyncRule
+		want    string
+		message string
+	}{
+		{dirShare, rsyncOptions{recurse: true}, []string{"share/"}, nil, ". b.txt sub.txt top.txt sub sub/inner.txt sub/deep sub/deep/x.bin", ""},
+		{dirShare, rsyncOptions{recurse: true}, []string{"share/sub"}, nil, "sub sub/inner.txt sub/deep sub/deep/x.bin", ""},
+		{dirShare, rsyncOptions{recurse: true}, []string{"share/"}, []rsyncRule{deep}, ". b.txt sub.txt top.txt sub sub/inner.txt", ""},
+		{dirShare, rsyncOptions{dirs: true}, []string{"share/"}, nil, ". b.txt sub.txt top.txt sub", ""},
+		{dirShare, rsyncOptions{}, []string{"share/*.txt", "share/sub/../top.txt"}, nil, "b.txt sub.txt top.txt", ""},
+		{dirShare, rsyncOptions{}, []string{"share/sub"}, nil, "", "skipping directory sub"},
+		{dirShare, rsyncOptions{recurse: true}, []string{"share/.env", "share/nope"}, nil, "", "file not found in the share: share/.env"},
+		{fileShare, rsyncOptions{recurse: true}, []string{"file.bin/"}, nil, "file.bin", ""},
+	} {
+		var wire bytes.Buffer
+		c := &rsyncSession{server: tc.server, opts: tc.opts, out: &rsyncWriter{w: &wire}}
+		var names []string
+		for _, f := range c.fileList(tc.paths, tc.rules) {
+			names = append(names, f.name)
+		}
+		if got := strings.Join(names, " "); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.paths, tc.want, got)
+		}
+		if !strings.Contains(wire.String(), tc.message) {
+			t.Errorf("%q: expected the message %q, got %q", tc.paths, tc.message, wire.String())
+		}
+	}
+}
+
+// rsyncClient is the receiving end of a pull, for TestRsyncSession
+type rsyncClient struct {
+	t    *testing.T
+	conn net.Conn
+	in   *rsyncReader
+	out  *rsyncWriter
+}
+
+// dialRsync connects to module with args, and returns the server's answer
+// to the module name
+func dialRsync(t *testing.T, addr net.Addr, version, module string, args ...string) (*rsyncClient, string) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &rsyncClient{t: t, conn: conn, in: &rsyncReader{r: bufio.NewReader(conn), prevNdx: -1, prevNeg: 1}, out: &rsyncWriter{w: conn, prevNdx: -1}}
+	if greeting, _ := c.in.r.ReadString('\n'); greeting != "@RSYNCD: 30.0\n" {
+		t.Fatalf("unexpected greeting %q", greeting)
+	}
+	io.WriteString(conn, "@RSYNCD: "+version+" md5\n"+module+"\n")
+	answer, _ := c.in.r.ReadString('\n')
+	if answer == "@RSYNCD: OK\n" {
+		io.WriteString(conn, strings.Join(args, "\x00")+"\x00\x00")
+		if flags := c.in.varint(); flags != 0 || c.in.err != nil {
+			t.Fatalf("expected no compatibility flags, got %d, %v", flags, c.in.err)
+		}
+		c.in.int32()
+		c.in.mux, c.out.mux = true, true
+	}
+	return c, answer
+}
+
+// rsyncEntry is a file list entry as the client gets it
+type rsyncEntry struct {
+	name string
+	size int64
+	mode int32
+}
+
+// fileList reads the file list of a pull with -o and -g
+func (c *rsyncClient) fileList() ([]rsyncEntry, []string) {
+	var entries []rsyncEntry
+	var last rsyncEntry
+	for {
+		flags := int(c.in.byte())
+		if flags == 0 {
+			break
+		}
+		if flags&rsyncXmitExtendedFlags != 0 {
+			flags |= int(c.in.byte()) << 8
+		}
+		prefix := 0
+		if flags&rsyncXmitSameName != 0 {
+			prefix = int(c.in.byte())
+		}
+		n := int(c.in.byte())
+		if flags&rsyncXmitLongName != 0 {
+			n = int(c.in.varint())
+		}
+		e := rsyncEntry{name: last.name[:prefix] + string(c.in.take(n)), size: c.in.varlong(3), mode: last.mode}
+		if flags&rsyncXmitSameTime == 0 {
+			c.in.varlong(4)
+		}
+		if flags&rsyncXmitSameMode == 0 {
+			e.mode = c.in.int32()
+		}
+		if flags&rsyncXmitSameUID == 0 {
+			c.in.varint()
+		}
+		if flags&rsyncXmitSameGID == 0 {
+			c.in.varint()
+		}
+		entries = append(entries, e)
+		last = e
+	}
+	var ids []string
+	for range 2 {
+		for c.in.varint() != 0 {
+			ids = append(ids, string(c.in.take(int(c.in.byte()))))
+		}
+	}
+	if c.in.err != nil {
+		c.t.Fatal(c.in.err)
+	}
+	return entries, ids
+}
+
+// get asks for file ndx, with the block checksums of old, and returns the
+// file rebuilt from the reply with the number of literal bytes sent
+func (c *rsyncClient) get(ndx int32, old []byte, blength int) ([]byte, int) {
+	c.t.Helper()
+	c.out.ndx(ndx)
+	c.out.shortint(rsyncItemTransfer)
+	count, remainder := 0, 0
+	if blength > 0 {
+		count, remainder = (len(old)+blength-1)/blength, len(old)%blength
+	}
+	for _, v := range []int{count, blength, md5.Size, remainder} {
+		c.out.int32(int32(v))
+	}
+	for i := 0; i < count; i++ {
+		block := old[i*blength : min(len(old), (i+1)*blength)]
+		s1, s2 := rsyncWeakSums(block)
+		c.out.int32(int32(s1&0xFFFF | s2<<16))
+		c.out.Write(c.strong(block))
+	}
+	c.out.flush()
+
+	if got := c.in.ndx(); got != ndx {
+		c.t.Fatalf("expected file %d, got %d", ndx, got)
+	}
+	c.in.shortint()
+	c.in.take(16)
+	var file []byte
+	literal := 0
+	for {
+		token := c.in.int32()
+		if c.in.err != nil {
+			c.t.Fatal(c.in.err)
+		}
+		switch {
+		case token > 0:
+			file = append(file, c.in.take(int(token))...)
+			literal += int(token)
+		case token < 0:
+			i := int(-token - 1)
+			file = append(file, old[i*blength:min(len(old), (i+1)*blength)]...)
+		}
+		if token == 0 {
+			break
+		}
+	}
+	if sum := md5.Sum(file); !bytes.Equal(c.in.take(md5.Size), sum[:]) {
+		c.t.Error("expected the checksum of the file")
+	}
+	return file, literal
+}
+
+// strong is the block checksum with the seed of the session, which the test
+// sets with --checksum-seed
+func (c *rsyncClient) strong(block []byte) []byte {
+	h := md5.New()
+	h.Write(block)
+	h.Write(binary.LittleEndian.AppendUint32(nil, 42))
+	return h.Sum(nil)
+}
+
+// messages returns the text the server sends until it closes the connection
+func (c *rsyncClient) messages() string {
+	var text strings.Builder
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(c.in.r, head); err != nil {
+			return text.String()
+		}
+		h := binary.LittleEndian.Uint32(head)
+		payload := make([]byte, h&0xFFFFFF)
+		io.ReadFull(c.in.r, payload)
+		if tag := int(h>>24) - rsyncMuxBase; tag != rsyncMsgData && tag != rsyncMsgNoSend {
+			text.Write(payload)
+		}
+	}
+}
+
+func TestRsyncSession(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	data := make([]byte, 200000)
+	rand.New(rand.NewSource(1)).Read(data)
+	os.WriteFile(filepath.Join(dir, "data.bin"), data, 0644)
+	os.WriteFile(filepath.Join(dir, "skip.iso"), []byte("iso"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "notes.txt"), []byte("notes"), 0600)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := newArchiveProvider(dir, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	h := &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 2}
+	s := newRsyncServer(l, &shareTree{archive: archive}, h)
+	go s.serve()
+	defer s.Close()
+	pull := []string{"--server", "--sender", "-logDtpre.iLsfxCIvu", "--checksum-seed=42", ".", "share/"}
+
+	for _, tc := range []struct {
+		version, module, want string
+	}{
+		{"31.0", "#list", "share          \tuserve share (read-only)\n"},
+		{"31.0", "other", "@ERROR: Unknown module 'other'\n"},
+		{"29.0", "share", "@ERROR: protocol version mismatch -- this server needs rsync 3.0 or later\n"},
+	} {
+		if c, answer := dialRsync(t, l.Addr(), tc.version, tc.module); answer != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.module, tc.want, answer)
+		} else {
+			c.conn.Close()
+		}
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--server", "-logDtpre.iLsfxCIvu", ".", "share/"}, "ERROR: module is read only\n"},
+		{[]string{"--server", "--sender", "-logDtprze.iLsfxCIvu", ".", "share/"}, "ERROR: --compress (-z) isn't supported\n"},
+	} {
+		c, _ := dialRsync(t, l.Addr(), "31.0", "share", tc.args...)
+		if got := c.messages(); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.args, tc.want, got)
+		}
+		c.conn.Close()
+	}
+
+	c, _ := dialRsync(t, l.Addr(), "31.0", "share", pull...)
+	defer c.conn.Close()
+	c.out.int32(int32(len("- *.iso")))
+	c.out.Write([]byte("- *.iso"))
+	c.out.int32(0)
+	c.out.flush()
+	entries, _ := c.fileList()
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.name)
+	}
+	if strings.Join(names, " ") != ". data.bin sub sub/notes.txt" {
+		t.Fatalf("unexpected file list %q", names)
+	}
+	if e := entries[3]; e.size != 5 || e.mode != 0100600 {
+		t.Errorf("unexpected entry %+v", e)
+	}
+
+	// A new file is sent whole, and a changed one as the differences
+	if got, literal := c.get(1, nil, 0); !bytes.Equal(got, data) || literal != len(data) {
+		t.Errorf("expected the file, got %d bytes", len(got))
+	}
+	old := bytes.Clone(data[:150000])
+	copy(old[70000:], "changed")
+	if got, literal := c.get(1, old, 700); !bytes.Equal(got, data) || literal > 52000 {
+		t.Errorf("expected the file from the blocks it has, got %d bytes with %d sent", len(got), literal)
+	}
+
+	// The limit is reached, so the next file isn't sent
+	c.out.ndx(3)
+	c.out.shortint(rsyncItemTransfer)
+	for range 4 {
+		c.out.int32(0)
+	}
+	for range 3 {
+		c.out.ndx(rsyncNdxDone)
+	}
+	c.out.flush()
+	for range 3 {
+		if got := c.in.ndx(); got != rsyncNdxDone {
+			t.Fatalf("expected the end of a phase, got %d", got)
+		}
+	}
+	for range 5 {
+		c.in.varlong(3)
+	}
+	c.out.ndx(rsyncNdxDone)
+	c.out.flush()
+	if c.in.err != nil {
+		t.Fatal(c.in.err)
+	}
+}
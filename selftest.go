@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const selftestSize = 4 << 20
+
+// isolated is set while the self-test's share runs, which ignores USERVE_*
+// variables and the config file so they can't change what is checked
+var isolated bool
+
+// skippedError marks a self-test check that could not be evaluated
+type skippedError struct {
+	reason string
+}
+
+func (e *skippedError) Error() string {
+	return e.reason
+}
+
+// runSelftest serves a generated file on a loopback port using the regular
+// serving code, downloads it back and reports each check to w. The file is
+// served in a cached tar archive, which has a length and takes Range
+// requests, so resuming can be checked too.
+func runSelftest(w io.Writer) error {
+	dir, err := os.MkdirTemp("", "userve-selftest")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data := make([]byte, selftestSize)
+	rand.Read(data)
+	shareDir := filepath.Join(dir, "selftest")
+	if err := os.Mkdir(shareDir, 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(shareDir, "selftest.bin"), data, 0644); err != nil {
+		return err
+	}
+
+	// Pick a free port, then hand it to the server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return fmt.Errorf("cannot listen on loopback: %v", err)
+	}
+	addr := ln.Addr().String()
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+
+	isolated = true
+	defer func() { isolated = false }()
+	serverDone := make(chan error, 1)
+	go func() {
+		serverDone <- serve([]string{"-p", strconv.Itoa(port), "-i", "127.0.0.1", "-c", "2", "-q", "-a", "tar", "--cache-archives", shareDir}, nil)
+	}()
+	url := fmt.Sprintf("http://%s/selftest.tar", addr)
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	var failed bool
+	var skips int
+	report := func(name string, err error) {
+		var skipped *skippedError
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "  PASS  %s\n", name)
+		case errors.As(err, &skipped):
+			skips++
+			fmt.Fprintf(w, "  SKIP  %s: %v\n", name, err)
+		default:
+			failed = true
+			fmt.Fprintf(w, "  FAIL  %s: %v\n", name, err)
+		}
+	}
+
+	fmt.Fprintf(w, "Running self-test on %s\n", addr)
+
+	if err := waitForServer(addr, serverDone, 5*time.Second); err != nil {
+		report("server startup", err)
+		return errors.New("self-test failed")
+	}
+	report("server startup", nil)
+
+	// The whole archive, which the resumed download is compared with
+	var archive []byte
+	report("download and checksum", func() error {
+		resp, err := client.Get(url)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return fmt.Errorf("interrupted after %d bytes: %v", len(body), err)
+		}
+		// Skip the directory's own entry
+		tr := tar.NewReader(bytes.NewReader(body))
+		for {
+			hdr, err := tr.Next()
+			if err != nil {
+				return fmt.Errorf("cannot read archive: %v", err)
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				break
+			}
+		}
+		h := sha256.New()
+		n, err := io.Copy(h, tr)
+		if err != nil {
+			return fmt.Errorf("cannot read archive: %v", err)
+		}
+		if want := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), want[:]) {
+			return fmt.Errorf("checksum mismatch after %d bytes", n)
+		}
+		archive = body
+		return nil
+	}())
+
+	report("range resume", func() error {
+		if archive == nil {
+			return &skippedError{"no full download to compare with"}
+		}
+		offset := len(archive) / 2
+		req, _ := http.NewRequest("GET", url, nil)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return &skippedError{"server sent the full file instead of a range"}
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		if !bytes.Equal(body, archive[offset:]) {
+			return errors.New("resumed content does not match")
+		}
+		return nil
+	}())
+
+	report("shutdown after download limit", func() error {
+		select {
+		case err := <-serverDone:
+			if err != nil {
+				return err
+			}
+		case <-time.After(10 * time.Second):
+			return errors.New("server still running")
+		}
+		if conn, err := net.DialTimeout("tcp", addr, time.Second); err == nil {
+			conn.Close()
+			return errors.New("server still accepting connections")
+		}
+		return nil
+	}())
+
+	if failed {
+		return errors.New("self-test failed")
+	}
+	if skips > 0 {
+		fmt.Fprintf(w, "No checks failed, %d skipped\n", skips)
+		return nil
+	}
+	fmt.Fprintf(w, "All checks passed\n")
+	return nil
+}
+
+// waitForServer polls addr until it accepts connections
+func waitForServer(addr string, serverDone <-chan error, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		select {
+		case err := <-serverDone:
+			return fmt.Errorf("server exited: %v", err)
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", addr, 100*time.Millisecond); err == nil {
+			conn.Close()
+			return nil
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	return errors.New("server did not start listening")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// secondaryServer is a protocol that serves the share next to HTTP, such
+// as --ftp. Each is turned on by the flag of its name, and one with a port
+// of its own takes it from --<name>-port; port is 0 for one that uses the
+// HTTP server's.
+type secondaryServer struct {
+	name    string
+	enabled bool
+	port    int
+	udp     bool // Listens on a UDP port, which TCP ones don't conflict with
+	noLive  bool // Can't serve a --live file, which may change under it
+	perFile bool // Counts each file of a directory as a download
+}
+
+// secondaryShare is what the secondary servers need to know of the share
+type secondaryShare struct {
+	receiving bool // --receive or --two-way
+	cached    bool // --cache-archives or --prebuild
+	live      bool // --live
+	single    bool // A single file or directory, which they serve as a tree
+}
+
+// checkSecondaryServers checks that the enabled servers can serve share,
+// and that none of them listens on the port of another or on the HTTP
+// server's httpPort. A port is only given with its server.
+func checkSecondaryServers(fs *flag.FlagSet, servers []secondaryServer, httpPort int, share secondaryShare) error {
+	for _, s := range servers {
+		if !s.enabled {
+			if flagSet(fs, s.name+"-port") {
+				return fmt.Errorf("--%s-port needs --%s", s.name, s.name)
+			}
+			continue
+		}
+		switch {
+		case share.receiving:
+			return fmt.Errorf("--%s can't be used with --receive or --two-way", s.name)
+		case share.cached:
+			return fmt.Errorf("--%s can't be used with --cache-archives or --prebuild", s.name)
+		case !share.single:
+			return fmt.Errorf("--%s needs a single file or directory", s.name)
+		case share.live && s.noLive:
+			return fmt.Errorf("--%s can't be used with --live", s.name)
+		}
+	}
+
+	// Port 0 is a free port, or none of the server's own, which never
+	// conflicts
+	for i, s := range servers {
+		if !s.enabled || s.port == 0 {
+			continue
+		}
+		if s.port == httpPort && !s.udp {
+			return fmt.Errorf("--%s-port and -p must differ", s.name)
+		}
+		for _, other := range servers[:i] {
+			if other.enabled && other.port == s.port && other.udp == s.udp {
+				return fmt.Errorf("--%s-port and --%s-port must differ", s.name, other.name)
+			}
+		}
+	}
+	return nil
+}
+
+// perFileServer returns the name of the first enabled server that counts
+// each file of a directory as a download, or "" if there is none
+func perFileServer(servers []secondaryServer) string {
+	for _, s := range servers {
+		if s.enabled && s.perFile {
+			return s.name
+		}
+	}
+	return ""
+}
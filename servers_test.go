@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSecondaryServerFlags(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	os.WriteFile(a, []byte("a"), 0644)
+	os.WriteFile(b, []byte("b"), 0644)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--ftp", "--bundle", a, b}, "--ftp needs a single file or directory"},
+		{[]string{"--ftp", "--text", "hello"}, "--ftp needs a single file or directory"},
+		{[]string{"--ftp", "--receive", dir}, "--ftp can't be used with --receive or --two-way"},
+		{[]string{"--ftp", "--cache-archives", dir}, "--ftp can't be used with --cache-archives or --prebuild"},
+		{[]string{"--ftp", "-p", "2121", dir}, "--ftp-port and -p must differ"},
+		{[]string{"--ftp-port", "2122", dir}, "--ftp-port needs --ftp"},
+		{[]string{"--sftp", "--bundle", a, b}, "--sftp needs a single file or directory"},
+		{[]string{"--sftp", "--prebuild", dir}, "--sftp can't be used with --cache-archives or --prebuild"},
+		{[]string{"--sftp", "--ftp", "--sftp-port", "2121", dir}, "--sftp-port and --ftp-port must differ"},
+		{[]string{"--sftp-port", "2223", dir}, "--sftp-port needs --sftp"},
+		{[]string{"--tftp", "--bundle", a, b}, "--tftp needs a single file or directory"},
+		{[]string{"--tftp", "--two-way", dir, a}, "--tftp can't be used with --receive or --two-way"},
+		{[]string{"--tftp-port", "6969", dir}, "--tftp-port needs --tftp"},
+		{[]string{"--rsyncd", "--cache-archives", dir}, "--rsyncd can't be used with --cache-archives or --prebuild"},
+		{[]string{"--rsyncd", "--sftp", "--rsyncd-port", "2222", dir}, "--rsyncd-port and --sftp-port must differ"},
+		{[]string{"--rsyncd", "--rsyncd-port", "8080", dir}, "--rsyncd-port and -p must differ"},
+		{[]string{"--rsyncd-port", "8874", dir}, "--rsyncd-port needs --rsyncd"},
+		{[]string{"--torrent", "--receive", dir}, "--torrent can't be used with --receive or --two-way"},
+		{[]string{"--torrent", "--live", a}, "--torrent can't be used with --live"},
+		{[]string{"--torrent", "--rsyncd", "--torrent-port", "9000", "--rsyncd-port", "9000", dir}, "--torrent-port and --rsyncd-port must differ"},
+		{[]string{"--torrent-port", "7000", dir}, "--torrent-port needs --torrent"},
+		{[]string{"--dlna", "--text", "hello"}, "--dlna needs a single file or directory"},
+		{[]string{"--dlna", "--prebuild", dir}, "--dlna can't be used with --cache-archives or --prebuild"},
+		{[]string{"--dlna", a}, "--dlna needs a video, audio or image file, or a directory"},
+	} {
+		if err := run(tc.args); err == nil || err.Error() != tc.want {
+			t.Errorf("%q: expected %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
+
+func TestSecondaryServerPorts(t *testing.T) {
+	share := secondaryShare{single: true}
+	fs := flag.NewFlagSet("userve", flag.ContinueOnError)
+	udp := []secondaryServer{
+		{name: "ftp", enabled: true, port: 8080},
+		{name: "tftp", enabled: true, port: 8080, udp: true},
+	}
+	if err := checkSecondaryServers(fs, udp, 8081, share); err != nil {
+		t.Errorf("expected a UDP port to leave TCP ones alone, got %v", err)
+	}
+	if err := checkSecondaryServers(fs, udp[1:], 8080, share); err != nil {
+		t.Errorf("expected a UDP port to leave the HTTP one alone, got %v", err)
+	}
+	free := []secondaryServer{
+		{name: "ftp", enabled: true},
+		{name: "sftp", enabled: true},
+	}
+	if err := checkSecondaryServers(fs, free, 0, share); err != nil {
+		t.Errorf("expected free ports not to conflict, got %v", err)
+	}
+}
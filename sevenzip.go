@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// sevenZipCommands are the names the 7-Zip command line tool is installed
+// under: 7z (p7zip, Windows), 7zz (7-Zip for Linux/macOS) and 7za
+var sevenZipCommands = []string{"7z", "7zz", "7za"}
+
+// find7z returns the path of an installed 7-Zip command line tool
+func find7z() (string, error) {
+	for _, name := range sevenZipCommands {
+		if path, err := exec.LookPath(name); err == nil {
+			return path, nil
+		}
+	}
+	return "", fmt.Errorf("7z archives require 7-Zip (7z, 7zz or 7za) to be installed")
+}
+
+// sevenZipList is the files of one archived root, relative to the root's
+// parent directory where 7z runs
+type sevenZipList struct {
+	dir   string
+	names []string
+}
+
+// sevenZipLists walks each archived root, applying the filter. 7z can't
+// write to a pipe or take a filter, so it gets explicit file lists;
+// directories are implied by the files in them.
+func (p *archiveProvider) sevenZipLists() ([]sevenZipList, error) {
+	var lists []sevenZipList
+	for _, root := range append([]string{p.dirPath}, p.extraPaths...) {
+		single := *p
+		single.dirPath, single.extraPaths = root, nil
+
+		list := sevenZipList{dir: filepath.Dir(root)}
+		err := single.walk(func(path, name string, info os.FileInfo) error {
+			if !info.IsDir() {
+				list.names = append(list.names, name)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if len(list.names) > 0 {
+			lists = append(lists, list)
+		}
+	}
+	return lists, nil
+}
+
+// write7zArchive builds the archive in a temporary directory with the 7z
+// tool and then streams it. Nothing is sent until the archive is complete,
+// so 7z is killed once ctx is done rather than when a write fails.
+func (p *archiveProvider) write7zArchive(ctx context.Context, w io.Writer) error {
+	bin, err := find7z()
+	if err != nil {
+		return err
+	}
+	lists, err := p.sevenZipLists()
+	if err != nil {
+		return err
+	}
+	if len(lists) == 0 {
+		return fmt.Errorf("no files to archive")
+	}
+
+	tmpDir, err := os.MkdirTemp("", "userve-7z-")
+	if err != nil {
+		return fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	archivePath := filepath.Join(tmpDir, "archive.7z")
+
+	for i, list := range lists {
+		listPath := filepath.Join(tmpDir, fmt.Sprintf("list%d.txt", i))
+		if err := os.WriteFile(listPath, []byte(strings.Join(list.names, "\n")+"\n"), 0600); err != nil {
+			return err
+		}
+		args := []string{"a", "-t7z", "-bd", "-y", "-scsUTF-8"}
+		if p.level >= 0 {
+			args = append(args, fmt.Sprintf("-mx=%d", p.level))
+		}
+		if p.reproducible {
+			// Leave out timestamps
+			args = append(args, "-mtm=off", "-mtc=off", "-mta=off")
+		}
+		if p.filter.symlinkMode() == symlinksPreserve {
+			// Store symlinks as links rather than their targets
+			args = append(args, "-snl")
+		}
+		cmd := exec.CommandContext(ctx, bin, append(args, archivePath, "@"+listPath)...)
+		cmd.Dir = list.dir
+		if out, err := cmd.CombinedOutput(); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return fmt.Errorf("7z failed: %v: %s", err, strings.TrimSpace(string(out)))
+		}
+	}
+
+	file, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
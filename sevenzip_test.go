@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSevenZipLists(t *testing.T) {
+	root := makeTree(t, "a.txt", "empty/.keep", "sub/b.log", "sub/c.txt")
+	other := filepath.Join(t.TempDir(), "notes.md")
+	if err := os.WriteFile(other, []byte("notes"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	p := &archiveProvider{
+		dirPath:    root,
+		dirName:    "project",
+		format:     Archive7z,
+		extraPaths: []string{other},
+		filter:     &archiveFilter{exclude: []string{"*.log"}},
+	}
+	lists, err := p.sevenZipLists()
+	if err != nil {
+		t.Fatalf("sevenZipLists failed: %v", err)
+	}
+	if len(lists) != 2 {
+		t.Fatalf("expected a list per root, got %d", len(lists))
+	}
+
+	// Each root is listed relative to its parent directory
+	if lists[0].dir != filepath.Dir(root) || lists[1].dir != filepath.Dir(other) {
+		t.Errorf("unexpected directories %q, %q", lists[0].dir, lists[1].dir)
+	}
+	var names []string
+	for _, list := range lists {
+		for _, name := range list.names {
+			names = append(names, filepath.ToSlash(name))
+		}
+	}
+	if got := strings.Join(names, " "); got != "project/a.txt project/empty/.keep project/sub/c.txt notes.md" {
+		t.Errorf("unexpected file lists: %s", got)
+	}
+}
+
+func TestSevenZipArchive(t *testing.T) {
+	if _, err := find7z(); err != nil {
+		t.Skip("7-Zip not installed")
+	}
+	root := makeTree(t, "a.txt", "sub/b.txt")
+
+	p := &archiveProvider{dirPath: root, dirName: "project", format: Archive7z}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("7z\xbc\xaf\x27\x1c")) {
+		t.Error("expected 7z signature")
+	}
+}
@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultSFTPPort is where --sftp listens; ports below 1024 need root
+const defaultSFTPPort = 2222
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), which every client
+// speaks: packet types (SSH_FXP_*) and status codes (SSH_FX_*)
+const (
+	fxpInit     = 1
+	fxpVersion  = 2
+	fxpOpen     = 3
+	fxpClose    = 4
+	fxpRead     = 5
+	fxpWrite    = 6
+	fxpLstat    = 7
+	fxpFstat    = 8
+	fxpSetstat  = 9
+	fxpFsetstat = 10
+	fxpOpendir  = 11
+	fxpReaddir  = 12
+	fxpRemove   = 13
+	fxpMkdir    = 14
+	fxpRmdir    = 15
+	fxpRealpath = 16
+	fxpStat     = 17
+	fxpRename   = 18
+	fxpSymlink  = 20
+	fxpStatus   = 101
+	fxpHandle   = 102
+	fxpData     = 103
+	fxpName     = 104
+	fxpAttrs    = 105
+
+	fxOK               = 0
+	fxEOF              = 1
+	fxNoSuchFile       = 2
+	fxPermissionDenied = 3
+	fxFailure          = 4
+	fxBadMessage       = 5
+	fxUnsupported      = 8
+
+	sftpOpenRead    = 1
+	sftpAttrSize    = 1
+	sftpAttrPerms   = 4
+	sftpAttrTimes   = 8
+	sftpMaxRead     = 256 << 10
+	sftpMaxHandles  = 64
+	sftpNamesPerMsg = 100
+)
+
+// sftpSession is the sftp subsystem of one SSH session channel
+type sftpSession struct {
+	tree       *shareTree
+	downloads  *handler
+	conn       *sshConn // Lets the server's Close wait for files being sent
+	client     string
+	out        io.Writer
+	handles    map[string]*sftpHandle
+	nextHandle int
+}
+
+// sftpHandle is an open file or directory
+type sftpHandle struct {
+	entry   treeEntry
+	entries []treeEntry // A directory's, until READDIR has sent them
+	listed  bool
+	stream  *sftpStream
+}
+
+// sftpStream is a download of an open file, read by the client from pos
+// on. Clients read a file in order, several requests ahead, so one
+// download through the share's handler serves them all; a read elsewhere
+// starts another.
+type sftpStream struct {
+	pos      int64
+	reader   *io.PipeReader
+	response *treeResponse
+	done     chan struct{}
+}
+
+// serve answers requests until the channel closes
+func (s *sftpSession) serve(rw io.ReadWriter) {
+	s.out = rw
+	defer func() {
+		for _, h := range s.handles {
+			s.stop(h)
+		}
+	}()
+	r := bufio.NewReader(rw)
+	head := make([]byte, 4)
+	for {
+		if _, err := io.ReadFull(r, head); err != nil {
+			return
+		}
+		length := binary.BigEndian.Uint32(head)
+		if length == 0 || length > sshMaxPacket {
+			return
+		}
+		packet := make([]byte, length)
+		if _, err := io.ReadFull(r, packet); err != nil {
+			return
+		}
+		if err := s.handle(packet); err != nil {
+			return
+		}
+	}
+}
+
+// send writes a response packet
+func (s *sftpSession) send(payload []byte) error {
+	_, err := s.out.Write(appendSSHString(nil, payload))
+	return err
+}
+
+func (s *sftpSession) status(id, code uint32, message string) error {
+	payload := binary.BigEndian.AppendUint32([]byte{fxpStatus}, id)
+	payload = binary.BigEndian.AppendUint32(payload, code)
+	payload = appendSSHString(payload, []byte(message))
+	return s.send(appendSSHString(payload, nil))
+}
+
+// handle answers a request. Only errors writing to the client end the
+// session.
+func (s *sftpSession) handle(packet []byte) error {
+	if packet[0] == fxpInit {
+		return s.send(binary.BigEndian.AppendUint32([]byte{fxpVersion}, 3))
+	}
+	r := &sshReader{b: packet[1:]}
+	id := r.uint32()
+	switch packet[0] {
+	case fxpRealpath:
+		name := "/" + s.resolve(r.string())
+		return s.names(id, []sftpEntry{{name: name, long: name}})
+	case fxpStat, fxpLstat:
+		entry, _, ok := s.tree.lookup(s.resolve(r.string()))
+		if !ok {
+			return s.status(id, fxNoSuchFile, "No such file")
+		}
+		return s.send(sftpAttributes(binary.BigEndian.AppendUint32([]byte{fxpAttrs}, id), entry.info))
+	case fxpFstat:
+		h, ok := s.handles[r.string()]
+		if !ok {
+			return s.status(id, fxFailure, "Invalid handle")
+		}
+		return s.send(sftpAttributes(binary.BigEndian.AppendUint32([]byte{fxpAttrs}, id), h.entry.info))
+	case fxpOpendir:
+		entry, ignores, ok := s.tree.lookup(s.resolve(r.string()))
+		if !ok || !entry.info.IsDir() {
+			return s.status(id, fxNoSuchFile, "No such directory")
+		}
+		return s.open(id, &sftpHandle{entry: entry, entries: s.tree.children(entry, ignores)})
+	case fxpReaddir:
+		return s.readDir(id, r.string())
+	case fxpOpen:
+		name, flags := r.string(), r.uint32()
+		if flags&^sftpOpenRead != 0 {
+			return s.status(id, fxPermissionDenied, "The share is read-only")
+		}
+		entry, _, ok := s.tree.lookup(s.resolve(name))
+		if !ok || entry.info.IsDir() {
+			return s.status(id, fxNoSuchFile, "No such file")
+		}
+		return s.open(id, &sftpHandle{entry: entry})
+	case fxpRead:
+		handle, offset, length := r.string(), r.uint64(), r.uint32()
+		if r.bad {
+			return s.status(id, fxBadMessage, "Malformed request")
+		}
+		return s.read(id, handle, int64(offset), int(min(length, sftpMaxRead)))
+	case fxpClose:
+		handle := r.string()
+		h, ok := s.handles[handle]
+		if !ok {
+			return s.status(id, fxFailure, "Invalid handle")
+		}
+		delete(s.handles, handle)
+		err := s.status(id, fxOK, "")
+		s.stop(h)
+		return err
+	case fxpWrite, fxpSetstat, fxpFsetstat, fxpRemove, fxpMkdir, fxpRmdir, fxpRename, fxpSymlink:
+		return s.status(id, fxPermissionDenied, "The share is read-only")
+	}
+	return s.status(id, fxUnsupported, "Not supported")
+}
+
+// resolve returns the slash-separated path below the root named by a
+// client's path. The root of the share is the client's home directory.
+func (s *sftpSession) resolve(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+func (s *sftpSession) open(id uint32, h *sftpHandle) error {
+	if len(s.handles) >= sftpMaxHandles {
+		return s.status(id, fxFailure, "Too many open files")
+	}
+	s.nextHandle++
+	handle := strconv.Itoa(s.nextHandle)
+	s.handles[handle] = h
+	return s.send(appendSSHString(binary.BigEndian.AppendUint32([]byte{fxpHandle}, id), []byte(handle)))
+}
+
+// sftpEntry is a name of a NAME response
+type sftpEntry struct {
+	name, long string
+	info       os.FileInfo // Or nil for a name without attributes
+}
+
+func (s *sftpSession) names(id uint32, entries []sftpEntry) error {
+	payload := binary.BigEndian.AppendUint32([]byte{fxpName}, id)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(len(entries)))
+	for _, e := range entries {
+		payload = appendSSHString(payload, []byte(e.name))
+		payload = appendSSHString(payload, []byte(e.long))
+		if e.info == nil {
+			payload = binary.BigEndian.AppendUint32(payload, 0)
+		} else {
+			payload = sftpAttributes(payload, e.info)
+		}
+	}
+	return s.send(payload)
+}
+
+// readDir sends the entries of an open directory, a batch at a time
+func (s *sftpSession) readDir(id uint32, handle string) error {
+	h, ok := s.handles[handle]
+	if !ok || !h.entry.info.IsDir() {
+		return s.status(id, fxFailure, "Invalid handle")
+	}
+	if len(h.entries) == 0 && h.listed {
+		return s.status(id, fxEOF, "")
+	}
+	h.listed = true
+	batch := h.entries[:min(len(h.entries), sftpNamesPerMsg)]
+	h.entries = h.entries[len(batch):]
+	now := time.Now()
+	entries := make([]sftpEntry, len(batch))
+	for i, e := range batch {
+		name := path.Base("/" + e.rel)
+		entries[i] = sftpEntry{name: name, long: ftpListLine(e.info.IsDir(), e.info.Size(), e.info.ModTime(), name, now), info: e.info}
+	}
+	return s.names(id, entries)
+}
+
+// read sends the part of an open file at offset
+func (s *sftpSession) read(id uint32, handle string, offset int64, length int) error {
+	h, ok := s.handles[handle]
+	if !ok || h.entry.info.IsDir() {
+		return s.status(id, fxFailure, "Invalid handle")
+	}
+	if h.stream != nil && h.stream.pos != offset {
+		s.stop(h)
+	}
+	if h.stream == nil {
+		// Clients read ahead past the end, which needs no download
+		if offset > 0 && offset >= h.entry.info.Size() {
+			return s.status(id, fxEOF, "")
+		}
+		item, remaining := s.downloads.fileStatus()
+		if remaining == 0 {
+			return s.status(id, fxPermissionDenied, "Download limit reached")
+		}
+		h.stream = s.start(h.entry, item, offset)
+	}
+
+	st := h.stream
+	buf := make([]byte, length)
+	n, _ := io.ReadFull(st.reader, buf)
+	st.pos += int64(n)
+	if n > 0 {
+		payload := binary.BigEndian.AppendUint32([]byte{fxpData}, id)
+		return s.send(appendSSHString(payload, buf[:n]))
+	}
+	<-st.done
+	switch {
+	case st.response.status >= 300:
+		return s.status(id, fxFailure, strings.TrimSpace(st.response.message.String()))
+	case st.pos < h.entry.info.Size():
+		return s.status(id, fxFailure, "Transfer interrupted")
+	}
+	return s.status(id, fxEOF, "")
+}
+
+// start downloads the file e through the share's handler from offset on
+func (s *sftpSession) start(e treeEntry, item contentProvider, offset int64) *sftpStream {
+	reader, writer := io.Pipe()
+	st := &sftpStream{
+		pos:      offset,
+		reader:   reader,
+		response: &treeResponse{out: writer, header: make(http.Header), skip: offset},
+		done:     make(chan struct{}),
+	}
+	// The download lasts until the client closes the file, so that shutdown
+	// lets it read the end
+	s.downloads.activeDownloads.Add(1)
+	s.conn.startDownload()
+	go func() {
+		s.downloads.deliver(st.response, treeRequest(s.client, "/"+e.rel), item, s.tree.content(e))
+		writer.Close()
+		close(st.done)
+	}()
+	return st
+}
+
+// stop ends the download of an open file, if one is running
+func (s *sftpSession) stop(h *sftpHandle) {
+	if h.stream != nil {
+		h.stream.reader.CloseWithError(errors.New("file closed by the client"))
+		<-h.stream.done
+		h.stream = nil
+		s.downloads.activeDownloads.Done()
+		s.conn.endDownload()
+	}
+}
+
+// sftpAttributes appends the size, permissions and times of a file. The
+// share is read-only, so files show as such.
+func sftpAttributes(b []byte, info os.FileInfo) []byte {
+	mode, size := uint32(0100444), uint64(info.Size())
+	if info.IsDir() {
+		mode, size = 040555, 0
+	}
+	b = binary.BigEndian.AppendUint32(b, sftpAttrSize|sftpAttrPerms|sftpAttrTimes)
+	b = binary.BigEndian.AppendUint64(b, size)
+	b = binary.BigEndian.AppendUint32(b, mode)
+	modified := uint32(info.ModTime().Unix())
+	b = binary.BigEndian.AppendUint32(b, modified)
+	return binary.BigEndian.AppendUint32(b, modified)
+}
+
+// sftpListener opens the --sftp port next to the HTTP one
+func sftpListener(host string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if isAddrInUse(err) {
+		return nil, fmt.Errorf("SFTP port %d is in use; pick another with --sftp-port", port)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for SFTP: %v", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// sftpClient sends requests to an sftp session over a pipe
+type sftpClient struct {
+	t    *testing.T
+	conn net.Conn
+	id   uint32
+}
+
+// call sends a request of type kind with the fields after its id, and
+// returns the type and the fields of the response
+func (c *sftpClient) call(kind byte, fields []byte) (byte, *sshReader) {
+	c.t.Helper()
+	c.id++
+	packet := append(binary.BigEndian.AppendUint32([]byte{kind}, c.id), fields...)
+	if _, err := c.conn.Write(appendSSHString(nil, packet)); err != nil {
+		c.t.Fatal(err)
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c.conn, head); err != nil {
+		c.t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(head))
+	if _, err := io.ReadFull(c.conn, body); err != nil {
+		c.t.Fatal(err)
+	}
+	r := &sshReader{b: body[1:]}
+	// The version answering INIT has no id
+	if id := r.uint32(); kind != fxpInit && id != c.id {
+		c.t.Fatalf("expected a response to %d, got %d", c.id, id)
+	}
+	return body[0], r
+}
+
+// status sends a request and returns the status it is answered with, or ""
+// for another response
+func (c *sftpClient) status(kind byte, fields []byte) string {
+	c.t.Helper()
+	kind, r := c.call(kind, fields)
+	if kind != fxpStatus {
+		return ""
+	}
+	code := r.uint32()
+	return strings.TrimSpace(fmt.Sprintf("%d %s", code, r.string()))
+}
+
+// handle opens a file or directory
+func (c *sftpClient) handle(kind byte, fields []byte) []byte {
+	c.t.Helper()
+	got, r := c.call(kind, fields)
+	if got != fxpHandle {
+		c.t.Fatalf("expected a handle, got response %d", got)
+	}
+	return appendSSHString(nil, r.bytes())
+}
+
+func sftpRequest(name string, rest ...uint32) []byte {
+	b := appendSSHString(nil, []byte(name))
+	for _, v := range rest {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b
+}
+
+func sftpReadRequest(handle []byte, offset uint64, length uint32) []byte {
+	b := binary.BigEndian.AppendUint64(append([]byte(nil), handle...), offset)
+	return binary.BigEndian.AppendUint32(b, length)
+}
+
+func TestSFTPSession(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub", "inner.txt"), []byte("inner"), 0644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+
+	archive := newArchiveProvider(dir, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	h := &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 2}
+	server, client := net.Pipe()
+	session := &sftpSession{tree: &shareTree{archive: archive}, downloads: h, conn: &sshConn{}, client: "192.0.2.9:4000", handles: make(map[string]*sftpHandle)}
+	go session.serve(server)
+	defer client.Close()
+	c := &sftpClient{t: t, conn: client}
+
+	if kind, _ := c.call(fxpInit, nil); kind != fxpVersion {
+		t.Fatalf("expected the version, got response %d", kind)
+	}
+	if kind, r := c.call(fxpRealpath, sftpRequest("sub/../.")); kind != fxpName || r.uint32() != 1 || r.string() != "/" {
+		t.Errorf("expected the root as the home directory")
+	}
+
+	dirHandle := c.handle(fxpOpendir, sftpRequest("/"))
+	kind, r := c.call(fxpReaddir, dirHandle)
+	if kind != fxpName {
+		t.Fatalf("expected names, got response %d", kind)
+	}
+	var names []string
+	for n := r.uint32(); n > 0; n-- {
+		names = append(names, r.string())
+		if long := r.string(); !strings.HasSuffix(long, " "+names[len(names)-1]) {
+			t.Errorf("unexpected long name %q", long)
+		}
+		r.take(4 + 8 + 4 + 8) // Flags, size, permissions and times
+	}
+	if strings.Join(names, " ") != "notes.txt sub" {
+		t.Errorf("expected the unfiltered entries of the root, got %q", names)
+	}
+	if got := c.status(fxpReaddir, dirHandle); got != "1" {
+		t.Errorf("expected the end of the directory, got %q", got)
+	}
+	c.status(fxpClose, dirHandle)
+
+	if kind, r := c.call(fxpStat, sftpRequest("/sub/inner.txt")); kind != fxpAttrs || r.uint32() != sftpAttrSize|sftpAttrPerms|sftpAttrTimes || r.uint64() != 5 || r.uint32() != 0100444 {
+		t.Errorf("expected the attributes of a read-only file")
+	}
+	if got := c.status(fxpStat, sftpRequest("/.env")); got != "2 No such file" {
+		t.Errorf("expected a filtered file to be missing, got %q", got)
+	}
+	for _, tc := range []struct {
+		kind   byte
+		fields []byte
+	}{
+		{fxpOpen, sftpRequest("notes.txt", 0x2|0x8, 0)},
+		{fxpRemove, sftpRequest("notes.txt")},
+		{fxpMkdir, sftpRequest("new", 0)},
+		{fxpRename, append(sftpRequest("notes.txt"), sftpRequest("moved.txt")...)},
+	} {
+		if got := c.status(tc.kind, tc.fields); got != "3 The share is read-only" {
+			t.Errorf("request %d: expected the share to be read-only, got %q", tc.kind, got)
+		}
+	}
+
+	// Each file counts towards the limit, however it is read
+	file := c.handle(fxpOpen, sftpRequest("sub/inner.txt", sftpOpenRead, 0))
+	for i, want := range []string{"inn", "er"} {
+		if kind, r := c.call(fxpRead, sftpReadRequest(file, uint64(3*i), 3)); kind != fxpData || r.string() != want {
+			t.Errorf("expected %q", want)
+		}
+	}
+	if got := c.status(fxpRead, sftpReadRequest(file, 5, 3)); got != "1" {
+		t.Errorf("expected the end of the file, got %q", got)
+	}
+	c.status(fxpClose, file)
+	file = c.handle(fxpOpen, sftpRequest("/notes.txt", sftpOpenRead, 0))
+	if kind, r := c.call(fxpRead, sftpReadRequest(file, 2, 100)); kind != fxpData || r.string() != "tes" {
+		t.Errorf("expected the rest of the file")
+	}
+	c.status(fxpRead, sftpReadRequest(file, 5, 100))
+	c.status(fxpClose, file)
+	file = c.handle(fxpOpen, sftpRequest("/notes.txt", sftpOpenRead, 0))
+	if got := c.status(fxpRead, sftpReadRequest(file, 0, 100)); got != "3 Download limit reached" {
+		t.Errorf("expected the download limit to be reached, got %q", got)
+	}
+}
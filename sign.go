@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gpgSignature makes a detached, ASCII-armored signature of payload with
+// the secret key keyID. gpg asks for the key's passphrase itself if needed.
+func gpgSignature(keyID string, payload io.Reader) ([]byte, error) {
+	cmd := exec.Command("gpg", "--armor", "--detach-sign", "--local-user", keyID, "--output", "-")
+	cmd.Stdin = payload
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	signature, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("gpg failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return signature, nil
+}
+
+// minisignSignature signs the file at path with the minisign secret key at
+// keyPath, running program (minisign or a compatible tool). It asks for
+// the key's password on the terminal if the key has one.
+func minisignSignature(program, keyPath, path string) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "userve-minisign-")
+	if err != nil {
+		return nil, fmt.Errorf("cannot create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+
+	sigPath := filepath.Join(dir, "signature.minisig")
+	cmd := exec.Command(program, "-S", "-s", keyPath, "-m", path, "-x", sigPath)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stderr, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s failed: %v", filepath.Base(program), err)
+	}
+	return os.ReadFile(sigPath)
+}
+
+// payloadPath returns a file holding what p serves, and a function that
+// removes it again if it was made for the purpose, as for text in memory
+func payloadPath(p contentProvider) (string, func(), error) {
+	switch p := p.(type) {
+	case *fileProvider:
+		return p.filePath, func() {}, nil
+	case *cachedArchive:
+		if p.checksum() != "" {
+			file, err := p.open()
+			if err != nil {
+				return "", nil, err
+			}
+			file.Close()
+			return file.Name(), func() {}, nil
+		}
+	case *memoryProvider:
+		file, err := os.CreateTemp("", "userve-*-"+p.name)
+		if err != nil {
+			return "", nil, fmt.Errorf("cannot create temporary file: %v", err)
+		}
+		_, err = file.Write(p.data)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			os.Remove(file.Name())
+			return "", nil, err
+		}
+		return file.Name(), func() { os.Remove(file.Name()) }, nil
+	}
+	return "", nil, errStreamed
+}
+
+// signPayload signs what p serves with sign
+func signPayload(p contentProvider, sign func(io.Reader) ([]byte, error)) ([]byte, error) {
+	payload, err := openPayload(p)
+	if err != nil {
+		return nil, err
+	}
+	defer payload.Close()
+
+	return sign(payload)
+}
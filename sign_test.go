@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestGPGSignature(t *testing.T) {
+	if _, err := exec.LookPath("gpg"); err != nil {
+		t.Skip("gpg not installed")
+	}
+	home := t.TempDir()
+	t.Setenv("GNUPGHOME", home)
+	t.Cleanup(func() { exec.Command("gpgconf", "--kill", "gpg-agent").Run() })
+	gen := exec.Command("gpg", "--batch", "--passphrase", "", "--quick-gen-key", "Test <test@example.com>", "ed25519", "sign", "never")
+	if out, err := gen.CombinedOutput(); err != nil {
+		t.Skipf("cannot create a test key: %v: %s", err, out)
+	}
+
+	path := filepath.Join(t.TempDir(), "app.bin")
+	os.WriteFile(path, []byte("release"), 0644)
+	sig, err := signPayload(&fileProvider{filePath: path, fileName: "app.bin"}, func(payload io.Reader) ([]byte, error) {
+		return gpgSignature("test@example.com", payload)
+	})
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	if !strings.HasPrefix(string(sig), "-----BEGIN PGP SIGNATURE-----") {
+		t.Fatalf("expected an armored signature, got %q", sig)
+	}
+
+	sigPath := path + ".asc"
+	os.WriteFile(sigPath, sig, 0644)
+	if out, err := exec.Command("gpg", "--verify", sigPath, path).CombinedOutput(); err != nil {
+		t.Errorf("signature doesn't verify: %v: %s", err, out)
+	}
+
+	if _, err := gpgSignature("nobody@example.com", strings.NewReader("x")); err == nil || !strings.Contains(err.Error(), "gpg failed") {
+		t.Errorf("expected gpg to fail for an unknown key, got %v", err)
+	}
+}
+
+func TestSignStreamedArchive(t *testing.T) {
+	_, err := signPayload(newArchiveProvider(t.TempDir(), "dir", archiveOptions{}), func(payload io.Reader) ([]byte, error) {
+		t.Fatal("a streamed archive can't be signed up front")
+		return nil, nil
+	})
+	if err != errStreamed {
+		t.Errorf("expected errStreamed, got %v", err)
+	}
+}
+
+func TestMinisignSignature(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("uses a shell script as minisign")
+	}
+	dir := t.TempDir()
+	// Stands in for minisign -S -s key -m file -x sig, "signing" with the
+	// first line of the key
+	program := filepath.Join(dir, "minisign")
+	script := "#!/bin/sh\n[ \"$1 $2 $4 $6\" = \"-S -s -m -x\" ] || exit 2\n" +
+		"{ echo 'untrusted comment: signature'; head -n 1 \"$3\"; cat \"$5\"; } > \"$7\"\n"
+	if err := os.WriteFile(program, []byte(script), 0755); err != nil {
+		t.Fatalf("failed to create script: %v", err)
+	}
+	key := filepath.Join(dir, "minisign.key")
+	os.WriteFile(key, []byte("secret\n"), 0600)
+
+	path, cleanup, err := payloadPath(&memoryProvider{name: textFileName, data: []byte("payload\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := minisignSignature(program, key, path)
+	cleanup()
+	if err != nil {
+		t.Fatalf("signing failed: %v", err)
+	}
+	if want := "untrusted comment: signature\nsecret\npayload\n"; string(sig) != want {
+		t.Errorf("expected %q, got %q", want, sig)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary payload file to be removed, got %v", err)
+	}
+
+	if _, err := minisignSignature(filepath.Join(dir, "missing"), key, path); err == nil {
+		t.Error("expected an error for a missing program")
+	}
+}
@@ -0,0 +1,1059 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The SSH server behind --sftp implements just what sftp and scp clients
+// need (RFC 4253, 4252 and 4254): curve25519 key exchange, an ed25519 host
+// key, AES-GCM or AES-CTR with HMAC-SHA-256, password logins, and session
+// channels that run the sftp subsystem. Shells, commands and port
+// forwarding are refused.
+const (
+	sshVersion      = "SSH-2.0-userve"
+	sshMaxPacket    = 256 << 10 // Largest packet accepted from a client
+	sshWindow       = 2 << 20   // Bytes a client may send a channel before it is read
+	sshChannelMax   = 32 << 10  // Largest data message sent to a client
+	sshMaxChannels  = 10
+	sshAuthAttempts = 6
+	sshKexTimeout   = 30 * time.Second // For the handshake and login
+)
+
+// SSH message numbers
+const (
+	msgDisconnect       = 1
+	msgIgnore           = 2
+	msgUnimplemented    = 3
+	msgDebug            = 4
+	msgServiceRequest   = 5
+	msgServiceAccept    = 6
+	msgKexInit          = 20
+	msgNewKeys          = 21
+	msgKexECDHInit      = 30
+	msgKexECDHReply     = 31
+	msgUserAuthRequest  = 50
+	msgUserAuthFailure  = 51
+	msgUserAuthSuccess  = 52
+	msgGlobalRequest    = 80
+	msgRequestFailure   = 82
+	msgChannelOpen      = 90
+	msgChannelOpenOK    = 91
+	msgChannelOpenFail  = 92
+	msgChannelWindow    = 93
+	msgChannelData      = 94
+	msgChannelExtData   = 95
+	msgChannelEOF       = 96
+	msgChannelClose     = 97
+	msgChannelRequest   = 98
+	msgChannelSuccess   = 99
+	msgChannelFailure   = 100
+	sshProtocolError    = 2  // Disconnect reason
+	sshNoMoreAuth       = 14 // Disconnect reason
+	sshOpenProhibited   = 1  // Channel open failure reason
+	sshOpenUnknownType  = 3  // Channel open failure reason
+	sshOpenOutOfChannel = 4  // Channel open failure reason
+)
+
+var (
+	sshKexAlgos    = []string{"curve25519-sha256", "curve25519-sha256@libssh.org"}
+	sshCiphers     = []string{"aes128-gcm@openssh.com", "aes256-gcm@openssh.com", "aes128-ctr", "aes256-ctr"}
+	sshMACs        = []string{"hmac-sha2-256"}
+	sshHostKeyAlgo = "ssh-ed25519"
+	// Strict key exchange resets sequence numbers at each NEWKEYS, which
+	// closes the prefix truncation attack known as Terrapin
+	sshStrictClient = "kex-strict-c-v00@openssh.com"
+	sshStrictServer = "kex-strict-s-v00@openssh.com"
+)
+
+// sshHostKey is an ephemeral host key, made for one run of the share
+type sshHostKey struct {
+	private ed25519.PrivateKey
+	blob    []byte // The public key as SSH encodes it
+}
+
+func newSSHHostKey() (*sshHostKey, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("cannot generate SSH host key: %v", err)
+	}
+	blob := appendSSHString(nil, []byte(sshHostKeyAlgo))
+	blob = appendSSHString(blob, public)
+	return &sshHostKey{private: private, blob: blob}, nil
+}
+
+// fingerprint is the key's SHA-256 fingerprint as ssh prints it when it
+// asks whether to trust a host
+func (k *sshHostKey) fingerprint() string {
+	sum := sha256.Sum256(k.blob)
+	return "SHA256:" + base64.RawStdEncoding.EncodeToString(sum[:])
+}
+
+// appendSSHString appends s with its uint32 length, SSH's string encoding
+func appendSSHString(b, s []byte) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(len(s)))
+	return append(b, s...)
+}
+
+// appendSSHMpint appends a big-endian unsigned integer as an SSH mpint
+func appendSSHMpint(b, n []byte) []byte {
+	for len(n) > 0 && n[0] == 0 {
+		n = n[1:]
+	}
+	if len(n) > 0 && n[0]&0x80 != 0 {
+		n = append([]byte{0}, n...)
+	}
+	return appendSSHString(b, n)
+}
+
+func appendSSHBool(b []byte, v bool) []byte {
+	if v {
+		return append(b, 1)
+	}
+	return append(b, 0)
+}
+
+// sshReader decodes the fields of an SSH or SFTP message. Reading past the
+// end yields zero values and marks the message as malformed.
+type sshReader struct {
+	b   []byte
+	bad bool
+}
+
+func (r *sshReader) take(n int) []byte {
+	if r.bad || n < 0 || n > len(r.b) {
+		r.bad = true
+		return nil
+	}
+	v := r.b[:n]
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *sshReader) byte() byte {
+	if v := r.take(1); v != nil {
+		return v[0]
+	}
+	return 0
+}
+
+func (r *sshReader) bool() bool {
+	return r.byte() != 0
+}
+
+func (r *sshReader) uint32() uint32 {
+	if v := r.take(4); v != nil {
+		return binary.BigEndian.Uint32(v)
+	}
+	return 0
+}
+
+func (r *sshReader) uint64() uint64 {
+	if v := r.take(8); v != nil {
+		return binary.BigEndian.Uint64(v)
+	}
+	return 0
+}
+
+func (r *sshReader) bytes() []byte {
+	return r.take(int(r.uint32()))
+}
+
+func (r *sshReader) string() string {
+	return string(r.bytes())
+}
+
+// sshCipher reads and writes the packets of one direction of a connection
+type sshCipher interface {
+	readPacket(seq uint32, r io.Reader) ([]byte, error)
+	writePacket(seq uint32, w io.Writer, payload []byte) error
+}
+
+// sshPadding returns the padding that makes a packet of the payload, with
+// the length field if it is encrypted, a multiple of the block size
+func sshPadding(payload []byte, block int, withLength bool) []byte {
+	n := 1 + len(payload)
+	if withLength {
+		n += 4
+	}
+	pad := block - n%block
+	if pad < 4 {
+		pad += block
+	}
+	padding := make([]byte, pad)
+	rand.Read(padding)
+	return padding
+}
+
+// sshPacket lays out a packet: length, padding length, payload, padding
+func sshPacket(payload, padding []byte) []byte {
+	packet := binary.BigEndian.AppendUint32(nil, uint32(1+len(payload)+len(padding)))
+	packet = append(packet, byte(len(padding)))
+	packet = append(packet, payload...)
+	return append(packet, padding...)
+}
+
+// sshPayload extracts the payload of a decrypted packet body, which starts
+// at the padding length
+func sshPayload(body []byte) ([]byte, error) {
+	if len(body) < 1 || int(body[0])+1 > len(body) {
+		return nil, errors.New("invalid packet padding")
+	}
+	return body[1 : len(body)-int(body[0])], nil
+}
+
+// sshLength checks the length field at the start of a packet
+func sshLength(b []byte, block int, withLength bool) (int, error) {
+	length := int(binary.BigEndian.Uint32(b))
+	aligned := length
+	if withLength {
+		aligned += 4
+	}
+	if length < 5 || length > sshMaxPacket || aligned%block != 0 {
+		return 0, errors.New("invalid packet length")
+	}
+	return length, nil
+}
+
+// plainCipher is the unencrypted transport before the first key exchange
+type plainCipher struct{}
+
+func (plainCipher) readPacket(seq uint32, r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(head))
+	if length < 5 || length > sshMaxPacket {
+		return nil, errors.New("invalid packet length")
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return sshPayload(body)
+}
+
+func (plainCipher) writePacket(seq uint32, w io.Writer, payload []byte) error {
+	_, err := w.Write(sshPacket(payload, sshPadding(payload, 8, true)))
+	return err
+}
+
+// gcmCipher is aes128-gcm@openssh.com or aes256-gcm@openssh.com: the
+// length goes in the clear as additional data, and the nonce counts
+// packets
+type gcmCipher struct {
+	aead  cipher.AEAD
+	nonce []byte
+}
+
+func (c *gcmCipher) next() {
+	counter := binary.BigEndian.Uint64(c.nonce[4:])
+	binary.BigEndian.PutUint64(c.nonce[4:], counter+1)
+}
+
+func (c *gcmCipher) readPacket(seq uint32, r io.Reader) ([]byte, error) {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return nil, err
+	}
+	length, err := sshLength(head, aes.BlockSize, false)
+	if err != nil {
+		return nil, err
+	}
+	sealed := make([]byte, length+c.aead.Overhead())
+	if _, err := io.ReadFull(r, sealed); err != nil {
+		return nil, err
+	}
+	body, err := c.aead.Open(sealed[:0], c.nonce, sealed, head)
+	if err != nil {
+		return nil, errors.New("packet failed authentication")
+	}
+	c.next()
+	return sshPayload(body)
+}
+
+func (c *gcmCipher) writePacket(seq uint32, w io.Writer, payload []byte) error {
+	packet := sshPacket(payload, sshPadding(payload, aes.BlockSize, false))
+	out := c.aead.Seal(packet[:4], c.nonce, packet[4:], packet[:4])
+	c.next()
+	_, err := w.Write(out)
+	return err
+}
+
+// ctrCipher is aes128-ctr or aes256-ctr with hmac-sha2-256 over the
+// sequence number and the unencrypted packet
+type ctrCipher struct {
+	stream cipher.Stream
+	mac    hash.Hash
+}
+
+func (c *ctrCipher) sum(seq uint32, packet []byte) []byte {
+	c.mac.Reset()
+	c.mac.Write(binary.BigEndian.AppendUint32(nil, seq))
+	c.mac.Write(packet)
+	return c.mac.Sum(nil)
+}
+
+func (c *ctrCipher) readPacket(seq uint32, r io.Reader) ([]byte, error) {
+	first := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(r, first); err != nil {
+		return nil, err
+	}
+	c.stream.XORKeyStream(first, first)
+	length, err := sshLength(first, aes.BlockSize, true)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, 4+length+c.mac.Size())
+	copy(packet, first)
+	if _, err := io.ReadFull(r, packet[len(first):]); err != nil {
+		return nil, err
+	}
+	body, mac := packet[len(first):4+length], packet[4+length:]
+	c.stream.XORKeyStream(body, body)
+	if !hmac.Equal(mac, c.sum(seq, packet[:4+length])) {
+		return nil, errors.New("packet failed authentication")
+	}
+	return sshPayload(packet[4 : 4+length])
+}
+
+func (c *ctrCipher) writePacket(seq uint32, w io.Writer, payload []byte) error {
+	packet := sshPacket(payload, sshPadding(payload, aes.BlockSize, true))
+	mac := c.sum(seq, packet)
+	c.stream.XORKeyStream(packet, packet)
+	_, err := w.Write(append(packet, mac...))
+	return err
+}
+
+// newSSHCipher sets up the negotiated cipher with keys derived by key, which
+// returns n bytes for the letter RFC 4253 assigns to each of them
+func newSSHCipher(name string, key func(letter byte, n int) []byte, iv, enc, integrity byte) (sshCipher, error) {
+	size := 16
+	if strings.HasPrefix(name, "aes256") {
+		size = 32
+	}
+	block, err := aes.NewCipher(key(enc, size))
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasSuffix(name, "-gcm@openssh.com") {
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		return &gcmCipher{aead: aead, nonce: key(iv, 12)}, nil
+	}
+	return &ctrCipher{
+		stream: cipher.NewCTR(block, key(iv, aes.BlockSize)),
+		mac:    hmac.New(sha256.New, key(integrity, sha256.Size)),
+	}, nil
+}
+
+// sshDirection is one direction of a connection with its packet counter
+type sshDirection struct {
+	cipher sshCipher
+	seq    uint32
+}
+
+// sshConn is a client's connection to the SSH server
+type sshConn struct {
+	server  *sshServer
+	conn    net.Conn
+	reader  *bufio.Reader
+	in      sshDirection
+	writeMu sync.Mutex // Held for each packet sent, and during key exchange
+	out     sshDirection
+
+	clientVersion []byte
+	sessionID     []byte
+	strict        bool
+
+	mu        sync.Mutex
+	channels  map[uint32]*sshChannel
+	nextID    uint32
+	downloads int // Files being sent, which Close waits for
+	closing   bool
+}
+
+// readPacket returns the payload of the next packet
+func (c *sshConn) readPacket() ([]byte, error) {
+	payload, err := c.in.cipher.readPacket(c.in.seq, c.reader)
+	c.in.seq++
+	if err == nil && len(payload) == 0 {
+		err = errors.New("empty packet")
+	}
+	return payload, err
+}
+
+// write sends a packet, waiting out a key exchange in progress
+func (c *sshConn) write(payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.writeLocked(payload)
+}
+
+func (c *sshConn) writeLocked(payload []byte) error {
+	err := c.out.cipher.writePacket(c.out.seq, c.conn, payload)
+	c.out.seq++
+	return err
+}
+
+// disconnect tells the client why the connection ends
+func (c *sshConn) disconnect(reason uint32, message string) {
+	payload := binary.BigEndian.AppendUint32([]byte{msgDisconnect}, reason)
+	payload = appendSSHString(payload, []byte(message))
+	payload = appendSSHString(payload, nil)
+	c.write(payload)
+}
+
+// exchangeVersions sends the server's version and reads the client's
+func (c *sshConn) exchangeVersions() error {
+	if _, err := io.WriteString(c.conn, sshVersion+"\r\n"); err != nil {
+		return err
+	}
+	for range 16 {
+		line, err := c.reader.ReadSlice('\n')
+		if err != nil {
+			return fmt.Errorf("no SSH version from client")
+		}
+		line = []byte(strings.TrimRight(string(line), "\r\n"))
+		if strings.HasPrefix(string(line), "SSH-2.0-") || strings.HasPrefix(string(line), "SSH-1.99-") {
+			c.clientVersion = line
+			return nil
+		}
+		if strings.HasPrefix(string(line), "SSH-") {
+			return fmt.Errorf("unsupported SSH version %q", line)
+		}
+	}
+	return fmt.Errorf("no SSH version from client")
+}
+
+// kexInit is the server's KEXINIT message
+func (c *sshConn) kexInit() []byte {
+	cookie := make([]byte, 16)
+	rand.Read(cookie)
+	kex := sshKexAlgos
+	if c.sessionID == nil {
+		kex = append(slices.Clone(kex), sshStrictServer)
+	}
+	payload := append([]byte{msgKexInit}, cookie...)
+	for _, list := range [][]string{kex, {sshHostKeyAlgo}, sshCiphers, sshCiphers, sshMACs, sshMACs, {"none"}, {"none"}, {}, {}} {
+		payload = appendSSHString(payload, []byte(strings.Join(list, ",")))
+	}
+	payload = appendSSHBool(payload, false)
+	return binary.BigEndian.AppendUint32(payload, 0)
+}
+
+// negotiate picks the client's first algorithm that the server supports
+func negotiate(client string, server []string) (string, error) {
+	for _, name := range strings.Split(client, ",") {
+		if slices.Contains(server, name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("no common algorithm, the server supports %s", strings.Join(server, ", "))
+}
+
+// sshKexChoice is what a key exchange agreed on
+type sshKexChoice struct {
+	cipherIn, cipherOut string
+	wrongGuess          bool
+}
+
+func (c *sshConn) parseKexInit(payload []byte) (sshKexChoice, error) {
+	var choice sshKexChoice
+	r := &sshReader{b: payload[1:]}
+	r.take(16)
+	lists := make([]string, 10)
+	for i := range lists {
+		lists[i] = r.string()
+	}
+	guessed := r.bool()
+	if r.bad {
+		return choice, errors.New("malformed KEXINIT")
+	}
+	kex, err := negotiate(lists[0], sshKexAlgos)
+	if err != nil {
+		return choice, fmt.Errorf("key exchange: %v", err)
+	}
+	if _, err := negotiate(lists[1], []string{sshHostKeyAlgo}); err != nil {
+		return choice, fmt.Errorf("host key: %v", err)
+	}
+	if choice.cipherIn, err = negotiate(lists[2], sshCiphers); err != nil {
+		return choice, fmt.Errorf("cipher: %v", err)
+	}
+	if choice.cipherOut, err = negotiate(lists[3], sshCiphers); err != nil {
+		return choice, fmt.Errorf("cipher: %v", err)
+	}
+	// GCM authenticates packets itself, so its MAC list doesn't matter
+	for i, name := range []string{choice.cipherIn, choice.cipherOut} {
+		if !strings.HasSuffix(name, "-gcm@openssh.com") {
+			if _, err := negotiate(lists[4+i], sshMACs); err != nil {
+				return choice, fmt.Errorf("MAC: %v", err)
+			}
+		}
+	}
+	if _, err := negotiate(lists[6], []string{"none"}); err != nil {
+		return choice, fmt.Errorf("compression: %v", err)
+	}
+	if _, err := negotiate(lists[7], []string{"none"}); err != nil {
+		return choice, fmt.Errorf("compression: %v", err)
+	}
+	// A key exchange packet sent on a wrong guess is ignored
+	choice.wrongGuess = guessed && !strings.HasPrefix(lists[0], kex)
+	if c.sessionID == nil && slices.Contains(strings.Split(lists[0], ","), sshStrictClient) {
+		c.strict = true
+	}
+	return choice, nil
+}
+
+// readKex reads the next key exchange message, which must be of type want
+func (c *sshConn) readKex(want byte) ([]byte, error) {
+	for {
+		payload, err := c.readPacket()
+		if err != nil {
+			return nil, err
+		}
+		if payload[0] == want {
+			return payload, nil
+		}
+		if !c.strict && (payload[0] == msgIgnore || payload[0] == msgDebug) {
+			continue
+		}
+		return nil, fmt.Errorf("unexpected message %d during key exchange", payload[0])
+	}
+}
+
+// keyExchange runs a key exchange. clientInit is the client's KEXINIT if
+// it started one, or nil to wait for it after sending the server's.
+func (c *sshConn) keyExchange(clientInit []byte) error {
+	c.writeMu.Lock()
+	locked := true
+	defer func() {
+		if locked {
+			c.writeMu.Unlock()
+		}
+	}()
+	serverInit := c.kexInit()
+	if err := c.writeLocked(serverInit); err != nil {
+		return err
+	}
+	if clientInit == nil {
+		var err error
+		if clientInit, err = c.readKex(msgKexInit); err != nil {
+			return err
+		}
+	}
+	choice, err := c.parseKexInit(clientInit)
+	if err != nil {
+		return err
+	}
+	if choice.wrongGuess {
+		if _, err := c.readPacket(); err != nil {
+			return err
+		}
+	}
+
+	init, err := c.readKex(msgKexECDHInit)
+	if err != nil {
+		return err
+	}
+	r := &sshReader{b: init[1:]}
+	clientPublic := r.bytes()
+	peer, err := ecdh.X25519().NewPublicKey(clientPublic)
+	if r.bad || err != nil {
+		return errors.New("invalid client key")
+	}
+	ephemeral, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return err
+	}
+	secret, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return errors.New("invalid client key")
+	}
+	serverPublic := ephemeral.PublicKey().Bytes()
+	key := appendSSHMpint(nil, secret)
+
+	h := sha256.New()
+	for _, s := range [][]byte{c.clientVersion, []byte(sshVersion), clientInit, serverInit, c.server.hostKey.blob, clientPublic, serverPublic} {
+		h.Write(appendSSHString(nil, s))
+	}
+	h.Write(key)
+	exchangeHash := h.Sum(nil)
+	if c.sessionID == nil {
+		c.sessionID = exchangeHash
+	}
+
+	signature := appendSSHString(nil, []byte(sshHostKeyAlgo))
+	signature = appendSSHString(signature, ed25519.Sign(c.server.hostKey.private, exchangeHash))
+	reply := appendSSHString([]byte{msgKexECDHReply}, c.server.hostKey.blob)
+	reply = appendSSHString(reply, serverPublic)
+	reply = appendSSHString(reply, signature)
+	if err := c.writeLocked(reply); err != nil {
+		return err
+	}
+
+	derive := func(letter byte, n int) []byte {
+		h := sha256.New()
+		h.Write(key)
+		h.Write(exchangeHash)
+		h.Write([]byte{letter})
+		h.Write(c.sessionID)
+		out := h.Sum(nil)
+		for len(out) < n {
+			h.Reset()
+			h.Write(key)
+			h.Write(exchangeHash)
+			h.Write(out)
+			out = h.Sum(out)
+		}
+		return out[:n]
+	}
+	out, err := newSSHCipher(choice.cipherOut, derive, 'B', 'D', 'F')
+	if err != nil {
+		return err
+	}
+	in, err := newSSHCipher(choice.cipherIn, derive, 'A', 'C', 'E')
+	if err != nil {
+		return err
+	}
+	if err := c.writeLocked([]byte{msgNewKeys}); err != nil {
+		return err
+	}
+	c.out.cipher = out
+	if c.strict {
+		c.out.seq = 0
+	}
+	c.writeMu.Unlock()
+	locked = false
+
+	if _, err := c.readKex(msgNewKeys); err != nil {
+		return err
+	}
+	c.in.cipher = in
+	if c.strict {
+		c.in.seq = 0
+	}
+	return nil
+}
+
+// authenticate runs the login, which takes the share's password with any
+// user name
+func (c *sshConn) authenticate() error {
+	client := c.conn.RemoteAddr().String()
+	for attempts := 0; ; {
+		payload, err := c.readPacket()
+		if err != nil {
+			return err
+		}
+		r := &sshReader{b: payload[1:]}
+		switch payload[0] {
+		case msgIgnore, msgDebug, msgUnimplemented:
+			continue
+		case msgServiceRequest:
+			service := r.string()
+			if service != "ssh-userauth" {
+				c.disconnect(sshProtocolError, "unknown service")
+				return fmt.Errorf("unknown service %q", service)
+			}
+			c.write(appendSSHString([]byte{msgServiceAccept}, []byte(service)))
+			continue
+		case msgUserAuthRequest:
+		default:
+			return fmt.Errorf("unexpected message %d before login", payload[0])
+		}
+
+		r.string() // The user name
+		service, method := r.string(), r.string()
+		if method == "password" && service == "ssh-connection" && !r.bool() {
+			password := r.bytes()
+			if !r.bad && subtle.ConstantTimeCompare(password, []byte(c.server.password)) == 1 {
+				return c.write([]byte{msgUserAuthSuccess})
+			}
+			logEvent("login_refused", logFields{"client": client, "protocol": "sftp"}, "Refused SFTP login from %s: wrong password", client)
+			attempts++
+		}
+		if attempts >= sshAuthAttempts {
+			c.disconnect(sshNoMoreAuth, "too many wrong passwords")
+			return errors.New("too many wrong passwords")
+		}
+		failure := appendSSHString([]byte{msgUserAuthFailure}, []byte("password"))
+		if err := c.write(appendSSHBool(failure, false)); err != nil {
+			return err
+		}
+	}
+}
+
+// serve runs the connection until the client leaves
+func (c *sshConn) serve() {
+	defer c.close()
+	c.conn.SetDeadline(time.Now().Add(sshKexTimeout))
+	if err := c.exchangeVersions(); err != nil {
+		return
+	}
+	if err := c.keyExchange(nil); err != nil {
+		c.disconnect(sshProtocolError, err.Error())
+		return
+	}
+	if err := c.authenticate(); err != nil {
+		return
+	}
+	c.conn.SetWriteDeadline(time.Time{})
+	for {
+		// Clients that go quiet are dropped, as idle HTTP connections are
+		c.conn.SetReadDeadline(time.Now().Add(defaultIdleTimeout))
+		payload, err := c.readPacket()
+		if err != nil {
+			return
+		}
+		if err := c.dispatch(payload); err != nil {
+			c.disconnect(sshProtocolError, err.Error())
+			return
+		}
+	}
+}
+
+// dispatch handles a message of the connection protocol
+func (c *sshConn) dispatch(payload []byte) error {
+	r := &sshReader{b: payload[1:]}
+	switch payload[0] {
+	case msgKexInit:
+		return c.keyExchange(payload)
+	case msgIgnore, msgDebug, msgUnimplemented, msgUserAuthRequest:
+		return nil
+	case msgDisconnect:
+		return io.EOF
+	case msgGlobalRequest:
+		// Keepalives and forwarding requests alike are declined
+		r.string()
+		if r.bool() {
+			return c.write([]byte{msgRequestFailure})
+		}
+		return nil
+	case msgChannelOpen:
+		return c.openChannel(r)
+	}
+
+	if payload[0] < msgChannelWindow || payload[0] > msgChannelFailure {
+		return c.write(binary.BigEndian.AppendUint32([]byte{msgUnimplemented}, c.in.seq-1))
+	}
+	c.mu.Lock()
+	ch := c.channels[r.uint32()]
+	c.mu.Unlock()
+	if ch == nil || r.bad {
+		return errors.New("message for an unknown channel")
+	}
+	switch payload[0] {
+	case msgChannelWindow:
+		ch.mu.Lock()
+		ch.remoteWindow += r.uint32()
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+	case msgChannelData:
+		data := r.bytes()
+		ch.mu.Lock()
+		ch.in = append(ch.in, data...)
+		overflow := len(ch.in) > sshWindow
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+		if overflow {
+			return errors.New("channel window exceeded")
+		}
+	case msgChannelEOF:
+		ch.mu.Lock()
+		ch.eof = true
+		ch.cond.Broadcast()
+		ch.mu.Unlock()
+	case msgChannelClose:
+		ch.closeRemote()
+	case msgChannelRequest:
+		return ch.request(r)
+	}
+	return nil
+}
+
+// openChannel accepts session channels, the only kind sftp opens
+func (c *sshConn) openChannel(r *sshReader) error {
+	kind := r.string()
+	remote, window, maxPacket := r.uint32(), r.uint32(), r.uint32()
+	if r.bad {
+		return errors.New("malformed channel open")
+	}
+	fail := func(reason uint32, message string) error {
+		payload := binary.BigEndian.AppendUint32([]byte{msgChannelOpenFail}, remote)
+		payload = binary.BigEndian.AppendUint32(payload, reason)
+		payload = appendSSHString(payload, []byte(message))
+		return c.write(appendSSHString(payload, nil))
+	}
+	switch {
+	case kind == "direct-tcpip" || kind == "forwarded-tcpip":
+		return fail(sshOpenProhibited, "port forwarding is not allowed")
+	case kind != "session":
+		return fail(sshOpenUnknownType, "only sftp sessions are offered")
+	}
+
+	c.mu.Lock()
+	if len(c.channels) >= sshMaxChannels {
+		c.mu.Unlock()
+		return fail(sshOpenOutOfChannel, "too many channels")
+	}
+	ch := &sshChannel{conn: c, local: c.nextID, remote: remote, remoteWindow: window, remoteMax: min(max(maxPacket, 1024), sshChannelMax)}
+	ch.cond = sync.NewCond(&ch.mu)
+	c.channels[ch.local] = ch
+	c.nextID++
+	c.mu.Unlock()
+
+	payload := binary.BigEndian.AppendUint32([]byte{msgChannelOpenOK}, remote)
+	payload = binary.BigEndian.AppendUint32(payload, ch.local)
+	payload = binary.BigEndian.AppendUint32(payload, sshWindow)
+	return c.write(binary.BigEndian.AppendUint32(payload, sshMaxPacket-1024))
+}
+
+// close ends the connection and each of its channels
+func (c *sshConn) close() {
+	c.conn.Close()
+	c.mu.Lock()
+	channels := c.channels
+	c.channels = nil
+	c.mu.Unlock()
+	for _, ch := range channels {
+		ch.closeRemote()
+	}
+	c.server.mu.Lock()
+	delete(c.server.conns, c)
+	c.server.mu.Unlock()
+}
+
+// startDownload and endDownload bracket a file being sent, so that Close
+// lets it finish
+func (c *sshConn) startDownload() {
+	c.mu.Lock()
+	c.downloads++
+	c.mu.Unlock()
+}
+
+func (c *sshConn) endDownload() {
+	c.mu.Lock()
+	c.downloads--
+	done := c.closing && c.downloads == 0
+	c.mu.Unlock()
+	if done {
+		c.conn.Close()
+	}
+}
+
+// sshChannel is a session channel, read and written as a stream by the
+// subsystem running on it
+type sshChannel struct {
+	conn          *sshConn
+	local, remote uint32
+
+	mu           sync.Mutex
+	cond         *sync.Cond
+	in           []byte // Received and not read yet
+	consumed     uint32 // Read since the window was last extended
+	remoteWindow uint32
+	remoteMax    uint32
+	eof          bool
+	closed       bool // The client closed the channel or the connection ended
+	subsystem    bool
+	sentClose    bool
+}
+
+func (ch *sshChannel) Read(b []byte) (int, error) {
+	ch.mu.Lock()
+	for len(ch.in) == 0 && !ch.eof && !ch.closed {
+		ch.cond.Wait()
+	}
+	if len(ch.in) == 0 {
+		ch.mu.Unlock()
+		return 0, io.EOF
+	}
+	n := copy(b, ch.in)
+	ch.in = ch.in[n:]
+	ch.consumed += uint32(n)
+	adjust := uint32(0)
+	if ch.consumed >= sshWindow/2 {
+		adjust, ch.consumed = ch.consumed, 0
+	}
+	ch.mu.Unlock()
+	if adjust > 0 {
+		payload := binary.BigEndian.AppendUint32([]byte{msgChannelWindow}, ch.remote)
+		ch.conn.write(binary.BigEndian.AppendUint32(payload, adjust))
+	}
+	return n, nil
+}
+
+func (ch *sshChannel) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		ch.mu.Lock()
+		for ch.remoteWindow == 0 && !ch.closed {
+			ch.cond.Wait()
+		}
+		if ch.closed {
+			ch.mu.Unlock()
+			return written, io.ErrClosedPipe
+		}
+		n := min(uint32(len(b)), ch.remoteWindow, ch.remoteMax)
+		ch.remoteWindow -= n
+		ch.mu.Unlock()
+
+		payload := binary.BigEndian.AppendUint32([]byte{msgChannelData}, ch.remote)
+		if err := ch.conn.write(appendSSHString(payload, b[:n])); err != nil {
+			return written, err
+		}
+		written += int(n)
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Close ends the channel from the server's side
+func (ch *sshChannel) Close() error {
+	ch.mu.Lock()
+	sent := ch.sentClose
+	ch.sentClose = true
+	ch.mu.Unlock()
+	if sent {
+		return nil
+	}
+	ch.conn.write(binary.BigEndian.AppendUint32([]byte{msgChannelEOF}, ch.remote))
+	return ch.conn.write(binary.BigEndian.AppendUint32([]byte{msgChannelClose}, ch.remote))
+}
+
+// closeRemote handles the client closing the channel, or the connection
+// ending
+func (ch *sshChannel) closeRemote() {
+	ch.mu.Lock()
+	ch.closed = true
+	ch.cond.Broadcast()
+	ch.mu.Unlock()
+	ch.Close()
+	ch.conn.mu.Lock()
+	delete(ch.conn.channels, ch.local)
+	ch.conn.mu.Unlock()
+}
+
+// request answers a channel request. Only the sftp subsystem is started;
+// environment variables, terminals and the like are ignored.
+func (ch *sshChannel) request(r *sshReader) error {
+	kind, wantReply := r.string(), r.bool()
+	ok := false
+	if kind == "subsystem" && r.string() == "sftp" && !r.bad {
+		ch.mu.Lock()
+		ok = !ch.subsystem
+		ch.subsystem = true
+		ch.mu.Unlock()
+	}
+	if wantReply {
+		reply := byte(msgChannelFailure)
+		if ok {
+			reply = msgChannelSuccess
+		}
+		if err := ch.conn.write(binary.BigEndian.AppendUint32([]byte{reply}, ch.remote)); err != nil {
+			return err
+		}
+	}
+	if ok {
+		s := ch.conn.server
+		session := &sftpSession{tree: s.tree, downloads: s.downloads, conn: ch.conn, client: ch.conn.conn.RemoteAddr().String(), handles: make(map[string]*sftpHandle)}
+		go func() {
+			session.serve(ch)
+			ch.Close()
+		}()
+	}
+	return nil
+}
+
+// sshServer serves the share's file tree over SFTP, for networks that let
+// SSH out but not HTTP. Everyone logs in with the share's password, which
+// is made for each run like the host key. As with --ftp, files are sent by
+// the HTTP handler, so each one counts towards the share's limit and is
+// waited for at shutdown.
+type sshServer struct {
+	tree      *shareTree
+	downloads *handler
+	listener  net.Listener
+	hostKey   *sshHostKey
+	password  string
+
+	mu     sync.Mutex
+	conns  map[*sshConn]bool
+	closed bool
+}
+
+func newSSHServer(listener net.Listener, tree *shareTree, downloads *handler, hostKey *sshHostKey, password string) *sshServer {
+	return &sshServer{tree: tree, downloads: downloads, listener: listener, hostKey: hostKey, password: password, conns: make(map[*sshConn]bool)}
+}
+
+// serve accepts connections until the server is closed
+func (s *sshServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &sshConn{server: s, conn: conn, reader: bufio.NewReader(conn), channels: make(map[uint32]*sshChannel)}
+		c.in.cipher, c.out.cipher = plainCipher{}, plainCipher{}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[c] = true
+		s.mu.Unlock()
+		go c.serve()
+	}
+}
+
+// Close stops taking connections and ends each one once the files it is
+// sending are done
+func (s *sshServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for c := range s.conns {
+		c.mu.Lock()
+		c.closing = true
+		idle := c.downloads == 0
+		c.mu.Unlock()
+		if idle {
+			c.conn.Close()
+		}
+	}
+	return s.listener.Close()
+}
+
+// sftpPassword makes the password of a share: short enough to read out,
+// with about 60 bits of randomness
+func sftpPassword() string {
+	const alphabet = "abcdefghijkmnpqrstuvwxyz23456789"
+	b := make([]byte, 12)
+	rand.Read(b)
+	for i := range b {
+		b[i] = alphabet[int(b[i])%len(alphabet)]
+	}
+	return string(b[:4]) + "-" + string(b[4:8]) + "-" + string(b[8:])
+}
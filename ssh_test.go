@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestSSHCiphers(t *testing.T) {
+	key := func(letter byte, n int) []byte {
+		return bytes.Repeat([]byte{letter}, n)
+	}
+	for _, name := range sshCiphers {
+		// Each end of a connection derives the same keys
+		out, err := newSSHCipher(name, key, 'A', 'C', 'E')
+		if err != nil {
+			t.Fatal(err)
+		}
+		in, _ := newSSHCipher(name, key, 'A', 'C', 'E')
+		var wire bytes.Buffer
+		for seq, payload := range [][]byte{{msgIgnore}, bytes.Repeat([]byte("payload"), 1000), {msgNewKeys}} {
+			if err := out.writePacket(uint32(seq), &wire, payload); err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(wire.Bytes(), []byte("payload")) {
+				t.Fatalf("%s: expected the packet to be encrypted", name)
+			}
+			got, err := in.readPacket(uint32(seq), &wire)
+			if err != nil || !bytes.Equal(got, payload) {
+				t.Fatalf("%s: expected the payload back, got %v", name, err)
+			}
+		}
+
+		// A packet altered on the way is refused
+		out.writePacket(3, &wire, []byte{msgIgnore, 1, 2, 3})
+		wire.Bytes()[wire.Len()-1] ^= 1
+		if _, err := in.readPacket(3, &wire); err == nil {
+			t.Errorf("%s: expected an altered packet to be refused", name)
+		}
+	}
+}
+
+func TestSSHEncoding(t *testing.T) {
+	for _, tc := range []struct {
+		n    []byte
+		want []byte
+	}{
+		{[]byte{0, 0, 0x12}, []byte{0, 0, 0, 1, 0x12}},
+		{[]byte{0x80, 1}, []byte{0, 0, 0, 3, 0, 0x80, 1}},
+		{[]byte{0, 0}, []byte{0, 0, 0, 0}},
+	} {
+		if got := appendSSHMpint(nil, tc.n); !bytes.Equal(got, tc.want) {
+			t.Errorf("mpint %x: expected %x, got %x", tc.n, tc.want, got)
+		}
+	}
+
+	r := &sshReader{b: appendSSHString([]byte{1}, []byte("name"))}
+	if !r.bool() || r.string() != "name" || r.bad {
+		t.Error("expected the fields back")
+	}
+	if r.uint32(); !r.bad {
+		t.Error("expected reading past the end to mark the message as malformed")
+	}
+
+	if got, err := negotiate("chacha20-poly1305@openssh.com,aes256-ctr,aes128-gcm@openssh.com", sshCiphers); err != nil || got != "aes256-ctr" {
+		t.Errorf("expected the client's first supported cipher, got %q, %v", got, err)
+	}
+	if _, err := negotiate("3des-cbc", sshCiphers); err == nil {
+		t.Error("expected no common cipher")
+	}
+}
+
+func TestSFTPPassword(t *testing.T) {
+	password := sftpPassword()
+	if !regexp.MustCompile(`^[a-z2-9]{4}-[a-z2-9]{4}-[a-z2-9]{4}$`).MatchString(password) {
+		t.Errorf("unexpected password %q", password)
+	}
+	if sftpPassword() == password {
+		t.Error("expected a new password each time")
+	}
+	key, err := newSSHHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fp := key.fingerprint(); !strings.HasPrefix(fp, "SHA256:") || len(fp) != len("SHA256:")+43 {
+		t.Errorf("unexpected fingerprint %q", fp)
+	}
+}
+
+// TestSFTPClient downloads from the server with OpenSSH's sftp
+func TestSFTPClient(t *testing.T) {
+	sftpPath, err := exec.LookPath("sftp")
+	if err != nil || testing.Short() {
+		t.Skip("needs sftp")
+	}
+	dir := t.TempDir()
+	share := filepath.Join(dir, "share")
+	os.MkdirAll(filepath.Join(share, "sub"), 0755)
+	data := bytes.Repeat([]byte("0123456789"), 100000)
+	os.WriteFile(filepath.Join(share, "sub", "data.bin"), data, 0644)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := newSSHHostKey()
+	archive := newArchiveProvider(share, "share", archiveOptions{format: ArchiveTarGz})
+	h := &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1)}
+	s := newSSHServer(l, &shareTree{archive: archive}, h, key, "right-pass")
+	go s.serve()
+	defer s.Close()
+
+	download := func(password string) ([]byte, error) {
+		askpass := filepath.Join(dir, "askpass-"+password)
+		os.WriteFile(askpass, []byte("#!/bin/sh\necho "+password+"\n"), 0755)
+		os.WriteFile(filepath.Join(dir, "batch"), []byte("cd sub\nget data.bin "+filepath.Join(dir, "got.bin")+"\nput "+filepath.Join(dir, "batch")+" /batch\n"), 0644)
+		// -b turns off password prompts unless BatchMode comes first
+		cmd := exec.Command(sftpPath, "-o", "BatchMode=no", "-o", "NumberOfPasswordPrompts=1", "-o", "StrictHostKeyChecking=no", "-o", "UserKnownHostsFile=/dev/null",
+			"-b", filepath.Join(dir, "batch"), "-P", strconv.Itoa(l.Addr().(*net.TCPAddr).Port), "userve@127.0.0.1")
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS="+askpass, "SSH_ASKPASS_REQUIRE=force", "DISPLAY=:0")
+		return cmd.CombinedOutput()
+	}
+	if out, err := download("wrong-pass"); err == nil || !strings.Contains(string(out), "Permission denied") {
+		t.Errorf("expected a wrong password to be refused, got %v: %s", err, out)
+	}
+	out, _ := download("right-pass")
+	if got, _ := os.ReadFile(filepath.Join(dir, "got.bin")); !bytes.Equal(got, data) {
+		t.Fatalf("expected the file, got %d bytes: %s", len(got), out)
+	}
+	if !strings.Contains(string(out), "Permission denied") {
+		t.Errorf("expected an upload to be refused: %s", out)
+	}
+}
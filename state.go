@@ -0,0 +1,272 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	stateMagic      = "USERVE-STATE1\n"
+	stateSaltSize   = 16
+	stateIterations = 200000
+	stateKeyEnv     = "USERVE_STATE_KEY"
+)
+
+// errBadStateKey is returned when a state bundle cannot be decrypted
+var errBadStateKey = errors.New("cannot decrypt share state: wrong key or corrupted file")
+
+// shareState is everything needed to continue a suspended share: the
+// original options, the shared paths and how far the share has progressed
+type shareState struct {
+	Queue     bool      `json:"queue"`
+	Flags     []string  `json:"flags"`
+	Paths     []string  `json:"paths"`
+	Position  int       `json:"position"`
+	Downloads int32     `json:"downloads"`
+	SavedAt   time.Time `json:"saved_at"`
+}
+
+// newShareState captures a share's options, resolving paths so the share
+// can be resumed from any working directory
+func newShareState(queue bool, flags, paths []string) (*shareState, error) {
+	st := &shareState{Queue: queue, Flags: flags}
+	for _, p := range paths {
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot resolve %s: %v", p, err)
+		}
+		st.Paths = append(st.Paths, abs)
+	}
+	return st, nil
+}
+
+// args rebuilds the command line that started the share, keeping its state
+// in statePath
+func (st *shareState) args(statePath string) []string {
+	var args []string
+	if st.Queue {
+		args = append(args, "queue")
+	}
+	args = append(args, st.Flags...)
+	args = append(args, "-state="+statePath)
+	return append(args, st.Paths...)
+}
+
+// save encrypts the state and atomically replaces the file at path
+func (st *shareState) save(path string) error {
+	secret, err := stateSecret()
+	if err != nil {
+		return err
+	}
+	st.SavedAt = time.Now()
+	bundle, err := encryptState(st, secret)
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, bundle, 0600); err != nil {
+		return fmt.Errorf("cannot write share state: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("cannot write share state: %v", err)
+	}
+	return nil
+}
+
+// loadState reads and decrypts the state file at path
+func loadState(path string) (*shareState, error) {
+	bundle, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read share state: %v", err)
+	}
+	secret, err := stateSecret()
+	if err != nil {
+		return nil, err
+	}
+	return decryptState(bundle, secret)
+}
+
+// encryptState seals the state with AES-256-GCM under a key derived from
+// secret. The bundle is the magic, the salt, the nonce and the ciphertext.
+func encryptState(st *shareState, secret []byte) ([]byte, error) {
+	plain, err := json.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, stateSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := stateCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	bundle := append([]byte(stateMagic), salt...)
+	bundle = append(bundle, nonce...)
+	return aead.Seal(bundle, nonce, plain, []byte(stateMagic)), nil
+}
+
+// decryptState opens a bundle produced by encryptState
+func decryptState(bundle, secret []byte) (*shareState, error) {
+	rest, ok := strings.CutPrefix(string(bundle), stateMagic)
+	if !ok {
+		return nil, errors.New("not a userve state file")
+	}
+	if len(rest) < stateSaltSize {
+		return nil, errBadStateKey
+	}
+	salt, rest := []byte(rest[:stateSaltSize]), rest[stateSaltSize:]
+
+	aead, err := stateCipher(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errBadStateKey
+	}
+	nonce, sealed := []byte(rest[:aead.NonceSize()]), []byte(rest[aead.NonceSize():])
+	plain, err := aead.Open(nil, nonce, sealed, []byte(stateMagic))
+	if err != nil {
+		return nil, errBadStateKey
+	}
+
+	var st shareState
+	if err := json.Unmarshal(plain, &st); err != nil {
+		return nil, fmt.Errorf("invalid share state: %v", err)
+	}
+	return &st, nil
+}
+
+func stateCipher(secret, salt []byte) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(secret), salt, stateIterations, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// stateSecret returns the passphrase protecting state files: USERVE_STATE_KEY
+// if set, otherwise a random key kept in the user's config directory and
+// created on first use
+func stateSecret() ([]byte, error) {
+	if key := os.Getenv(stateKeyEnv); key != "" {
+		return []byte(key), nil
+	}
+
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, fmt.Errorf("cannot locate state key (set %s): %v", stateKeyEnv, err)
+	}
+	keyPath := filepath.Join(dir, "userve", "state.key")
+	if key, err := os.ReadFile(keyPath); err == nil {
+		return []byte(strings.TrimSpace(string(key))), nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return nil, fmt.Errorf("cannot create state key: %v", err)
+	}
+	encoded := hex.EncodeToString(key)
+	if err := os.WriteFile(keyPath, []byte(encoded+"\n"), 0600); err != nil {
+		return nil, fmt.Errorf("cannot create state key: %v", err)
+	}
+	return []byte(encoded), nil
+}
+
+// writePIDFile records the running share's process at path, next to its
+// state file so "userve suspend" can find it or where --daemon was told
+func writePIDFile(path string) error {
+	if err := os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0600); err != nil {
+		return fmt.Errorf("cannot write pid file: %v", err)
+	}
+	return nil
+}
+
+// readPIDFile returns the process recorded at path by writePIDFile
+func readPIDFile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 {
+		return 0, fmt.Errorf("invalid pid file %s", path)
+	}
+	return pid, nil
+}
+
+// runSuspend asks the share owning a state file to save its state and exit
+func runSuspend(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: userve suspend <state-file>")
+	}
+	if suspendSignal == nil {
+		return errors.New("suspend is not supported on this platform; stop the share with Ctrl+C instead")
+	}
+	pidPath := args[0] + ".pid"
+	pid, err := readPIDFile(pidPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no running share for %s", args[0])
+	}
+	if err != nil {
+		return err
+	}
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return fmt.Errorf("cannot find share process: %v", err)
+	}
+	if err := process.Signal(suspendSignal); err != nil {
+		return fmt.Errorf("cannot signal share process: %v", err)
+	}
+
+	// The share removes its pid file once the state is saved
+	deadline := time.Now().Add(shutdownTimeout + 5*time.Second)
+	for time.Now().Before(deadline) {
+		if _, err := os.Stat(pidPath); os.IsNotExist(err) {
+			fmt.Printf("Share suspended; resume with: userve resume %s\n", args[0])
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return errors.New("share did not exit in time")
+}
+
+// runResume continues a share from its state file
+func runResume(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: userve resume <state-file>")
+	}
+	st, err := loadState(args[0])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Resuming share saved at %s\n", st.SavedAt.Format("2006-01-02 15:04:05"))
+	return serve(st.args(args[0]), st)
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	st := &shareState{
+		Queue:     true,
+		Flags:     []string{"-c=2", "-qr=true"},
+		Paths:     []string{"/srv/a.iso", "/srv/b.iso"},
+		Position:  1,
+		Downloads: 1,
+	}
+
+	bundle, err := encryptState(st, []byte("secret"))
+	if err != nil {
+		t.Fatalf("encryptState failed: %v", err)
+	}
+	if strings.Contains(string(bundle), "a.iso") {
+		t.Error("state bundle contains plaintext paths")
+	}
+
+	got, err := decryptState(bundle, []byte("secret"))
+	if err != nil {
+		t.Fatalf("decryptState failed: %v", err)
+	}
+	if !reflect.DeepEqual(got, st) {
+		t.Errorf("expected %+v, got %+v", st, got)
+	}
+}
+
+func TestDecryptStateRejectsBadInput(t *testing.T) {
+	bundle, err := encryptState(&shareState{Paths: []string{"/srv/a.iso"}}, []byte("secret"))
+	if err != nil {
+		t.Fatalf("encryptState failed: %v", err)
+	}
+	tampered := append([]byte{}, bundle...)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		bundle  []byte
+		secret  string
+		wantErr string
+	}{
+		{"wrong key", bundle, "other", errBadStateKey.Error()},
+		{"tampered", tampered, "secret", errBadStateKey.Error()},
+		{"truncated", bundle[:len(stateMagic)+4], "secret", errBadStateKey.Error()},
+		{"not a state file", []byte("hello"), "secret", "not a userve state file"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decryptState(tt.bundle, []byte(tt.secret))
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expected error %q, got %v", tt.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestStateSaveLoad(t *testing.T) {
+	t.Setenv(stateKeyEnv, "test-key")
+	path := filepath.Join(t.TempDir(), "share.state")
+
+	st, err := newShareState(false, []string{"-c=3"}, []string{"file.txt"})
+	if err != nil {
+		t.Fatalf("newShareState failed: %v", err)
+	}
+	if !filepath.IsAbs(st.Paths[0]) {
+		t.Errorf("expected absolute path, got %s", st.Paths[0])
+	}
+	st.Downloads = 2
+	if err := st.save(path); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("state file not written: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("expected mode 0600, got %v", info.Mode().Perm())
+	}
+
+	got, err := loadState(path)
+	if err != nil {
+		t.Fatalf("loadState failed: %v", err)
+	}
+	if got.Downloads != 2 || got.Paths[0] != st.Paths[0] {
+		t.Errorf("expected %+v, got %+v", st, got)
+	}
+
+	want := []string{"-c=3", "-state=" + path, st.Paths[0]}
+	if args := got.args(path); !reflect.DeepEqual(args, want) {
+		t.Errorf("expected args %q, got %q", want, args)
+	}
+}
+
+func TestRunResumeMissingState(t *testing.T) {
+	t.Setenv(stateKeyEnv, "test-key")
+	err := run([]string{"resume", filepath.Join(t.TempDir(), "missing.state")})
+	if err == nil || !strings.HasPrefix(err.Error(), "cannot read share state") {
+		t.Errorf("expected read error, got %v", err)
+	}
+}
+
+func TestRunSuspendWithoutShare(t *testing.T) {
+	if suspendSignal == nil {
+		t.Skip("suspend not supported on this platform")
+	}
+	err := run([]string{"suspend", filepath.Join(t.TempDir(), "share.state")})
+	if err == nil || !strings.HasPrefix(err.Error(), "no running share") {
+		t.Errorf("expected no running share error, got %v", err)
+	}
+}
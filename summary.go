@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// shareStats adds up the transfers of a share for the summary printed at
+// exit
+type shareStats struct {
+	started time.Time
+
+	mu        sync.Mutex
+	downloads int
+	uploads   int
+	sent      int64   // Body bytes of all downloads, also interrupted ones
+	received  int64   // Bytes of received files
+	busy      float64 // Seconds spent sending, for the average speed
+	clients   map[string]bool
+}
+
+func newShareStats() *shareStats {
+	return &shareStats{started: time.Now(), clients: make(map[string]bool)}
+}
+
+// notify counts the transfers that end in e
+func (s *shareStats) notify(e event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch e.kind {
+	case "download_completed", "download_interrupted", "download_partial", "stream_ended", "stream_interrupted":
+		if e.kind == "download_completed" {
+			s.downloads++
+		}
+		if n, ok := e.fields["bytes"].(int64); ok {
+			s.sent += n
+		}
+		if d, ok := e.fields["duration"].(float64); ok {
+			s.busy += d
+		}
+	case "upload_completed":
+		s.uploads++
+		if n, ok := e.fields["bytes"].(int64); ok {
+			s.received += n
+		}
+	default:
+		return
+	}
+	if client, ok := e.fields["client"].(string); ok {
+		s.clients[clientIP(client)] = true
+	}
+}
+
+// log logs the summary of the share
+func (s *shareStats) log() {
+	s.mu.Lock()
+	fields, message := s.summary()
+	s.mu.Unlock()
+	logNotice("summary", fields, "%s", message)
+}
+
+func (s *shareStats) summary() (logFields, string) {
+	elapsed := time.Since(s.started)
+	var speed float64
+	if s.busy > 0 {
+		speed = float64(s.sent) / s.busy
+	}
+	fields := logFields{
+		"downloads":      s.downloads,
+		"uploads":        s.uploads,
+		"clients":        len(s.clients),
+		"bytes":          s.sent,
+		"bytes_received": s.received,
+		"duration":       elapsed.Round(time.Millisecond).Seconds(),
+		"bytes_per_sec":  int64(speed),
+	}
+	message := fmt.Sprintf("Summary: %d download(s) by %d client(s), %s sent", s.downloads, len(s.clients), formatSize(s.sent))
+	if s.uploads > 0 {
+		message += fmt.Sprintf(", %d upload(s) received (%s)", s.uploads, formatSize(s.received))
+	}
+	message += fmt.Sprintf(" in %s", elapsed.Round(time.Second))
+	if speed > 0 {
+		message += fmt.Sprintf(", %s/s on average", formatSize(int64(speed)))
+	}
+	return fields, message
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestShareStats(t *testing.T) {
+	buf := captureEvents(t, logJSON)
+	stats := newShareStats()
+	stats.started = time.Now().Add(-time.Minute)
+	stop := events.listen(stats.notify)
+	logEvent("download_completed", logFields{"client": "192.0.2.1:1234", "bytes": int64(1000), "duration": 0.5}, "Download completed")
+	logEvent("download_completed", logFields{"client": "192.0.2.1:5678", "bytes": int64(1000), "duration": 0.5}, "Download completed")
+	logEvent("download_interrupted", logFields{"client": "192.0.2.7:1234", "bytes": int64(500), "duration": 1.0}, "Download interrupted")
+	logEvent("download_started", logFields{"client": "192.0.2.9:1234"}, "Download started")
+	buf.Reset()
+	stats.log()
+	stop()
+
+	var summary map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(buf.String())), &summary); err != nil {
+		t.Fatalf("expected one JSON summary, got %q", buf.String())
+	}
+	expected := map[string]any{"event": "summary", "downloads": 2.0, "clients": 2.0, "bytes": 2500.0, "bytes_per_sec": 1250.0}
+	for key, want := range expected {
+		if summary[key] != want {
+			t.Errorf("expected %s %v, got %v", key, want, summary[key])
+		}
+	}
+	if d, _ := summary["duration"].(float64); d < 60 {
+		t.Errorf("expected the share's duration, got %v", summary["duration"])
+	}
+	if message := summary["message"].(string); message != "Summary: 2 download(s) by 2 client(s), 2.4 KiB sent in 1m0s, 1.2 KiB/s on average" {
+		t.Errorf("unexpected summary %q", message)
+	}
+}
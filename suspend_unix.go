@@ -0,0 +1,11 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// suspendSignal asks a running share to save its state and exit
+var suspendSignal os.Signal = syscall.SIGUSR1
@@ -0,0 +1,9 @@
+//go:build windows
+
+package main
+
+import "os"
+
+// suspendSignal is nil because Windows has no user signals; an interrupted
+// share still keeps its state file and can be resumed
+var suspendSignal os.Signal
@@ -0,0 +1,38 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"log/syslog"
+)
+
+// unixSyslog logs to the local syslog daemon, or journald where it owns
+// /dev/log
+type unixSyslog struct {
+	w *syslog.Writer
+}
+
+func openSyslog() (systemLog, error) {
+	w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "userve")
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to syslog: %v", err)
+	}
+	return &unixSyslog{w: w}, nil
+}
+
+func (s *unixSyslog) log(sev severity, message string) error {
+	switch sev {
+	case severityDebug:
+		return s.w.Debug(message)
+	case severityWarning:
+		return s.w.Warning(message)
+	case severityError:
+		return s.w.Err(message)
+	}
+	return s.w.Info(message)
+}
+
+func (s *unixSyslog) Close() error {
+	return s.w.Close()
+}
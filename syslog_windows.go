@@ -0,0 +1,8 @@
+package main
+
+import "fmt"
+
+// openSyslog fails on Windows, which has the Event Log rather than syslog
+func openSyslog() (systemLog, error) {
+	return nil, fmt.Errorf("--log-dest syslog isn't supported on Windows")
+}
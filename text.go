@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// textFileName is the name text shared with --text is served under
+const textFileName = "snippet.txt"
+
+// memoryProvider serves content held in memory, such as --text snippets
+// and clipboard contents
+type memoryProvider struct {
+	name        string
+	contentType string
+	data        []byte
+}
+
+// newTextProvider returns a provider for text, which is read from stdin
+// if it is "-"
+func newTextProvider(text string, stdin io.Reader) (*memoryProvider, error) {
+	p := &memoryProvider{name: textFileName, contentType: "text/plain; charset=utf-8", data: []byte(text)}
+	if text != "-" {
+		return p, nil
+	}
+	data, err := io.ReadAll(stdin)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read standard input: %v", err)
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("no text on standard input")
+	}
+	p.data = data
+	return p, nil
+}
+
+func (p *memoryProvider) Filename() string {
+	return p.name
+}
+
+func (p *memoryProvider) ContentType() string {
+	return p.contentType
+}
+
+func (p *memoryProvider) ContentLength() int64 {
+	return int64(len(p.data))
+}
+
+func (p *memoryProvider) WriteTo(w io.Writer) (int64, error) {
+	return bytes.NewReader(p.data).WriteTo(w)
+}
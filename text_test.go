@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewTextProvider(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		stdin   string
+		want    string
+		wantErr bool
+	}{
+		{"argument", "listen 8080", "ignored", "listen 8080", false},
+		{"stdin", "-", "panic: oops\ngoroutine 1\n", "panic: oops\ngoroutine 1\n", false},
+		{"empty stdin", "-", "", "", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := newTextProvider(tt.text, strings.NewReader(tt.stdin))
+			if tt.wantErr {
+				if err == nil {
+					t.Error("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newTextProvider failed: %v", err)
+			}
+			if string(p.data) != tt.want || p.ContentLength() != int64(len(tt.want)) {
+				t.Errorf("expected %q, got %q (length %d)", tt.want, p.data, p.ContentLength())
+			}
+		})
+	}
+}
+
+func TestTextHandler(t *testing.T) {
+	var wg sync.WaitGroup
+	p, _ := newTextProvider("key = value\n", nil)
+	h := &handler{provider: p, activeDownloads: &wg, downloadComplete: make(chan struct{}, 1), maxDownloads: 1}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/"+textFileName, nil))
+	if got := rec.Header().Get("Content-Type"); got != "text/plain; charset=utf-8" {
+		t.Errorf("expected text/plain, got %q", got)
+	}
+	if !strings.Contains(rec.Header().Get("Content-Disposition"), textFileName) {
+		t.Errorf("expected %s in Content-Disposition, got %q", textFileName, rec.Header().Get("Content-Disposition"))
+	}
+	if rec.Body.String() != "key = value\n" {
+		t.Errorf("unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestRunTextConflicts(t *testing.T) {
+	for _, args := range [][]string{
+		{"--text", "hello", "file.txt"},
+		{"--text", "hello", "--bundle"},
+		{"--text", "hello", "--receive"},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "--text") {
+			t.Errorf("%v: expected a --text error, got %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultTFTPPort is where netboot firmware looks, so it needs root or
+// CAP_NET_BIND_SERVICE
+const defaultTFTPPort = 69
+
+// TFTP (RFC 1350) opcodes and error codes, and the option extension
+// (RFC 2347, 2348 and 2349) that netboot clients use for larger blocks
+const (
+	tftpRRQ   = 1
+	tftpWRQ   = 2
+	tftpDATA  = 3
+	tftpACK   = 4
+	tftpERROR = 5
+	tftpOACK  = 6
+
+	tftpErrUndefined    = 0
+	tftpErrNotFound     = 1
+	tftpErrAccess       = 2
+	tftpErrIllegal      = 4
+	tftpErrUnknownTID   = 5
+	tftpDefaultBlock    = 512
+	tftpMaxBlock        = 65464
+	tftpDefaultTimeout  = time.Second
+	tftpRetries         = 5
+	tftpMaxRequestBytes = 1500
+)
+
+// tftpServer serves the share's file tree read-only over TFTP, for
+// firmware and PXE boot loaders that can't fetch over anything else. Each
+// transfer runs on its own port, as the protocol has it. Files are sent by
+// the HTTP handler, so each one counts towards the share's limit and is
+// waited for at shutdown like any other download.
+type tftpServer struct {
+	tree      *shareTree
+	downloads *handler
+	conn      *net.UDPConn
+}
+
+// tftpRequest is a read request with the options the client asked for
+type tftpRequest struct {
+	file    string
+	mode    string
+	options map[string]string
+}
+
+// tftpTransfer is a file being sent to a client
+type tftpTransfer struct {
+	conn    *net.UDPConn
+	client  *net.UDPAddr
+	block   int
+	timeout time.Duration
+}
+
+func newTFTPServer(conn *net.UDPConn, tree *shareTree, downloads *handler) *tftpServer {
+	return &tftpServer{tree: tree, downloads: downloads, conn: conn}
+}
+
+// serve answers requests until the server is closed
+func (s *tftpServer) serve() {
+	buf := make([]byte, tftpMaxRequestBytes)
+	for {
+		n, client, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		packet := bytes.Clone(buf[:n])
+		go s.answer(packet, client)
+	}
+}
+
+// Close stops taking requests; transfers in progress go on until done
+func (s *tftpServer) Close() error {
+	return s.conn.Close()
+}
+
+// answer handles a request from a new client on a port of its own
+func (s *tftpServer) answer(packet []byte, client *net.UDPAddr) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.conn.LocalAddr().(*net.UDPAddr).IP})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	t := &tftpTransfer{conn: conn, client: client, block: tftpDefaultBlock, timeout: tftpDefaultTimeout}
+
+	if len(packet) < 2 {
+		return
+	}
+	switch binary.BigEndian.Uint16(packet) {
+	case tftpRRQ:
+	case tftpWRQ:
+		t.fail(tftpErrAccess, "The share is read-only")
+		return
+	default:
+		t.fail(tftpErrIllegal, "Expected a read request")
+		return
+	}
+	req, err := parseTFTPRequest(packet[2:])
+	if err != nil {
+		t.fail(tftpErrIllegal, err.Error())
+		return
+	}
+	entry, _, ok := s.tree.lookup(tftpPath(req.file))
+	if !ok || entry.info.IsDir() {
+		t.fail(tftpErrNotFound, "File not found")
+		return
+	}
+	item, remaining := s.downloads.fileStatus()
+	if remaining == 0 {
+		t.fail(tftpErrAccess, "Download limit reached")
+		return
+	}
+
+	// Options are acknowledged before the file is sent; a client that
+	// only asked for the size leaves then, which is no download
+	if oack := t.negotiate(req, entry.info.Size()); oack != nil {
+		if err := t.send(oack, 0); err != nil {
+			return
+		}
+	}
+	s.sendFile(t, entry, item, req.mode == "netascii")
+}
+
+// negotiate applies the options the server supports and returns the
+// OACK that confirms them, or nil if the client asked for none
+func (t *tftpTransfer) negotiate(req tftpRequest, size int64) []byte {
+	oack := binary.BigEndian.AppendUint16(nil, tftpOACK)
+	accepted := false
+	accept := func(name, value string) {
+		oack = append(append(oack, name...), 0)
+		oack = append(append(oack, value...), 0)
+		accepted = true
+	}
+	if v, err := strconv.Atoi(req.options["blksize"]); err == nil && v >= 8 {
+		t.block = min(v, tftpMaxBlock)
+		accept("blksize", strconv.Itoa(t.block))
+	}
+	if v, err := strconv.Atoi(req.options["timeout"]); err == nil && v >= 1 && v <= 255 {
+		t.timeout = time.Duration(v) * time.Second
+		accept("timeout", strconv.Itoa(v))
+	}
+	// The size of a netascii transfer isn't known before it is made
+	if _, ok := req.options["tsize"]; ok && req.mode == "octet" {
+		accept("tsize", strconv.FormatInt(size, 10))
+	}
+	if !accepted {
+		return nil
+	}
+	return oack
+}
+
+// sendFile downloads the file e through the share's handler, a block at a
+// time
+func (s *tftpServer) sendFile(t *tftpTransfer, e treeEntry, item contentProvider, netascii bool) {
+	// The download lasts until the last block is acknowledged, so that
+	// shutdown lets the client get it
+	s.downloads.activeDownloads.Add(1)
+	defer s.downloads.activeDownloads.Done()
+	reader, writer := io.Pipe()
+	defer reader.Close()
+	response := &treeResponse{out: writer, header: make(http.Header)}
+	if netascii {
+		response.out = netasciiWriter{writer}
+	}
+	done := make(chan struct{})
+	go func() {
+		s.downloads.deliver(response, treeRequest(t.client.String(), "/"+e.rel), item, s.tree.content(e))
+		writer.Close()
+		close(done)
+	}()
+
+	buf := make([]byte, t.block)
+	sent := int64(0)
+	for block := uint16(1); ; block++ {
+		n, _ := io.ReadFull(reader, buf)
+		sent += int64(n)
+		last := n < len(buf)
+		if last {
+			<-done
+			switch {
+			case response.status >= 300:
+				t.fail(tftpErrAccess, strings.TrimSpace(response.message.String()))
+				return
+			case !netascii && sent < e.info.Size():
+				t.fail(tftpErrUndefined, "Transfer interrupted")
+				return
+			}
+		}
+		// Block numbers roll over to 0 past 65535, which clients expect for
+		// files larger than 32 MB at the default block size
+		packet := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, tftpDATA), block)
+		if err := t.send(append(packet, buf[:n]...), block); err != nil {
+			reader.CloseWithError(err)
+			return
+		}
+		if last {
+			return
+		}
+	}
+}
+
+// send sends a packet until the client acknowledges block, or gives up
+// after several timeouts. Duplicate acknowledgements are ignored rather
+// than answered, which would double every packet from then on.
+func (t *tftpTransfer) send(packet []byte, block uint16) error {
+	buf := make([]byte, tftpMaxRequestBytes)
+	for range tftpRetries {
+		if _, err := t.conn.WriteToUDP(packet, t.client); err != nil {
+			return err
+		}
+		deadline := time.Now().Add(t.timeout)
+		for {
+			t.conn.SetReadDeadline(deadline)
+			n, from, err := t.conn.ReadFromUDP(buf)
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				break
+			}
+			if err != nil {
+				return err
+			}
+			if !from.IP.Equal(t.client.IP) || from.Port != t.client.Port {
+				t.conn.WriteToUDP(tftpError(tftpErrUnknownTID, "Unknown transfer"), from)
+				continue
+			}
+			if n < 4 {
+				continue
+			}
+			switch binary.BigEndian.Uint16(buf) {
+			case tftpACK:
+				if binary.BigEndian.Uint16(buf[2:]) == block {
+					return nil
+				}
+			case tftpERROR:
+				return fmt.Errorf("cancelled by the client: %s", strings.TrimRight(string(buf[4:n]), "\x00"))
+			}
+		}
+	}
+	return errors.New("client stopped answering")
+}
+
+// fail tells the client why its request can't be served
+func (t *tftpTransfer) fail(code uint16, message string) {
+	t.conn.WriteToUDP(tftpError(code, message), t.client)
+}
+
+func tftpError(code uint16, message string) []byte {
+	packet := binary.BigEndian.AppendUint16(binary.BigEndian.AppendUint16(nil, tftpERROR), code)
+	return append(append(packet, message...), 0)
+}
+
+// parseTFTPRequest decodes the file name, mode and options of a read
+// request, which are NUL-terminated strings
+func parseTFTPRequest(b []byte) (tftpRequest, error) {
+	fields := strings.Split(string(b), "\x00")
+	if len(fields) < 3 || fields[len(fields)-1] != "" {
+		return tftpRequest{}, errors.New("malformed request")
+	}
+	fields = fields[:len(fields)-1]
+	req := tftpRequest{file: fields[0], mode: strings.ToLower(fields[1]), options: make(map[string]string)}
+	if req.mode != "octet" && req.mode != "netascii" {
+		return tftpRequest{}, fmt.Errorf("unsupported mode %s", fields[1])
+	}
+	for i := 2; i+1 < len(fields); i += 2 {
+		req.options[strings.ToLower(fields[i])] = fields[i+1]
+	}
+	return req, nil
+}
+
+// tftpPath returns the slash-separated path below the root named by a
+// requested file. Boot loaders send names relative to the TFTP root, some
+// with a leading slash and some with backslashes.
+func tftpPath(file string) string {
+	file = strings.ReplaceAll(file, `\`, "/")
+	return strings.TrimPrefix(path.Clean("/"+file), "/")
+}
+
+// netasciiWriter converts line ends for a netascii transfer: LF to CR LF
+// and a bare CR to CR NUL
+type netasciiWriter struct {
+	w io.Writer
+}
+
+func (n netasciiWriter) Write(b []byte) (int, error) {
+	out := make([]byte, 0, len(b)+len(b)/16)
+	for _, c := range b {
+		switch c {
+		case '\n':
+			out = append(out, '\r', '\n')
+		case '\r':
+			out = append(out, '\r', 0)
+		default:
+			out = append(out, c)
+		}
+	}
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// tftpListener opens the --tftp port
+func tftpListener(host string, port int) (*net.UDPConn, error) {
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for TFTP: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	switch {
+	case isAddrInUse(err):
+		return nil, fmt.Errorf("TFTP port %d is in use; pick another with --tftp-port", port)
+	case errors.Is(err, os.ErrPermission):
+		return nil, fmt.Errorf("TFTP port %d needs root; run as root or pick another with --tftp-port", port)
+	case err != nil:
+		return nil, fmt.Errorf("cannot listen for TFTP: %v", err)
+	}
+	return conn, nil
+}
+
+// tftpURL is the address of a TFTP share, without the port when it is
+// the standard one
+func tftpURL(host string, port int, name string) string {
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+	if port != defaultTFTPPort {
+		host += ":" + strconv.Itoa(port)
+	}
+	return "tftp://" + host + "/" + name
+}
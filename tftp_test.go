@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTFTPRequest(t *testing.T) {
+	req, err := parseTFTPRequest([]byte("pxelinux.0\x00OCTET\x00blksize\x001468\x00TSIZE\x000\x00"))
+	if err != nil || req.file != "pxelinux.0" || req.mode != "octet" || req.options["blksize"] != "1468" || req.options["tsize"] != "0" {
+		t.Errorf("unexpected request %+v, %v", req, err)
+	}
+	for _, b := range []string{"file\x00octet", "file\x00", "file\x00mail\x00"} {
+		if _, err := parseTFTPRequest([]byte(b)); err == nil {
+			t.Errorf("%q: expected an error", b)
+		}
+	}
+
+	for _, tc := range []struct{ file, want string }{
+		{"pxelinux.0", "pxelinux.0"},
+		{"/boot/grub/grub.cfg", "boot/grub/grub.cfg"},
+		{`EFI\BOOT\bootx64.efi`, "EFI/BOOT/bootx64.efi"},
+		{"../../etc/passwd", "etc/passwd"},
+	} {
+		if got := tftpPath(tc.file); got != tc.want {
+			t.Errorf("%q: expected %q, got %q", tc.file, tc.want, got)
+		}
+	}
+	if got := tftpURL("fd00::2", 6969, "a.bin"); got != "tftp://[fd00::2]:6969/a.bin" {
+		t.Errorf("unexpected URL %s", got)
+	}
+	if got := tftpURL("192.0.2.1", defaultTFTPPort, ""); got != "tftp://192.0.2.1/" {
+		t.Errorf("unexpected URL %s", got)
+	}
+
+	var out bytes.Buffer
+	netasciiWriter{&out}.Write([]byte("a\nb\rc"))
+	if out.String() != "a\r\nb\r\x00c" {
+		t.Errorf("unexpected netascii %q", out.String())
+	}
+}
+
+// tftpGet downloads file from the server at addr, asking for blocks of
+// blksize bytes unless it is 0, and returns the content or the error
+// message the server sent
+func tftpGet(t *testing.T, addr net.Addr, opcode uint16, file string, blksize int) (string, string) {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	req := binary.BigEndian.AppendUint16(nil, opcode)
+	req = append(append(req, file...), 0)
+	req = append(req, "octet\x00"...)
+	block := tftpDefaultBlock
+	if blksize > 0 {
+		block = blksize
+		req = append(req, "blksize\x00"+strconv.Itoa(blksize)+"\x00"...)
+	}
+	conn.WriteTo(req, addr)
+
+	var content []byte
+	buf := make([]byte, 1500)
+	for {
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch binary.BigEndian.Uint16(buf) {
+		case tftpERROR:
+			return "", strings.TrimRight(string(buf[4:n]), "\x00")
+		case tftpOACK:
+			if want := "blksize\x00" + strconv.Itoa(blksize) + "\x00"; string(buf[2:n]) != want {
+				t.Errorf("expected OACK %q, got %q", want, buf[2:n])
+			}
+			conn.WriteTo([]byte{0, tftpACK, 0, 0}, from)
+		case tftpDATA:
+			content = append(content, buf[4:n]...)
+			conn.WriteTo(append([]byte{0, tftpACK}, buf[2:4]...), from)
+			if n-4 < block {
+				return string(content), ""
+			}
+		}
+	}
+}
+
+func TestTFTPServer(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "boot"), 0755)
+	os.WriteFile(filepath.Join(dir, "boot", "kernel"), []byte("kernel image, 26 bytes"), 0644)
+	os.WriteFile(filepath.Join(dir, "empty"), nil, 0644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+
+	conn, err := tftpListener("127.0.0.1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := newArchiveProvider(dir, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	h := &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 3}
+	s := newTFTPServer(conn, &shareTree{archive: archive}, h)
+	go s.serve()
+	defer s.Close()
+	addr := conn.LocalAddr()
+
+	// With blksize 8 the file takes several blocks
+	if got, msg := tftpGet(t, addr, tftpRRQ, `\boot\kernel`, 8); got != "kernel image, 26 bytes" {
+		t.Errorf("expected the file, got %q %q", got, msg)
+	}
+	if got, msg := tftpGet(t, addr, tftpRRQ, "empty", 0); got != "" || msg != "" {
+		t.Errorf("expected an empty file, got %q %q", got, msg)
+	}
+	for _, tc := range []struct {
+		opcode uint16
+		file   string
+		want   string
+	}{
+		{tftpRRQ, ".env", "File not found"},
+		{tftpRRQ, "boot", "File not found"},
+		{tftpWRQ, "upload", "The share is read-only"},
+	} {
+		if _, msg := tftpGet(t, addr, tc.opcode, tc.file, 0); msg != tc.want {
+			t.Errorf("%s: expected %q, got %q", tc.file, tc.want, msg)
+		}
+	}
+
+	// Each file counts towards the limit
+	tftpGet(t, addr, tftpRRQ, "boot/kernel", 0)
+	if _, msg := tftpGet(t, addr, tftpRRQ, "boot/kernel", 0); msg != "Download limit reached" {
+		t.Errorf("expected the download limit to be reached, got %q", msg)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"time"
+)
+
+// Defaults for --read-timeout, --write-timeout and --idle-timeout
+const (
+	defaultReadTimeout  = time.Minute
+	defaultWriteTimeout = time.Minute
+	defaultIdleTimeout  = 2 * time.Minute
+)
+
+// deadlineChunk is the most written at once under one write deadline, so a
+// large write to a slow client isn't taken for a stalled one
+const deadlineChunk = 32 << 10
+
+// withTimeouts gives up on a request whose body makes no progress for read
+// or whose response makes no progress for write. Unlike the server's own
+// ReadTimeout and WriteTimeout, these limit each read and write rather than
+// the whole request, so hours-long transfers run while dead connections
+// are dropped. Zero disables a timeout.
+func withTimeouts(next http.Handler, read, write time.Duration) http.Handler {
+	if read == 0 && write == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rc := http.NewResponseController(w)
+		if read > 0 && r.Body != nil && r.Body != http.NoBody {
+			r.Body = &deadlineReader{ReadCloser: r.Body, rc: rc, timeout: read}
+		}
+		if write > 0 {
+			w = &deadlineWriter{ResponseWriter: w, rc: rc, timeout: write}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deadlineReader moves the connection's read deadline before each read of
+// a request body
+type deadlineReader struct {
+	io.ReadCloser
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d *deadlineReader) Read(b []byte) (int, error) {
+	d.rc.SetReadDeadline(time.Now().Add(d.timeout))
+	n, err := d.ReadCloser.Read(b)
+	if err == io.EOF {
+		// The server goes on reading to notice the client leaving
+		d.rc.SetReadDeadline(time.Time{})
+	}
+	return n, err
+}
+
+// deadlineWriter moves the connection's write deadline before each write
+// of a response
+type deadlineWriter struct {
+	http.ResponseWriter
+	rc      *http.ResponseController
+	timeout time.Duration
+}
+
+func (d *deadlineWriter) Write(b []byte) (int, error) {
+	written := 0
+	for len(b) > 0 {
+		chunk := b[:min(len(b), deadlineChunk)]
+		d.rc.SetWriteDeadline(time.Now().Add(d.timeout))
+		n, err := d.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to flush
+// a --follow stream
+func (d *deadlineWriter) Unwrap() http.ResponseWriter {
+	return d.ResponseWriter
+}
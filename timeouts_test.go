@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTimeoutsStall(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		handler func(w http.ResponseWriter, r *http.Request) error
+	}{
+		{
+			// The client sends a tenth of the announced body, then nothing
+			name:    "read",
+			request: "POST /upload HTTP/1.1\r\nHost: x\r\nContent-Length: 100\r\n\r\n0123456789",
+			handler: func(w http.ResponseWriter, r *http.Request) error {
+				_, err := io.ReadAll(r.Body)
+				return err
+			},
+		},
+		{
+			// The client never reads the response
+			name:    "write",
+			request: "GET /file HTTP/1.1\r\nHost: x\r\n\r\n",
+			handler: func(w http.ResponseWriter, r *http.Request) error {
+				chunk := make([]byte, 1<<20)
+				for i := 0; i < 256; i++ {
+					if _, err := w.Write(chunk); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			result := make(chan error, 1)
+			srv := httptest.NewServer(withTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				result <- tt.handler(w, r)
+			}), 100*time.Millisecond, 100*time.Millisecond))
+			defer srv.Close()
+
+			conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			fmt.Fprint(conn, tt.request)
+
+			select {
+			case err := <-result:
+				if err == nil {
+					t.Error("expected the stalled transfer to fail")
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("expected the stalled transfer to time out")
+			}
+		})
+	}
+}
+
+func TestTimeoutsSlowTransfer(t *testing.T) {
+	// Each write is quick, the whole response takes longer than the timeout
+	srv := httptest.NewServer(withTimeouts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < 6; i++ {
+			w.Write([]byte("data\n"))
+			http.NewResponseController(w).Flush()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}), 100*time.Millisecond, 100*time.Millisecond))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || !bytes.Equal(body, bytes.Repeat([]byte("data\n"), 6)) {
+		t.Errorf("expected the whole body, got %q, %v", body, err)
+	}
+}
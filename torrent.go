@@ -0,0 +1,733 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultTorrentPort is where --torrent takes connections from peers, the
+// first of the ports BitTorrent clients have long used
+const defaultTorrentPort = 6881
+
+// The BitTorrent peer protocol (BEP 3) and the extension protocol (BEP
+// 10) that carries the info dictionary to clients that only have the
+// magnet link (BEP 9)
+const (
+	torrentProtocol = "BitTorrent protocol"
+
+	torrentUnchoke    = 1
+	torrentInterested = 2
+	torrentBitfield   = 5
+	torrentRequest    = 6
+	torrentPiece      = 7
+	torrentExtended   = 20
+
+	torrentExtHandshake = 0
+	torrentExtMetadata  = 1 // Our id for ut_metadata messages
+
+	torrentMetadataRequest = 0
+	torrentMetadataData    = 1
+	torrentMetadataReject  = 2
+
+	torrentMetadataBlock = 16 << 10
+	torrentMaxBlock      = 128 << 10
+	torrentMaxMessage    = 1 << 20
+	torrentMinPiece      = 256 << 10
+	torrentMaxPiece      = 16 << 20
+	torrentTargetPieces  = 2000
+	torrentInterval      = time.Minute
+	torrentPeerTimeout   = 3 * time.Minute // Peers send keep-alives every 2 minutes
+	torrentMaxDepth      = 32
+)
+
+// torrentMeta is the share as a torrent: its files, one after the other as
+// the pieces are cut, and the info dictionary whose hash identifies it
+type torrentMeta struct {
+	name        string
+	single      bool // A single file rather than a directory
+	files       []torrentFile
+	length      int64
+	pieceLength int64
+	pieces      []byte // The SHA-1 of each piece
+	info        []byte
+	hash        [sha1.Size]byte
+}
+
+// torrentFile is a file of the torrent, starting at offset in the content
+type torrentFile struct {
+	path   string
+	rel    string
+	size   int64
+	offset int64
+}
+
+// newTorrentMeta lists the files of the tree and hashes their pieces. The
+// torrent is private, so clients only find peers through the share's own
+// tracker and don't announce it on the public DHT.
+func newTorrentMeta(tree *shareTree) (*torrentMeta, error) {
+	m := &torrentMeta{name: tree.name(), single: tree.archive == nil}
+	if m.single {
+		e, _, ok := tree.lookup(m.name)
+		if !ok {
+			return nil, fmt.Errorf("cannot access %s", m.name)
+		}
+		m.add(e)
+	} else {
+		root, ignores, ok := tree.lookup("")
+		if !ok {
+			return nil, fmt.Errorf("cannot access %s", m.name)
+		}
+		m.addChildren(tree, root, ignores)
+	}
+	if m.length == 0 {
+		return nil, errors.New("there's nothing to seed")
+	}
+	m.pieceLength = torrentPieceLength(m.length)
+	if err := m.hashPieces(); err != nil {
+		return nil, err
+	}
+
+	info := map[string]any{"name": m.name, "piece length": m.pieceLength, "pieces": m.pieces, "private": 1}
+	if m.single {
+		info["length"] = m.length
+	} else {
+		var files []any
+		for _, f := range m.files {
+			files = append(files, map[string]any{"length": f.size, "path": strings.Split(f.rel, "/")})
+		}
+		info["files"] = files
+	}
+	m.info = bencode(info)
+	m.hash = sha1.Sum(m.info)
+	return m, nil
+}
+
+func (m *torrentMeta) add(e treeEntry) {
+	m.files = append(m.files, torrentFile{path: e.path, rel: e.rel, size: e.info.Size(), offset: m.length})
+	m.length += e.info.Size()
+}
+
+// addChildren adds the regular files below dir, in the order they are
+// listed; a torrent has no place for empty directories or links
+func (m *torrentMeta) addChildren(tree *shareTree, dir treeEntry, ignores ignoreRules) {
+	for _, e := range tree.children(dir, ignores) {
+		switch {
+		case e.info.IsDir():
+			if sub, subIgnores, ok := tree.lookup(e.rel); ok {
+				m.addChildren(tree, sub, subIgnores)
+			}
+		case e.info.Mode().IsRegular():
+			m.add(e)
+		}
+	}
+}
+
+// torrentPieceLength picks a power of two between 256 KiB and 16 MiB that
+// cuts length into no more than about 2000 pieces
+func torrentPieceLength(length int64) int64 {
+	n := int64(torrentMinPiece)
+	for n < torrentMaxPiece && length/n > torrentTargetPieces {
+		n *= 2
+	}
+	return n
+}
+
+func (m *torrentMeta) hashPieces() error {
+	piece := make([]byte, 0, m.pieceLength)
+	hash := func() {
+		sum := sha1.Sum(piece)
+		m.pieces = append(m.pieces, sum[:]...)
+		piece = piece[:0]
+	}
+	for _, f := range m.files {
+		file, err := os.Open(f.path)
+		if err != nil {
+			return err
+		}
+		r := io.LimitReader(file, f.size)
+		read := int64(0)
+		for {
+			n, err := io.ReadFull(r, piece[len(piece):cap(piece)])
+			piece = piece[:len(piece)+n]
+			read += int64(n)
+			if len(piece) == cap(piece) {
+				hash()
+			}
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+		}
+		file.Close()
+		if read < f.size {
+			return fmt.Errorf("%s got shorter while being hashed", f.rel)
+		}
+	}
+	if len(piece) > 0 {
+		hash()
+	}
+	return nil
+}
+
+// count is the number of pieces
+func (m *torrentMeta) count() int {
+	return len(m.pieces) / sha1.Size
+}
+
+// size is the length of piece index; the last one is usually shorter
+func (m *torrentMeta) size(index int) int64 {
+	return min(m.pieceLength, m.length-int64(index)*m.pieceLength)
+}
+
+// torrentFile is the .torrent file, pointing at the share's tracker
+func (m *torrentMeta) torrentFile(announce string) []byte {
+	return bencode(map[string]any{
+		"announce":      announce,
+		"created by":    "userve",
+		"creation date": time.Now().Unix(),
+		"info":          bencodeRaw(m.info),
+	})
+}
+
+// magnet is the magnet link of the torrent. Besides the tracker it names
+// the seed itself, so clients can fetch the info from it straight away.
+func (m *torrentMeta) magnet(announce, seed string) string {
+	return "magnet:?xt=urn:btih:" + hex.EncodeToString(m.hash[:]) + "&dn=" + url.QueryEscape(m.name) +
+		"&tr=" + url.QueryEscape(announce) + "&x.pe=" + seed
+}
+
+// torrentServer seeds the share's torrent: every peer is sent the whole
+// bitfield, unchoked once it is interested and sent whatever blocks it
+// asks for. Peers share what they got among each other as well, so one
+// sender can hand a large file to many recipients at once. Blocks aren't
+// downloads; a peer counts as one once it tells the tracker it is done.
+type torrentServer struct {
+	meta     *torrentMeta
+	listener net.Listener
+	peerID   [20]byte
+
+	mu     sync.Mutex
+	files  map[int]*os.File // Opened as peers ask for them
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+// torrentPeer is a connection from a peer
+type torrentPeer struct {
+	server     *torrentServer
+	conn       net.Conn
+	r          *bufio.Reader
+	w          *bufio.Writer
+	metadataID int // The peer's id for ut_metadata messages, 0 if it has none
+	unchoked   bool
+}
+
+func newTorrentServer(listener net.Listener, meta *torrentMeta) *torrentServer {
+	s := &torrentServer{meta: meta, listener: listener, files: make(map[int]*os.File), conns: make(map[net.Conn]bool)}
+	copy(s.peerID[:], "-UV0001-")
+	const digits = "0123456789abcdefghijklmnopqrstuvwxyz"
+	random := make([]byte, len(s.peerID)-8)
+	rand.Read(random)
+	for i, b := range random {
+		s.peerID[8+i] = digits[int(b)%len(digits)]
+	}
+	return s
+}
+
+// serve accepts peers until the server is closed
+func (s *torrentServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = true
+		s.mu.Unlock()
+		p := &torrentPeer{server: s, conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}
+		go p.run()
+	}
+}
+
+// Close stops seeding; peers that haven't got everything yet can still
+// get it from each other
+func (s *torrentServer) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	for _, f := range s.files {
+		f.Close()
+	}
+	return s.listener.Close()
+}
+
+// read fills b with the content at offset, which may span files
+func (s *torrentServer) read(b []byte, offset int64) error {
+	files := s.meta.files
+	for len(b) > 0 {
+		i := sort.Search(len(files), func(i int) bool { return files[i].offset+files[i].size > offset })
+		if i == len(files) {
+			return io.ErrUnexpectedEOF
+		}
+		n := min(int64(len(b)), files[i].offset+files[i].size-offset)
+		file, err := s.open(i)
+		if err != nil {
+			return err
+		}
+		if _, err := file.ReadAt(b[:n], offset-files[i].offset); err != nil {
+			return err
+		}
+		b = b[n:]
+		offset += n
+	}
+	return nil
+}
+
+// open returns file i, opened once for all peers
+func (s *torrentServer) open(i int) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.files[i]; ok {
+		return f, nil
+	}
+	if s.closed {
+		return nil, net.ErrClosed
+	}
+	f, err := os.Open(s.meta.files[i].path)
+	if err != nil {
+		return nil, err
+	}
+	s.files[i] = f
+	return f, nil
+}
+
+// run answers the peer until it leaves or breaks the protocol
+func (p *torrentPeer) run() {
+	defer func() {
+		p.conn.Close()
+		p.server.mu.Lock()
+		delete(p.server.conns, p.conn)
+		p.server.mu.Unlock()
+	}()
+	if err := p.handshake(); err != nil {
+		return
+	}
+	for {
+		if p.r.Buffered() == 0 {
+			// Answers to pipelined requests go out together
+			p.conn.SetWriteDeadline(time.Now().Add(torrentPeerTimeout))
+			if err := p.w.Flush(); err != nil {
+				return
+			}
+		}
+		p.conn.SetReadDeadline(time.Now().Add(torrentPeerTimeout))
+		msg, err := p.readMessage()
+		if err != nil {
+			return
+		}
+		if len(msg) == 0 {
+			continue // Keep-alive
+		}
+		if err := p.handle(msg[0], msg[1:]); err != nil {
+			return
+		}
+	}
+}
+
+// handshake checks that the peer wants the share's torrent and sends the
+// bitfield of a seed
+func (p *torrentPeer) handshake() error {
+	p.conn.SetReadDeadline(time.Now().Add(torrentPeerTimeout))
+	var in [68]byte
+	if _, err := io.ReadFull(p.r, in[:]); err != nil {
+		return err
+	}
+	meta := p.server.meta
+	if in[0] != byte(len(torrentProtocol)) || string(in[1:20]) != torrentProtocol || !bytes.Equal(in[28:48], meta.hash[:]) {
+		return errors.New("not a peer of the torrent")
+	}
+	out := append([]byte{byte(len(torrentProtocol))}, torrentProtocol...)
+	out = append(out, 0, 0, 0, 0, 0, 0x10, 0, 0) // Extension protocol
+	out = append(append(out, meta.hash[:]...), p.server.peerID[:]...)
+	p.w.Write(out)
+	if in[25]&0x10 != 0 {
+		p.sendExtended(torrentExtHandshake, bencode(map[string]any{
+			"m":             map[string]any{"ut_metadata": torrentExtMetadata},
+			"metadata_size": len(meta.info),
+			"v":             "userve",
+			"reqq":          250,
+		}))
+	}
+	bitfield := bytes.Repeat([]byte{0xff}, (meta.count()+7)/8)
+	if extra := meta.count() % 8; extra != 0 {
+		bitfield[len(bitfield)-1] = 0xff << (8 - extra)
+	}
+	p.send(torrentBitfield, bitfield)
+	return nil
+}
+
+func (p *torrentPeer) readMessage() ([]byte, error) {
+	var length [4]byte
+	if _, err := io.ReadFull(p.r, length[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(length[:])
+	if n > torrentMaxMessage {
+		return nil, errors.New("message too large")
+	}
+	msg := make([]byte, n)
+	_, err := io.ReadFull(p.r, msg)
+	return msg, err
+}
+
+// handle answers a message; an error drops the peer
+func (p *torrentPeer) handle(id byte, payload []byte) error {
+	meta := p.server.meta
+	switch id {
+	case torrentInterested:
+		if !p.unchoked {
+			p.unchoked = true
+			p.send(torrentUnchoke)
+		}
+	case torrentRequest:
+		if len(payload) != 12 {
+			return errors.New("malformed request")
+		}
+		index := int(binary.BigEndian.Uint32(payload))
+		begin := int64(binary.BigEndian.Uint32(payload[4:]))
+		length := int64(binary.BigEndian.Uint32(payload[8:]))
+		if !p.unchoked {
+			return nil
+		}
+		if index >= meta.count() || length == 0 || length > torrentMaxBlock || begin+length > meta.size(index) {
+			return errors.New("request out of range")
+		}
+		block := make([]byte, length)
+		if err := p.server.read(block, int64(index)*meta.pieceLength+begin); err != nil {
+			return err
+		}
+		return p.send(torrentPiece, payload[:8], block)
+	case torrentExtended:
+		if len(payload) == 0 {
+			return errors.New("malformed extended message")
+		}
+		return p.handleExtended(payload[0], payload[1:])
+	}
+	// Have, cancel and the rest mean nothing to a seed that answers
+	// requests as they come
+	return nil
+}
+
+// handleExtended answers extension messages: the peer's extension
+// handshake and its requests for the info dictionary
+func (p *torrentPeer) handleExtended(id byte, payload []byte) error {
+	v, _, err := parseBencode(payload)
+	if err != nil {
+		return err
+	}
+	d, _ := v.(map[string]any)
+	switch id {
+	case torrentExtHandshake:
+		m, _ := d["m"].(map[string]any)
+		if n, ok := m["ut_metadata"].(int64); ok && n > 0 && n < 256 {
+			p.metadataID = int(n)
+		}
+	case torrentExtMetadata:
+		if p.metadataID == 0 {
+			return nil
+		}
+		msgType, _ := d["msg_type"].(int64)
+		piece, _ := d["piece"].(int64)
+		if msgType != torrentMetadataRequest {
+			return nil
+		}
+		info := p.server.meta.info
+		start := piece * torrentMetadataBlock
+		if piece < 0 || start >= int64(len(info)) {
+			return p.sendExtended(byte(p.metadataID), bencode(map[string]any{"msg_type": torrentMetadataReject, "piece": piece}))
+		}
+		end := min(start+torrentMetadataBlock, int64(len(info)))
+		header := bencode(map[string]any{"msg_type": torrentMetadataData, "piece": piece, "total_size": len(info)})
+		return p.sendExtended(byte(p.metadataID), header, info[start:end])
+	}
+	return nil
+}
+
+// send buffers a message made of id and the parts of its payload
+func (p *torrentPeer) send(id byte, parts ...[]byte) error {
+	n := 1
+	for _, part := range parts {
+		n += len(part)
+	}
+	p.w.Write(binary.BigEndian.AppendUint32(nil, uint32(n)))
+	p.w.WriteByte(id)
+	for _, part := range parts {
+		if _, err := p.w.Write(part); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *torrentPeer) sendExtended(id byte, parts ...[]byte) error {
+	return p.send(torrentExtended, append([][]byte{{id}}, parts...)...)
+}
+
+// torrentTracker is the HTTP tracker of the share's torrent, answering
+// with compact peer lists (BEP 23 and BEP 7). Each peer is told about the
+// seed, at the address it reached the tracker at, and the other peers.
+// A peer that reports having finished counts as a download.
+type torrentTracker struct {
+	meta      *torrentMeta
+	downloads *handler
+	seedPort  int
+
+	mu        sync.Mutex
+	peers     map[string]trackedPeer // By peer id
+	completed map[string]bool
+}
+
+// trackedPeer is a peer as last announced
+type trackedPeer struct {
+	addr netip.AddrPort
+	seen time.Time
+	done bool
+}
+
+func newTorrentTracker(meta *torrentMeta, downloads *handler, seedPort int) *torrentTracker {
+	return &torrentTracker{meta: meta, downloads: downloads, seedPort: seedPort, peers: make(map[string]trackedPeer), completed: make(map[string]bool)}
+}
+
+func (t *torrentTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowReads(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	q := r.URL.Query()
+	if q.Get("info_hash") != string(t.meta.hash[:]) {
+		w.Write(bencode(map[string]any{"failure reason": "unknown torrent"}))
+		return
+	}
+	id := q.Get("peer_id")
+	port, err := strconv.Atoi(q.Get("port"))
+	host, _, _ := net.SplitHostPort(r.RemoteAddr)
+	ip, ipErr := netip.ParseAddr(host)
+	if len(id) != 20 || err != nil || port <= 0 || port > 65535 || ipErr != nil {
+		w.Write(bencode(map[string]any{"failure reason": "malformed announce"}))
+		return
+	}
+	peer := trackedPeer{addr: netip.AddrPortFrom(ip.Unmap().WithZone(""), uint16(port)), seen: time.Now(), done: q.Get("left") == "0"}
+
+	var peers, peers6 []byte
+	appendPeer := func(addr netip.AddrPort) {
+		if addr.Addr().Is4() {
+			peers = binary.BigEndian.AppendUint16(append(peers, addr.Addr().AsSlice()...), addr.Port())
+		} else {
+			peers6 = binary.BigEndian.AppendUint16(append(peers6, addr.Addr().AsSlice()...), addr.Port())
+		}
+	}
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		if seed, err := netip.ParseAddrPort(local.String()); err == nil {
+			appendPeer(netip.AddrPortFrom(seed.Addr().Unmap().WithZone(""), uint16(t.seedPort)))
+		}
+	}
+	complete, incomplete := 1, 0
+
+	t.mu.Lock()
+	for other, p := range t.peers {
+		if time.Since(p.seen) > 3*torrentInterval {
+			delete(t.peers, other)
+		}
+	}
+	event := q.Get("event")
+	if event == "stopped" {
+		delete(t.peers, id)
+	} else {
+		t.peers[id] = peer
+	}
+	finished := event == "completed" && !t.completed[id]
+	if finished {
+		t.completed[id] = true
+	}
+	for other, p := range t.peers {
+		if other == id {
+			continue
+		}
+		appendPeer(p.addr)
+		if p.done {
+			complete++
+		} else {
+			incomplete++
+		}
+	}
+	t.mu.Unlock()
+
+	w.Write(bencode(map[string]any{
+		"interval":   int64(torrentInterval / time.Second),
+		"complete":   complete,
+		"incomplete": incomplete,
+		"peers":      peers,
+		"peers6":     peers6,
+	}))
+	if finished {
+		client := peer.addr.Addr().String()
+		logEvent("download_completed", logFields{"client": client, "file": t.meta.name, "protocol": "bittorrent"}, "Download completed from %s over BitTorrent", client)
+		item, _ := t.downloads.status()
+		t.downloads.count(item)
+	}
+}
+
+// torrentListener opens the --torrent port
+func torrentListener(host string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if isAddrInUse(err) {
+		return nil, fmt.Errorf("BitTorrent port %d is in use; pick another with --torrent-port", port)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot listen for BitTorrent: %v", err)
+	}
+	return l, nil
+}
+
+// bencodeRaw is a value that is already bencoded
+type bencodeRaw []byte
+
+// bencode encodes integers, strings, byte slices, lists and dictionaries
+// with string keys, which are sorted as the format requires
+func bencode(v any) []byte {
+	return appendBencode(nil, v)
+}
+
+func appendBencode(b []byte, v any) []byte {
+	switch v := v.(type) {
+	case int:
+		return append(strconv.AppendInt(append(b, 'i'), int64(v), 10), 'e')
+	case int64:
+		return append(strconv.AppendInt(append(b, 'i'), v, 10), 'e')
+	case string:
+		return append(append(strconv.AppendInt(b, int64(len(v)), 10), ':'), v...)
+	case []byte:
+		return append(append(strconv.AppendInt(b, int64(len(v)), 10), ':'), v...)
+	case bencodeRaw:
+		return append(b, v...)
+	case []string:
+		b = append(b, 'l')
+		for _, s := range v {
+			b = appendBencode(b, s)
+		}
+		return append(b, 'e')
+	case []any:
+		b = append(b, 'l')
+		for _, item := range v {
+			b = appendBencode(b, item)
+		}
+		return append(b, 'e')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		slices.Sort(keys)
+		b = append(b, 'd')
+		for _, k := range keys {
+			b = appendBencode(appendBencode(b, k), v[k])
+		}
+		return append(b, 'e')
+	}
+	panic(fmt.Sprintf("cannot bencode %T", v))
+}
+
+// parseBencode decodes the value at the start of b into int64, string,
+// []any or map[string]any, and returns what follows it
+func parseBencode(b []byte) (any, []byte, error) {
+	return parseBencodeDepth(b, 0)
+}
+
+func parseBencodeDepth(b []byte, depth int) (any, []byte, error) {
+	malformed := errors.New("malformed bencoded value")
+	if len(b) == 0 || depth > torrentMaxDepth {
+		return nil, nil, malformed
+	}
+	switch c := b[0]; {
+	case c == 'i':
+		end := bytes.IndexByte(b, 'e')
+		if end < 0 {
+			return nil, nil, malformed
+		}
+		n, err := strconv.ParseInt(string(b[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, malformed
+		}
+		return n, b[end+1:], nil
+	case c >= '0' && c <= '9':
+		colon := bytes.IndexByte(b, ':')
+		if colon < 0 {
+			return nil, nil, malformed
+		}
+		n, err := strconv.Atoi(string(b[:colon]))
+		if err != nil || n < 0 || n > len(b)-colon-1 {
+			return nil, nil, malformed
+		}
+		return string(b[colon+1 : colon+1+n]), b[colon+1+n:], nil
+	case c == 'l':
+		list := []any{}
+		for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+			var item any
+			var err error
+			if item, b, err = parseBencodeDepth(b, depth+1); err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+		}
+		if len(b) == 0 {
+			return nil, nil, malformed
+		}
+		return list, b[1:], nil
+	case c == 'd':
+		dict := make(map[string]any)
+		for b = b[1:]; len(b) > 0 && b[0] != 'e'; {
+			key, rest, err := parseBencodeDepth(b, depth+1)
+			k, ok := key.(string)
+			if err != nil || !ok {
+				return nil, nil, malformed
+			}
+			if dict[k], b, err = parseBencodeDepth(rest, depth+1); err != nil {
+				return nil, nil, err
+			}
+		}
+		if len(b) == 0 {
+			return nil, nil, malformed
+		}
+		return dict, b[1:], nil
+	}
+	return nil, nil, malformed
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBencode(t *testing.T) {
+	got := bencode(map[string]any{"b": []any{1, "x"}, "a": int64(-3), "c": []byte{0xff}, "d": bencodeRaw("de")})
+	if want := "d1:ai-3e1:bli1e1:xe1:c1:\xff1:ddee"; string(got) != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	v, rest, err := parseBencode([]byte("d1:md11:ut_metadatai3ee4:listli1e0:ee5:piece"))
+	want := map[string]any{"m": map[string]any{"ut_metadata": int64(3)}, "list": []any{int64(1), ""}}
+	if err != nil || !reflect.DeepEqual(v, want) || string(rest) != "5:piece" {
+		t.Errorf("unexpected %#v, rest %q, %v", v, rest, err)
+	}
+	for _, b := range []string{"", "i12", "5:abc", "l1:a", "di1ei2ee", "x", strings.Repeat("l", 100)} {
+		if _, _, err := parseBencode([]byte(b)); err == nil {
+			t.Errorf("%q: expected an error", b)
+		}
+	}
+}
+
+func TestTorrentPieceLength(t *testing.T) {
+	for _, tc := range []struct{ length, want int64 }{
+		{1, 256 << 10},
+		{500 << 20, 256 << 10},
+		{501 << 20, 512 << 10},
+		{4 << 30, 4 << 20},
+		{1 << 40, 16 << 20},
+	} {
+		if got := torrentPieceLength(tc.length); got != tc.want {
+			t.Errorf("%d: expected %d, got %d", tc.length, tc.want, got)
+		}
+	}
+}
+
+// testTorrent makes the torrent of a directory with files that don't fall
+// on piece boundaries
+func testTorrent(t *testing.T) (*torrentMeta, []byte) {
+	t.Helper()
+	dir := t.TempDir()
+	share := filepath.Join(dir, "share")
+	os.MkdirAll(filepath.Join(share, "sub"), 0755)
+	a := bytes.Repeat([]byte("a"), 300<<10)
+	b := bytes.Repeat([]byte("0123456789"), 30<<10)
+	os.WriteFile(filepath.Join(share, "a.bin"), a, 0644)
+	os.WriteFile(filepath.Join(share, "empty"), nil, 0644)
+	os.WriteFile(filepath.Join(share, "sub", "b.bin"), b, 0644)
+	os.WriteFile(filepath.Join(share, ".env"), []byte("secret"), 0644)
+	archive := newArchiveProvider(share, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	m, err := newTorrentMeta(&shareTree{archive: archive})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m, append(a, b...)
+}
+
+func TestTorrentMeta(t *testing.T) {
+	m, content := testTorrent(t)
+	if m.pieceLength != 256<<10 || m.count() != 3 {
+		t.Fatalf("unexpected pieces: %d of %d bytes", m.count(), m.pieceLength)
+	}
+	for i := range m.count() {
+		piece := content[int64(i)*m.pieceLength : int64(i)*m.pieceLength+m.size(i)]
+		if sum := sha1.Sum(piece); !bytes.Equal(m.pieces[i*sha1.Size:(i+1)*sha1.Size], sum[:]) {
+			t.Errorf("piece %d: unexpected hash", i)
+		}
+	}
+
+	v, rest, err := parseBencode(m.info)
+	info, _ := v.(map[string]any)
+	if err != nil || len(rest) != 0 || info["name"] != "share" || info["private"] != int64(1) {
+		t.Fatalf("unexpected info %v, %v", v, err)
+	}
+	files := []any{
+		map[string]any{"length": int64(300 << 10), "path": []any{"a.bin"}},
+		map[string]any{"length": int64(0), "path": []any{"empty"}},
+		map[string]any{"length": int64(300 << 10), "path": []any{"sub", "b.bin"}},
+	}
+	if !reflect.DeepEqual(info["files"], files) {
+		t.Errorf("unexpected files %v", info["files"])
+	}
+
+	magnet, err := url.Parse(m.magnet("http://192.0.2.1:8080/announce", "192.0.2.1:6881"))
+	if err != nil || magnet.Query().Get("xt") != "urn:btih:"+hex.EncodeToString(m.hash[:]) || magnet.Query().Get("tr") != "http://192.0.2.1:8080/announce" || magnet.Query().Get("x.pe") != "192.0.2.1:6881" {
+		t.Errorf("unexpected magnet link %v, %v", magnet, err)
+	}
+
+	file := filepath.Join(t.TempDir(), "empty.iso")
+	os.WriteFile(file, nil, 0644)
+	if _, err := newTorrentMeta(&shareTree{file: &fileProvider{filePath: file, fileName: "empty.iso"}}); err == nil {
+		t.Error("expected an empty share to have nothing to seed")
+	}
+}
+
+// torrentClient is the downloading end of a peer connection
+type torrentClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func (c *torrentClient) send(id byte, payload ...byte) {
+	c.conn.Write(append(binary.BigEndian.AppendUint32(nil, uint32(len(payload)+1)), append([]byte{id}, payload...)...))
+}
+
+// next returns the next message other than a keep-alive
+func (c *torrentClient) next() (byte, []byte) {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var length [4]byte
+		if _, err := io.ReadFull(c.r, length[:]); err != nil {
+			c.t.Fatal(err)
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(length[:]))
+		if _, err := io.ReadFull(c.r, msg); err != nil {
+			c.t.Fatal(err)
+		}
+		if len(msg) > 0 {
+			return msg[0], msg[1:]
+		}
+	}
+}
+
+func TestTorrentPeer(t *testing.T) {
+	m, content := testTorrent(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTorrentServer(l, m)
+	go s.serve()
+	defer s.Close()
+
+	connect := func(hash []byte) *torrentClient {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hs := append([]byte{19}, "BitTorrent protocol"...)
+		hs = append(hs, 0, 0, 0, 0, 0, 0x10, 0, 0)
+		hs = append(append(hs, hash...), "-XX0000-abcdefghijkl"...)
+		conn.Write(hs)
+		return &torrentClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+	}
+
+	// Another torrent's peers are hung up on
+	other := connect(bytes.Repeat([]byte{1}, 20))
+	other.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if n, err := other.r.Read(make([]byte, 1)); n != 0 || err == nil {
+		t.Error("expected a peer of another torrent to be refused")
+	}
+
+	c := connect(m.hash[:])
+	defer c.conn.Close()
+	var hs [68]byte
+	io.ReadFull(c.r, hs[:])
+	if !bytes.Equal(hs[28:48], m.hash[:]) || hs[25]&0x10 == 0 || string(hs[48:56]) != "-UV0001-" {
+		t.Fatalf("unexpected handshake %q", hs)
+	}
+	id, payload := c.next()
+	if v, _, _ := parseBencode(payload[1:]); id != torrentExtended || payload[0] != torrentExtHandshake || v.(map[string]any)["metadata_size"] != int64(len(m.info)) {
+		t.Fatalf("expected the extension handshake, got %d %q", id, payload)
+	}
+	if id, payload := c.next(); id != torrentBitfield || !bytes.Equal(payload, []byte{0xe0}) {
+		t.Fatalf("expected a full bitfield, got %d %x", id, payload)
+	}
+
+	// The info dictionary, for a client that has only the magnet link
+	c.send(torrentExtended, append([]byte{torrentExtHandshake}, bencode(map[string]any{"m": map[string]any{"ut_metadata": 7}})...)...)
+	c.send(torrentExtended, append([]byte{torrentExtMetadata}, bencode(map[string]any{"msg_type": 0, "piece": 0})...)...)
+	id, payload = c.next()
+	v, data, err := parseBencode(payload[1:])
+	if id != torrentExtended || payload[0] != 7 || err != nil || v.(map[string]any)["msg_type"] != int64(torrentMetadataData) || sha1.Sum(data) != m.hash {
+		t.Fatalf("expected the info dictionary, got %d %q, %v", id, payload, err)
+	}
+	c.send(torrentExtended, append([]byte{torrentExtMetadata}, bencode(map[string]any{"msg_type": 0, "piece": 1})...)...)
+	if _, payload := c.next(); !bytes.Contains(payload, []byte("8:msg_typei2e")) {
+		t.Errorf("expected a request past the end to be rejected, got %q", payload)
+	}
+
+	// Blocks are sent once the peer is unchoked, here one across two files
+	c.send(torrentInterested)
+	if id, _ := c.next(); id != torrentUnchoke {
+		t.Fatalf("expected to be unchoked, got %d", id)
+	}
+	request := binary.BigEndian.AppendUint32(nil, 1)
+	request = binary.BigEndian.AppendUint32(request, 40<<10)
+	request = binary.BigEndian.AppendUint32(request, 16<<10)
+	c.send(torrentRequest, request...)
+	id, payload = c.next()
+	offset := int(m.pieceLength) + 40<<10
+	if id != torrentPiece || !bytes.Equal(payload[:8], request[:8]) || !bytes.Equal(payload[8:], content[offset:offset+16<<10]) {
+		t.Errorf("expected the block, got %d with %d bytes", id, len(payload))
+	}
+
+	// A request past the end of the last piece drops the peer
+	request = binary.BigEndian.AppendUint32(nil, 2)
+	request = binary.BigEndian.AppendUint32(request, uint32(m.size(2)))
+	request = binary.BigEndian.AppendUint32(request, 1)
+	c.send(torrentRequest, request...)
+	c.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Error("expected the connection to be closed")
+	}
+}
+
+func TestTorrentTracker(t *testing.T) {
+	m, _ := testTorrent(t)
+	archive := newArchiveProvider(t.TempDir(), "share", archiveOptions{format: ArchiveTarGz})
+	h := &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 2}
+	srv := httptest.NewServer(newTorrentTracker(m, h, 6881))
+	defer srv.Close()
+
+	announce := func(peerID, port, event string) map[string]any {
+		q := url.Values{"info_hash": {string(m.hash[:])}, "peer_id": {peerID}, "port": {port}, "left": {"100"}, "compact": {"1"}}
+		if event != "" {
+			q.Set("event", event)
+		}
+		if event == "completed" {
+			q.Set("left", "0")
+		}
+		resp, err := http.Get(srv.URL + "/announce?" + q.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		v, _, err := parseBencode(body)
+		if err != nil {
+			t.Fatalf("unexpected response %q", body)
+		}
+		return v.(map[string]any)
+	}
+	seed := string([]byte{127, 0, 0, 1, 0x1a, 0xe1})
+	first := strings.Repeat("1", 20)
+	if got := announce(first, "7000", "started"); got["peers"] != seed || got["interval"] != int64(60) {
+		t.Errorf("expected only the seed, got %q", got)
+	}
+	got := announce(strings.Repeat("2", 20), "7001", "started")
+	if got["peers"] != seed+string([]byte{127, 0, 0, 1, 0x1b, 0x58}) || got["incomplete"] != int64(1) {
+		t.Errorf("expected the seed and the first peer, got %q", got)
+	}
+
+	// Finishing counts once per peer
+	announce(first, "7000", "completed")
+	announce(first, "7000", "completed")
+	if remaining := h.remaining(); remaining != 1 {
+		t.Errorf("expected 1 download remaining, got %d", remaining)
+	}
+	announce(strings.Repeat("2", 20), "7001", "completed")
+	select {
+	case <-h.downloadComplete:
+	default:
+		t.Error("expected the limit to be reached")
+	}
+
+	if got := announce(first, "7000", "stopped"); got["complete"] != int64(2) {
+		t.Errorf("expected a stopped peer to be forgotten, got %q", got)
+	}
+	if got := announce("short", "7000", ""); got["failure reason"] != "malformed announce" {
+		t.Errorf("expected a malformed announce to fail, got %q", got)
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// transport makes the local server reachable from outside the LAN, e.g.
+// through a router port mapping, a relay tunnel or an overlay network
+type transport interface {
+	// Name labels the transport's URL in the startup output
+	Name() string
+	// URL returns the base URL of the server, without a trailing slash
+	URL() string
+	// Close tears down the transport
+	Close() error
+}
+
+// portMapTransport exposes the server through a router port mapping
+type portMapTransport struct {
+	portMapping
+}
+
+func (t *portMapTransport) Name() string {
+	return "Public"
+}
+
+func (t *portMapTransport) URL() string {
+	return "http://" + net.JoinHostPort(t.ExternalIP().String(), fmt.Sprint(t.ExternalPort()))
+}
+
+// closeTransports tears down transports in reverse order of opening
+func closeTransports(transports []transport) {
+	for i := len(transports) - 1; i >= 0; i-- {
+		transports[i].Close()
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// shareTree is the shared file or directory as a tree of files, for the
+// protocols that let clients list and pick them: --webdav, --ftp and
+// --sftp. The archive's filter applies as with --browse: what the archive
+// would leave out is neither listed nor served.
+type shareTree struct {
+	archive *archiveProvider // The shared directory, or nil
+	file    *fileProvider    // The shared file, if it isn't a directory
+}
+
+// treeEntry is a file or directory of the share, at the slash-separated
+// path rel below its root
+type treeEntry struct {
+	rel  string
+	path string
+	info os.FileInfo
+}
+
+// newShareTree returns the tree of a single file or directory share, or
+// nil for other content
+func newShareTree(p contentProvider) *shareTree {
+	switch p := p.(type) {
+	case *archiveProvider:
+		return &shareTree{archive: p}
+	case *fileProvider:
+		return &shareTree{file: p}
+	}
+	return nil
+}
+
+// name is the name of the tree's root
+func (t *shareTree) name() string {
+	if t.archive != nil {
+		return t.archive.dirName
+	}
+	return t.file.fileName
+}
+
+// lookup finds the entry at rel, and for a directory the ignore rules in
+// effect inside it
+func (t *shareTree) lookup(rel string) (treeEntry, ignoreRules, bool) {
+	if t.archive != nil {
+		filePath, info, ignores, ok := t.archive.resolve(rel)
+		return treeEntry{rel: rel, path: filePath, info: info}, ignores, ok
+	}
+	// A single file is the only entry of the root directory
+	target := t.file.filePath
+	switch rel {
+	case "":
+		target = filepath.Dir(target)
+	case t.file.fileName:
+	default:
+		return treeEntry{}, nil, false
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return treeEntry{}, nil, false
+	}
+	return treeEntry{rel: rel, path: target, info: info}, nil, true
+}
+
+// children returns the entries of the directory dir
+func (t *shareTree) children(dir treeEntry, ignores ignoreRules) []treeEntry {
+	if t.archive == nil {
+		if file, _, ok := t.lookup(t.file.fileName); ok {
+			return []treeEntry{file}
+		}
+		return nil
+	}
+	dirEntries, err := os.ReadDir(dir.path)
+	if err != nil {
+		return nil
+	}
+	var entries []treeEntry
+	for _, de := range dirEntries {
+		childRel := path.Join(dir.rel, de.Name())
+		childPath := filepath.Join(dir.path, de.Name())
+		if info, ok := t.archive.browsable(childPath, childRel, ignores); ok {
+			entries = append(entries, treeEntry{rel: childRel, path: childPath, info: info})
+		}
+	}
+	return entries
+}
+
+// exists reports whether the URL path names an entry of the share, so the
+// share's other endpoints don't hide it
+func (t *shareTree) exists(urlPath string) bool {
+	_, _, ok := t.lookup(strings.TrimPrefix(path.Clean(urlPath), "/"))
+	return ok
+}
+
+// content returns the provider that downloads the file e
+func (t *shareTree) content(e treeEntry) contentProvider {
+	if t.archive == nil {
+		return t.file
+	}
+	return &fileProvider{filePath: e.path, fileName: e.info.Name(), fileSize: e.info.Size()}
+}
+
+// treeRequest makes the request a download over FTP or SFTP is served as
+func treeRequest(client, target string) *http.Request {
+	r, _ := http.NewRequest(http.MethodGet, target, nil)
+	r.RemoteAddr = client
+	return r
+}
+
+// treeResponse is the response of a download over FTP or SFTP: the body
+// goes to out, after the first skip bytes for a restarted transfer, and an
+// error response is kept for the client's reply
+type treeResponse struct {
+	out     io.Writer
+	header  http.Header
+	status  int
+	skip    int64
+	message bytes.Buffer
+	err     error
+}
+
+func (d *treeResponse) Header() http.Header {
+	return d.header
+}
+
+func (d *treeResponse) WriteHeader(code int) {
+	if d.status == 0 {
+		d.status = code
+	}
+}
+
+func (d *treeResponse) Write(b []byte) (int, error) {
+	d.WriteHeader(http.StatusOK)
+	if d.status >= 300 {
+		return d.message.Write(b)
+	}
+	n := len(b)
+	if d.skip > 0 {
+		skipped := min(d.skip, int64(len(b)))
+		d.skip -= skipped
+		b = b[skipped:]
+	}
+	if _, err := d.out.Write(b); err != nil {
+		d.err = err
+		return 0, err
+	}
+	return n, nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const tunnelStartTimeout = 30 * time.Second
+
+// tunnel is an outbound tunnel to a relay exposing the local server
+type tunnel struct {
+	cmd *exec.Cmd
+	out *io.PipeWriter
+	url string
+}
+
+// tunnelSpec describes how to run a tunnel client and read its public URL
+// from the client's output
+type tunnelSpec struct {
+	name  string
+	args  []string
+	match func(line string) string
+}
+
+var trycloudflareURL = regexp.MustCompile(`https://[a-z0-9-]+\.trycloudflare\.com`)
+var sshAllocatedPort = regexp.MustCompile(`Allocated port (\d+) for remote forward`)
+
+// parseTunnelSpec maps a --tunnel value to the client command forwarding
+// to localAddr: "cloudflare" (quick tunnel), "ngrok" (uses the configured
+// authtoken) or "ssh://[user@]host[:port]" for a self-hosted relay
+func parseTunnelSpec(value, localAddr string) (*tunnelSpec, error) {
+	switch {
+	case value == "cloudflare":
+		return &tunnelSpec{
+			name: "cloudflared",
+			args: []string{"tunnel", "--no-autoupdate", "--url", "http://" + localAddr},
+			match: func(line string) string {
+				return trycloudflareURL.FindString(line)
+			},
+		}, nil
+	case value == "ngrok":
+		return &tunnelSpec{
+			name: "ngrok",
+			args: []string{"http", localAddr, "--log", "stdout", "--log-format", "json"},
+			match: func(line string) string {
+				var entry struct {
+					URL string `json:"url"`
+				}
+				if json.Unmarshal([]byte(line), &entry) == nil && strings.HasPrefix(entry.URL, "https://") {
+					return entry.URL
+				}
+				return ""
+			},
+		}, nil
+	case strings.HasPrefix(value, "ssh://"):
+		u, err := url.Parse(value)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("invalid relay URL %q", value)
+		}
+		dest := u.Hostname()
+		if u.User != nil {
+			dest = u.User.Username() + "@" + dest
+		}
+		args := []string{"-N", "-o", "ExitOnForwardFailure=yes", "-R", "0:" + localAddr}
+		if u.Port() != "" {
+			args = append(args, "-p", u.Port())
+		}
+		relayHost := u.Hostname()
+		return &tunnelSpec{
+			name: "ssh",
+			args: append(args, dest),
+			match: func(line string) string {
+				if m := sshAllocatedPort.FindStringSubmatch(line); m != nil {
+					return "http://" + net.JoinHostPort(relayHost, m[1])
+				}
+				return ""
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid tunnel %q: valid values are cloudflare, ngrok, ssh://[user@]host[:port]", value)
+	}
+}
+
+// startTunnel runs the tunnel client and waits until it reports its
+// public URL
+func startTunnel(spec *tunnelSpec) (*tunnel, error) {
+	path, err := exec.LookPath(spec.name)
+	if err != nil {
+		return nil, fmt.Errorf("tunnel requires %s to be installed", spec.name)
+	}
+
+	pr, pw := io.Pipe()
+	cmd := exec.Command(path, spec.args...)
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start %s: %v", spec.name, err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+		pw.Close()
+	}()
+
+	found := make(chan string, 1)
+	go func() {
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if u := spec.match(scanner.Text()); u != "" {
+				select {
+				case found <- u:
+				default:
+				}
+			}
+		}
+		// Keep draining so the client never blocks on a full pipe
+		io.Copy(io.Discard, pr)
+	}()
+
+	t := &tunnel{cmd: cmd, out: pw}
+	select {
+	case t.url = <-found:
+		return t, nil
+	case err := <-exited:
+		if err == nil {
+			err = errors.New("exited")
+		}
+		return nil, fmt.Errorf("%s: %v", spec.name, err)
+	case <-time.After(tunnelStartTimeout):
+		t.Close()
+		return nil, fmt.Errorf("%s did not report a public URL within %v", spec.name, tunnelStartTimeout)
+	}
+}
+
+func (t *tunnel) Name() string {
+	return "Tunnel"
+}
+
+func (t *tunnel) URL() string {
+	return strings.TrimSuffix(t.url, "/")
+}
+
+func (t *tunnel) Close() error {
+	if t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+	}
+	return t.out.Close()
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTunnelSpec(t *testing.T) {
+	tests := []struct {
+		value string
+		name  string
+		args  string
+		line  string
+		url   string
+	}{
+		{
+			value: "cloudflare",
+			name:  "cloudflared",
+			args:  "tunnel --no-autoupdate --url http://127.0.0.1:8080",
+			line:  "2024-01-01T00:00:00Z INF |  https://quiet-river-1234.trycloudflare.com  |",
+			url:   "https://quiet-river-1234.trycloudflare.com",
+		},
+		{
+			value: "ngrok",
+			name:  "ngrok",
+			args:  "http 127.0.0.1:8080 --log stdout --log-format json",
+			line:  `{"lvl":"info","msg":"started tunnel","name":"command_line","url":"https://abcd.ngrok-free.app"}`,
+			url:   "https://abcd.ngrok-free.app",
+		},
+		{
+			value: "ssh://ops@relay.example.com:2222",
+			name:  "ssh",
+			args:  "-N -o ExitOnForwardFailure=yes -R 0:127.0.0.1:8080 -p 2222 ops@relay.example.com",
+			line:  "Allocated port 41234 for remote forward to 127.0.0.1:8080",
+			url:   "http://relay.example.com:41234",
+		},
+	}
+
+	for _, tt := range tests {
+		spec, err := parseTunnelSpec(tt.value, "127.0.0.1:8080")
+		if err != nil {
+			t.Fatalf("parseTunnelSpec(%q) failed: %v", tt.value, err)
+		}
+		if spec.name != tt.name {
+			t.Errorf("parseTunnelSpec(%q) command = %q, want %q", tt.value, spec.name, tt.name)
+		}
+		if args := strings.Join(spec.args, " "); args != tt.args {
+			t.Errorf("parseTunnelSpec(%q) args = %q, want %q", tt.value, args, tt.args)
+		}
+		if u := spec.match("unrelated output"); u != "" {
+			t.Errorf("parseTunnelSpec(%q) matched unrelated output: %q", tt.value, u)
+		}
+		if u := spec.match(tt.line); u != tt.url {
+			t.Errorf("parseTunnelSpec(%q) URL = %q, want %q", tt.value, u, tt.url)
+		}
+	}
+}
+
+func TestParseTunnelSpecInvalid(t *testing.T) {
+	for _, value := range []string{"tor", "ssh://", "http://relay.example.com"} {
+		if _, err := parseTunnelSpec(value, "127.0.0.1:8080"); err == nil {
+			t.Errorf("parseTunnelSpec(%q): expected error", value)
+		}
+	}
+}
+
+func TestStartTunnelMissingClient(t *testing.T) {
+	spec := &tunnelSpec{name: "userve-no-such-tunnel-client"}
+	if _, err := startTunnel(spec); err == nil || !strings.Contains(err.Error(), "installed") {
+		t.Errorf("expected missing client error, got %v", err)
+	}
+}
+
+func TestStartTunnelReadsURL(t *testing.T) {
+	spec := &tunnelSpec{
+		name: "sh",
+		args: []string{"-c", "echo starting >&2; echo 'url https://example.test'; sleep 10"},
+		match: func(line string) string {
+			if rest, ok := strings.CutPrefix(line, "url "); ok {
+				return rest
+			}
+			return ""
+		},
+	}
+	tun, err := startTunnel(spec)
+	if err != nil {
+		t.Fatalf("startTunnel failed: %v", err)
+	}
+	defer tun.Close()
+	if tun.URL() != "https://example.test" {
+		t.Errorf("expected tunnel URL https://example.test, got %q", tun.URL())
+	}
+}
+
+func TestStartTunnelClientExits(t *testing.T) {
+	spec := &tunnelSpec{
+		name:  "sh",
+		args:  []string{"-c", "echo 'authentication failed'; exit 1"},
+		match: func(string) string { return "" },
+	}
+	if _, err := startTunnel(spec); err == nil {
+		t.Error("expected error when the tunnel client exits without a URL")
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// tusPrefix is where resumable uploads are created and continued, using
+// the tus protocol (https://tus.io/protocols/resumable-upload)
+const tusPrefix = "/uploads/"
+
+const tusVersion = "1.0.0"
+
+// tusUpload is a resumable upload in progress. Its data is written to a
+// .part file, which gets the final name once the last byte arrives.
+type tusUpload struct {
+	name   string // Sanitized name the file is saved under
+	part   string
+	length int64
+	offset atomic.Int64
+
+	mu    sync.Mutex // Held while a PATCH writes
+	hash  hash.Hash  // SHA-256 of the data up to offset; guarded by mu
+	abort func()     // Ends the PATCH that's writing; guarded by the handler's mu
+}
+
+// serveTus handles the tus endpoints: POST to tusPrefix creates an upload,
+// and HEAD, PATCH and DELETE on its URL query, continue and cancel it
+func (rh *receiveHandler) serveTus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Tus-Version", tusVersion)
+		w.Header().Set("Tus-Extension", "creation,termination")
+		if rh.policy.maxSize > 0 {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(rh.policy.maxSize, 10))
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Header.Get("Tus-Resumable") != tusVersion {
+		w.Header().Set("Tus-Version", tusVersion)
+		http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+		return
+	}
+
+	id := strings.TrimPrefix(r.URL.Path, tusPrefix)
+	if id == "" {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", "POST, OPTIONS")
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		rh.createTus(w, r)
+		return
+	}
+	rh.mu.Lock()
+	upload := rh.uploads[id]
+	rh.mu.Unlock()
+	if upload == nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset.Load(), 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.length, 10))
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+	case http.MethodPatch:
+		rh.patchTus(w, r, id, upload)
+	case http.MethodDelete:
+		rh.takeOver(upload)
+		defer upload.mu.Unlock()
+		if rh.forget(id) {
+			os.Remove(upload.part)
+			rh.release()
+			logEvent("upload_cancelled", logFields{"client": r.RemoteAddr, "file": upload.name}, "Upload of %s cancelled from %s", upload.name, r.RemoteAddr)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "HEAD, PATCH, DELETE, OPTIONS")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// createTus starts an upload of the length and file name given in the
+// request headers. It takes a place towards the upload limit until it is
+// completed or cancelled.
+func (rh *receiveHandler) createTus(w http.ResponseWriter, r *http.Request) {
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length < 0 {
+		http.Error(w, "Upload-Length required", http.StatusBadRequest)
+		return
+	}
+	name := tusMetadata(r.Header.Get("Upload-Metadata"), "filename")
+	if name == "" {
+		name = tusMetadata(r.Header.Get("Upload-Metadata"), "name")
+	}
+	name, ok := sanitizeUploadName(name)
+	if !ok {
+		http.Error(w, "invalid file name", http.StatusBadRequest)
+		return
+	}
+	if err := rh.policy.check(rh.dir, name, length); err != nil {
+		logEvent("upload_refused", logFields{"client": r.RemoteAddr, "file": name, "error": err}, "Upload of %s refused from %s: %v", name, r.RemoteAddr, err)
+		status, message := uploadStatus(err)
+		http.Error(w, message, status)
+		return
+	}
+	if !rh.reserve() {
+		http.Error(w, "upload limit reached", http.StatusGone)
+		return
+	}
+
+	file, err := createPart(rh.dir, name)
+	if err == nil {
+		err = file.Close()
+	}
+	if err != nil {
+		rh.release()
+		logEvent("upload_failed", logFields{"client": r.RemoteAddr, "file": name, "error": err}, "Upload of %s failed from %s: %v", name, r.RemoteAddr, err)
+		http.Error(w, "cannot save upload", http.StatusInternalServerError)
+		return
+	}
+	random := make([]byte, 16)
+	rand.Read(random)
+	id := hex.EncodeToString(random)
+	upload := &tusUpload{name: name, part: file.Name(), length: length, hash: sha256.New()}
+
+	rh.mu.Lock()
+	if rh.uploads == nil {
+		rh.uploads = make(map[string]*tusUpload)
+	}
+	rh.uploads[id] = upload
+	rh.mu.Unlock()
+	logEvent("upload_started", logFields{"client": r.RemoteAddr, "file": name, "length": length}, "Upload of %s (%s) started from %s", name, formatSize(length), r.RemoteAddr)
+
+	if length == 0 {
+		upload.mu.Lock()
+		defer upload.mu.Unlock()
+		if err := rh.finishTus(w, id, upload, r.RemoteAddr); err != nil {
+			status, message := uploadStatus(err)
+			http.Error(w, message, status)
+			return
+		}
+	}
+	w.Header().Set("Location", rh.base+tusPrefix+id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// patchTus appends the request body to an upload at the offset the client
+// asks for, which must be where the upload stands. Whatever arrives is
+// kept if the connection drops, so the client can resume from there.
+func (rh *receiveHandler) patchTus(w http.ResponseWriter, r *http.Request, id string, upload *tusUpload) {
+	rh.activeDownloads.Add(1)
+	defer rh.activeDownloads.Done()
+
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "expected application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset required", http.StatusBadRequest)
+		return
+	}
+
+	rh.takeOver(upload)
+	defer upload.mu.Unlock()
+	if offset != upload.offset.Load() {
+		http.Error(w, "offset mismatch", http.StatusConflict)
+		return
+	}
+	rc := http.NewResponseController(w)
+	rh.mu.Lock()
+	upload.abort = func() { rc.SetReadDeadline(time.Now()) }
+	rh.mu.Unlock()
+	defer func() {
+		rh.mu.Lock()
+		upload.abort = nil
+		rh.mu.Unlock()
+	}()
+
+	file, err := os.OpenFile(upload.part, os.O_WRONLY, 0)
+	if err != nil {
+		http.Error(w, "upload expired", http.StatusNotFound)
+		return
+	}
+	if _, err = file.Seek(offset, io.SeekStart); err == nil {
+		_, err = io.Copy(&tusWriter{file: file, upload: upload}, io.LimitReader(r.Body, upload.length-offset))
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.offset.Load(), 10))
+	if err != nil {
+		logEvent("upload_paused", logFields{"client": r.RemoteAddr, "file": upload.name, "bytes": upload.offset.Load(), "error": err}, "Upload of %s paused from %s at %s: %v", upload.name, r.RemoteAddr, formatSize(upload.offset.Load()), err)
+		http.Error(w, "upload interrupted", http.StatusInternalServerError)
+		return
+	}
+
+	if upload.offset.Load() == upload.length {
+		if err := rh.finishTus(w, id, upload, r.RemoteAddr); err != nil {
+			status, message := uploadStatus(err)
+			http.Error(w, message, status)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// takeOver locks upload for writing, first ending a PATCH still holding
+// it, e.g. one whose client lost the connection and came back
+func (rh *receiveHandler) takeOver(upload *tusUpload) {
+	rh.mu.Lock()
+	abort := upload.abort
+	rh.mu.Unlock()
+	if abort != nil {
+		abort()
+	}
+	upload.mu.Lock()
+}
+
+// finishTus gives a complete upload its final name and counts it, putting
+// its receipt in the headers of w
+func (rh *receiveHandler) finishTus(w http.ResponseWriter, id string, upload *tusUpload, remoteAddr string) error {
+	rh.forget(id)
+	saved, err := rh.policy.place(rh.dir, upload.part, upload.name)
+	if err != nil {
+		os.Remove(upload.part)
+		rh.release()
+		logEvent("upload_failed", logFields{"client": remoteAddr, "file": upload.name, "error": err}, "Upload of %s failed from %s: %v", upload.name, remoteAddr, err)
+		return err
+	}
+	receipt := rh.complete(uploadReceipt{name: saved, size: upload.length, sha256: hex.EncodeToString(upload.hash.Sum(nil))}, remoteAddr)
+	w.Header().Set("X-Upload-Size", strconv.FormatInt(receipt.size, 10))
+	w.Header().Set("X-Upload-Sha256", receipt.sha256)
+	w.Header().Set("X-Upload-Received", receipt.received.Format(time.RFC3339))
+	return nil
+}
+
+// forget drops an upload from the handler, reporting whether it was there
+func (rh *receiveHandler) forget(id string) bool {
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+
+	_, ok := rh.uploads[id]
+	delete(rh.uploads, id)
+	return ok
+}
+
+// tusWriter advances an upload's offset as its data is written, so a HEAD
+// request sees how far an interrupted PATCH got
+type tusWriter struct {
+	file   *os.File
+	upload *tusUpload
+}
+
+func (t *tusWriter) Write(b []byte) (int, error) {
+	n, err := t.file.Write(b)
+	t.upload.hash.Write(b[:n])
+	t.upload.offset.Add(int64(n))
+	return n, err
+}
+
+// tusMetadata returns the value of key in an Upload-Metadata header, a
+// comma-separated list of keys and base64 values
+func tusMetadata(header, key string) string {
+	for pair := range strings.SplitSeq(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k != key {
+			continue
+		}
+		value, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			return ""
+		}
+		return string(value)
+	}
+	return ""
+}
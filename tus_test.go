@@ -0,0 +1,208 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTusUpload(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	done := make(chan struct{}, 1)
+	rh := &receiveHandler{dir: dir, maxUploads: 1, activeDownloads: &wg, downloadComplete: done}
+	do := func(method, target string, body io.Reader, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, body)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		rh.ServeHTTP(rec, req)
+		return rec
+	}
+	content := "0123456789abcdefghij"
+
+	rec := do("POST", tusPrefix, nil, "Upload-Length", "20", "Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte("../video.mp4")))
+	if rec.Code != 201 {
+		t.Fatalf("expected 201 on creation, got %d: %s", rec.Code, rec.Body.String())
+	}
+	location := rec.Header().Get("Location")
+	if !strings.HasPrefix(location, tusPrefix) {
+		t.Fatalf("unexpected Location %q", location)
+	}
+	part := filepath.Join(dir, "video.mp4.part")
+	if _, err := os.Stat(part); err != nil {
+		t.Fatalf("expected a .part file: %v", err)
+	}
+
+	// The first half arrives, then the connection drops
+	rec = do("PATCH", location, strings.NewReader(content[:8]), "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream")
+	if rec.Code != 204 || rec.Header().Get("Upload-Offset") != "8" {
+		t.Fatalf("expected 204 at offset 8, got %d at %q", rec.Code, rec.Header().Get("Upload-Offset"))
+	}
+	if rec := do("HEAD", location, nil); rec.Header().Get("Upload-Offset") != "8" || rec.Header().Get("Upload-Length") != "20" {
+		t.Errorf("expected HEAD to report 8 of 20, got %q of %q", rec.Header().Get("Upload-Offset"), rec.Header().Get("Upload-Length"))
+	}
+	if rec := do("PATCH", location, strings.NewReader(content), "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream"); rec.Code != 409 {
+		t.Errorf("expected 409 for a wrong offset, got %d", rec.Code)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "video.mp4")); !os.IsNotExist(err) {
+		t.Errorf("expected no final file before the upload completes, got %v", err)
+	}
+
+	rec = do("PATCH", location, strings.NewReader(content[8:]), "Upload-Offset", "8", "Content-Type", "application/offset+octet-stream")
+	if rec.Code != 204 {
+		t.Fatalf("expected 204 on completion, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if sum := sha256.Sum256([]byte(content)); rec.Header().Get("X-Upload-Sha256") != hex.EncodeToString(sum[:]) {
+		t.Errorf("expected the receipt to carry the SHA-256 of the whole upload, got %q", rec.Header().Get("X-Upload-Sha256"))
+	}
+	if got := rec.Header().Get("X-Upload-Size"); got != strconv.Itoa(len(content)) {
+		t.Errorf("expected the receipt to carry the size %d, got %q", len(content), got)
+	}
+	if _, err := time.Parse(time.RFC3339, rec.Header().Get("X-Upload-Received")); err != nil {
+		t.Errorf("expected the receipt to carry the time received: %v", err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "video.mp4")); string(got) != content {
+		t.Errorf("expected %q, got %q", content, got)
+	}
+	if _, err := os.Stat(part); !os.IsNotExist(err) {
+		t.Errorf("expected the .part file to be gone, got %v", err)
+	}
+	select {
+	case <-done:
+	default:
+		t.Error("expected the completed upload to count")
+	}
+	if rec := do("HEAD", location, nil); rec.Code != 404 {
+		t.Errorf("expected a completed upload to be gone, got %d", rec.Code)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		method  string
+		headers []string
+		code    int
+	}{
+		{"old version", "POST", []string{"Tus-Resumable", "0.2.2", "Upload-Length", "1"}, 412},
+		{"no length", "POST", []string{"Upload-Metadata", "filename YQ=="}, 400},
+		{"limit reached", "POST", []string{"Upload-Length", "1", "Upload-Metadata", "filename YQ=="}, 410},
+		{"wrong method", "PATCH", nil, 405},
+	} {
+		if rec := do(tt.method, tusPrefix, nil, tt.headers...); rec.Code != tt.code {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.code, rec.Code)
+		}
+	}
+}
+
+func TestTusUploadCancel(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	rh := &receiveHandler{dir: dir, maxUploads: 1, activeDownloads: &wg, downloadComplete: make(chan struct{}, 1)}
+	do := func(method, target string, headers ...string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		rec := httptest.NewRecorder()
+		rh.ServeHTTP(rec, req)
+		return rec
+	}
+	create := func() string {
+		rec := do("POST", tusPrefix, "Upload-Length", "10", "Upload-Metadata", "filename YS50eHQ=")
+		if rec.Code != 201 {
+			t.Fatalf("expected 201, got %d", rec.Code)
+		}
+		return rec.Header().Get("Location")
+	}
+
+	location := create()
+	if rec := do("DELETE", location); rec.Code != 204 {
+		t.Fatalf("expected 204 on DELETE, got %d", rec.Code)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the .part file to be removed, found %d entries", len(entries))
+	}
+	// The cancelled upload gave back its place
+	create()
+}
+
+func TestTusMetadata(t *testing.T) {
+	header := "relativePath bnVsbA==, filename cmVwb3J0LnBkZg==,is_confidential"
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"filename", "report.pdf"},
+		{"relativePath", "null"},
+		{"is_confidential", ""},
+		{"missing", ""},
+	}
+
+	for _, tt := range tests {
+		if got := tusMetadata(header, tt.key); got != tt.want {
+			t.Errorf("tusMetadata(%q) = %q, want %q", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestTusUploadTakeOver(t *testing.T) {
+	dir := t.TempDir()
+	var wg sync.WaitGroup
+	rh := &receiveHandler{dir: dir, activeDownloads: &wg, downloadComplete: make(chan struct{}, 1)}
+	server := httptest.NewServer(rh)
+	defer server.Close()
+	do := func(method, target string, body io.Reader, headers ...string) (*http.Response, error) {
+		req, _ := http.NewRequest(method, server.URL+target, body)
+		req.Header.Set("Tus-Resumable", tusVersion)
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		return http.DefaultClient.Do(req)
+	}
+
+	resp, err := do("POST", tusPrefix, nil, "Upload-Length", "10", "Upload-Metadata", "filename YS50eHQ=")
+	if err != nil || resp.StatusCode != 201 {
+		t.Fatalf("creation failed: %v", err)
+	}
+	location := resp.Header.Get("Location")
+
+	// A PATCH whose client goes quiet halfway keeps the upload locked
+	pr, pw := io.Pipe()
+	stalled := make(chan struct{})
+	go func() {
+		defer close(stalled)
+		if resp, err := do("PATCH", location, pr, "Upload-Offset", "0", "Content-Type", "application/offset+octet-stream"); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	pw.Write([]byte("01234"))
+	for range 100 {
+		if resp, err := do("HEAD", location, nil); err == nil && resp.Header.Get("Upload-Offset") == "5" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	resp, err = do("PATCH", location, strings.NewReader("56789"), "Upload-Offset", "5", "Content-Type", "application/offset+octet-stream")
+	if err != nil || resp.StatusCode != 204 {
+		t.Fatalf("expected the resumed PATCH to take over, got %v %v", resp, err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(got) != "0123456789" {
+		t.Errorf("expected the joined upload, got %q", got)
+	}
+	pw.Close()
+	<-stalled
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Name collision modes for --overwrite
+const (
+	overwriteRename  = "rename"
+	overwriteReject  = "reject"
+	overwriteReplace = "replace"
+)
+
+var (
+	errUploadTooLarge = errors.New("file too large")
+	errUploadType     = errors.New("file type not accepted")
+	errUploadExists   = errors.New("file already exists")
+)
+
+// uploadPolicy limits what receive mode accepts and decides what happens
+// when a received file's name is taken
+type uploadPolicy struct {
+	maxSize    int64    // Largest accepted file in bytes, 0 for any
+	overwrite  string   // overwriteRename (default), overwriteReject or overwriteReplace
+	extensions []string // Accepted extensions such as ".pdf"; any if empty
+}
+
+func (p uploadPolicy) validate() error {
+	switch p.overwrite {
+	case "", overwriteRename, overwriteReject, overwriteReplace:
+		return nil
+	}
+	return fmt.Errorf("invalid overwrite mode %q: valid modes are reject, rename, replace", p.overwrite)
+}
+
+// check tells whether to accept a file before any of it is received.
+// size is -1 if it isn't known up front.
+func (p uploadPolicy) check(dir, name string, size int64) error {
+	if !p.acceptsType(name) {
+		return errUploadType
+	}
+	if p.maxSize > 0 && size > p.maxSize {
+		return errUploadTooLarge
+	}
+	if p.overwrite == overwriteReject {
+		if _, err := os.Lstat(filepath.Join(dir, name)); err == nil {
+			return errUploadExists
+		}
+	}
+	return nil
+}
+
+// acceptsType reports whether name ends in one of the accepted extensions,
+// ignoring case
+func (p uploadPolicy) acceptsType(name string) bool {
+	if len(p.extensions) == 0 {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, ext := range p.extensions {
+		if len(lower) > len(ext) && strings.HasSuffix(lower, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// place moves a complete upload from its part file to name in dir, as
+// the overwrite mode says, and returns the name it got
+func (p uploadPolicy) place(dir, part, name string) (string, error) {
+	switch p.overwrite {
+	case overwriteReplace:
+		// Renaming over the old file never leaves it half-written
+		return name, os.Rename(part, filepath.Join(dir, name))
+	case overwriteReject:
+		err := claim(filepath.Join(dir, name), part)
+		if os.IsExist(err) {
+			return "", errUploadExists
+		}
+		return name, err
+	default:
+		return uniqueName(dir, name, func(path string) error {
+			return claim(path, part)
+		})
+	}
+}
+
+// claim moves part to path unless a file is already there. The empty
+// placeholder created first reserves the name against concurrent uploads.
+func claim(path, part string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Rename(part, path)
+}
+
+// uploadStatus returns the HTTP status and client message for an upload
+// that failed with err
+func uploadStatus(err error) (int, string) {
+	switch {
+	case errors.Is(err, errUploadTooLarge):
+		return http.StatusRequestEntityTooLarge, err.Error()
+	case errors.Is(err, errUploadType):
+		return http.StatusUnsupportedMediaType, err.Error()
+	case errors.Is(err, errUploadExists):
+		return http.StatusConflict, err.Error()
+	default:
+		return http.StatusInternalServerError, "cannot save upload"
+	}
+}
+
+// parseExtensions normalizes --accept-ext values, which may each list
+// several extensions separated by commas, to lowercase with a leading dot
+func parseExtensions(values []string) []string {
+	var exts []string
+	for _, value := range values {
+		for ext := range strings.SplitSeq(value, ",") {
+			ext = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(ext)), ".")
+			if ext != "" {
+				exts = append(exts, "."+ext)
+			}
+		}
+	}
+	return exts
+}
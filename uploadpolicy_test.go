@@ -0,0 +1,102 @@
+package main
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestParseExtensions(t *testing.T) {
+	got := parseExtensions([]string{"pdf,.JPG", " tar.gz ", ","})
+	want := []string{".pdf", ".jpg", ".tar.gz"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseExtensions = %v, want %v", got, want)
+	}
+}
+
+func TestUploadPolicyCheck(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "taken.pdf"), []byte("x"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	tests := []struct {
+		name   string
+		policy uploadPolicy
+		file   string
+		size   int64
+		want   error
+	}{
+		{"any file", uploadPolicy{}, "taken.pdf", 100, nil},
+		{"accepted extension", uploadPolicy{extensions: []string{".pdf"}}, "SCAN.PDF", -1, nil},
+		{"other extension", uploadPolicy{extensions: []string{".pdf"}}, "setup.exe", -1, errUploadType},
+		{"extension only", uploadPolicy{extensions: []string{".pdf"}}, ".pdf", -1, errUploadType},
+		{"double extension", uploadPolicy{extensions: []string{".tar.gz"}}, "backup.tar.gz", -1, nil},
+		{"within size", uploadPolicy{maxSize: 100}, "a.bin", 100, nil},
+		{"too large", uploadPolicy{maxSize: 100}, "a.bin", 101, errUploadTooLarge},
+		{"unknown size", uploadPolicy{maxSize: 100}, "a.bin", -1, nil},
+		{"reject taken", uploadPolicy{overwrite: overwriteReject}, "taken.pdf", -1, errUploadExists},
+		{"reject free", uploadPolicy{overwrite: overwriteReject}, "free.pdf", -1, nil},
+		{"replace taken", uploadPolicy{overwrite: overwriteReplace}, "taken.pdf", -1, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.check(dir, tt.file, tt.size); err != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+
+	if err := (uploadPolicy{overwrite: "merge"}).validate(); err == nil {
+		t.Error("expected error for invalid overwrite mode")
+	}
+}
+
+func TestReceiveHandlerPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		policy    uploadPolicy
+		body      string
+		code      int
+		wantFiles map[string]string
+	}{
+		{"rename", uploadPolicy{}, "new", 201, map[string]string{"notes.txt": "old", "notes (1).txt": "new"}},
+		{"reject", uploadPolicy{overwrite: overwriteReject}, "new", 409, map[string]string{"notes.txt": "old"}},
+		{"replace", uploadPolicy{overwrite: overwriteReplace}, "new", 201, map[string]string{"notes.txt": "new"}},
+		{"too large", uploadPolicy{maxSize: 2}, "new", 413, map[string]string{"notes.txt": "old"}},
+		{"type", uploadPolicy{extensions: []string{".pdf"}}, "new", 415, map[string]string{"notes.txt": "old"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("old"), 0644); err != nil {
+				t.Fatalf("failed to create test file: %v", err)
+			}
+			var wg sync.WaitGroup
+			rh := &receiveHandler{dir: dir, policy: tt.policy, activeDownloads: &wg, downloadComplete: make(chan struct{}, 1)}
+			// A chunked body hides the size, so the limit applies while receiving
+			req := httptest.NewRequest("PUT", "/notes.txt", strings.NewReader(tt.body))
+			req.ContentLength = -1
+			rec := httptest.NewRecorder()
+			rh.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Errorf("expected %d, got %d: %s", tt.code, rec.Code, rec.Body.String())
+			}
+
+			entries, _ := os.ReadDir(dir)
+			if len(entries) != len(tt.wantFiles) {
+				t.Errorf("expected %d files, found %d", len(tt.wantFiles), len(entries))
+			}
+			for name, want := range tt.wantFiles {
+				if got, _ := os.ReadFile(filepath.Join(dir, name)); string(got) != want {
+					t.Errorf("%s: expected %q, got %q", name, want, got)
+				}
+			}
+		})
+	}
+}
@@ -3,8 +3,9 @@ package main
 import (
 	"archive/tar"
 	"archive/zip"
-	"compress/gzip"
+	"compress/flate"
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -12,8 +13,13 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"syscall"
@@ -22,6 +28,22 @@ import (
 
 const defaultPort = 8080
 
+// shutdownTimeout bounds how long running downloads may finish on exit,
+// unless --drain-timeout says otherwise, and how long hooks may take
+const shutdownTimeout = 30 * time.Second
+
+// stringList is a flag that can be repeated, collecting every value
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 // ArchiveFormat represents the archive format for directories
 type ArchiveFormat int
 
@@ -29,6 +51,8 @@ const (
 	ArchiveTarGz ArchiveFormat = iota
 	ArchiveZip
 	ArchiveTar
+	ArchiveTarXz
+	Archive7z
 )
 
 func main() {
@@ -39,15 +63,168 @@ func main() {
 }
 
 func run(args []string) error {
+	// Set for the share started by --daemon, but not for its hooks
+	if path, ok := os.LookupEnv(daemonEnv); ok {
+		daemonPIDFile = path
+		os.Unsetenv(daemonEnv)
+	}
+	if len(args) > 0 {
+		switch args[0] {
+		case "selftest":
+			// Check that serving works on this machine
+			return runSelftest(os.Stdout)
+		case "version":
+			return printVersion(os.Stdout)
+		case "suspend":
+			return runSuspend(args[1:])
+		case "resume":
+			return runResume(args[1:])
+		case "stop":
+			return runStop(args[1:])
+		case "status":
+			return runStatus(args[1:])
+		case "host":
+			return runHost(args[1:])
+		case "add":
+			return runAdd(args[1:])
+		case "list":
+			return runList(args[1:])
+		case "remove":
+			return runRemove(args[1:])
+		}
+	}
+	return serve(args, nil)
+}
+
+// serveShare runs a share until its download limit is reached, it is
+// interrupted or asked to reload. The share listens on *kept, or on a new
+// listener that it leaves in *kept.
+func serveShare(args []string, resumed *shareState, kept **reloadableListener) error {
+	// "queue" serves several files one after another at the same URL
+	queueMode := len(args) > 0 && args[0] == "queue"
+	if queueMode {
+		args = args[1:]
+	}
+
 	fs := flag.NewFlagSet("userve", flag.ContinueOnError)
 	port := fs.Int("p", defaultPort, "port to listen on")
+	portFallback := fs.Bool("port-fallback", false, "if the port is in use, try the next ports and then a random free one")
 	bindIP := fs.String("i", "", "IP address to bind to (default: all interfaces)")
+	ifaceName := fs.String("iface", "", "only advertise addresses of the network `interface`")
 	count := fs.Int("c", 1, "number of downloads allowed (0 for unlimited)")
-	archiveFormat := fs.String("a", "tar.gz", "archive format for directories: tar.gz, zip, tar")
+	perFile := fs.Bool("per-file", false, "with several files, allow -c downloads of each file rather than in total")
+	archiveFormat := fs.String("a", "tar.gz", "archive format for directories: tar.gz, zip, tar, tar.xz, 7z")
+	var excludes stringList
+	fs.Var(&excludes, "exclude", "leave files and directories matching the glob `pattern` out of archives (repeatable)")
+	var includes stringList
+	fs.Var(&includes, "include", "only pack files matching the glob `pattern` into archives (repeatable)")
+	gitignore := fs.Bool("gitignore", false, "leave files ignored by git out of archives")
+	skipHidden := fs.Bool("skip-hidden", false, "leave dotfiles and dot-directories (.ssh, .env, .git) out of archives")
+	symlinks := fs.String("symlinks", symlinksPreserve, "symlinks in archives: preserve, follow or skip")
+	maxDepth := fs.Int("max-depth", 0, "only archive this many directory levels (0 for all)")
+	var maxFileSize byteSize
+	fs.Var(&maxFileSize, "max-file-size", "leave files larger than `size` (e.g. 500M) out of archives")
+	level := fs.Int("compression-level", -1, "archive compression `level` from 0 (none, fastest) to 9 (smallest); -1 for the format's default")
+	noCompress := fs.Bool("no-compress", false, "store files in zip archives without compression")
+	zipPassword := fs.String("zip-password", "", "encrypt zip archives with AES-256 using `password` (\"-\" to prompt)")
+	cacheArchives := fs.Bool("cache-archives", false, "build directory archives in a temporary file on the first download, so they have a size and can be resumed")
+	withChecksum := fs.Bool("sha256", false, "print the SHA-256 of the download and serve it at /<file>.sha256")
+	manifestMode := fs.String("manifest", "", "list the SHA-256 of every archived file in SHA256SUMS: `mode` embed (inside the archive) or serve (at /<dir>.sha256sums)")
+	signKey := fs.String("sign", "", "sign the download with the GPG key `keyid` and serve the signature at /<file>.asc")
+	minisignKey := fs.String("minisign-key", "", "sign the download with the minisign secret key at `path` and serve the signature at /<file>.minisig")
+	prebuild := fs.Bool("prebuild", false, "build directory archives before printing the URL and show their size and SHA-256 (implies -cache-archives)")
+	xattrs := fs.Bool("xattrs", false, "store extended attributes and ACLs in tar archives (Linux only)")
+	numericOwner := fs.Bool("numeric-owner", false, "store owners in tar archives as numeric IDs only, without account names")
+	anonymizeOwner := fs.Bool("anonymize-owner", false, "store all tar entries as owned by root (0/0), without account names")
+	reproducible := fs.Bool("reproducible", false, "make archives byte-identical for the same files: fixed timestamps, no owners")
+	text := fs.String("text", "", "serve `text` as "+textFileName+" instead of files (\"-\" to read standard input)")
+	follow := fs.Bool("follow", false, "stream a growing file such as a log, sending new data as it is appended (like tail -f)")
+	live := fs.Bool("live", false, "look at files again for each download, for files that are rebuilt while shared")
+	latestDir := fs.String("latest", "", "serve the most recently modified file in `directory`, at a URL that stays the same")
+	fromClipboard := fs.Bool("clipboard", false, "serve the current clipboard contents, text or an image, instead of files")
+	bundle := fs.Bool("bundle", false, "serve all given files and directories as a single archive")
+	var servedName string
+	fs.StringVar(&servedName, "n", "", "shorthand for --name")
+	fs.StringVar(&servedName, "name", "", "serve under `name`, in the URL and as the download's file name (default: the file's own name)")
+	view := fs.Bool("view", false, "let browsers open files such as PDFs, images and videos instead of downloading them")
+	var headerValues stringList
+	fs.Var(&headerValues, "header", "add `header`, given as \"Key: Value\", to every response (repeatable)")
+	cacheControl := fs.String("cache-control", "no-store", "Cache-Control `value` sent with every response, or empty to send none")
+	pathFlag := fs.String("path", "", "serve the download only at URL `path`, e.g. /nightly/build.zip (default: /<filename>)")
+	copyURL := fs.Bool("copy", false, "copy the URL to the clipboard")
+	showQR := fs.Bool("qr", false, "print the URL as a QR code in the terminal")
+	mdnsName := fs.String("mdns", "", "advertise the server as `name`.local via mDNS")
+	checkHost := fs.Bool("check-host", false, "refuse requests for host names the server isn't advertised under, against DNS rebinding")
+	extract := fs.Bool("extract", false, "expose /contents and /extract?path= for served zip and tar files")
+	helpPage := fs.Bool("help-page", false, "show a download page for browsers at the root URL")
+	browse := fs.Bool("browse", false, "list a shared directory's files so they can be downloaded one by one, besides the whole archive")
+	ftp := fs.Bool("ftp", false, "also serve the file or directory read-only over FTP, for devices that can't fetch over HTTP")
+	ftpPort := fs.Int("ftp-port", defaultFTPPort, "port for -ftp to listen on")
+	sftp := fs.Bool("sftp", false, "also serve the file or directory read-only over SFTP, with a password made for the share")
+	sftpPort := fs.Int("sftp-port", defaultSFTPPort, "port for -sftp to listen on")
+	tftp := fs.Bool("tftp", false, "also serve the file or directory read-only over TFTP, for netboot and firmware updates")
+	tftpPort := fs.Int("tftp-port", defaultTFTPPort, "UDP port for -tftp to listen on")
+	rsyncd := fs.Bool("rsyncd", false, "also serve the file or directory as a read-only rsync module, for resumable pulls of large trees")
+	rsyncPort := fs.Int("rsyncd-port", defaultRsyncPort, "port for -rsyncd to listen on")
+	seedTorrent := fs.Bool("torrent", false, "also seed the file or directory over BitTorrent, with a magnet link and .torrent file, for many recipients at once")
+	torrentPort := fs.Int("torrent-port", defaultTorrentPort, "port for -torrent to take peers on")
+	dlna := fs.Bool("dlna", false, "also announce the media file or directory as a DLNA media server, for smart TVs to play from")
+	webdav := fs.Bool("webdav", false, "serve the file or directory over read-only WebDAV at the root URL, to be mounted in Finder or Explorer")
+	receive := fs.Bool("receive", false, "accept uploads into the given directory instead of serving it; -c counts uploaded files")
+	var maxUploadSize byteSize
+	fs.Var(&maxUploadSize, "max-upload-size", "with -receive or -two-way, refuse files larger than `size` (e.g. 2G)")
+	overwrite := fs.String("overwrite", overwriteRename, "with -receive or -two-way, when a file's name is taken: reject, rename or replace")
+	var acceptExts stringList
+	fs.Var(&acceptExts, "accept-ext", "with -receive or -two-way, only accept files with this `extension`, e.g. pdf (repeatable or comma-separated)")
+	twoWay := fs.String("two-way", "", "also accept uploads into `directory` at /upload/, besides serving the given files")
+	public := fs.Bool("public", false, "forward the port on the router via NAT-PMP/UPnP and print a public URL")
+	onion := fs.Bool("onion", false, "publish the share as a Tor onion service")
+	torControl := fs.String("tor-control", defaultTorControl, "Tor control port `address` used by -onion")
+	tunnelRelay := fs.String("tunnel", "", "expose the server through a `relay`: cloudflare, ngrok or ssh://[user@]host[:port]")
+	statePath := fs.String("state", "", "keep encrypted share state in `file` so the share can be suspended and resumed")
+	configPath := fs.String("config", "", "read default flag values from the TOML `file` (default: ~/.config/userve/config.toml)")
+	profile := fs.String("profile", "", "use the settings of the `name`d profile in the config file, e.g. [profiles.lan]")
+	logFormat := fs.String("log-format", logText, "log events as text or as json, one object per line")
+	jsonEvents := fs.Bool("json", false, "print only newline-delimited JSON events, for programs running userve (same as -log-format json)")
+	logDest := fs.String("log-dest", logStdout, "send events to stdout or to syslog, e.g. the systemd journal")
+	quiet := fs.Bool("q", false, "print only the URL, and errors, e.g. for URL=$(userve -q file)")
+	verbose := fs.Bool("v", false, "also log request headers and why files were or weren't archived")
+	onStart := fs.String("on-start", "", "run the shell `command` when a download starts, with USERVE_CLIENT and USERVE_FILE set")
+	onComplete := fs.String("on-complete", "", "run the shell `command` when a download completes, with USERVE_CLIENT, USERVE_FILE, USERVE_BYTES and USERVE_DURATION set")
+	webhookURL := fs.String("webhook", "", "POST a JSON notice to `url` when a download starts or completes and when the limit is reached")
+	readTimeout := fs.Duration("read-timeout", defaultReadTimeout, "drop a request whose upload makes no progress for this `duration` (0 for no limit)")
+	writeTimeout := fs.Duration("write-timeout", defaultWriteTimeout, "drop a download the client takes nothing of for this `duration` (0 for no limit)")
+	idleTimeout := fs.Duration("idle-timeout", defaultIdleTimeout, "close keep-alive connections idle for this `duration` (0 for no limit)")
+	drainTimeout := fs.Duration("drain-timeout", shutdownTimeout, "on exit, let downloads in progress finish for up to this `duration` (0 to wait as long as they take)")
+	maxPending := fs.Int("max-pending", defaultMaxPending, "close new connections while this many haven't sent a request yet (0 for no limit)")
+	daemon := fs.Bool("daemon", false, "run in the background, logging to -log-file; stop with \"userve stop\"")
+	pidFile := fs.String("pid-file", defaultDaemonPath("daemon.pid"), "with -daemon, record the process in `file`")
+	logFile := fs.String("log-file", defaultDaemonPath("daemon.log"), "with -daemon, append the output to `file`")
+	showVersion := fs.Bool("version", false, "print the version, commit and build date and exit")
+	accessLogPath := fs.String("access-log", "", "append a line per request to `file` in the Combined Log Format")
 
 	fs.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: userve [options] <file|directory>\n\n")
-		fmt.Fprintf(os.Stderr, "Serve a file or directory over HTTP on your local network.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: userve [options] <file|directory>...\n")
+		fmt.Fprintf(os.Stderr, "       userve queue [options] <file|directory>...\n")
+		fmt.Fprintf(os.Stderr, "       userve --receive [options] <directory>\n")
+		fmt.Fprintf(os.Stderr, "       userve --text <text|-> [options]\n")
+		fmt.Fprintf(os.Stderr, "       userve --clipboard [options]\n")
+		fmt.Fprintf(os.Stderr, "       userve --latest <directory> [options]\n")
+		fmt.Fprintf(os.Stderr, "       userve suspend <state-file>\n")
+		fmt.Fprintf(os.Stderr, "       userve resume <state-file>\n")
+		fmt.Fprintf(os.Stderr, "       userve stop [--pid-file <file>]\n")
+		fmt.Fprintf(os.Stderr, "       userve status [--pid-file <file>]\n")
+		fmt.Fprintf(os.Stderr, "       userve host [-p <port>] [-a <format>]\n")
+		fmt.Fprintf(os.Stderr, "       userve add [-c <n>] [--expire <duration>] <file|directory>\n")
+		fmt.Fprintf(os.Stderr, "       userve list\n")
+		fmt.Fprintf(os.Stderr, "       userve remove <token>\n")
+		fmt.Fprintf(os.Stderr, "       userve selftest\n")
+		fmt.Fprintf(os.Stderr, "       userve version\n\n")
+		fmt.Fprintf(os.Stderr, "Serve a file or directory over HTTP on your local network.\n")
+		fmt.Fprintf(os.Stderr, "In queue mode, each item is served until its download count is used up,\n")
+		fmt.Fprintf(os.Stderr, "then the next one becomes available at the same URL.\n")
+		fmt.Fprintf(os.Stderr, "Several files are served side by side, each at its own URL, with an index\n")
+		fmt.Fprintf(os.Stderr, "page listing them at the root.\n\n")
 		fmt.Fprintf(os.Stderr, "Options:\n")
 		fs.PrintDefaults()
 	}
@@ -55,54 +232,655 @@ func run(args []string) error {
 	if err := fs.Parse(args); err != nil {
 		return err
 	}
+	if *showVersion {
+		return printVersion(os.Stdout)
+	}
+	// Flags given on the command line win over USERVE_* variables, and both
+	// over the config file. The self-test's share uses neither.
+	if !isolated {
+		if err := applyEnv(fs, os.Environ()); err != nil {
+			return err
+		}
+	}
+	configFile, explicit := *configPath, true
+	if configFile == "" && !isolated {
+		configFile, explicit = defaultConfigPath(), false
+	}
+	if configFile == "" && *profile != "" {
+		return fmt.Errorf("--profile needs a config file")
+	}
+	if configFile != "" {
+		if err := applyConfig(fs, configFile, explicit, *profile); err != nil {
+			return err
+		}
+	}
+	if *logFormat != logText && *logFormat != logJSON {
+		return fmt.Errorf("invalid log format %q: valid formats are text, json", *logFormat)
+	}
+	if *jsonEvents {
+		if *logFormat != logJSON && flagSet(fs, "log-format") {
+			return fmt.Errorf("--json can't be used with --log-format %s", *logFormat)
+		}
+		*logFormat = logJSON
+	}
+	for _, t := range []struct {
+		name  string
+		value time.Duration
+	}{{"read-timeout", *readTimeout}, {"write-timeout", *writeTimeout}, {"idle-timeout", *idleTimeout}, {"drain-timeout", *drainTimeout}} {
+		if t.value < 0 {
+			return fmt.Errorf("invalid --%s %s: use 0 for no limit", t.name, t.value)
+		}
+	}
+	if *maxPending < 0 {
+		return fmt.Errorf("invalid --max-pending %d: use 0 for no limit", *maxPending)
+	}
+	if *daemon {
+		switch {
+		case *statePath != "":
+			return fmt.Errorf("--daemon can't be used with --state")
+		case *text == "-" || *zipPassword == "-":
+			// The background share has no terminal to read from
+			return fmt.Errorf("--daemon can't be used with --text - or --zip-password -")
+		case *pidFile == "" || *logFile == "":
+			return fmt.Errorf("--daemon needs --pid-file and --log-file")
+		}
+		if daemonPIDFile == "" {
+			if queueMode {
+				args = append([]string{"queue"}, args...)
+			}
+			// Only the share's own output is printed for programs
+			return startDaemon(args, *pidFile, *logFile, !*quiet && *logFormat == logText)
+		}
+	} else {
+		for _, name := range []string{"pid-file", "log-file"} {
+			if flagSet(fs, name) {
+				return fmt.Errorf("--%s needs --daemon", name)
+			}
+		}
+	}
+	switch {
+	case *quiet && *logFormat == logJSON:
+		return fmt.Errorf("-q can't be used with JSON logs")
+	case *quiet && *verbose:
+		return fmt.Errorf("-q can't be used with -v")
+	}
+	events.configure(*logFormat, *quiet, *verbose)
+	switch *logDest {
+	case logStdout:
+	case logSyslog:
+		system, err := openSyslog()
+		if err != nil {
+			return err
+		}
+		defer events.useSystemLog(system)()
+	default:
+		return fmt.Errorf("invalid log destination %q: valid destinations are stdout, syslog", *logDest)
+	}
 
-	if fs.NArg() < 1 {
+	// --text, --clipboard and --latest serve something other than the
+	// given files
+	var sources []string
+	for _, s := range []struct {
+		set  bool
+		name string
+	}{{*text != "", "text"}, {*fromClipboard, "clipboard"}, {*latestDir != "", "latest"}} {
+		if s.set {
+			sources = append(sources, s.name)
+		}
+	}
+	if len(sources) > 1 {
+		return fmt.Errorf("--%s can't be used with --%s", sources[0], sources[1])
+	}
+	var source string
+	if len(sources) > 0 {
+		source = sources[0]
+	}
+	if source != "" {
+		switch {
+		case fs.NArg() > 0 || queueMode:
+			return fmt.Errorf("--%s can't be used with files to serve", source)
+		case *bundle || *receive || *statePath != "":
+			return fmt.Errorf("--%s can't be used with --bundle, --receive or --state", source)
+		case source == "latest" && (*browse || *helpPage || *extract):
+			// These describe one file or directory, picked at startup
+			return fmt.Errorf("--latest can't be used with --browse, --help-page or --extract")
+		}
+	} else if fs.NArg() < 1 {
 		fs.Usage()
 		return fmt.Errorf("file path required")
 	}
 
-	filePath := fs.Arg(0)
+	// Several files without "queue" are served side by side with an index
+	// unless they are bundled into one archive
+	paths, err := expandGlobs(fs.Args())
+	if err != nil {
+		return err
+	}
+	if *bundle && queueMode {
+		return fmt.Errorf("--bundle cannot be used with queue")
+	}
+	setMode := !queueMode && !*bundle && len(paths) > 1
+	headers, err := parseHeaders(headerValues)
+	if err != nil {
+		return err
+	}
+	if headers.Get("Cache-Control") == "" {
+		if *cacheControl != "" {
+			headers.Set("Cache-Control", *cacheControl)
+		}
+	} else if flagSet(fs, "cache-control") {
+		return fmt.Errorf("--cache-control can't be used with --header \"Cache-Control: ...\"")
+	}
+	if *webhookURL != "" {
+		wh, err := newWebhook(*webhookURL)
+		if err != nil {
+			return err
+		}
+		defer wh.Close()
+		defer events.listen(wh.notify)()
+	}
+	stats := newShareStats()
+	defer events.listen(stats.notify)()
+	for _, hook := range []*commandHook{
+		{flag: "--on-start", kind: "download_started", command: *onStart},
+		{flag: "--on-complete", kind: "download_completed", command: *onComplete},
+	} {
+		if hook.command != "" {
+			defer hook.wait()
+			defer events.listen(hook.notify)()
+		}
+	}
+	var access *accessLog
+	if *accessLogPath != "" {
+		if access, err = openAccessLog(*accessLogPath); err != nil {
+			return err
+		}
+		defer access.Close()
+	}
+	var fixedPath string
+	if *pathFlag != "" {
+		if fixedPath, err = downloadPath(*pathFlag); err != nil {
+			return err
+		}
+		switch {
+		case setMode:
+			return fmt.Errorf("--path can't be used with several files; they are listed on an index page")
+		case *helpPage || *browse || *receive:
+			return fmt.Errorf("--path can't be used with --help-page, --browse or --receive")
+		}
+	}
+	if servedName != "" {
+		switch {
+		case strings.ContainsAny(servedName, `/\`) || servedName == "." || servedName == "..":
+			return fmt.Errorf("--name must be a file name, not a path")
+		case queueMode || setMode || *receive || *browse || source == "latest":
+			return fmt.Errorf("--name needs a single file or directory, or --bundle")
+		}
+	}
+	if setMode {
+		switch {
+		case *statePath != "":
+			return fmt.Errorf("--state needs a single file or a queue")
+		case *extract:
+			return fmt.Errorf("--extract needs a single file")
+		case *helpPage:
+			return fmt.Errorf("--help-page needs a single file; several files get an index page")
+		}
+	}
+	for _, receiveOnly := range []struct {
+		set  bool
+		name string
+	}{{maxUploadSize != 0, "max-upload-size"}, {*overwrite != overwriteRename, "overwrite"}, {len(acceptExts) > 0, "accept-ext"}} {
+		if receiveOnly.set && !*receive && *twoWay == "" {
+			return fmt.Errorf("--%s needs --receive or --two-way", receiveOnly.name)
+		}
+	}
+	policy := uploadPolicy{maxSize: int64(maxUploadSize), overwrite: *overwrite, extensions: parseExtensions(acceptExts)}
+	if err := policy.validate(); err != nil {
+		return err
+	}
+	if *receive {
+		switch {
+		case queueMode || *bundle || setMode:
+			return fmt.Errorf("--receive needs a single directory")
+		case *browse || *helpPage || *extract || *statePath != "":
+			return fmt.Errorf("--receive can't be used with --browse, --help-page, --extract or --state")
+		}
+		info, err := os.Stat(paths[0])
+		if err != nil {
+			return fmt.Errorf("cannot access directory: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("--receive needs a single directory")
+		}
+	}
+	if *twoWay != "" {
+		switch {
+		case *receive:
+			return fmt.Errorf("--two-way can't be used with --receive")
+		case *statePath != "":
+			return fmt.Errorf("--two-way can't be used with --state")
+		}
+		info, err := os.Stat(*twoWay)
+		if err != nil {
+			return fmt.Errorf("cannot access directory: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("--two-way needs a directory")
+		}
+	}
 
-	// Parse archive format
-	var format ArchiveFormat
-	switch *archiveFormat {
-	case "tar.gz":
-		format = ArchiveTarGz
-	case "zip":
-		format = ArchiveZip
-	case "tar":
-		format = ArchiveTar
+	if *live && (source != "" || *receive || *follow) {
+		return fmt.Errorf("--live needs files to serve")
+	}
+	if *manifestMode != "" {
+		switch {
+		case *manifestMode != manifestEmbed && *manifestMode != manifestServe:
+			return fmt.Errorf("invalid manifest mode %q: valid modes are embed, serve", *manifestMode)
+		case queueMode || setMode || *receive || *browse || source != "":
+			return fmt.Errorf("--manifest needs a single directory or --bundle")
+		}
+	}
+	for _, upFront := range []struct {
+		set  bool
+		name string
+	}{{*withChecksum, "sha256"}, {*signKey != "", "sign"}, {*minisignKey != "", "minisign-key"}} {
+		if upFront.set && (queueMode || setMode || *receive || *browse || *live || *follow || source == "latest") {
+			return fmt.Errorf("--%s needs a single file or directory, --bundle or --text", upFront.name)
+		}
+	}
+	if *follow {
+		switch {
+		case queueMode || setMode || *bundle || *receive || source != "":
+			return fmt.Errorf("--follow needs a single file")
+		case flagSet(fs, "c"):
+			return fmt.Errorf("--follow streams never complete, so -c doesn't apply")
+		}
+		*count = 0
+	}
+
+	format, err := parseArchiveFormat(*archiveFormat)
+	if err != nil {
+		return err
+	}
+
+	filter := &archiveFilter{
+		exclude:     excludes,
+		include:     includes,
+		gitignore:   *gitignore,
+		skipHidden:  *skipHidden,
+		symlinks:    *symlinks,
+		maxDepth:    *maxDepth,
+		maxFileSize: int64(maxFileSize),
+	}
+	if err := filter.validate(); err != nil {
+		return err
+	}
+	if *level < -1 || *level > 9 {
+		return fmt.Errorf("invalid compression level %d: valid levels are 0-9", *level)
+	}
+	opts := archiveOptions{format: format, filter: filter, zipPassword: *zipPassword, level: *level, store: *noCompress, cache: *cacheArchives || *prebuild, reproducible: *reproducible, xattrs: *xattrs}
+	switch {
+	case *anonymizeOwner:
+		opts.owner = ownerAnonymous
+	case *numericOwner:
+		opts.owner = ownerNumeric
+	}
+	if *noCompress && format != ArchiveZip {
+		return fmt.Errorf("--no-compress needs -a zip")
+	}
+	if *zipPassword != "" && format != ArchiveZip {
+		return fmt.Errorf("--zip-password needs -a zip")
+	}
+	if *xattrs && !xattrsSupported {
+		return fmt.Errorf("--xattrs is only supported on Linux")
+	}
+	if format == ArchiveZip || format == Archive7z {
+		for _, tarOnly := range []struct {
+			set  bool
+			name string
+		}{{*xattrs, "xattrs"}, {*numericOwner, "numeric-owner"}, {*anonymizeOwner, "anonymize-owner"}} {
+			if tarOnly.set {
+				return fmt.Errorf("--%s needs a tar format", tarOnly.name)
+			}
+		}
+	}
+	if *zipPassword != "" && *reproducible {
+		return fmt.Errorf("--reproducible can't be used with --zip-password, which encrypts with a random salt")
+	}
+	if *zipPassword == "-" {
+		if opts.zipPassword, err = readPassword("Zip password: "); err != nil {
+			return err
+		}
+	}
+
+	// Create a content provider for each served path; a receiving
+	// directory is not served
+	var providers []contentProvider
+	var latest *latestProvider
+	switch {
+	case *receive:
+	case *text != "":
+		provider, err := newTextProvider(*text, os.Stdin)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
+	case *fromClipboard:
+		provider, err := readClipboard(pasteCommands(runtime.GOOS, os.Getenv))
+		if err != nil {
+			return fmt.Errorf("cannot read clipboard: %v", err)
+		}
+		providers = append(providers, provider)
+	case *latestDir != "":
+		info, err := os.Stat(*latestDir)
+		if err != nil {
+			return fmt.Errorf("cannot access directory: %v", err)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("--latest needs a directory")
+		}
+		// Only the name patterns apply, since the directory is looked at
+		// again and again and size skips would be logged each time
+		names := &archiveFilter{exclude: filter.exclude, include: filter.include}
+		latest = &latestProvider{dirPath: *latestDir, filter: names}
+		providers = append(providers, latest)
+	case *follow:
+		info, err := os.Stat(paths[0])
+		if err != nil {
+			return fmt.Errorf("cannot access file: %v", err)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("--follow needs a single file")
+		}
+		providers = append(providers, &followProvider{filePath: paths[0], fileName: filepath.Base(paths[0])})
+	case *bundle:
+		provider, err := newBundleProvider(paths, servedName, opts)
+		if err != nil {
+			return err
+		}
+		providers = append(providers, provider)
 	default:
-		return fmt.Errorf("invalid archive format %q: valid formats are tar.gz, zip, tar", *archiveFormat)
+		for _, path := range paths {
+			provider, err := newProvider(path, opts)
+			if err != nil {
+				return err
+			}
+			if file, ok := provider.(*fileProvider); ok {
+				file.live = *live
+			}
+			providers = append(providers, provider)
+		}
 	}
 
-	// Validate file exists
-	info, err := os.Stat(filePath)
-	if os.IsNotExist(err) {
-		return fmt.Errorf("file not found: %s", filePath)
+	if servedName != "" && !*bundle {
+		rename(providers[0], servedName, format)
 	}
-	if err != nil {
-		return fmt.Errorf("cannot access file: %v", err)
+
+	// --browse lists the files of a single directory
+	var browsed *archiveProvider
+	if *browse {
+		archive, ok := providers[0].(*archiveProvider)
+		switch {
+		case *cacheArchives || *prebuild:
+			return fmt.Errorf("--browse can't be used with --cache-archives or --prebuild")
+		case *helpPage:
+			return fmt.Errorf("--browse can't be used with --help-page")
+		case !ok || queueMode || setMode || *bundle:
+			return fmt.Errorf("--browse needs a single directory")
+		}
+		browsed = archive
+	}
+	// --webdav mounts a single file or directory
+	var davShare *webdavHandler
+	if *webdav {
+		switch {
+		case *browse || *helpPage || *extract || fixedPath != "":
+			return fmt.Errorf("--webdav can't be used with --browse, --help-page, --extract or --path")
+		case *receive || *twoWay != "":
+			return fmt.Errorf("--webdav can't be used with --receive or --two-way")
+		case *cacheArchives || *prebuild:
+			return fmt.Errorf("--webdav can't be used with --cache-archives or --prebuild")
+		case queueMode || setMode || *bundle || *follow || source != "":
+			return fmt.Errorf("--webdav needs a single file or directory")
+		}
+		davShare = &webdavHandler{shareTree: newShareTree(providers[0])}
+	}
+	// --ftp and the other secondary servers serve the same tree next to
+	// the HTTP server
+	var tree *shareTree
+	if len(providers) > 0 {
+		tree = newShareTree(providers[0])
+	}
+	secondary := []secondaryServer{
+		{name: "ftp", enabled: *ftp, port: *ftpPort, perFile: true},
+		// Behind a password and host key made for this run
+		{name: "sftp", enabled: *sftp, port: *sftpPort, perFile: true},
+		// For devices that can do nothing else
+		{name: "tftp", enabled: *tftp, port: *tftpPort, udp: true, perFile: true},
+		// For pulls that only fetch what changed
+		{name: "rsyncd", enabled: *rsyncd, port: *rsyncPort, perFile: true},
+		// Seeds a swarm that recipients also share among themselves
+		{name: "torrent", enabled: *seedTorrent, port: *torrentPort, noLive: true},
+		// Lists the share among the sources of TVs on the network, on the
+		// HTTP port
+		{name: "dlna", enabled: *dlna},
+	}
+	if err := checkSecondaryServers(fs, secondary, *port, secondaryShare{
+		receiving: *receive || *twoWay != "",
+		cached:    *cacheArchives || *prebuild,
+		live:      *live,
+		single:    tree != nil && !(queueMode || setMode || *bundle || *follow || source != ""),
+	}); err != nil {
+		return err
+	}
+	// A directory fetched a file at a time would use up the default
+	// limit with its first file, so only HTTP downloads count then
+	var uncountedFor string
+	if tree != nil && tree.archive != nil && !flagSet(fs, "c") {
+		uncountedFor = perFileServer(secondary)
+	}
+	var dlnaShare *dlnaServer
+	if *dlna {
+		dlnaShare = newDLNAServer(tree)
+		if !dlnaShare.hasMedia() {
+			return fmt.Errorf("--dlna needs a video, audio or image file, or a directory")
+		}
+	}
+
+	defer func() {
+		for _, provider := range providers {
+			if cached, ok := provider.(*cachedArchive); ok {
+				cached.remove()
+			}
+		}
+	}()
+
+	// The manifest lists the files as they are at startup
+	var manifest []byte
+	if *manifestMode != "" {
+		archive := archiveOf(providers[0])
+		switch {
+		case archive == nil:
+			return fmt.Errorf("--manifest needs a single directory or --bundle")
+		case *manifestMode == manifestEmbed && archive.format == Archive7z:
+			return fmt.Errorf("--manifest embed can't be used with 7z archives; use --manifest serve")
+		}
+		if manifest, err = archive.buildManifest(); err != nil {
+			return fmt.Errorf("cannot build manifest: %v", err)
+		}
+		if *manifestMode == manifestEmbed {
+			archive.manifest = manifest
+		}
+	}
+	if *prebuild {
+		for _, provider := range providers {
+			if cached, ok := provider.(*cachedArchive); ok {
+				if err := cached.prebuild(); err != nil {
+					return err
+				}
+			}
+		}
 	}
 
-	// Determine bind address
-	bindAddr := "0.0.0.0"
-	if *bindIP != "" {
-		bindAddr = *bindIP
+	// The checksum and signature are made before the URL is handed out
+	var checksum string
+	if *withChecksum {
+		checksum, err = payloadChecksum(providers[0])
+		if errors.Is(err, errStreamed) {
+			return fmt.Errorf("--sha256 needs --prebuild for a directory")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot compute checksum: %v", err)
+		}
+	}
+	var gpgSig []byte
+	if *signKey != "" {
+		gpgSig, err = signPayload(providers[0], func(payload io.Reader) ([]byte, error) {
+			return gpgSignature(*signKey, payload)
+		})
+		if errors.Is(err, errStreamed) {
+			return fmt.Errorf("--sign needs --prebuild for a directory")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot sign: %v", err)
+		}
+	}
+	var minisig []byte
+	if *minisignKey != "" {
+		path, cleanup, err := payloadPath(providers[0])
+		if errors.Is(err, errStreamed) {
+			return fmt.Errorf("--minisign-key needs --prebuild for a directory")
+		}
+		if err != nil {
+			return fmt.Errorf("cannot sign: %v", err)
+		}
+		minisig, err = minisignSignature("minisign", *minisignKey, path)
+		cleanup()
+		if err != nil {
+			return fmt.Errorf("cannot sign: %v", err)
+		}
+	}
+	// So are the torrent's piece hashes
+	var torrent *torrentMeta
+	if *seedTorrent {
+		if torrent, err = newTorrentMeta(tree); err != nil {
+			return fmt.Errorf("cannot make torrent: %v", err)
+		}
 	}
 
-	// Determine display IP (for URL)
-	displayIP := *bindIP
+	// Determine bind address; an empty host listens on all IPv4 and IPv6
+	// interfaces. IPv6 addresses may be given with or without brackets and
+	// with a zone, e.g. fe80::1%en0.
+	bindAddr := strings.TrimSuffix(strings.TrimPrefix(*bindIP, "["), "]")
+
+	// Determine display IP (for URL). When listening on all interfaces,
+	// the other usable addresses are listed as alternatives.
+	displayIP := bindAddr
+	var otherAddrs []candidateAddr
 	if displayIP == "" {
+		candidates, err := candidateAddrs(*ifaceName)
+		if err != nil {
+			return err
+		}
 		displayIP = getLocalIP()
+		for _, c := range candidates {
+			if c.best {
+				displayIP = c.ip.String()
+			} else {
+				otherAddrs = append(otherAddrs, c)
+			}
+		}
 	}
 
-	addr := fmt.Sprintf("%s:%d", bindAddr, *port)
+	// Create listener first to detect port-in-use errors early; a reload
+	// keeps the one it had
+	listener := *kept
+	if listener == nil {
+		l, err := listen(bindAddr, *port, *portFallback)
+		if err != nil {
+			return err
+		}
+		listener = &reloadableListener{TCPListener: l.(*net.TCPListener)}
+		*kept = listener
+		if chosen := listener.Addr().(*net.TCPAddr).Port; chosen != *port {
+			logNotice("port_changed", logFields{"port": chosen}, "Port %d is in use, using port %d instead", *port, chosen)
+		}
+	} else if err := listener.reuse(); err != nil {
+		listener.Close()
+		return fmt.Errorf("cannot reuse listener: %v", err)
+	}
+	*port = listener.Addr().(*net.TCPAddr).Port
+	var ftpL net.Listener
+	if *ftp {
+		if ftpL, err = ftpListener(bindAddr, *ftpPort); err != nil {
+			listener.Close()
+			return err
+		}
+		defer ftpL.Close()
+		*ftpPort = ftpL.Addr().(*net.TCPAddr).Port
+	}
+	var sftpL net.Listener
+	if *sftp {
+		if sftpL, err = sftpListener(bindAddr, *sftpPort); err != nil {
+			listener.Close()
+			return err
+		}
+		defer sftpL.Close()
+		*sftpPort = sftpL.Addr().(*net.TCPAddr).Port
+	}
+	var tftpConn *net.UDPConn
+	if *tftp {
+		if tftpConn, err = tftpListener(bindAddr, *tftpPort); err != nil {
+			listener.Close()
+			return err
+		}
+		defer tftpConn.Close()
+		*tftpPort = tftpConn.LocalAddr().(*net.UDPAddr).Port
+	}
+	var rsyncL net.Listener
+	if *rsyncd {
+		if rsyncL, err = rsyncListener(bindAddr, *rsyncPort); err != nil {
+			listener.Close()
+			return err
+		}
+		defer rsyncL.Close()
+		*rsyncPort = rsyncL.Addr().(*net.TCPAddr).Port
+	}
+	var torrentL net.Listener
+	if torrent != nil {
+		if torrentL, err = torrentListener(bindAddr, *torrentPort); err != nil {
+			listener.Close()
+			return err
+		}
+		defer torrentL.Close()
+		*torrentPort = torrentL.Addr().(*net.TCPAddr).Port
+	}
 
-	// Create listener first to detect port-in-use errors early
-	listener, err := net.Listen("tcp", addr)
-	if err != nil {
-		return fmt.Errorf("cannot bind to %s: %v", addr, err)
+	// Tunnel clients and Tor connect to the server over loopback unless it
+	// is bound to a specific address
+	localAddr := listener.Addr().String()
+	if *bindIP == "" {
+		localAddr = fmt.Sprintf("127.0.0.1:%d", *port)
+	}
+	var tunnel *tunnelSpec
+	if *tunnelRelay != "" {
+		if tunnel, err = parseTunnelSpec(*tunnelRelay, localAddr); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	// Advertise a .local name so the URL doesn't depend on the IP address
+	urlHost := displayIP
+	if *mdnsName != "" {
+		responder, err := startMDNS(*mdnsName, displayIP)
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		defer responder.Close()
+		urlHost = responder.Hostname()
 	}
 
 	// Track active downloads for graceful shutdown
@@ -111,89 +889,740 @@ func run(args []string) error {
 	// Channel to signal when download limit reached
 	downloadComplete := make(chan struct{}, 1)
 
-	// Create appropriate content provider
-	var provider contentProvider
-	if info.IsDir() {
-		provider = &archiveProvider{
-			dirPath: filePath,
-			dirName: filepath.Base(filePath),
-			format:  format,
-		}
-	} else {
-		provider = &fileProvider{
-			filePath: filePath,
-			fileName: filepath.Base(filePath),
-			fileSize: info.Size(),
-		}
+	// A two-way share ends once the downloads are used up and a file has
+	// come back
+	downloadsDone := downloadComplete
+	received := make(chan struct{}, 1)
+	if *twoWay != "" {
+		downloadsDone = make(chan struct{}, 1)
+		go func() {
+			<-downloadsDone
+			select {
+			case <-received:
+			default:
+				logEvent("waiting_for_upload", nil, "Download limit reached, waiting for an upload")
+				<-received
+			}
+			downloadComplete <- struct{}{}
+		}()
 	}
 
 	h := &handler{
-		provider:         provider,
+		path:             fixedPath,
+		inline:           *view,
 		activeDownloads:  &activeDownloads,
-		downloadComplete: downloadComplete,
+		downloadComplete: downloadsDone,
 		maxDownloads:     int32(*count),
+		uncountedFiles:   uncountedFor != "",
+	}
+	if len(providers) > 0 {
+		h.provider, h.queue = providers[0], providers[1:]
+	}
+	if resumed != nil {
+		h.restore(resumed.Position, resumed.Downloads)
+	}
+
+	// Persist progress so the share survives a suspend or reboot
+	var state *shareState
+	if *statePath != "" {
+		// The state file location comes from the resume command line
+		var flags []string
+		fs.Visit(func(f *flag.Flag) {
+			switch value := f.Value.(type) {
+			case *stringList:
+				for _, v := range *value {
+					flags = append(flags, "-"+f.Name+"="+v)
+				}
+			default:
+				if f.Name != "state" {
+					flags = append(flags, "-"+f.Name+"="+value.String())
+				}
+			}
+		})
+		if state, err = newShareState(queueMode, flags, paths); err != nil {
+			listener.Close()
+			return err
+		}
+		state.Position, state.Downloads = h.position, h.downloadCount.Load()
+		if err := state.save(*statePath); err != nil {
+			listener.Close()
+			return err
+		}
+		if err := writePIDFile(*statePath + ".pid"); err != nil {
+			listener.Close()
+			return err
+		}
+		defer os.Remove(*statePath + ".pid")
+
+		// Downloads finishing together save one at a time, and one that
+		// comes after a later download has been saved is left out
+		var saving sync.Mutex
+		h.onDownload = func(position int, downloads int32) {
+			saving.Lock()
+			defer saving.Unlock()
+			if position < state.Position || position == state.Position && downloads <= state.Downloads {
+				return
+			}
+			state.Position, state.Downloads = position, downloads
+			if err := state.save(*statePath); err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: cannot save share state: %v\n", err)
+			}
+		}
+	}
+
+	// The handler serves the current item at any path, so a queue is
+	// advertised at the root rather than under the first item's name.
+	// The help page and the upload form also live at the root.
+	var displayName string
+	switch {
+	case fixedPath != "":
+		displayName = strings.TrimPrefix(fixedPath, "/")
+	case !queueMode && !setMode && !*helpPage && !*browse && !*receive && !*webdav && *latestDir == "":
+		displayName = providers[0].Filename()
+	}
+
+	var index *indexHandler
+	if setMode {
+		if index, err = newIndexHandler(providers, int32(*count), *perFile, &activeDownloads, downloadsDone); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+	// A single archive is also served in the other formats, unless it is
+	// served at a fixed path only
+	var variantNames []string
+	if archive, ok := h.provider.(*archiveProvider); ok && !queueMode && !setMode && fixedPath == "" && davShare == nil {
+		variantNames = archive.variantNames()
+	}
+	variants := make(map[string]bool)
+	for _, name := range variantNames {
+		variants[name] = true
+	}
+
+	// isDownloadPath reports whether a URL path serves shared content
+	isDownloadPath := func(path string) bool {
+		if index != nil {
+			return index.served(path)
+		}
+		if davShare != nil {
+			return davShare.exists(path)
+		}
+		return path == "/"+displayName || variants[strings.TrimPrefix(path, "/")]
+	}
+	url := httpURL(urlHost, *port, displayName)
+
+	// Files that go with the download are served next to it
+	companions := make(map[string]*memoryProvider)
+	downloadPath := "/" + displayName
+	if displayName == "" && len(providers) > 0 {
+		downloadPath = "/" + providers[0].Filename()
+	}
+	if checksum != "" {
+		companions[downloadPath+".sha256"] = checksumFile(checksum, providers[0].Filename())
+	}
+	if gpgSig != nil {
+		companions[downloadPath+".asc"] = &memoryProvider{name: providers[0].Filename() + ".asc", contentType: "application/pgp-signature", data: gpgSig}
+	}
+	if minisig != nil {
+		companions[downloadPath+".minisig"] = &memoryProvider{name: providers[0].Filename() + ".minisig", contentType: "text/plain; charset=utf-8", data: minisig}
+	}
+	var manifestPath string
+	if *manifestMode == manifestServe {
+		name := archiveOf(providers[0]).dirName + ".sha256sums"
+		manifestPath = "/" + name
+		companions[manifestPath] = &memoryProvider{name: name, contentType: "text/plain; charset=utf-8", data: manifest}
+	}
+	var torrentURL, announceURL, magnet string
+	if torrent != nil {
+		name := torrent.name + ".torrent"
+		torrentURL, announceURL = httpURL(urlHost, *port, name), httpURL(urlHost, *port, "announce")
+		magnet = torrent.magnet(announceURL, net.JoinHostPort(displayIP, strconv.Itoa(*torrentPort)))
+		companions["/"+name] = &memoryProvider{name: name, contentType: "application/x-bittorrent", data: torrent.torrentFile(announceURL)}
+	}
+
+	// Open transports that make the share reachable from outside the LAN;
+	// they are torn down on shutdown
+	var transports []transport
+	defer func() { closeTransports(transports) }()
+	openTransport := func(open func() (transport, error)) error {
+		t, err := open()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		transports = append(transports, t)
+		return nil
+	}
+	if *public {
+		// Ask the router to forward the port
+		err := openTransport(func() (transport, error) {
+			mapping, err := mapPort(net.ParseIP(displayIP), *port)
+			if err != nil {
+				return nil, err
+			}
+			return &portMapTransport{mapping}, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if tunnel != nil {
+		// Outbound tunnel for sharing from behind NAT
+		err := openTransport(func() (transport, error) {
+			return startTunnel(tunnel)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if *onion {
+		err := openTransport(func() (transport, error) {
+			return startOnionService(*torControl, localAddr)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	qr, err := encodeQR([]byte(url))
+	if err != nil {
+		return err
+	}
+
+	// QR code images are served alongside the download and never count
+	// towards the limit
+	mux := http.NewServeMux()
+	var receiver *receiveHandler
+	switch {
+	case index != nil:
+		mux.Handle("/", index)
+	case *helpPage:
+		mux.Handle("/", &helpPageHandler{downloads: h})
+	case browsed != nil:
+		mux.Handle("/", &browseHandler{downloads: h, archive: browsed})
+	case davShare != nil:
+		davShare.downloads = h
+		mux.Handle("/", davShare)
+	case *receive:
+		receiver = &receiveHandler{dir: paths[0], maxUploads: int32(*count), policy: policy, activeDownloads: &activeDownloads, downloadComplete: downloadComplete}
+		mux.Handle("/", receiver)
+	default:
+		mux.Handle("/", h)
+	}
+	health := &healthHandler{started: time.Now(), remaining: h.remaining}
+	switch {
+	case index != nil:
+		health.remaining = index.remaining
+	case *receive:
+		health.remaining, health.uploads = receiver.remaining, true
+	}
+	// Auxiliary endpoints never shadow the download URL itself
+	handleAux := func(pattern string, handler http.Handler) {
+		if !isDownloadPath(pattern) {
+			mux.Handle(pattern, handler)
+		}
+	}
+	handleAux("/qr", &qrHandler{code: qr})
+	handleAux("/qr.svg", &qrHandler{code: qr, svg: true})
+	handleAux(healthPath, health)
+	if *twoWay != "" {
+		rh := &receiveHandler{
+			dir:              *twoWay,
+			base:             strings.TrimSuffix(uploadPrefix, "/"),
+			download:         "/" + displayName,
+			policy:           policy,
+			activeDownloads:  &activeDownloads,
+			downloadComplete: downloadComplete,
+			onReceive: func() {
+				select {
+				case received <- struct{}{}:
+				default:
+				}
+			},
+		}
+		handleAux(uploadPrefix, http.StripPrefix(rh.base, rh))
+	}
+	if *extract {
+		handleAux("/contents", &archiveIndexHandler{downloads: h})
+		handleAux("/extract", &archiveIndexHandler{downloads: h, extract: true})
+	}
+	if torrent != nil {
+		handleAux("/announce", newTorrentTracker(torrent, h, *torrentPort))
+	}
+	if dlnaShare != nil {
+		dlnaShare.downloads = h
+		handleAux(dlnaPrefix, dlnaShare)
 	}
-	displayName := provider.Filename()
 
+	// Requests that wait for more data, like --follow streams, end when
+	// the share shuts down
+	serveCtx, stopServing := context.WithCancel(context.Background())
+	defer stopServing()
+	h.stopping = serveCtx
+	if latest != nil {
+		go latest.watch(serveCtx)
+	}
+	// Progress lines stay up while downloads finish on exit
+	progressCtx, stopProgress := context.WithCancel(context.Background())
+	defer stopProgress()
+	if *logFormat == logText && !*quiet && *logDest == logStdout && isTerminal(os.Stdout) {
+		go events.showProgress(progressCtx)
+	}
+	var root http.Handler = mux
+	if len(companions) > 0 {
+		root = &companionFiles{next: mux, files: companions}
+	}
+	if *checkHost {
+		names := []string{urlHost, displayIP}
+		for _, c := range otherAddrs {
+			names = append(names, c.ip.String())
+		}
+		if hostname, err := os.Hostname(); err == nil {
+			names = append(names, hostname, hostname+".local")
+		}
+		root = newHostChecker(root, names, *port, transports)
+	}
+	root = withHeaders(root, headers)
+	if *verbose {
+		root = logRequests(root)
+	}
+	if access != nil {
+		root = access.wrap(root)
+	}
+	root = withTimeouts(root, *readTimeout, *writeTimeout)
 	server := &http.Server{
-		Handler: h,
+		Handler:           root,
+		ReadHeaderTimeout: headerTimeout,
+		IdleTimeout:       *idleTimeout,
+	}
+	if *maxPending > 0 {
+		server.ConnState = newPendingLimit(*maxPending).connState
 	}
 
 	// Set up signal handling for graceful shutdown
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	suspendChan := make(chan os.Signal, 1)
+	if state != nil && suspendSignal != nil {
+		signal.Notify(suspendChan, suspendSignal)
+	}
+	// SIGHUP reloads a share no terminal can hang up, such as one run with
+	// --daemon or by a service manager; otherwise the terminal was closed
+	// and the share ends as on Ctrl+C. Never delivered on Windows.
+	reloadChan := make(chan os.Signal, 1)
+	if daemonPIDFile != "" || !hasTerminal() {
+		signal.Notify(reloadChan, syscall.SIGHUP)
+	} else {
+		signal.Notify(sigChan, syscall.SIGHUP)
+	}
 
 	// Start server in goroutine
 	errChan := make(chan error, 1)
 	go func() {
 		errChan <- server.Serve(listener)
 	}()
+	var ftpSrv *ftpServer
+	var ftpURL string
+	if ftpL != nil {
+		ftpSrv = newFTPServer(ftpL, tree, h)
+		go ftpSrv.serve()
+		name := ""
+		if tree.archive == nil {
+			name = tree.name()
+		}
+		ftpURL = "ftp" + strings.TrimPrefix(httpURL(urlHost, *ftpPort, name), "http")
+	}
+	var sftpSrv *sshServer
+	var sftpURL, sftpCommand string
+	if sftpL != nil {
+		hostKey, err := newSSHHostKey()
+		if err != nil {
+			listener.Close()
+			return err
+		}
+		sftpSrv = newSSHServer(sftpL, tree, h, hostKey, sftpPassword())
+		go sftpSrv.serve()
+		sshHost := urlHost
+		if strings.Contains(sshHost, ":") {
+			sshHost = "[" + sshHost + "]"
+		}
+		sftpURL = fmt.Sprintf("sftp://userve@%s:%d/", sshHost, *sftpPort)
+		sftpCommand = fmt.Sprintf("sftp -P %d userve@%s", *sftpPort, sshHost)
+	}
+	var tftpSrv *tftpServer
+	var tftpAddr string
+	if tftpConn != nil {
+		tftpSrv = newTFTPServer(tftpConn, tree, h)
+		go tftpSrv.serve()
+		name := ""
+		if tree.archive == nil {
+			name = tree.name()
+		}
+		tftpAddr = tftpURL(urlHost, *tftpPort, name)
+	}
+	var rsyncSrv *rsyncServer
+	var rsyncAddr, rsyncCommand string
+	if rsyncL != nil {
+		rsyncSrv = newRsyncServer(rsyncL, tree, h)
+		go rsyncSrv.serve()
+		rsyncAddr = rsyncURL(urlHost, *rsyncPort, rsyncSrv.module)
+		// A directory's contents go into one of the same name, a file into
+		// the current directory
+		dest := "."
+		if tree.archive != nil {
+			dest = rsyncSrv.module + "/"
+		}
+		rsyncCommand = fmt.Sprintf("rsync -aP %s %s", rsyncAddr, dest)
+	}
+	var torrentSrv *torrentServer
+	if torrentL != nil {
+		torrentSrv = newTorrentServer(torrentL, torrent)
+		go torrentSrv.serve()
+	}
+	// TVs are told about the server once it answers
+	var ssdp *ssdpAnnouncer
+	var dlnaURL string
+	if dlnaShare != nil {
+		dlnaURL = dlnaLocation(displayIP, *port)
+		if ssdp, err = startSSDP(dlnaShare.uuid, dlnaURL, displayIP); err != nil {
+			listener.Close()
+			return err
+		}
+		defer ssdp.Close()
+	}
 
-	url := fmt.Sprintf("http://%s:%d/%s", displayIP, *port, displayName)
-	fmt.Printf("Serving %s\n", filePath)
-	fmt.Printf("URL: %s\n", url)
-	if *count == 0 {
-		fmt.Printf("Downloads: unlimited\n")
-	} else {
-		fmt.Printf("Downloads: %d remaining\n", *count)
+	switch {
+	case queueMode:
+		say("Serving queue of %d items:\n", len(paths))
+		for i, path := range paths {
+			say("  %d. %s\n", i+1, path)
+		}
+	case setMode:
+		say("Serving %d files:\n", len(paths))
+		for _, provider := range providers {
+			say("  %s\n", httpURL(urlHost, *port, provider.Filename()))
+		}
+	case *bundle:
+		say("Serving %d items as %s\n", len(paths), providers[0].Filename())
+	case *receive:
+		say("Receiving files into %s\n", paths[0])
+	case *latestDir != "":
+		say("Serving the newest file in %s\n", *latestDir)
+	case source != "":
+		say("Serving %s (%s)\n", providers[0].Filename(), formatSize(providers[0].ContentLength()))
+	default:
+		say("Serving %s\n", paths[0])
+	}
+	sayURL(url)
+	if checksum != "" {
+		say("SHA-256: %s (also at %s)\n", checksum, httpURL(urlHost, *port, strings.TrimPrefix(downloadPath, "/")+".sha256"))
+	}
+	if gpgSig != nil {
+		say("GPG signature: %s\n", httpURL(urlHost, *port, strings.TrimPrefix(downloadPath, "/")+".asc"))
+	}
+	if minisig != nil {
+		say("Minisign signature: %s\n", httpURL(urlHost, *port, strings.TrimPrefix(downloadPath, "/")+".minisig"))
+	}
+	switch *manifestMode {
+	case manifestEmbed:
+		say("Checksums of the archived files are in its %s\n", manifestName)
+	case manifestServe:
+		say("Checksums of the archived files: %s\n", httpURL(urlHost, *port, strings.TrimPrefix(manifestPath, "/")))
+	}
+	if davShare != nil {
+		say("WebDAV: connect to the URL from Finder (Go > Connect to Server) or Explorer (Map network drive)\n")
+	}
+	if ftpURL != "" {
+		say("FTP URL: %s (anonymous, read-only)\n", ftpURL)
+	}
+	if sftpSrv != nil {
+		say("SFTP: %s (password %s, read-only)\n", sftpCommand, sftpSrv.password)
+		say("SFTP host key: %s\n", sftpSrv.hostKey.fingerprint())
+	}
+	if tftpAddr != "" {
+		say("TFTP URL: %s (read-only)\n", tftpAddr)
+	}
+	if rsyncSrv != nil {
+		say("rsync: %s (read-only)\n", rsyncCommand)
+	}
+	if torrentSrv != nil {
+		say("Torrent: %s (seeding on port %d)\n", torrentURL, *torrentPort)
+		say("Magnet link: %s\n", magnet)
+	}
+	if ssdp != nil {
+		say("DLNA: listed as %q on TVs and media players on the network\n", dlnaShare.name)
+	}
+	if *twoWay != "" {
+		say("Upload URL: %s (into %s; its page also links the download)\n", httpURL(urlHost, *port, strings.TrimPrefix(uploadPrefix, "/")), *twoWay)
+	}
+	for _, provider := range providers {
+		if cached, ok := provider.(*cachedArchive); ok && cached.checksum() != "" {
+			say("%s: %s, SHA-256 %s\n", cached.Filename(), formatSize(cached.ContentLength()), cached.checksum())
+		}
+	}
+	if len(variantNames) > 0 {
+		say("Other formats:\n")
+		for _, name := range variantNames {
+			say("  %s\n", httpURL(urlHost, *port, name))
+		}
+	}
+	if len(otherAddrs) > 0 {
+		say("Also reachable at:\n")
+		for _, c := range otherAddrs {
+			say("  %s (%s)\n", httpURL(c.ip.String(), *port, displayName), c.iface)
+		}
+	}
+	for _, t := range transports {
+		say("%s URL: %s/%s\n", t.Name(), t.URL(), displayName)
+	}
+	if !isDownloadPath("/qr") {
+		say("QR code: %s\n", httpURL(urlHost, *port, "qr"))
+	}
+	if *showQR {
+		say("%s", qr.Terminal())
+	}
+	if *copyURL {
+		// Prefer the most recently opened transport's URL
+		shareURL := url
+		if len(transports) > 0 {
+			shareURL = transports[len(transports)-1].URL() + "/" + displayName
+		}
+		if err := copyToClipboard(shareURL); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: cannot copy URL to clipboard: %v\n", err)
+		} else {
+			say("URL copied to clipboard\n")
+		}
+	}
+	switch {
+	case *receive && *count == 0:
+		say("Uploads: unlimited\n")
+	case *receive:
+		say("Uploads: %d remaining\n", *count)
+	case uncountedFor != "":
+		say("Downloads: %d remaining over HTTP; files fetched over --%s don't count, set -c to count them\n", *count, uncountedFor)
+	case *count == 0:
+		say("Downloads: unlimited\n")
+	case queueMode:
+		say("Downloads: %d per item\n", *count)
+	case setMode && *perFile:
+		say("Downloads: %d per file\n", *count)
+	case setMode:
+		say("Downloads: %d in total\n", *count)
+	default:
+		say("Downloads: %d remaining\n", *count)
+	}
+	if *twoWay != "" {
+		say("Uploads: unlimited; the share ends after the last download once a file has come back\n")
+	}
+	if daemonPIDFile == "" {
+		say("Press Ctrl+C to stop\n")
+	}
+	if events.logsStartup() {
+		logNotice("startup", logFields{"url": url, "paths": paths, "limit": *count}, "Serving at %s", url)
+		// Every address the share is reachable at, for programs to pick from
+		logNotice("url", logFields{"url": url}, "URL: %s", url)
+		for _, c := range otherAddrs {
+			other := httpURL(c.ip.String(), *port, displayName)
+			logNotice("url", logFields{"url": other, "interface": c.iface}, "URL: %s (%s)", other, c.iface)
+		}
+		for _, t := range transports {
+			public := t.URL() + "/" + displayName
+			logNotice("url", logFields{"url": public, "transport": t.Name()}, "%s URL: %s", t.Name(), public)
+		}
+		if ftpURL != "" {
+			logNotice("url", logFields{"url": ftpURL, "protocol": "ftp"}, "FTP URL: %s", ftpURL)
+		}
+		if sftpSrv != nil {
+			logNotice("url", logFields{"url": sftpURL, "protocol": "sftp", "password": sftpSrv.password, "host_key": sftpSrv.hostKey.fingerprint()}, "SFTP URL: %s (password %s, host key %s)", sftpURL, sftpSrv.password, sftpSrv.hostKey.fingerprint())
+		}
+		if tftpAddr != "" {
+			logNotice("url", logFields{"url": tftpAddr, "protocol": "tftp"}, "TFTP URL: %s", tftpAddr)
+		}
+		if rsyncSrv != nil {
+			logNotice("url", logFields{"url": rsyncAddr, "protocol": "rsync"}, "rsync URL: %s", rsyncAddr)
+		}
+		if torrentSrv != nil {
+			logNotice("url", logFields{"url": torrentURL, "protocol": "bittorrent", "magnet": magnet}, "Torrent URL: %s (magnet link %s)", torrentURL, magnet)
+		}
+		if ssdp != nil {
+			logNotice("url", logFields{"url": dlnaURL, "protocol": "dlna", "name": dlnaShare.name}, "DLNA device URL: %s (listed as %q)", dlnaURL, dlnaShare.name)
+		}
+	}
+	// startDaemon returns once the share in the background is listening
+	if daemonPIDFile != "" {
+		if err := writePIDFile(daemonPIDFile); err != nil {
+			listener.Close()
+			return err
+		}
 	}
-	fmt.Printf("Press Ctrl+C to stop\n")
 
+	limitReached, reloading := false, false
 	select {
 	case sig := <-sigChan:
-		fmt.Printf("\nReceived %v, shutting down...\n", sig)
+		logNotice("shutdown", logFields{"reason": "signal", "signal": sig.String()}, "\nReceived %v, shutting down...", sig)
+	case <-suspendChan:
+		logNotice("shutdown", logFields{"reason": "suspend"}, "Suspending share...")
+	case <-reloadChan:
+		reloading = true
+		logNotice("shutdown", logFields{"reason": "reload"}, "Received SIGHUP, reloading...")
+		listener.keep()
 	case err := <-errChan:
 		if err != http.ErrServerClosed {
 			return fmt.Errorf("server error: %v", err)
 		}
 	case <-downloadComplete:
-		fmt.Println("Download limit reached, shutting down...")
+		limitReached = true
+		switch {
+		case *receive:
+			logNotice("shutdown", logFields{"reason": "upload limit"}, "Upload limit reached, shutting down...")
+		case *twoWay != "":
+			logNotice("shutdown", logFields{"reason": "exchanged"}, "Files exchanged, shutting down...")
+		default:
+			logNotice("shutdown", logFields{"reason": "download limit"}, "Download limit reached, shutting down...")
+		}
+	}
+
+	// Graceful shutdown: stop accepting new connections and end streams,
+	// then let downloads in progress finish. Shutdown doesn't wait for
+	// handlers, so they are waited for as well.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopServing()
+	if ftpSrv != nil {
+		ftpSrv.Close()
+	}
+	if sftpSrv != nil {
+		sftpSrv.Close()
+	}
+	if tftpSrv != nil {
+		tftpSrv.Close()
+	}
+	if rsyncSrv != nil {
+		rsyncSrv.Close()
+	}
+	if torrentSrv != nil {
+		torrentSrv.Close()
+	}
+	if ssdp != nil {
+		ssdp.Close()
 	}
-
-	// Graceful shutdown: stop accepting new connections
-	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-	defer cancel()
-
-	// Shutdown stops accepting new connections but doesn't wait for handlers
-	server.Shutdown(ctx)
-
-	// Wait for active downloads to complete
 	done := make(chan struct{})
 	go func() {
+		server.Shutdown(ctx)
 		activeDownloads.Wait()
 		close(done)
 	}()
 
-	select {
-	case <-done:
-		fmt.Println("All downloads completed")
-	case <-ctx.Done():
-		fmt.Println("Shutdown timeout reached")
+	var timeout <-chan time.Time
+	if *drainTimeout > 0 {
+		timeout = time.After(*drainTimeout)
+	}
+	// The wait is only mentioned if there is one
+	notice := time.After(time.Second)
+	for waiting := true; waiting; {
+		select {
+		case <-done:
+			logNotice("stopped", nil, "All downloads completed")
+			waiting = false
+		case <-notice:
+			logNotice("draining", logFields{"timeout": drainTimeout.Seconds()}, "Waiting for downloads in progress to finish; press Ctrl+C to stop now")
+		case <-timeout:
+			logNotice("stopped", logFields{"timeout": true}, "Shutdown timeout reached")
+			waiting = false
+		case sig := <-sigChan:
+			logNotice("stopped", logFields{"signal": sig.String()}, "Received %v, stopping without waiting for downloads", sig)
+			waiting = false
+		}
+	}
+	stopProgress()
+	stats.log()
+
+	if reloading {
+		return errReload
+	}
+	// A finished share has nothing left to resume
+	if state != nil {
+		if limitReached {
+			os.Remove(*statePath)
+		} else {
+			logNotice("state_saved", logFields{"path": *statePath}, "Share state saved; resume with: userve resume %s", *statePath)
+		}
 	}
 
 	return nil
 }
 
+// expandGlobs replaces arguments containing glob patterns with the
+// matching paths, for shells that don't expand them (e.g. on Windows).
+// Arguments naming an existing path are kept as they are.
+func expandGlobs(args []string) ([]string, error) {
+	var paths []string
+	for _, arg := range args {
+		if !strings.ContainsAny(arg, "*?[") {
+			paths = append(paths, arg)
+			continue
+		}
+		if _, err := os.Stat(arg); err == nil {
+			paths = append(paths, arg)
+			continue
+		}
+		matches, err := filepath.Glob(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", arg, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no files match %s", arg)
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// parseArchiveFormat returns the archive format named by -a, checking that
+// the tools it needs are installed
+func parseArchiveFormat(name string) (ArchiveFormat, error) {
+	switch name {
+	case "tar.gz":
+		return ArchiveTarGz, nil
+	case "zip":
+		return ArchiveZip, nil
+	case "tar":
+		return ArchiveTar, nil
+	case "tar.xz":
+		// Compressed by the xz tool, which must be installed
+		if _, err := exec.LookPath("xz"); err != nil {
+			return 0, fmt.Errorf("tar.xz archives require xz to be installed")
+		}
+		return ArchiveTarXz, nil
+	case "7z":
+		if _, err := find7z(); err != nil {
+			return 0, err
+		}
+		return Archive7z, nil
+	}
+	return 0, fmt.Errorf("invalid archive format %q: valid formats are tar.gz, zip, tar, tar.xz, 7z", name)
+}
+
+// newProvider returns the content provider for a file or directory path
+func newProvider(path string, opts archiveOptions) (contentProvider, error) {
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("file not found: %s", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot access file: %v", err)
+	}
+
+	if info.IsDir() {
+		return cacheArchive(newArchiveProvider(path, filepath.Base(path), opts), opts), nil
+	}
+	return &fileProvider{
+		filePath: path,
+		fileName: filepath.Base(path),
+		fileSize: info.Size(),
+	}, nil
+}
+
 // contentProvider abstracts the content being served (file or archive)
 type contentProvider interface {
 	// Filename returns the name to use in Content-Disposition
@@ -203,42 +1632,275 @@ type contentProvider interface {
 	// ContentLength returns the size if known, or -1 for streaming
 	ContentLength() int64
 	// WriteTo writes the content to the writer
-	WriteTo(w io.Writer) error
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// cancelableContent is implemented by providers that work hard to produce
+// their content, such as archives, so the work can stop with the download
+type cancelableContent interface {
+	contentProvider
+	// writeContext is WriteTo, giving up once ctx is done
+	writeContext(ctx context.Context, w io.Writer) (int64, error)
 }
 
 // handler is the unified HTTP handler for serving any content
 type handler struct {
+	mu               sync.Mutex
+	path             string // If set, the only URL path downloads are served at
+	inline           bool   // Content-Disposition inline, so browsers show the content
 	provider         contentProvider
+	queue            []contentProvider // served after provider, in order
+	position         int               // index of provider among all items
+	onDownload       func(position int, downloads int32)
 	activeDownloads  *sync.WaitGroup
 	downloadComplete chan struct{}
+	stopping         context.Context // Done when the share shuts down, ending streams
 	maxDownloads     int32
 	downloadCount    atomic.Int32
+	uncountedFiles   bool // Files of a directory fetched one at a time don't count, see fileStatus
+}
+
+// restore skips the first position items and marks downloads of the
+// current one as used, continuing a suspended share
+func (h *handler) restore(position int, downloads int32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ; h.position < position && len(h.queue) > 0; h.position++ {
+		h.provider = h.queue[0]
+		h.queue = h.queue[1:]
+	}
+	h.downloadCount.Store(downloads)
+}
+
+// status returns the item currently being served and the number of
+// downloads it has left, or -1 when unlimited
+func (h *handler) status() (contentProvider, int32) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxDownloads == 0 {
+		return h.provider, -1
+	}
+	return h.provider, h.maxDownloads - h.downloadCount.Load()
+}
+
+// fileStatus is status for the servers that fetch a directory a file at a
+// time, such as --ftp. With uncountedFiles set their files don't use up the
+// limit, so there is no item to count and no limit.
+func (h *handler) fileStatus() (contentProvider, int32) {
+	if h.uncountedFiles {
+		return nil, -1
+	}
+	return h.status()
+}
+
+// remaining returns the downloads left of the current and queued items,
+// or -1 when unlimited
+func (h *handler) remaining() int32 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.maxDownloads == 0 {
+		return -1
+	}
+	return h.maxDownloads - h.downloadCount.Load() + int32(len(h.queue))*h.maxDownloads
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !allowReads(w, r) {
+		return
+	}
+	if h.path != "" && r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+
+	// The server may outlive the last download, e.g. to take uploads
+	provider, remaining := h.status()
+	if isProbePath(r.URL.Path) && r.URL.Path != "/"+provider.Filename() && r.URL.Path != h.path {
+		http.NotFound(w, r)
+		return
+	}
+	if remaining == 0 {
+		http.Error(w, "download limit reached", http.StatusGone)
+		return
+	}
+
+	// Archives are served in the format the client asks for
+	content := provider
+	if archive, ok := provider.(*archiveProvider); ok {
+		content = negotiateFormat(archive, r)
+	}
+	// The newest file is picked when the download starts
+	if latest, ok := provider.(*latestProvider); ok {
+		file := latest.current()
+		if file == nil {
+			http.Error(w, "no file to serve yet", http.StatusNotFound)
+			return
+		}
+		content = file
+	}
+	h.deliver(w, r, provider, content)
+}
+
+// allowReads answers requests other than GET and HEAD with 405, so that
+// e.g. a scanner's stray POST isn't taken for a download. It reports
+// whether the request may go on.
+func allowReads(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return true
+	}
+	w.Header().Set("Allow", "GET, HEAD")
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	return false
+}
+
+// deliver sends content to the client and counts a completed transfer as
+// a download of item, which is the provider that was current when the
+// request arrived
+func (h *handler) deliver(w http.ResponseWriter, r *http.Request, item, content contentProvider) {
 	h.activeDownloads.Add(1)
 	defer h.activeDownloads.Done()
 
+	start := time.Now()
 	remoteAddr := r.RemoteAddr
-	fmt.Printf("[%s] Download started from %s\n", time.Now().Format("15:04:05"), remoteAddr)
+	sent := &sentWriter{ResponseWriter: w}
+	w = sent
+	if file, ok := content.(*fileProvider); ok && file.live {
+		snapshot, err := file.snapshot()
+		if err != nil {
+			logEvent("download_failed", logFields{"client": remoteAddr, "error": err}, "Download failed from %s: %v", remoteAddr, err)
+			http.Error(w, "file not available right now", http.StatusServiceUnavailable)
+			return
+		}
+		defer snapshot.Close()
+		content = snapshot
+	}
 
-	// Set headers
-	w.Header().Set("Content-Type", h.provider.ContentType())
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", h.provider.Filename()))
-	if length := h.provider.ContentLength(); length >= 0 {
-		w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+	// The start is only reported once content goes out, so HEAD requests
+	// and probes don't look like downloads
+	var untrack func()
+	defer func() {
+		if untrack != nil {
+			untrack()
+		}
+	}()
+	logStart := func() {
+		logEvent("download_started", logFields{"client": remoteAddr, "file": content.Filename()}, "Download started from %s", remoteAddr)
+	}
+	started := func() {
+		logStart()
+		untrack = events.track(remoteAddr, content.Filename(), sent)
+	}
+
+	// Set headers; a followed file is watched in the browser
+	disposition := "attachment"
+	streaming, isStreaming := content.(streamingContent)
+	if isStreaming || h.inline {
+		disposition = "inline"
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	w.Header().Set("Content-Type", content.ContentType())
+	w.Header().Set("Content-Disposition", fmt.Sprintf("%s; filename=%q", disposition, content.Filename()))
+
+	// Link previews and prefetches are answered as a HEAD request would
+	// be, so a preview card shows the file without using up a download
+	if reason := unattended(r); reason != "" {
+		logEvent("preview_served", logFields{"client": remoteAddr, "reason": reason, "user_agent": r.UserAgent()}, "Sent only the headers for a %s to %s (%s)", reason, remoteAddr, r.UserAgent())
+		if length := content.ContentLength(); length >= 0 && !isStreaming {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+		}
+		w.WriteHeader(http.StatusOK)
+		return
 	}
 
-	// Serve content
-	if err := h.provider.WriteTo(w); err != nil {
-		fmt.Printf("[%s] Download interrupted from %s: %v\n", time.Now().Format("15:04:05"), remoteAddr, err)
+	// Streams end when the client leaves or the share stops, and never
+	// count as a download
+	if isStreaming {
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		logStart()
+		ctx, cancel := context.WithCancel(r.Context())
+		defer cancel()
+		if h.stopping != nil {
+			defer context.AfterFunc(h.stopping, cancel)()
+		}
+		if err := streaming.stream(ctx, w); err != nil && ctx.Err() == nil {
+			logEvent("stream_interrupted", transfer(remoteAddr, content.Filename(), sent, start).with("error", err), "Stream interrupted to %s: %v", remoteAddr, err)
+			return
+		}
+		logEvent("stream_ended", transfer(remoteAddr, content.Filename(), sent, start), "Stream ended to %s", remoteAddr)
 		return
 	}
 
-	fmt.Printf("[%s] Download completed from %s\n", time.Now().Format("15:04:05"), remoteAddr)
+	// Serve content; seekable content also answers Range requests, and
+	// only a response that reaches the end counts as a download
+	if seekable, ok := content.(seekableContent); ok {
+		complete, err := serveSeekable(w, r, seekable, started)
+		if err != nil {
+			logEvent("download_interrupted", transfer(remoteAddr, content.Filename(), sent, start).with("error", err), "Download interrupted from %s: %v", remoteAddr, err)
+			return
+		}
+		if !complete {
+			logEvent("download_partial", transfer(remoteAddr, content.Filename(), sent, start), "Partial download served to %s", remoteAddr)
+			return
+		}
+	} else {
+		if length := content.ContentLength(); length >= 0 {
+			w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+		}
+		// Only a transferred body counts
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		started()
+		// Archives stop being built once the client is gone
+		var err error
+		if cancelable, ok := content.(cancelableContent); ok {
+			_, err = cancelable.writeContext(r.Context(), w)
+		} else {
+			_, err = content.WriteTo(w)
+		}
+		if err != nil {
+			logEvent("download_interrupted", transfer(remoteAddr, content.Filename(), sent, start).with("error", err), "Download interrupted from %s: %v", remoteAddr, err)
+			return
+		}
+	}
+
+	logEvent("download_completed", transfer(remoteAddr, content.Filename(), sent, start), "Download completed from %s", remoteAddr)
+	h.count(item)
+}
+
+// count records a completed download of item towards the limit, moving on
+// to the next queued item or shutting down once it is reached. onDownload
+// is told after the lock is released, as saving the state is slow.
+func (h *handler) count(item contentProvider) {
+	position, downloads, counted := h.record(item)
+	if counted && h.onDownload != nil {
+		h.onDownload(position, downloads)
+	}
+}
+
+// record does the counting for count under the lock, and returns where
+// the share stands afterwards
+func (h *handler) record(item contentProvider) (position int, downloads int32, counted bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// A queued item that has already been replaced no longer counts
+	if item != h.provider {
+		return 0, 0, false
+	}
 
 	// Track download count
 	newCount := h.downloadCount.Add(1)
+	defer func() {
+		position, downloads, counted = h.position, h.downloadCount.Load(), true
+	}()
 
 	// Check if we've reached the limit
 	if h.maxDownloads == 0 {
@@ -248,7 +1910,14 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	remaining := h.maxDownloads - newCount
 	if remaining > 0 {
-		fmt.Printf("[%s] %d download(s) remaining\n", time.Now().Format("15:04:05"), remaining)
+		logEvent("downloads_remaining", logFields{"remaining": remaining}, "%d download(s) remaining", remaining)
+	} else if len(h.queue) > 0 {
+		// Move on to the next queued item
+		h.provider = h.queue[0]
+		h.queue = h.queue[1:]
+		h.position++
+		h.downloadCount.Store(0)
+		logEvent("now_serving", logFields{"file": h.provider.Filename(), "queued": len(h.queue)}, "Now serving %s (%d more queued)", h.provider.Filename(), len(h.queue))
 	} else {
 		// Signal shutdown when limit reached
 		select {
@@ -256,6 +1925,7 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		default:
 		}
 	}
+	return
 }
 
 // fileProvider serves a single file
@@ -263,6 +1933,7 @@ type fileProvider struct {
 	filePath string
 	fileName string
 	fileSize int64
+	live     bool // Looked at again for each download, see --live
 }
 
 func (p *fileProvider) Filename() string {
@@ -278,25 +1949,160 @@ func (p *fileProvider) ContentType() string {
 }
 
 func (p *fileProvider) ContentLength() int64 {
+	if p.live {
+		info, err := os.Stat(p.filePath)
+		if err != nil {
+			return -1
+		}
+		return info.Size()
+	}
 	return p.fileSize
 }
 
-func (p *fileProvider) WriteTo(w io.Writer) error {
+func (p *fileProvider) WriteTo(w io.Writer) (int64, error) {
 	file, err := os.Open(p.filePath)
 	if err != nil {
-		return err
+		return 0, err
 	}
 	defer file.Close()
 
-	_, err = io.Copy(w, file)
-	return err
+	return io.Copy(w, file)
+}
+
+// flagSet reports whether the flag called name was given on the command line
+func flagSet(fs *flag.FlagSet, name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+// downloadPath turns a --path value into a clean URL path
+func downloadPath(p string) (string, error) {
+	clean := path.Clean("/" + p)
+	if clean == "/" {
+		return "", fmt.Errorf("--path needs a path other than /")
+	}
+	return clean, nil
+}
+
+// newBundleProvider streams several files and directories as one archive
+// named name, or after the first path when name is empty
+func newBundleProvider(paths []string, name string, opts archiveOptions) (contentProvider, error) {
+	seen := make(map[string]bool)
+	for _, path := range paths {
+		if _, err := newProvider(path, opts); err != nil {
+			return nil, err
+		}
+		base := filepath.Base(path)
+		if seen[base] {
+			return nil, fmt.Errorf("duplicate name in bundle: %s", base)
+		}
+		seen[base] = true
+	}
+
+	p := newArchiveProvider(paths[0], "", opts)
+	p.extraPaths = paths[1:]
+	if name == "" {
+		base := filepath.Base(paths[0])
+		if info, err := os.Stat(paths[0]); err == nil && !info.IsDir() {
+			base = strings.TrimSuffix(base, filepath.Ext(base))
+		}
+		p.dirName = base
+	} else {
+		p.dirName = archiveBaseName(name, opts.format)
+	}
+	return cacheArchive(p, opts), nil
+}
+
+// rename makes a provider serve under name instead of the name of what
+// it serves
+func rename(p contentProvider, name string, format ArchiveFormat) {
+	switch p := p.(type) {
+	case *fileProvider:
+		p.fileName = name
+	case *followProvider:
+		p.fileName = name
+	case *memoryProvider:
+		p.name = name
+	case *archiveProvider:
+		p.dirName = archiveBaseName(name, format)
+	case *cachedArchive:
+		rename(p.contentProvider, name, format)
+	}
+}
+
+// archiveOf returns the archive p serves, also through a cache, or nil
+func archiveOf(p contentProvider) *archiveProvider {
+	if cached, ok := p.(*cachedArchive); ok {
+		p = cached.contentProvider
+	}
+	archive, _ := p.(*archiveProvider)
+	return archive
+}
+
+// archiveBaseName accepts an archive name with or without the extension
+// of format and returns it without
+func archiveBaseName(name string, format ArchiveFormat) string {
+	return strings.TrimSuffix(name, (&archiveProvider{format: format}).Filename())
+}
+
+// archiveOptions are the archive settings shared by all served directories
+type archiveOptions struct {
+	format       ArchiveFormat
+	filter       *archiveFilter
+	zipPassword  string // if set, zip entries are AES-256 encrypted
+	level        int    // compression level 0-9, or -1 for each format's default
+	store        bool   // zip entries are stored uncompressed
+	cache        bool   // archives are built once into a temporary file
+	reproducible bool   // same files give a byte-identical archive
+	xattrs       bool   // tar entries carry extended attributes
+	owner        string // ownerNumeric, ownerAnonymous or "" for tar entries
 }
 
-// archiveProvider serves a directory as an archive
+func newArchiveProvider(dirPath, dirName string, opts archiveOptions) *archiveProvider {
+	return &archiveProvider{
+		dirPath:      dirPath,
+		dirName:      dirName,
+		format:       opts.format,
+		filter:       opts.filter,
+		zipPassword:  opts.zipPassword,
+		level:        opts.level,
+		store:        opts.store,
+		reproducible: opts.reproducible,
+		xattrs:       opts.xattrs,
+		owner:        opts.owner,
+	}
+}
+
+// archiveProvider serves a directory as an archive. With --bundle,
+// dirPath may be a file and extraPaths holds the other bundled paths; each
+// is stored in the archive under its base name.
 type archiveProvider struct {
-	dirPath string
-	dirName string
-	format  ArchiveFormat
+	dirPath      string
+	dirName      string
+	format       ArchiveFormat
+	extraPaths   []string
+	filter       *archiveFilter
+	zipPassword  string
+	level        int
+	store        bool
+	reproducible bool
+	xattrs       bool
+	owner        string
+
+	// For an archive of a subdirectory: its path below the shared
+	// directory, and the ignore rules in effect there
+	prefix  string
+	ignores ignoreRules
+
+	// If set, only these slash-separated paths below the shared directory
+	// are archived, with the directories leading to them
+	selection []string
+
+	// If set, stored as SHA256SUMS after all other entries (--manifest)
+	manifest []byte
 }
 
 func (p *archiveProvider) Filename() string {
@@ -307,6 +2113,10 @@ func (p *archiveProvider) Filename() string {
 		return p.dirName + ".zip"
 	case ArchiveTar:
 		return p.dirName + ".tar"
+	case ArchiveTarXz:
+		return p.dirName + ".tar.xz"
+	case Archive7z:
+		return p.dirName + ".7z"
 	default:
 		return p.dirName + ".tar.gz"
 	}
@@ -320,58 +2130,180 @@ func (p *archiveProvider) ContentType() string {
 		return "application/zip"
 	case ArchiveTar:
 		return "application/x-tar"
+	case ArchiveTarXz:
+		return "application/x-xz"
+	case Archive7z:
+		return "application/x-7z-compressed"
 	default:
 		return "application/gzip"
 	}
 }
 
+// variantFormats are the formats every archive can also be downloaded in,
+// by changing the extension in its URL
+var variantFormats = []ArchiveFormat{ArchiveTarGz, ArchiveZip, ArchiveTar}
+
+// variant returns the archive in the format whose filename is name, or nil.
+// Encrypted zip archives have no variants, which would give the content
+// away unencrypted.
+func (p *archiveProvider) variant(name string) *archiveProvider {
+	if p.zipPassword != "" {
+		return nil
+	}
+	for _, format := range variantFormats {
+		v := *p
+		v.format = format
+		if format != p.format && v.Filename() == name {
+			return &v
+		}
+	}
+	return nil
+}
+
+// variantNames returns the filenames of the archive's variants
+func (p *archiveProvider) variantNames() []string {
+	if p.zipPassword != "" {
+		return nil
+	}
+	var names []string
+	for _, format := range variantFormats {
+		if format != p.format {
+			v := *p
+			v.format = format
+			names = append(names, v.Filename())
+		}
+	}
+	return names
+}
+
 func (p *archiveProvider) ContentLength() int64 {
 	return -1 // Streaming, unknown size
 }
 
-func (p *archiveProvider) WriteTo(w io.Writer) error {
-	if p.format == ArchiveZip {
-		return p.writeZipArchive(w)
+func (p *archiveProvider) WriteTo(w io.Writer) (int64, error) {
+	return p.writeContext(context.Background(), w)
+}
+
+// writeContext builds the archive into w, giving up at the next file or
+// read once ctx is done
+func (p *archiveProvider) writeContext(ctx context.Context, w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	var err error
+	switch p.format {
+	case ArchiveZip:
+		err = p.writeZipArchive(ctx, cw)
+	case Archive7z:
+		err = p.write7zArchive(ctx, cw)
+	default:
+		err = p.writeTarArchive(ctx, cw)
+	}
+	if err != nil && ctx.Err() != nil {
+		// Rather than whatever broke first, such as the pipe to xz
+		err = ctx.Err()
+	}
+	return cw.n, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// contextReader fails reads once ctx is done, so a copy from it stops
+// partway through a large file
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
-	return p.writeTarArchive(w)
+	return c.r.Read(b)
 }
 
-func (p *archiveProvider) writeTarArchive(w io.Writer) error {
+func (p *archiveProvider) writeTarArchive(ctx context.Context, w io.Writer) error {
 	var tw *tar.Writer
+	var gm *gzipMembers
 
 	switch p.format {
-	case ArchiveTarGz:
-		gw := gzip.NewWriter(w)
-		defer gw.Close()
-		tw = tar.NewWriter(gw)
 	case ArchiveTar:
 		tw = tar.NewWriter(w)
+	case ArchiveTarXz:
+		xw, err := newXZWriter(ctx, w, p.level, p.reproducible)
+		if err != nil {
+			return err
+		}
+		defer xw.Close()
+		tw = tar.NewWriter(xw)
 	default:
-		gw := gzip.NewWriter(w)
-		defer gw.Close()
-		tw = tar.NewWriter(gw)
+		var err error
+		if gm, err = newGzipMembers(w, p.level); err != nil {
+			return err
+		}
+		defer gm.Close()
+		tw = tar.NewWriter(gm)
 	}
 	defer tw.Close()
 
-	baseDir := filepath.Base(p.dirPath)
+	// Archive names of files with several hardlinks, by file
+	hardlinks := make(map[fileID]string)
 
-	return filepath.Walk(p.dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	err := p.walk(func(path, name string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
+		// Preserved symlinks are stored as links to their target
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			var err error
+			if link, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+
 		// Create tar header
-		header, err := tar.FileInfoHeader(info, "")
+		header, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return err
 		}
+		header.Name = name
+		setOwner(header, p.owner)
+		if p.reproducible {
+			normalizeTarHeader(header)
+		}
+		if p.xattrs && link == "" {
+			if err := addXattrs(header, path); err != nil {
+				return err
+			}
+		}
 
-		// Adjust the name to be relative to the directory being archived
-		relPath, err := filepath.Rel(p.dirPath, path)
-		if err != nil {
-			return err
+		// Later names of a hardlinked file are stored as links to the first
+		if id, ok := hardlinkID(info); ok {
+			if first, seen := hardlinks[id]; seen {
+				header.Typeflag = tar.TypeLink
+				header.Linkname = first
+				header.Size = 0
+			} else {
+				hardlinks[id] = name
+			}
+		}
+
+		// Already compressed files pass through gzip uncompressed
+		if gm != nil {
+			if err := gm.setStored(info.Mode().IsRegular() && isCompressed(path)); err != nil {
+				return err
+			}
 		}
-		header.Name = filepath.Join(baseDir, relPath)
 
 		// Write header
 		if err := tw.WriteHeader(header); err != nil {
@@ -379,30 +2311,43 @@ func (p *archiveProvider) writeTarArchive(w io.Writer) error {
 		}
 
 		// If it's a file, write its contents
-		if !info.IsDir() {
+		if header.Typeflag == tar.TypeReg {
 			file, err := os.Open(path)
 			if err != nil {
 				return err
 			}
 			defer file.Close()
 
-			if _, err := io.Copy(tw, file); err != nil {
+			if _, err := io.Copy(tw, &contextReader{ctx: ctx, r: file}); err != nil {
 				return err
 			}
 		}
 
 		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if gm != nil {
+		if err := gm.setStored(false); err != nil {
+			return err
+		}
+	}
+	return p.writeTarManifest(tw)
 }
 
-func (p *archiveProvider) writeZipArchive(w io.Writer) error {
+// writeZipArchive streams a zip archive. Entries and archives over 4 GiB
+// get Zip64 data descriptors, extra fields and end records from zip.Writer,
+// which it adds as soon as a size or offset needs them.
+func (p *archiveProvider) writeZipArchive(ctx context.Context, w io.Writer) error {
 	zw := zip.NewWriter(w)
 	defer zw.Close()
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, p.level)
+	})
 
-	baseDir := filepath.Base(p.dirPath)
-
-	return filepath.Walk(p.dirPath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
+	err := p.walk(func(path, name string, info os.FileInfo) error {
+		if err := ctx.Err(); err != nil {
 			return err
 		}
 
@@ -411,42 +2356,103 @@ func (p *archiveProvider) writeZipArchive(w io.Writer) error {
 		if err != nil {
 			return err
 		}
-
-		// Adjust the name to be relative to the directory being archived
-		relPath, err := filepath.Rel(p.dirPath, path)
-		if err != nil {
-			return err
+		header.Name = name
+		if p.reproducible {
+			normalizeZipHeader(header)
 		}
-		header.Name = filepath.Join(baseDir, relPath)
 
 		// Ensure directories end with /
 		if info.IsDir() {
 			header.Name += "/"
-		} else {
+		} else if info.Mode().IsRegular() && !p.store && !isCompressed(path) {
 			header.Method = zip.Deflate
 		}
 
-		// Write header
+		// Write header; with a password, the content is encrypted and the
+		// entry is finished by closing its writer
+		if p.zipPassword != "" && !info.IsDir() {
+			ew, err := createEncryptedEntry(zw, header, p.zipPassword, header.Method == zip.Deflate, p.level)
+			if err != nil {
+				return err
+			}
+			if err := writeZipContent(ctx, ew, path, info); err != nil {
+				return err
+			}
+			return ew.Close()
+		}
 		writer, err := zw.CreateHeader(header)
 		if err != nil {
 			return err
 		}
+		return writeZipContent(ctx, writer, path, info)
+	})
+	if err != nil {
+		return err
+	}
+	return p.writeZipManifest(zw)
+}
 
-		// If it's a file, write its contents
-		if !info.IsDir() {
-			file, err := os.Open(path)
-			if err != nil {
-				return err
-			}
-			defer file.Close()
+// writeZipContent writes the content of a zip entry: a file's data or a
+// symlink's target
+func writeZipContent(ctx context.Context, w io.Writer, path string, info os.FileInfo) error {
+	// Symlinks store their target as content
+	if info.Mode()&os.ModeSymlink != 0 {
+		link, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		_, err = io.WriteString(w, link)
+		return err
+	}
 
-			if _, err := io.Copy(writer, file); err != nil {
-				return err
-			}
+	// If it's a file, write its contents
+	if info.Mode().IsRegular() {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
 		}
+		defer file.Close()
 
-		return nil
-	})
+		if _, err := io.Copy(w, &contextReader{ctx: ctx, r: file}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// portFallbackAttempts is how many ports after the requested one
+// --port-fallback tries before picking a random free port
+const portFallbackAttempts = 10
+
+// listen binds to host:port. With fallback, a port already in use is
+// replaced by one of the following ports or, failing that, a random one.
+func listen(host string, port int, fallback bool) (net.Listener, error) {
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+	listener, err := net.Listen("tcp", addr)
+	if err == nil {
+		return listener, nil
+	}
+	if !fallback || !isAddrInUse(err) {
+		return nil, fmt.Errorf("cannot bind to %s: %v", addr, err)
+	}
+
+	for next := port + 1; next <= port+portFallbackAttempts && next <= 65535; next++ {
+		if listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(next))); err == nil {
+			return listener, nil
+		}
+	}
+	listener, err = net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, fmt.Errorf("cannot bind to %s or any fallback port: %v", addr, err)
+	}
+	return listener, nil
+}
+
+// isAddrInUse reports whether a listen error means the port is taken.
+// Windows reports WSAEADDRINUSE (10048) instead of EADDRINUSE.
+func isAddrInUse(err error) bool {
+	return errors.Is(err, syscall.EADDRINUSE) || errors.Is(err, syscall.Errno(10048))
 }
 
 func getLocalIP() string {
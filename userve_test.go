@@ -5,7 +5,11 @@ import (
 	"archive/zip"
 	"bytes"
 	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
@@ -35,6 +39,33 @@ func TestRunMissingFilePath(t *testing.T) {
 	}
 }
 
+func TestRunQueueMissingFilePath(t *testing.T) {
+	err := run([]string{"queue"})
+	if err == nil {
+		t.Fatal("expected error for queue without file paths")
+	}
+	if !strings.Contains(err.Error(), "file path required") {
+		t.Errorf("expected 'file path required' error, got: %v", err)
+	}
+}
+
+func TestRunQueueFileNotFound(t *testing.T) {
+	tmpDir := t.TempDir()
+	err := run([]string{"queue", tmpDir, "/nonexistent/path/to/file.txt"})
+	if err == nil {
+		t.Fatal("expected error for non-existent queued file")
+	}
+	if !strings.Contains(err.Error(), "file not found") {
+		t.Errorf("expected 'file not found' error, got: %v", err)
+	}
+}
+
+func TestRunSelftest(t *testing.T) {
+	if err := run([]string{"selftest"}); err != nil {
+		t.Fatalf("selftest failed: %v", err)
+	}
+}
+
 func TestRunInvalidFlag(t *testing.T) {
 	err := run([]string{"--invalid-flag"})
 	if err == nil {
@@ -53,6 +84,13 @@ func TestRunInvalidArchiveFormat(t *testing.T) {
 	}
 }
 
+func TestRunInvalidCompressionLevel(t *testing.T) {
+	err := run([]string{"--compression-level", "12", t.TempDir()})
+	if err == nil || !strings.Contains(err.Error(), "invalid compression level") {
+		t.Errorf("expected 'invalid compression level' error, got: %v", err)
+	}
+}
+
 func TestFileHandler(t *testing.T) {
 	// Create a temporary test file
 	tmpDir := t.TempDir()
@@ -115,6 +153,69 @@ func TestFileHandler(t *testing.T) {
 	}
 }
 
+func TestFileHandlerMethods(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "file.txt")
+	if err := os.WriteFile(path, []byte("content"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	h := &handler{
+		provider:         &fileProvider{filePath: path, fileName: "file.txt", fileSize: 7},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+		maxDownloads:     1,
+	}
+	for _, method := range []string{"POST", "PUT", "DELETE", "OPTIONS", "PROPFIND"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(method, "/file.txt", nil))
+		if rec.Code != http.StatusMethodNotAllowed || rec.Header().Get("Allow") != "GET, HEAD" {
+			t.Errorf("%s: expected 405 with Allow: GET, HEAD, got %d with %q", method, rec.Code, rec.Header().Get("Allow"))
+		}
+	}
+
+	// The refused requests left the one download for a GET
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/file.txt", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "content" {
+		t.Errorf("expected the file, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestFileHandlerDisposition(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "scan.pdf")
+	if err := os.WriteFile(path, []byte("%PDF-1.7"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		inline   bool
+		expected string
+	}{
+		{false, `attachment; filename="scan.pdf"`},
+		{true, `inline; filename="scan.pdf"`},
+	}
+	for _, tt := range tests {
+		var wg sync.WaitGroup
+		h := &handler{
+			provider:         &fileProvider{filePath: path, fileName: "scan.pdf", fileSize: 8},
+			inline:           tt.inline,
+			activeDownloads:  &wg,
+			downloadComplete: make(chan struct{}, 1),
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/scan.pdf", nil))
+		if got := rec.Header().Get("Content-Disposition"); got != tt.expected {
+			t.Errorf("inline %v: expected Content-Disposition %q, got %q", tt.inline, tt.expected, got)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "application/pdf" {
+			t.Errorf("inline %v: expected Content-Type application/pdf, got %q", tt.inline, got)
+		}
+	}
+}
+
 func TestGetLocalIP(t *testing.T) {
 	ip := getLocalIP()
 	if ip == "" {
@@ -126,6 +227,28 @@ func TestGetLocalIP(t *testing.T) {
 	}
 }
 
+func TestListenPortFallback(t *testing.T) {
+	busy, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to occupy a port: %v", err)
+	}
+	defer busy.Close()
+	port := busy.Addr().(*net.TCPAddr).Port
+
+	if _, err := listen("127.0.0.1", port, false); err == nil || !strings.HasPrefix(err.Error(), "cannot bind to") {
+		t.Errorf("expected bind error without fallback, got %v", err)
+	}
+
+	listener, err := listen("127.0.0.1", port, true)
+	if err != nil {
+		t.Fatalf("expected fallback port, got %v", err)
+	}
+	defer listener.Close()
+	if chosen := listener.Addr().(*net.TCPAddr).Port; chosen == port {
+		t.Errorf("expected a port other than %d", port)
+	}
+}
+
 func TestFileHandlerSignalsDownloadComplete(t *testing.T) {
 	// Create a temporary test file
 	tmpDir := t.TempDir()
@@ -162,6 +285,13 @@ func TestFileHandlerSignalsDownloadComplete(t *testing.T) {
 	default:
 		t.Error("expected downloadComplete to be signaled after successful download")
 	}
+
+	// A server that stays up, e.g. for uploads, refuses further downloads
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/testfile.txt", nil))
+	if rec.Code != http.StatusGone {
+		t.Errorf("expected 410 after the last download, got %d", rec.Code)
+	}
 }
 
 func TestFileHandlerDownloadCounting(t *testing.T) {
@@ -254,6 +384,207 @@ func TestFileHandlerUnlimitedDownloads(t *testing.T) {
 	}
 }
 
+func TestFileHandlerUncountedFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	testFile := filepath.Join(tmpDir, "testfile.txt")
+	if err := os.WriteFile(testFile, []byte("Hello, World!"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	info, _ := os.Stat(testFile)
+	provider := &fileProvider{filePath: testFile, fileName: "testfile.txt", fileSize: info.Size()}
+	var wg sync.WaitGroup
+	downloadComplete := make(chan struct{}, 1)
+	h := &handler{
+		provider:         provider,
+		activeDownloads:  &wg,
+		downloadComplete: downloadComplete,
+		maxDownloads:     1,
+		uncountedFiles:   true,
+	}
+
+	// Files fetched over a secondary server leave the limit alone
+	for i := range 3 {
+		item, remaining := h.fileStatus()
+		if remaining != -1 {
+			t.Fatalf("expected no limit for files, got %d remaining", remaining)
+		}
+		h.deliver(httptest.NewRecorder(), treeRequest("192.0.2.1:1234", "/testfile.txt"), item, provider)
+		select {
+		case <-downloadComplete:
+			t.Fatalf("downloadComplete signaled by file %d", i+1)
+		default:
+		}
+	}
+	if _, remaining := h.status(); remaining != 1 {
+		t.Fatalf("expected 1 download remaining over HTTP, got %d", remaining)
+	}
+
+	// An HTTP download still uses it up
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/testfile.txt", nil))
+	select {
+	case <-downloadComplete:
+	default:
+		t.Error("expected downloadComplete to be signaled after the HTTP download")
+	}
+}
+
+func TestFileHandlerQueue(t *testing.T) {
+	tmpDir := t.TempDir()
+	var providers []contentProvider
+	for _, name := range []string{"first.txt", "second.txt"} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+		providers = append(providers, &fileProvider{
+			filePath: path,
+			fileName: name,
+			fileSize: int64(len(name)),
+		})
+	}
+
+	var wg sync.WaitGroup
+	downloadComplete := make(chan struct{}, 1)
+
+	h := &handler{
+		provider:         providers[0],
+		queue:            providers[1:],
+		activeDownloads:  &wg,
+		downloadComplete: downloadComplete,
+		maxDownloads:     2,
+	}
+
+	// Each item is served until its count is used up, then the next one
+	expected := []string{"first.txt", "first.txt", "second.txt", "second.txt"}
+	for i, want := range expected {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+		if body := rec.Body.String(); body != want {
+			t.Errorf("download %d: expected body %q, got %q", i+1, want, body)
+		}
+
+		select {
+		case <-downloadComplete:
+			if i != len(expected)-1 {
+				t.Errorf("downloadComplete signaled too early on download %d", i+1)
+			}
+		default:
+			if i == len(expected)-1 {
+				t.Error("expected downloadComplete to be signaled after the last queued item")
+			}
+		}
+	}
+}
+
+func TestFileHandlerRestore(t *testing.T) {
+	tmpDir := t.TempDir()
+	var providers []contentProvider
+	for _, name := range []string{"first.txt", "second.txt", "third.txt"} {
+		path := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(path, []byte(name), 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+		providers = append(providers, &fileProvider{
+			filePath: path,
+			fileName: name,
+			fileSize: int64(len(name)),
+		})
+	}
+
+	var wg sync.WaitGroup
+	var saved []string
+	h := &handler{
+		provider:         providers[0],
+		queue:            providers[1:],
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+		maxDownloads:     2,
+		onDownload: func(position int, downloads int32) {
+			saved = append(saved, fmt.Sprintf("%d/%d", position, downloads))
+		},
+	}
+
+	// Saving the state mustn't hold up other requests
+	report := h.onDownload
+	h.onDownload = func(position int, downloads int32) {
+		if !h.mu.TryLock() {
+			t.Error("expected progress to be reported outside the handler's lock")
+		} else {
+			h.mu.Unlock()
+		}
+		report(position, downloads)
+	}
+
+	// Continue a share suspended after one download of the second item
+	h.restore(1, 1)
+
+	expected := []string{"second.txt", "third.txt"}
+	for i, want := range expected {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		if body := rec.Body.String(); body != want {
+			t.Errorf("download %d: expected body %q, got %q", i+1, want, body)
+		}
+	}
+
+	if got := strings.Join(saved, " "); got != "2/0 2/1" {
+		t.Errorf("expected progress 2/0 2/1 to be reported, got %q", got)
+	}
+}
+
+func TestFileHandlerFixedPath(t *testing.T) {
+	tmpDir := t.TempDir()
+	path := filepath.Join(tmpDir, "build.zip")
+	if err := os.WriteFile(path, []byte("build"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	var wg sync.WaitGroup
+	h := &handler{
+		path:             "/nightly/build.zip",
+		provider:         &fileProvider{filePath: path, fileName: "build.zip", fileSize: 5},
+		activeDownloads:  &wg,
+		downloadComplete: make(chan struct{}, 1),
+	}
+
+	tests := []struct {
+		path   string
+		status int
+	}{
+		{"/build.zip", http.StatusNotFound},
+		{"/nightly/", http.StatusNotFound},
+		{"/nightly/build.zip", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%s: expected status %d, got %d", tt.path, tt.status, rec.Code)
+		}
+	}
+}
+
+func TestDownloadPath(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected string
+		wantErr  bool
+	}{
+		{"/nightly/build.zip", "/nightly/build.zip", false},
+		{"nightly/build.zip", "/nightly/build.zip", false},
+		{"/a/../b//c.zip", "/b/c.zip", false},
+		{"/", "", true},
+	}
+	for _, tt := range tests {
+		got, err := downloadPath(tt.value)
+		if (err != nil) != tt.wantErr || got != tt.expected {
+			t.Errorf("%q: expected %q (error %v), got %q (%v)", tt.value, tt.expected, tt.wantErr, got, err)
+		}
+	}
+}
+
 func TestArchiveProviderFilename(t *testing.T) {
 	tests := []struct {
 		format   ArchiveFormat
@@ -262,6 +593,8 @@ func TestArchiveProviderFilename(t *testing.T) {
 		{ArchiveTarGz, "testdir.tar.gz"},
 		{ArchiveZip, "testdir.zip"},
 		{ArchiveTar, "testdir.tar"},
+		{ArchiveTarXz, "testdir.tar.xz"},
+		{Archive7z, "testdir.7z"},
 	}
 
 	for _, tt := range tests {
@@ -284,6 +617,8 @@ func TestArchiveProviderContentType(t *testing.T) {
 		{ArchiveTarGz, "application/gzip"},
 		{ArchiveZip, "application/zip"},
 		{ArchiveTar, "application/x-tar"},
+		{ArchiveTarXz, "application/x-xz"},
+		{Archive7z, "application/x-7z-compressed"},
 	}
 
 	for _, tt := range tests {
@@ -506,6 +841,46 @@ func TestDirHandlerUncompressedTar(t *testing.T) {
 	}
 }
 
+func TestDirHandlerFormatByExtension(t *testing.T) {
+	testDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(testDir, "file1.txt"), []byte("content1"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		path        string
+		contentType string
+		filename    string
+	}{
+		{"/testdir.tar.gz", "application/gzip", "testdir.tar.gz"},
+		{"/testdir.zip", "application/zip", "testdir.zip"},
+		{"/testdir.tar", "application/x-tar", "testdir.tar"},
+		{"/other.zip", "application/gzip", "testdir.tar.gz"},
+	}
+	for _, tt := range tests {
+		var wg sync.WaitGroup
+		h := &handler{
+			provider:         &archiveProvider{dirPath: testDir, dirName: "testdir", format: ArchiveTarGz, level: -1},
+			activeDownloads:  &wg,
+			downloadComplete: make(chan struct{}, 1),
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.path, nil))
+		if ct := rec.Header().Get("Content-Type"); ct != tt.contentType {
+			t.Errorf("%s: expected Content-Type %s, got %s", tt.path, tt.contentType, ct)
+		}
+		if cd := rec.Header().Get("Content-Disposition"); !strings.Contains(cd, tt.filename) {
+			t.Errorf("%s: expected filename %s, got %s", tt.path, tt.filename, cd)
+		}
+	}
+
+	// Encrypted archives are only served encrypted
+	p := &archiveProvider{dirName: "testdir", format: ArchiveZip, zipPassword: "s3cret"}
+	if p.variant("testdir.tar") != nil || len(p.variantNames()) != 0 {
+		t.Error("expected no unencrypted variants of an encrypted archive")
+	}
+}
+
 func TestDirHandlerDownloadCounting(t *testing.T) {
 	// Create a temporary directory with a file
 	tmpDir := t.TempDir()
@@ -555,3 +930,329 @@ func TestDirHandlerDownloadCounting(t *testing.T) {
 		t.Error("expected downloadComplete to be signaled after 2nd download")
 	}
 }
+
+func TestBundleProvider(t *testing.T) {
+	tmpDir := t.TempDir()
+	report := filepath.Join(tmpDir, "report.pdf")
+	photos := filepath.Join(tmpDir, "photos")
+	if err := os.WriteFile(report, []byte("report"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := os.Mkdir(photos, 0755); err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(photos, "a.jpg"), []byte("jpeg"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	tests := []struct {
+		name     string
+		format   ArchiveFormat
+		expected string
+	}{
+		{"", ArchiveTarGz, "report.tar.gz"},
+		{"handover", ArchiveZip, "handover.zip"},
+		{"handover.zip", ArchiveZip, "handover.zip"},
+	}
+	for _, tt := range tests {
+		p, err := newBundleProvider([]string{report, photos}, tt.name, archiveOptions{format: tt.format})
+		if err != nil {
+			t.Fatalf("newBundleProvider failed: %v", err)
+		}
+		if got := p.Filename(); got != tt.expected {
+			t.Errorf("name %q: expected filename %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+
+	p, err := newBundleProvider([]string{report, photos}, "", archiveOptions{format: ArchiveTar})
+	if err != nil {
+		t.Fatalf("newBundleProvider failed: %v", err)
+	}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		names = append(names, header.Name)
+	}
+	if got := strings.Join(names, " "); got != "report.pdf photos photos/a.jpg" {
+		t.Errorf("unexpected archive entries: %s", got)
+	}
+
+	if _, err := newBundleProvider([]string{report, filepath.Join(tmpDir, "missing")}, "", archiveOptions{format: ArchiveTar}); err == nil || !strings.HasPrefix(err.Error(), "file not found") {
+		t.Errorf("expected file not found error, got %v", err)
+	}
+	if _, err := newBundleProvider([]string{photos, photos}, "", archiveOptions{format: ArchiveTar}); err == nil || err.Error() != "duplicate name in bundle: photos" {
+		t.Errorf("expected duplicate name error, got %v", err)
+	}
+}
+
+func TestRename(t *testing.T) {
+	tmpDir := t.TempDir()
+	file := filepath.Join(tmpDir, "output.tar.gz")
+	if err := os.WriteFile(file, []byte("archive"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	dir := filepath.Join(tmpDir, "build")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatalf("failed to create test directory: %v", err)
+	}
+
+	tests := []struct {
+		path     string
+		name     string
+		opts     archiveOptions
+		expected string
+	}{
+		{file, "release-1.2.3.tar.gz", archiveOptions{}, "release-1.2.3.tar.gz"},
+		{dir, "release-1.2.3", archiveOptions{format: ArchiveZip}, "release-1.2.3.zip"},
+		{dir, "release-1.2.3.zip", archiveOptions{format: ArchiveZip, cache: true}, "release-1.2.3.zip"},
+	}
+	for _, tt := range tests {
+		p, err := newProvider(tt.path, tt.opts)
+		if err != nil {
+			t.Fatalf("newProvider failed: %v", err)
+		}
+		rename(p, tt.name, tt.opts.format)
+		if got := p.Filename(); got != tt.expected {
+			t.Errorf("name %q: expected filename %q, got %q", tt.name, tt.expected, got)
+		}
+	}
+
+	for _, args := range [][]string{
+		{"-n", "a/b.txt", file},
+		{"--name", "x.txt", file, file},
+	} {
+		if err := run(args); err == nil || !strings.Contains(err.Error(), "--name") {
+			t.Errorf("%v: expected a --name error, got %v", args, err)
+		}
+	}
+}
+
+func TestArchiveCompressionLevel(t *testing.T) {
+	root := t.TempDir()
+	if err := os.WriteFile(filepath.Join(root, "log.txt"), bytes.Repeat([]byte("GET /index.html 200\n"), 5000), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	for _, format := range []ArchiveFormat{ArchiveTarGz, ArchiveZip} {
+		sizes := map[int]int{}
+		for _, level := range []int{0, 9} {
+			p := &archiveProvider{dirPath: root, dirName: "logs", format: format, level: level}
+			var buf bytes.Buffer
+			if _, err := p.WriteTo(&buf); err != nil {
+				t.Fatalf("%v level %d: WriteTo failed: %v", format, level, err)
+			}
+			sizes[level] = buf.Len()
+		}
+		if sizes[9]*10 > sizes[0] {
+			t.Errorf("%v: expected level 9 (%d bytes) to be far smaller than level 0 (%d bytes)", format, sizes[9], sizes[0])
+		}
+	}
+}
+
+// cancelingWriter cancels a context on its first write
+type cancelingWriter struct {
+	cancel context.CancelFunc
+	n      int
+}
+
+func (c *cancelingWriter) Write(b []byte) (int, error) {
+	c.cancel()
+	c.n += len(b)
+	return len(b), nil
+}
+
+func TestArchiveCanceled(t *testing.T) {
+	root := t.TempDir()
+	size := 8 << 20
+	if err := os.WriteFile(filepath.Join(root, "a.bin"), make([]byte, size), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	os.WriteFile(filepath.Join(root, "b.bin"), make([]byte, size), 0644)
+
+	for _, format := range []ArchiveFormat{ArchiveTarGz, ArchiveZip, ArchiveTar} {
+		p := &archiveProvider{dirPath: root, dirName: "data", format: format, level: -1}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := p.writeContext(ctx, io.Discard); !errors.Is(err, context.Canceled) {
+			t.Errorf("%v: expected a canceled archive to fail with context.Canceled, got %v", format, err)
+		}
+	}
+
+	// A download abandoned partway stops in the middle of a file
+	for _, p := range []*archiveProvider{
+		{dirPath: root, dirName: "data", format: ArchiveTar},
+		{dirPath: root, dirName: "data", format: ArchiveZip, store: true},
+	} {
+		ctx, cancel := context.WithCancel(context.Background())
+		w := &cancelingWriter{cancel: cancel}
+		if _, err := p.writeContext(ctx, w); !errors.Is(err, context.Canceled) {
+			t.Errorf("%v: expected context.Canceled, got %v", p.format, err)
+		}
+		if w.n > size/2 {
+			t.Errorf("%v: expected the archive to stop soon after the cancellation, got %d bytes", p.format, w.n)
+		}
+	}
+}
+
+func TestZipArchiveNoCompress(t *testing.T) {
+	root := t.TempDir()
+	content := bytes.Repeat([]byte("frame"), 1000)
+	if err := os.WriteFile(filepath.Join(root, "clip.mp4"), content, 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	for _, password := range []string{"", "s3cret"} {
+		p := &archiveProvider{dirPath: root, dirName: "videos", format: ArchiveZip, store: true, zipPassword: password}
+		var buf bytes.Buffer
+		if _, err := p.WriteTo(&buf); err != nil {
+			t.Fatalf("WriteTo failed: %v", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		if err != nil {
+			t.Fatalf("failed to read zip: %v", err)
+		}
+		for _, f := range zr.File {
+			if f.Name != "videos/clip.mp4" {
+				continue
+			}
+			// Encrypted entries add salt, verifier and MAC around the data
+			if f.CompressedSize64 < uint64(len(content)) {
+				t.Errorf("password %q: expected stored entry of at least %d bytes, got %d", password, len(content), f.CompressedSize64)
+			}
+			if password == "" && f.Method != zip.Store {
+				t.Errorf("expected method Store, got %d", f.Method)
+			}
+		}
+	}
+
+	if err := run([]string{"--no-compress", t.TempDir()}); err == nil || err.Error() != "--no-compress needs -a zip" {
+		t.Errorf("expected --no-compress to need -a zip, got %v", err)
+	}
+}
+
+// tailWriter discards what is written except for the last bytes, which hold
+// a zip's central directory
+type tailWriter struct {
+	n    int64
+	tail []byte
+}
+
+func (w *tailWriter) Write(b []byte) (int, error) {
+	w.n += int64(len(b))
+	w.tail = append(w.tail, b...)
+	if over := len(w.tail) - 64<<10; over > 0 {
+		w.tail = append(w.tail[:0], w.tail[over:]...)
+	}
+	return len(b), nil
+}
+
+// ReadAt serves the tail; earlier bytes read as zeros
+func (w *tailWriter) ReadAt(b []byte, off int64) (int, error) {
+	start := w.n - int64(len(w.tail))
+	for i := range b {
+		if pos := off + int64(i); pos >= start && pos < w.n {
+			b[i] = w.tail[pos-start]
+		} else {
+			b[i] = 0
+		}
+	}
+	return len(b), nil
+}
+
+func TestZipArchiveZip64(t *testing.T) {
+	if testing.Short() {
+		t.Skip("streams a 4 GiB file")
+	}
+	root := t.TempDir()
+	const bigSize = 1<<32 + 1<<20
+	// Sparse, so it takes no disk space
+	big, err := os.Create(filepath.Join(root, "disk.img"))
+	if err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := big.Truncate(bigSize); err != nil {
+		t.Fatalf("failed to size test file: %v", err)
+	}
+	big.Close()
+	// Stored after the big file, so its offset is beyond 4 GiB
+	if err := os.WriteFile(filepath.Join(root, "notes.txt"), []byte("notes"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	// Stored rather than deflated, to keep the test fast
+	p := &archiveProvider{dirPath: root, dirName: "backup", format: ArchiveZip, store: true}
+	out := &tailWriter{}
+	if _, err := p.WriteTo(out); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+
+	if !bytes.Contains(out.tail, []byte("PK\x06\x06")) || !bytes.Contains(out.tail, []byte("PK\x06\x07")) {
+		t.Error("expected Zip64 end of central directory record and locator")
+	}
+	zr, err := zip.NewReader(out, out.n)
+	if err != nil {
+		t.Fatalf("failed to read zip: %v", err)
+	}
+	sizes := map[string]uint64{}
+	for _, f := range zr.File {
+		sizes[filepath.Base(f.Name)] = f.UncompressedSize64
+	}
+	if sizes["disk.img"] != bigSize {
+		t.Errorf("expected disk.img of %d bytes, got %d", uint64(bigSize), sizes["disk.img"])
+	}
+	if sizes["notes.txt"] != 5 {
+		t.Errorf("expected notes.txt of 5 bytes, got %d", sizes["notes.txt"])
+	}
+	if out.n < bigSize {
+		t.Errorf("expected an archive over 4 GiB, got %d bytes", out.n)
+	}
+}
+
+func TestExpandGlobs(t *testing.T) {
+	tmpDir := t.TempDir()
+	for _, name := range []string{"a.deb", "b.deb", "notes.txt", "odd[1].txt"} {
+		if err := os.WriteFile(filepath.Join(tmpDir, name), nil, 0644); err != nil {
+			t.Fatalf("failed to create test file: %v", err)
+		}
+	}
+	join := func(name string) string { return filepath.Join(tmpDir, name) }
+
+	tests := []struct {
+		args     []string
+		expected []string
+		wantErr  string
+	}{
+		{[]string{join("*.deb")}, []string{join("a.deb"), join("b.deb")}, ""},
+		{[]string{join("notes.txt"), join("?.deb")}, []string{join("notes.txt"), join("a.deb"), join("b.deb")}, ""},
+		// Existing names are never treated as patterns
+		{[]string{join("odd[1].txt")}, []string{join("odd[1].txt")}, ""},
+		{[]string{join("*.rpm")}, nil, "no files match " + join("*.rpm")},
+	}
+	for _, tt := range tests {
+		paths, err := expandGlobs(tt.args)
+		if tt.wantErr != "" {
+			if err == nil || err.Error() != tt.wantErr {
+				t.Errorf("expandGlobs(%q): expected error %q, got %v", tt.args, tt.wantErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandGlobs(%q) failed: %v", tt.args, err)
+			continue
+		}
+		if strings.Join(paths, "|") != strings.Join(tt.expected, "|") {
+			t.Errorf("expandGlobs(%q) = %q, want %q", tt.args, paths, tt.expected)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"runtime"
+	"runtime/debug"
+)
+
+// Release builds set these with -ldflags, e.g.
+// -X main.version=v1.2.0 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ).
+// Otherwise they are taken from the build info Go embeds.
+var (
+	version   string
+	commit    string
+	buildDate string
+)
+
+// buildVersion describes the binary that is running
+type buildVersion struct {
+	version   string
+	commit    string
+	date      string // Build date, only known from -ldflags
+	committed string // Commit date, from the build info
+	modified  bool   // Built from a checkout with uncommitted changes
+}
+
+// currentVersion returns the version set at link time, filling in what is
+// missing from the module and VCS information of the build
+func currentVersion() buildVersion {
+	info, _ := debug.ReadBuildInfo()
+	return buildVersion{version: version, commit: commit, date: buildDate}.withBuildInfo(info)
+}
+
+// withBuildInfo fills in v from info, which is nil for binaries built
+// without module support
+func (v buildVersion) withBuildInfo(info *debug.BuildInfo) buildVersion {
+	if info == nil {
+		info = &debug.BuildInfo{}
+	}
+	if v.version == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		v.version = info.Main.Version
+	}
+	if v.version == "" {
+		v.version = "devel"
+	}
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			if v.commit == "" {
+				v.commit = s.Value
+			}
+		case "vcs.time":
+			v.committed = s.Value
+		case "vcs.modified":
+			v.modified = s.Value == "true"
+		}
+	}
+	return v
+}
+
+// String formats the version as printed by --version, e.g.
+// "userve v1.2.0 (commit 3f2a1c9, built 2026-03-01T10:00:00Z, go1.25.5 linux/amd64)"
+func (v buildVersion) String() string {
+	s := "userve " + v.version + " ("
+	if v.commit != "" {
+		c := v.commit
+		if len(c) > 12 {
+			c = c[:12]
+		}
+		if v.modified {
+			c += "-dirty"
+		}
+		s += "commit " + c + ", "
+	}
+	if v.date != "" {
+		s += "built " + v.date + ", "
+	} else if v.committed != "" {
+		s += "committed " + v.committed + ", "
+	}
+	return s + runtime.Version() + " " + runtime.GOOS + "/" + runtime.GOARCH + ")"
+}
+
+// printVersion writes the version line for bug reports
+func printVersion(w io.Writer) error {
+	_, err := fmt.Fprintln(w, currentVersion())
+	return err
+}
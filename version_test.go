@@ -0,0 +1,33 @@
+package main
+
+import (
+	"runtime/debug"
+	"strings"
+	"testing"
+)
+
+func TestBuildVersion(t *testing.T) {
+	vcs := &debug.BuildInfo{
+		Main: debug.Module{Version: "v1.3.0"},
+		Settings: []debug.BuildSetting{
+			{Key: "vcs.revision", Value: "3f2a1c9e8b7d6c5b4a391827"},
+			{Key: "vcs.time", Value: "2026-03-01T10:00:00Z"},
+			{Key: "vcs.modified", Value: "true"},
+		},
+	}
+	tests := []struct {
+		linked   buildVersion
+		info     *debug.BuildInfo
+		expected string
+	}{
+		{info: vcs, expected: "userve v1.3.0 (commit 3f2a1c9e8b7d-dirty, committed 2026-03-01T10:00:00Z, "},
+		{linked: buildVersion{version: "v1.2.0", commit: "abc123", date: "2026-02-01T00:00:00Z"}, info: &debug.BuildInfo{}, expected: "userve v1.2.0 (commit abc123, built 2026-02-01T00:00:00Z, "},
+		{info: &debug.BuildInfo{Main: debug.Module{Version: "(devel)"}}, expected: "userve devel (go"},
+		{expected: "userve devel (go"},
+	}
+	for _, tt := range tests {
+		if got := tt.linked.withBuildInfo(tt.info).String(); !strings.HasPrefix(got, tt.expected) {
+			t.Errorf("expected %q..., got %q", tt.expected, got)
+		}
+	}
+}
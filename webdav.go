@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// webdavMethods are the methods of a read-only WebDAV share
+const webdavMethods = "OPTIONS, GET, HEAD, PROPFIND"
+
+// webdavHandler serves the shared file or directory as a read-only WebDAV
+// collection at the root, so Finder (Go > Connect to Server) and Explorer
+// (Map network drive) can mount the share and copy files out of it. As with
+// --browse, the archive's filter applies to what is listed and served, and
+// each file downloaded counts as a download of the share.
+type webdavHandler struct {
+	*shareTree
+	downloads *handler
+}
+
+func (d *webdavHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rel := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("DAV", "1")
+		w.Header().Set("Allow", webdavMethods)
+		// Office and Explorer look for this before they open files
+		w.Header().Set("MS-Author-Via", "DAV")
+	case "PROPFIND":
+		d.propfind(w, r, rel)
+	case http.MethodGet, http.MethodHead:
+		d.get(w, r, rel)
+	default:
+		// Clients mount the share read-only when LOCK and PUT are refused
+		w.Header().Set("Allow", webdavMethods)
+		http.Error(w, "the share is read-only", http.StatusMethodNotAllowed)
+	}
+}
+
+// webdav XML elements of a PROPFIND answer, in the DAV: namespace
+type davMultistatus struct {
+	XMLName   xml.Name      `xml:"D:multistatus"`
+	XMLNS     string        `xml:"xmlns:D,attr"`
+	Responses []davResponse `xml:"D:response"`
+}
+
+type davResponse struct {
+	Href     string      `xml:"D:href"`
+	Propstat davPropstat `xml:"D:propstat"`
+}
+
+type davPropstat struct {
+	Prop   davProp `xml:"D:prop"`
+	Status string  `xml:"D:status"`
+}
+
+type davProp struct {
+	DisplayName   string          `xml:"D:displayname"`
+	ResourceType  davResourceType `xml:"D:resourcetype"`
+	ContentLength *int64          `xml:"D:getcontentlength,omitempty"`
+	ContentType   string          `xml:"D:getcontenttype,omitempty"`
+	LastModified  string          `xml:"D:getlastmodified"`
+	ETag          string          `xml:"D:getetag,omitempty"`
+}
+
+type davResourceType struct {
+	Collection *struct{} `xml:"D:collection"`
+}
+
+// propfind describes the entry at rel and, with Depth: 1, its children.
+// All properties are sent whatever the client asked for, which WebDAV
+// clients accept. A whole tree at once (Depth: infinity, also the default)
+// is refused, as RFC 4918 allows, since a share may be large.
+func (d *webdavHandler) propfind(w http.ResponseWriter, r *http.Request, rel string) {
+	io.Copy(io.Discard, io.LimitReader(r.Body, 1<<20))
+	depth := r.Header.Get("Depth")
+	if depth != "0" && depth != "1" {
+		w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, xml.Header+`<D:error xmlns:D="DAV:"><D:propfind-finite-depth/></D:error>`)
+		return
+	}
+	entry, ignores, ok := d.lookup(rel)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	entries := []treeEntry{entry}
+	if depth == "1" && entry.info.IsDir() {
+		entries = append(entries, d.children(entry, ignores)...)
+	}
+
+	status := davMultistatus{XMLNS: "DAV:"}
+	for _, e := range entries {
+		status.Responses = append(status.Responses, d.response(e))
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.WriteHeader(http.StatusMultiStatus)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(status)
+}
+
+func (d *webdavHandler) response(e treeEntry) davResponse {
+	prop := davProp{
+		DisplayName:  path.Base("/" + e.rel),
+		LastModified: e.info.ModTime().UTC().Format(http.TimeFormat),
+	}
+	if e.rel == "" {
+		prop.DisplayName = d.name()
+	}
+	if e.info.IsDir() {
+		prop.ResourceType.Collection = &struct{}{}
+	} else {
+		size := e.info.Size()
+		prop.ContentLength = &size
+		prop.ContentType = d.content(e).ContentType()
+		prop.ETag = fmt.Sprintf(`"%x-%x"`, e.info.ModTime().UnixNano(), size)
+	}
+	return davResponse{
+		Href:     davHref(e.rel, e.info.IsDir()),
+		Propstat: davPropstat{Prop: prop, Status: "HTTP/1.1 200 OK"},
+	}
+}
+
+// get downloads a file. A browser opening a directory is told how to
+// mount the share instead.
+func (d *webdavHandler) get(w http.ResponseWriter, r *http.Request, rel string) {
+	entry, _, ok := d.lookup(rel)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if entry.info.IsDir() {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprintf(w, "This share is a WebDAV folder. Connect to this address from Finder (Go > Connect to Server)\nor Explorer (Map network drive) to copy files from it.\n")
+		return
+	}
+	item, remaining := d.downloads.status()
+	if remaining == 0 {
+		http.Error(w, "download limit reached", http.StatusGone)
+		return
+	}
+	d.downloads.deliver(w, r, item, d.content(entry))
+}
+
+// davHref returns the URL path of the entry at rel, with a trailing slash
+// for collections
+func davHref(rel string, dir bool) string {
+	if rel == "" {
+		return "/"
+	}
+	parts := strings.Split(rel, "/")
+	for i, part := range parts {
+		parts[i] = url.PathEscape(part)
+	}
+	href := "/" + strings.Join(parts, "/")
+	if dir {
+		href += "/"
+	}
+	return href
+}
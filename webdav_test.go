@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// webdavRequest sends a request with the method to d and returns the
+// response
+func webdavRequest(d *webdavHandler, method, target, depth string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, nil)
+	if depth != "" {
+		req.Header.Set("Depth", depth)
+	}
+	rec := httptest.NewRecorder()
+	d.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestWebDAVDirectory(t *testing.T) {
+	dir := t.TempDir()
+	os.MkdirAll(filepath.Join(dir, "sub dir"), 0755)
+	os.WriteFile(filepath.Join(dir, "notes.txt"), []byte("notes"), 0644)
+	os.WriteFile(filepath.Join(dir, "sub dir", "inner.txt"), []byte("inner"), 0644)
+	os.WriteFile(filepath.Join(dir, ".env"), []byte("secret"), 0644)
+
+	archive := newArchiveProvider(dir, "share", archiveOptions{format: ArchiveTarGz, filter: &archiveFilter{skipHidden: true}})
+	d := &webdavHandler{
+		shareTree: &shareTree{archive: archive},
+		downloads: &handler{provider: archive, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1), maxDownloads: 2},
+	}
+
+	rec := webdavRequest(d, "PROPFIND", "/", "1")
+	body := rec.Body.String()
+	if rec.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d", rec.Code)
+	}
+	for _, want := range []string{
+		"<D:href>/</D:href>",
+		"<D:displayname>share</D:displayname>",
+		"<D:href>/notes.txt</D:href>",
+		"<D:getcontentlength>5</D:getcontentlength>",
+		"<D:href>/sub%20dir/</D:href>",
+		"<D:collection></D:collection>",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("expected %s in %s", want, body)
+		}
+	}
+	if strings.Contains(body, ".env") || strings.Contains(body, "inner.txt") {
+		t.Errorf("expected only the unfiltered entries of the root, got %s", body)
+	}
+
+	rec = webdavRequest(d, "PROPFIND", "/sub%20dir/", "0")
+	if body := rec.Body.String(); strings.Count(body, "<D:response>") != 1 || !strings.Contains(body, "<D:href>/sub%20dir/</D:href>") {
+		t.Errorf("expected only the directory itself with Depth: 0, got %s", body)
+	}
+	if rec := webdavRequest(d, "PROPFIND", "/", "infinity"); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), "propfind-finite-depth") {
+		t.Errorf("expected Depth: infinity to be refused, got %d %s", rec.Code, rec.Body.String())
+	}
+	if rec := webdavRequest(d, "PROPFIND", "/.env", "0"); rec.Code != http.StatusNotFound {
+		t.Errorf("expected a filtered file to be missing, got %d", rec.Code)
+	}
+
+	if rec := webdavRequest(d, http.MethodGet, "/sub%20dir/inner.txt", ""); rec.Code != http.StatusOK || rec.Body.String() != "inner" {
+		t.Errorf("expected the file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := webdavRequest(d, http.MethodGet, "/.env", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected a filtered file not to be served, got %d", rec.Code)
+	}
+	for _, method := range []string{http.MethodPut, http.MethodDelete, "MKCOL", "LOCK", "MOVE"} {
+		if rec := webdavRequest(d, method, "/notes.txt", ""); rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: expected 405, got %d", method, rec.Code)
+		}
+	}
+
+	// Each file counts towards the limit
+	webdavRequest(d, http.MethodGet, "/notes.txt", "")
+	if rec := webdavRequest(d, http.MethodGet, "/notes.txt", ""); rec.Code != http.StatusGone {
+		t.Errorf("expected 410 after the download limit, got %d", rec.Code)
+	}
+	if rec := webdavRequest(d, "PROPFIND", "/", "1"); rec.Code != http.StatusMultiStatus {
+		t.Errorf("expected listing to go on after the limit, got %d", rec.Code)
+	}
+}
+
+func TestWebDAVFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "report.pdf")
+	os.WriteFile(path, []byte("%PDF"), 0644)
+	file := &fileProvider{filePath: path, fileName: "renamed.pdf", fileSize: 4}
+	d := &webdavHandler{
+		shareTree: &shareTree{file: file},
+		downloads: &handler{provider: file, activeDownloads: &sync.WaitGroup{}, downloadComplete: make(chan struct{}, 1)},
+	}
+
+	body := webdavRequest(d, "PROPFIND", "/", "1").Body.String()
+	if strings.Count(body, "<D:response>") != 2 || !strings.Contains(body, "<D:href>/renamed.pdf</D:href>") || !strings.Contains(body, "application/pdf") {
+		t.Errorf("expected a collection holding the file, got %s", body)
+	}
+	if rec := webdavRequest(d, http.MethodGet, "/renamed.pdf", ""); rec.Code != http.StatusOK || rec.Body.String() != "%PDF" {
+		t.Errorf("expected the file, got %d %q", rec.Code, rec.Body.String())
+	}
+	if rec := webdavRequest(d, http.MethodGet, "/report.pdf", ""); rec.Code != http.StatusNotFound {
+		t.Errorf("expected only the served name, got %d", rec.Code)
+	}
+	if !d.exists("/renamed.pdf") || d.exists("/qr") {
+		t.Error("expected exists to report the shared file only")
+	}
+}
+
+func TestWebDAVFlags(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.txt"), filepath.Join(dir, "b.txt")
+	os.WriteFile(a, []byte("a"), 0644)
+	os.WriteFile(b, []byte("b"), 0644)
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"--webdav", "--bundle", a, b}, "--webdav needs a single file or directory"},
+		{[]string{"--webdav", "--browse", dir}, "--webdav can't be used with --browse, --help-page, --extract or --path"},
+		{[]string{"--webdav", "--receive", dir}, "--webdav can't be used with --receive or --two-way"},
+		{[]string{"--webdav", "--cache-archives", dir}, "--webdav can't be used with --cache-archives or --prebuild"},
+		{[]string{"queue", "--webdav", a}, "--webdav needs a single file or directory"},
+	} {
+		if err := run(tc.args); err == nil || err.Error() != tc.want {
+			t.Errorf("%q: expected %q, got %v", tc.args, tc.want, err)
+		}
+	}
+}
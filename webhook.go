@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// webhookTimeout bounds each POST, so a slow receiver can't hold up the
+// ones after it for long
+const webhookTimeout = 10 * time.Second
+
+// webhook POSTs download events as JSON to a URL, e.g. a Slack bot or an
+// automation that acts once the file was picked up. Events are sent one at
+// a time in order, without holding up the downloads they are about.
+type webhook struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	done   chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// newWebhook checks that target is an HTTP URL and starts sending to it
+func newWebhook(target string) (*webhook, error) {
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("--webhook needs an http or https URL")
+	}
+	wh := &webhook{
+		url:    target,
+		client: &http.Client{Timeout: webhookTimeout},
+		queue:  make(chan []byte, 64),
+		done:   make(chan struct{}),
+	}
+	go wh.run()
+	return wh, nil
+}
+
+func (wh *webhook) run() {
+	defer close(wh.done)
+	for body := range wh.queue {
+		resp, err := wh.client.Post(wh.url, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode >= 300 {
+				err = fmt.Errorf("%s", resp.Status)
+			}
+		}
+		if err != nil {
+			logEvent("webhook_failed", logFields{"error": err}, "Webhook failed: %v", err)
+		}
+	}
+}
+
+// notify queues the webhook call for an event, if it is one of the
+// downloads starting or completing or the limit being reached
+func (wh *webhook) notify(e event) {
+	payload := map[string]any{"time": e.time.Format(time.RFC3339)}
+	switch e.kind {
+	case "download_started", "download_completed":
+		payload["event"] = e.kind
+		payload["client"] = clientIP(fmt.Sprint(e.fields["client"]))
+		for _, key := range []string{"file", "bytes", "duration"} {
+			if value, ok := e.fields[key]; ok {
+				payload[key] = value
+			}
+		}
+	case "waiting_for_upload":
+		payload["event"] = "limit_reached"
+	case "shutdown":
+		if reason := e.fields["reason"]; reason != "download limit" && reason != "upload limit" {
+			return
+		}
+		payload["event"] = "limit_reached"
+	default:
+		return
+	}
+	body, _ := json.Marshal(payload)
+	wh.mu.Lock()
+	defer wh.mu.Unlock()
+	if wh.closed {
+		return
+	}
+	select {
+	case wh.queue <- body:
+	default:
+		logEvent("webhook_failed", nil, "Webhook queue is full, dropped %s event", payload["event"])
+	}
+}
+
+// Close sends the events still queued, giving up after the shutdown
+// timeout
+func (wh *webhook) Close() {
+	wh.mu.Lock()
+	wh.closed = true
+	close(wh.queue)
+	wh.mu.Unlock()
+	select {
+	case <-wh.done:
+	case <-time.After(shutdownTimeout):
+	}
+}
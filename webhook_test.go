@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var received []map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		var payload map[string]any
+		if err := json.Unmarshal(body, &payload); err != nil || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("expected a JSON POST, got %s %q", r.Header.Get("Content-Type"), body)
+		}
+		mu.Lock()
+		received = append(received, payload)
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	captureEvents(t, logText)
+	wh, err := newWebhook(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := events.listen(wh.notify)
+	logEvent("download_started", logFields{"client": "192.0.2.1:1234", "file": "notes.txt"}, "Download started")
+	logEvent("downloads_remaining", logFields{"remaining": 1}, "1 download(s) remaining")
+	logEvent("download_completed", logFields{"client": "192.0.2.1:1234", "file": "notes.txt", "bytes": int64(5), "duration": 0.25}, "Download completed")
+	logNotice("shutdown", logFields{"reason": "signal"}, "Received interrupt")
+	logNotice("shutdown", logFields{"reason": "download limit"}, "Download limit reached")
+	stop()
+	wh.Close()
+
+	var got []string
+	for _, payload := range received {
+		got = append(got, payload["event"].(string))
+	}
+	if strings.Join(got, " ") != "download_started download_completed limit_reached" {
+		t.Fatalf("expected started, completed and limit events in order, got %v", got)
+	}
+	completed := received[1]
+	if completed["client"] != "192.0.2.1" || completed["file"] != "notes.txt" || completed["bytes"] != 5.0 || completed["duration"] != 0.25 {
+		t.Errorf("unexpected completion payload %v", completed)
+	}
+}
+
+func TestWebhookURL(t *testing.T) {
+	for _, target := range []string{"ftp://example.com/", "example.com/hook", "http://"} {
+		if _, err := newWebhook(target); err == nil {
+			t.Errorf("%s: expected an error", target)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// addXattrs records the extended attributes of the file at path as PAX
+// records, in the SCHILY.xattr namespace that GNU tar and bsdtar restore
+func addXattrs(header *tar.Header, path string) error {
+	attrs, err := readXattrs(path)
+	if err != nil {
+		return fmt.Errorf("cannot read extended attributes of %s: %v", path, err)
+	}
+	if len(attrs) == 0 {
+		return nil
+	}
+	if header.PAXRecords == nil {
+		header.PAXRecords = make(map[string]string)
+	}
+	for name, value := range attrs {
+		header.PAXRecords["SCHILY.xattr."+name] = string(value)
+	}
+	header.Format = tar.FormatPAX
+	return nil
+}
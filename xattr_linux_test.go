@@ -0,0 +1,45 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTarArchiveXattrs(t *testing.T) {
+	root := t.TempDir()
+	path := filepath.Join(root, "photo.raw")
+	if err := os.WriteFile(path, []byte("raw"), 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+	if err := syscall.Setxattr(path, "user.origin", []byte("camera\x00roll"), 0); err != nil {
+		t.Skipf("filesystem does not support user xattrs: %v", err)
+	}
+
+	p := &archiveProvider{dirPath: root, dirName: "photos", format: ArchiveTar, xattrs: true}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			t.Fatal("photo.raw not found in archive")
+		}
+		if err != nil {
+			t.Fatalf("failed to read tar: %v", err)
+		}
+		if filepath.Base(header.Name) != "photo.raw" {
+			continue
+		}
+		if got := header.PAXRecords["SCHILY.xattr.user.origin"]; got != "camera\x00roll" {
+			t.Errorf("expected xattr value to survive, got %q", got)
+		}
+		return
+	}
+}
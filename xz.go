@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+)
+
+// xzWriter compresses through an external xz process, since the standard
+// library has no xz encoder. xz is CPU-heavy; -T0 uses all cores.
+type xzWriter struct {
+	cmd   *exec.Cmd
+	stdin io.WriteCloser
+}
+
+// newXZWriter starts xz writing its output to w, compressing at level, or
+// xz's default for -1. Reproducible output is compressed on one thread,
+// since xz's multi-threaded format differs from its single-threaded one
+// and machines with one core fall back to the latter. xz is killed once ctx
+// is done.
+func newXZWriter(ctx context.Context, w io.Writer, level int, reproducible bool) (*xzWriter, error) {
+	args := []string{"-c", "-T0"}
+	if reproducible {
+		args[1] = "-T1"
+	}
+	if level >= 0 {
+		args = append(args, fmt.Sprintf("-%d", level))
+	}
+	cmd := exec.CommandContext(ctx, "xz", args...)
+	cmd.Stdout = w
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("cannot start xz: %v", err)
+	}
+	return &xzWriter{cmd: cmd, stdin: stdin}, nil
+}
+
+func (x *xzWriter) Write(b []byte) (int, error) {
+	return x.stdin.Write(b)
+}
+
+// Close flushes the input and waits until xz has written all its output
+func (x *xzWriter) Close() error {
+	x.stdin.Close()
+	return x.cmd.Wait()
+}
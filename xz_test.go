@@ -0,0 +1,45 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestTarXzArchive(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("xz not installed")
+	}
+	root := makeTree(t, "a.txt", "sub/b.txt")
+
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveTarXz}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if !bytes.HasPrefix(buf.Bytes(), []byte("\xfd7zXZ\x00")) {
+		t.Fatal("expected xz stream")
+	}
+
+	// Decompress with the same tool recipients would use
+	cmd := exec.Command("xz", "-dc")
+	cmd.Stdin = &buf
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("xz -dc failed: %v", err)
+	}
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(out))
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	if got := strings.Join(names, " "); got != "project project/a.txt project/sub project/sub/b.txt" {
+		t.Errorf("unexpected archive entries: %s", got)
+	}
+}
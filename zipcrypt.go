@@ -0,0 +1,207 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// WinZip AES (AE-2) as understood by 7-Zip, WinZip, WinRAR and macOS
+// Archive Utility: entries use method 99 with an extra field naming the
+// real compression method, and their data is salt, password verifier,
+// AES-256-CTR ciphertext and a truncated HMAC-SHA1.
+const (
+	zipMethodAES     = 99
+	zipAESExtraID    = 0x9901
+	zipAESStrength   = 3 // AES-256
+	zipAESSaltSize   = 16
+	zipAESKeySize    = 32
+	zipAESIterations = 1000
+	zipAESMACSize    = 10
+)
+
+// createEncryptedEntry adds an entry whose content, written to the
+// returned writer, is deflated at level (when deflate is set) and encrypted.
+// The entry is complete when the writer is closed.
+func createEncryptedEntry(zw *zip.Writer, header *zip.FileHeader, password string, deflate bool, level int) (io.WriteCloser, error) {
+	method := zip.Store
+	if deflate {
+		method = zip.Deflate
+	}
+
+	// AE-2 stores no CRC; the MAC authenticates the data instead
+	header.Method = zipMethodAES
+	header.Flags |= 0x1 | 0x8 // encrypted, sizes in data descriptor
+	header.CRC32 = 0
+	extra := make([]byte, 11)
+	binary.LittleEndian.PutUint16(extra[0:], zipAESExtraID)
+	binary.LittleEndian.PutUint16(extra[2:], 7)
+	binary.LittleEndian.PutUint16(extra[4:], 2) // AE-2
+	copy(extra[6:], "AE")
+	extra[8] = zipAESStrength
+	binary.LittleEndian.PutUint16(extra[9:], method)
+	header.Extra = append(header.Extra, extra...)
+
+	raw, err := zw.CreateRaw(header)
+	if err != nil {
+		return nil, err
+	}
+	cw := &countingWriter{w: raw}
+
+	salt := make([]byte, zipAESSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keys, err := pbkdf2.Key(sha1.New, password, salt, zipAESIterations, 2*zipAESKeySize+2)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(keys[:zipAESKeySize])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(salt); err != nil {
+		return nil, err
+	}
+	if _, err := cw.Write(keys[2*zipAESKeySize:]); err != nil {
+		return nil, err
+	}
+
+	e := &encryptedEntry{
+		header: header,
+		out:    cw,
+		stream: &winzipCTR{block: block},
+		mac:    hmac.New(sha1.New, keys[zipAESKeySize:2*zipAESKeySize]),
+	}
+	e.sink = e.encrypt
+	if deflate {
+		fw, err := flate.NewWriter(writerFunc(e.encrypt), level)
+		if err != nil {
+			return nil, err
+		}
+		e.deflater = fw
+		e.sink = fw.Write
+	}
+	return e, nil
+}
+
+// encryptedEntry compresses, encrypts and authenticates an entry's content
+type encryptedEntry struct {
+	header   *zip.FileHeader
+	out      *countingWriter
+	stream   cipher.Stream
+	mac      hash.Hash
+	deflater *flate.Writer
+	sink     func([]byte) (int, error)
+	size     uint64
+}
+
+func (e *encryptedEntry) Write(b []byte) (int, error) {
+	n, err := e.sink(b)
+	e.size += uint64(n)
+	return n, err
+}
+
+func (e *encryptedEntry) encrypt(b []byte) (int, error) {
+	buf := make([]byte, len(b))
+	e.stream.XORKeyStream(buf, b)
+	e.mac.Write(buf)
+	return e.out.Write(buf)
+}
+
+// Close appends the MAC and records the sizes, which zip.Writer writes in
+// the data descriptor and central directory
+func (e *encryptedEntry) Close() error {
+	if e.deflater != nil {
+		if err := e.deflater.Close(); err != nil {
+			return err
+		}
+	}
+	if _, err := e.out.Write(e.mac.Sum(nil)[:zipAESMACSize]); err != nil {
+		return err
+	}
+	e.header.CompressedSize64 = uint64(e.out.n)
+	e.header.UncompressedSize64 = e.size
+	e.header.CompressedSize = uint32(min(e.header.CompressedSize64, math.MaxUint32))
+	e.header.UncompressedSize = uint32(min(e.header.UncompressedSize64, math.MaxUint32))
+	if e.header.CompressedSize64 > math.MaxUint32 || e.header.UncompressedSize64 > math.MaxUint32 {
+		// Zip64 sizes need version 4.5, as zip.Writer sets for its own entries
+		e.header.ReaderVersion = 45
+	}
+	return nil
+}
+
+// winzipCTR is AES in CTR mode with the little-endian counter, starting
+// at 1, that WinZip uses instead of the standard big-endian one
+type winzipCTR struct {
+	block   cipher.Block
+	counter [aes.BlockSize]byte
+	stream  [aes.BlockSize]byte
+	used    int
+}
+
+func (c *winzipCTR) XORKeyStream(dst, src []byte) {
+	for i := range src {
+		if c.used == 0 || c.used == aes.BlockSize {
+			for j := range c.counter {
+				c.counter[j]++
+				if c.counter[j] != 0 {
+					break
+				}
+			}
+			c.block.Encrypt(c.stream[:], c.counter[:])
+			c.used = 0
+		}
+		dst[i] = src[i] ^ c.stream[c.used]
+		c.used++
+	}
+}
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+// readPassword prompts for a password on the terminal. Echo is turned off
+// with stty where available.
+func readPassword(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	stty := func(arg string) error {
+		cmd := exec.Command("stty", arg)
+		cmd.Stdin = os.Stdin
+		return cmd.Run()
+	}
+	if stty("-echo") == nil {
+		defer func() {
+			stty("echo")
+			fmt.Fprintln(os.Stderr)
+		}()
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("cannot read password: %v", err)
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password must not be empty")
+	}
+	return password, nil
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha1"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// decryptEntry checks and decrypts a WinZip AES entry the way extractors do
+func decryptEntry(t *testing.T, f *zip.File, password string) []byte {
+	t.Helper()
+	if f.Method != zipMethodAES || f.Flags&0x1 == 0 {
+		t.Fatalf("%s: expected an encrypted AES entry, got method %d flags %#x", f.Name, f.Method, f.Flags)
+	}
+	if len(f.Extra) < 11 || binary.LittleEndian.Uint16(f.Extra) != zipAESExtraID {
+		t.Fatalf("%s: missing AES extra field", f.Name)
+	}
+	method := binary.LittleEndian.Uint16(f.Extra[9:])
+
+	r, err := f.OpenRaw()
+	if err != nil {
+		t.Fatalf("OpenRaw failed: %v", err)
+	}
+	data, _ := io.ReadAll(r)
+	salt, verifier := data[:zipAESSaltSize], data[zipAESSaltSize:zipAESSaltSize+2]
+	sealed, mac := data[zipAESSaltSize+2:len(data)-zipAESMACSize], data[len(data)-zipAESMACSize:]
+
+	keys, _ := pbkdf2.Key(sha1.New, password, salt, zipAESIterations, 2*zipAESKeySize+2)
+	if !bytes.Equal(keys[2*zipAESKeySize:], verifier) {
+		t.Fatalf("%s: password verifier mismatch", f.Name)
+	}
+	h := hmac.New(sha1.New, keys[zipAESKeySize:2*zipAESKeySize])
+	h.Write(sealed)
+	if !bytes.Equal(h.Sum(nil)[:zipAESMACSize], mac) {
+		t.Fatalf("%s: authentication code mismatch", f.Name)
+	}
+
+	block, _ := aes.NewCipher(keys[:zipAESKeySize])
+	plain := make([]byte, len(sealed))
+	(&winzipCTR{block: block}).XORKeyStream(plain, sealed)
+	if method == zip.Deflate {
+		plain, err = io.ReadAll(flate.NewReader(bytes.NewReader(plain)))
+		if err != nil {
+			t.Fatalf("%s: inflate failed: %v", f.Name, err)
+		}
+	}
+	if uint64(len(plain)) != f.UncompressedSize64 {
+		t.Errorf("%s: expected %d bytes, got %d", f.Name, f.UncompressedSize64, len(plain))
+	}
+	return plain
+}
+
+func TestEncryptedZipArchive(t *testing.T) {
+	root := makeTree(t, "a.txt", "sub/b.txt")
+	secret := bytes.Repeat([]byte("TOP SECRET "), 100)
+	if err := os.WriteFile(filepath.Join(root, "secret.txt"), secret, 0644); err != nil {
+		t.Fatalf("failed to create test file: %v", err)
+	}
+
+	p := &archiveProvider{dirPath: root, dirName: "project", format: ArchiveZip, zipPassword: "s3cret"}
+	var buf bytes.Buffer
+	if _, err := p.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("TOP SECRET")) {
+		t.Error("archive contains plaintext content")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("failed to read zip: %v", err)
+	}
+	contents := map[string]string{}
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		contents[f.Name] = string(decryptEntry(t, f, "s3cret"))
+	}
+	if contents["project/a.txt"] != "a.txt" || contents["project/sub/b.txt"] != "sub/b.txt" || contents["project/secret.txt"] != string(secret) {
+		t.Errorf("unexpected contents: %v", contents)
+	}
+}
+
+func TestWinzipCTRCounter(t *testing.T) {
+	key := make([]byte, 32)
+	block, _ := aes.NewCipher(key)
+
+	// The counter starts at 1 and is incremented little-endian
+	var want []byte
+	for _, first := range []byte{1, 2} {
+		counter := make([]byte, aes.BlockSize)
+		counter[0] = first
+		keystream := make([]byte, aes.BlockSize)
+		block.Encrypt(keystream, counter)
+		want = append(want, keystream...)
+	}
+
+	got := make([]byte, 2*aes.BlockSize)
+	ctr := &winzipCTR{block: block}
+	ctr.XORKeyStream(got[:5], got[:5])
+	ctr.XORKeyStream(got[5:], got[5:])
+	if !bytes.Equal(got, want) {
+		t.Errorf("unexpected keystream:\n got  %x\n want %x", got, want)
+	}
+}